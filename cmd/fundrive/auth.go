@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/semmidev/fundrive"
+	"golang.org/x/oauth2"
+)
+
+func runInit(c *cli, args []string) error {
+	flags := newFlags("init")
+	clientSecret := flags.String("client-secret", "", "OAuth client JSON file")
+	key := flags.String("key", "", "token encryption key, 16, 24 or 32 bytes")
+	driver := flags.String("driver", c.config.Driver, "database driver, sqlite or mysql")
+	dsn := flags.String("dsn", "", "database DSN, defaults to a sqlite file next to the config")
+	if _, err := parseFlags(flags, args, 0, 0); err != nil {
+		return err
+	}
+	if *clientSecret == "" || *key == "" {
+		return errUsage
+	}
+
+	if _, err := fundrive.NewTokenEncryption(*key); err != nil {
+		return err
+	}
+
+	c.config.ClientSecretFile = *clientSecret
+	c.config.EncryptionKey = *key
+	c.config.Driver = *driver
+	if *dsn != "" {
+		c.config.DSN = *dsn
+	}
+
+	if err := c.config.save(); err != nil {
+		return err
+	}
+
+	return c.out.message(c.config, "Wrote %s", c.config.path)
+}
+
+// runAuthLogin connects an account with the loopback flow, or with the device flow
+// on machines without a browser
+func runAuthLogin(c *cli, args []string) error {
+	flags := newFlags("auth login")
+	device := flags.Bool("device", false, "use the device flow, requires a limited input device OAuth client")
+	noBrowser := flags.Bool("no-browser", false, "print the consent URL instead of opening the browser")
+	profile := flags.String("profile", "", "Drive access to request: file, readonly or full")
+	email := flags.String("email", "", "connected account to upgrade to the requested profile")
+	if _, err := parseFlags(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	var (
+		result *fundrive.AuthorizationResult
+		err    error
+	)
+	if *device {
+		result, err = c.service.OAuthService.AuthorizeDevice(c.ctx, &fundrive.DeviceAuthRequest{
+			UserID: c.config.UserID,
+			Prompt: func(auth *oauth2.DeviceAuthResponse) error {
+				fmt.Fprintf(os.Stderr, "Open %s on any device and enter the code %s\n", auth.VerificationURI, auth.UserCode)
+				return nil
+			},
+		})
+	} else {
+		result, err = c.service.OAuthService.AuthorizeLoopback(c.ctx, &fundrive.LoopbackAuthRequest{
+			UserID:       c.config.UserID,
+			Email:        *email,
+			ScopeProfile: fundrive.ScopeProfile(*profile),
+			OpenBrowser: func(authURL string) error {
+				fmt.Fprintf(os.Stderr, "Open this URL in your browser to connect an account:\n\n  %s\n\n", authURL)
+				if !*noBrowser {
+					// the URL is printed when there is no browser to open
+					_ = fundrive.OpenBrowser(authURL)
+				}
+				return nil
+			},
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.config.DefaultAccount == "" {
+		c.config.DefaultAccount = result.Email
+		if err := c.config.save(); err != nil {
+			return err
+		}
+	}
+
+	return c.out.message(result, "Connected %s", result.Email)
+}
+
+type accountRow struct {
+	Email   string   `json:"email"`
+	Default bool     `json:"default"`
+	Expiry  string   `json:"expiry"`
+	Scopes  []string `json:"scopes"`
+}
+
+func runAccountsList(c *cli, args []string) error {
+	if _, err := parseFlags(newFlags("accounts list"), args, 0, 0); err != nil {
+		return err
+	}
+
+	tokens, err := c.service.OAuthService.ListUserTokens(c.ctx, &fundrive.ListUserTokensRequest{UserID: c.config.UserID})
+	if err != nil {
+		return err
+	}
+
+	accounts := make([]accountRow, 0, len(tokens))
+	rows := make([][]string, 0, len(tokens))
+	for _, token := range tokens {
+		account := accountRow{
+			Email:   token.Email,
+			Default: token.Email == c.config.DefaultAccount,
+			Expiry:  token.Expiry.Format("2006-01-02 15:04"),
+			Scopes:  token.GrantedScopes(),
+		}
+		accounts = append(accounts, account)
+
+		marker := ""
+		if account.Default {
+			marker = "*"
+		}
+		scopes := make([]string, 0, len(account.Scopes))
+		for _, scope := range account.Scopes {
+			scopes = append(scopes, strings.TrimPrefix(scope, "https://www.googleapis.com/auth/"))
+		}
+		rows = append(rows, []string{marker, account.Email, account.Expiry, strings.Join(scopes, " ")})
+	}
+
+	return c.out.table(accounts, []string{"", "EMAIL", "TOKEN EXPIRY", "SCOPES"}, rows)
+}
+
+func runAccountsRemove(c *cli, args []string) error {
+	rest, err := parseFlags(newFlags("accounts remove"), args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	err = c.service.OAuthService.DeleteToken(c.ctx, &fundrive.DeleteTokenRequest{UserID: c.config.UserID, Email: rest[0]})
+	if err != nil {
+		return err
+	}
+
+	if c.config.DefaultAccount == rest[0] {
+		c.config.DefaultAccount = ""
+		if err := c.config.save(); err != nil {
+			return err
+		}
+	}
+
+	return c.out.message(map[string]string{"removed": rest[0]}, "Removed %s", rest[0])
+}
+
+func runAccountsUse(c *cli, args []string) error {
+	rest, err := parseFlags(newFlags("accounts use"), args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	exists, err := c.service.OAuthService.IsTokenExists(c.ctx, &fundrive.IsTokenExistsRequest{UserID: c.config.UserID, Email: rest[0]})
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("account is not connected: " + rest[0])
+	}
+
+	c.config.DefaultAccount = rest[0]
+	if err := c.config.save(); err != nil {
+		return err
+	}
+
+	return c.out.message(map[string]string{"default_account": rest[0]}, "Using %s", rest[0])
+}
+
+func runQuota(c *cli, args []string) error {
+	flags := newFlags("quota")
+	refresh := flags.Bool("refresh", false, "ignore the cached report")
+	if _, err := parseFlags(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	report, err := c.service.GetStorageReport(c.ctx, &fundrive.GetStorageReportRequest{UserID: c.config.UserID, Refresh: *refresh})
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(report.Accounts)+1)
+	for _, account := range report.Accounts {
+		limit := formatSize(account.Limit)
+		if account.IsUnlimited {
+			limit = "unlimited"
+		}
+		rows = append(rows, []string{
+			account.Email,
+			string(account.Status),
+			formatSize(account.Usage),
+			limit,
+			strconv.FormatInt(account.UsagePercentage, 10) + "%",
+		})
+	}
+	rows = append(rows, []string{
+		"total",
+		"",
+		formatSize(report.Totals.Usage),
+		formatSize(report.Totals.Limit),
+		strconv.FormatInt(report.Totals.UsagePercentage, 10) + "%",
+	})
+
+	return c.out.table(report, []string{"ACCOUNT", "STATUS", "USED", "LIMIT", "USAGE"}, rows)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/glebarez/sqlite"
+	"github.com/semmidev/fundrive"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// defaultUserID owns the accounts connected with the CLI
+const defaultUserID = "cli"
+
+// Config is the CLI configuration file
+type Config struct {
+	// Driver is "sqlite" or "mysql", sqlite stores the database next to the config file
+	Driver string `json:"driver"`
+	DSN    string `json:"dsn"`
+
+	// EncryptionKey encrypts the stored tokens, 16, 24 or 32 bytes
+	EncryptionKey string `json:"encryption_key"`
+
+	// ClientSecretFile is the OAuth client JSON downloaded from the Google Cloud console
+	ClientSecretFile string `json:"client_secret_file"`
+
+	// ScopeProfile is the Drive access requested by auth login: file, readonly or full
+	ScopeProfile fundrive.ScopeProfile `json:"scope_profile,omitempty"`
+
+	UserID         string `json:"user_id"`
+	DefaultAccount string `json:"default_account"`
+
+	path string
+}
+
+// defaultConfigPath returns $FUNDRIVE_CONFIG or fundrive/config.json in the user config directory
+func defaultConfigPath() string {
+	if path := os.Getenv("FUNDRIVE_CONFIG"); path != "" {
+		return path
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "fundrive.json"
+	}
+	return filepath.Join(dir, "fundrive", "config.json")
+}
+
+func loadConfig(path string) (*Config, error) {
+	config := &Config{path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("error parsing config %s: %w", path, err)
+		}
+	}
+
+	if config.Driver == "" {
+		config.Driver = "sqlite"
+	}
+	if config.DSN == "" && config.Driver == "sqlite" {
+		config.DSN = filepath.Join(filepath.Dir(path), "fundrive.db")
+	}
+	if config.UserID == "" {
+		config.UserID = defaultUserID
+	}
+	if config.ClientSecretFile != "" && !filepath.IsAbs(config.ClientSecretFile) {
+		config.ClientSecretFile = filepath.Join(filepath.Dir(path), config.ClientSecretFile)
+	}
+
+	return config, nil
+}
+
+func (c *Config) save() error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o700); err != nil {
+		return fmt.Errorf("error creating config directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(c.path, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("error writing config: %w", err)
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.EncryptionKey == "" {
+		return fmt.Errorf("encryption_key is missing in %s", c.path)
+	}
+	if c.ClientSecretFile == "" {
+		return fmt.Errorf("client_secret_file is missing in %s", c.path)
+	}
+	return nil
+}
+
+func (c *Config) openDB() (*gorm.DB, error) {
+	gormConfig := &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)}
+
+	switch c.Driver {
+	case "sqlite":
+		if err := os.MkdirAll(filepath.Dir(c.DSN), 0o700); err != nil {
+			return nil, fmt.Errorf("error creating database directory: %w", err)
+		}
+		return gorm.Open(sqlite.Open(c.DSN), gormConfig)
+	case "mysql":
+		return gorm.Open(mysql.Open(c.DSN), gormConfig)
+	}
+
+	return nil, fmt.Errorf("unknown database driver %q", c.Driver)
+}
+
+func (c *Config) openService() (*fundrive.GoogleDriveService, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	db, err := c.openDB()
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+
+	return fundrive.New(
+		fundrive.WithDB(db),
+		fundrive.WithClientSecretFilePath(c.ClientSecretFile),
+		fundrive.WithEncryptionKey(c.EncryptionKey),
+		fundrive.WithScopeProfile(c.ScopeProfile),
+	)
+}
+
+// account returns the email of the account a command runs against: the -account flag,
+// the configured default, or the only connected account
+func (c *Config) account(ctx context.Context, service *fundrive.GoogleDriveService, flagAccount string) (string, error) {
+	if flagAccount != "" {
+		return flagAccount, nil
+	}
+	if c.DefaultAccount != "" {
+		return c.DefaultAccount, nil
+	}
+
+	tokens, err := service.OAuthService.ListUserTokens(ctx, &fundrive.ListUserTokensRequest{UserID: c.UserID})
+	if err != nil {
+		return "", err
+	}
+
+	switch len(tokens) {
+	case 0:
+		return "", errors.New("no account connected, run: fundrive auth login")
+	case 1:
+		return tokens[0].Email, nil
+	}
+
+	return "", errors.New("several accounts are connected, choose one with -account")
+}
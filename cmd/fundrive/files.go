@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/semmidev/fundrive"
+	"google.golang.org/api/drive/v3"
+)
+
+const folderMimeType = "application/vnd.google-apps.folder"
+
+// fileRow is a Drive file in the output of a command
+type fileRow struct {
+	ID           string `json:"id"`
+	Path         string `json:"path,omitempty"`
+	Name         string `json:"name"`
+	MimeType     string `json:"mime_type"`
+	Size         int64  `json:"size"`
+	ModifiedTime string `json:"modified_time,omitempty"`
+}
+
+func newFileRow(file *drive.File, filePath string) fileRow {
+	return fileRow{
+		ID:           file.Id,
+		Path:         filePath,
+		Name:         file.Name,
+		MimeType:     file.MimeType,
+		Size:         file.Size,
+		ModifiedTime: file.ModifiedTime,
+	}
+}
+
+func (r fileRow) cells(name string) []string {
+	size := formatSize(r.Size)
+	if r.MimeType == folderMimeType {
+		name += "/"
+		size = "-"
+	}
+
+	modified := r.ModifiedTime
+	if t, err := time.Parse(time.RFC3339, r.ModifiedTime); err == nil {
+		modified = t.Local().Format("2006-01-02 15:04")
+	}
+
+	return []string{r.ID, name, size, modified}
+}
+
+var fileHeader = []string{"ID", "NAME", "SIZE", "MODIFIED"}
+
+// drivePath turns a Drive path like /projects/report.pdf into a path of the VFS
+func drivePath(p string) string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// lookup returns the file a path or an id: reference points to
+func (c *cli) lookup(ref string) (*drive.File, error) {
+	if id, ok := strings.CutPrefix(ref, "id:"); ok {
+		return c.service.GetFile(c.ctx, &fundrive.GetFileRequest{UserID: c.config.UserID, Email: c.email, FileID: id})
+	}
+
+	info, err := c.vfs.Stat(drivePath(ref))
+	if err != nil {
+		return nil, err
+	}
+	return info.Sys().(*drive.File), nil
+}
+
+// lookupFolder is lookup for the references that have to be folders
+func (c *cli) lookupFolder(ref string) (*drive.File, error) {
+	folder, err := c.lookup(ref)
+	if err != nil {
+		return nil, err
+	}
+	if folder.MimeType != folderMimeType {
+		return nil, fmt.Errorf("%s is not a folder", ref)
+	}
+	return folder, nil
+}
+
+func runLs(c *cli, args []string) error {
+	rest, err := parseFlags(newFlags("ls"), args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	name := "."
+	if len(rest) == 1 {
+		name = drivePath(rest[0])
+	}
+
+	entries, err := c.vfs.ReadDir(name)
+	if err != nil {
+		return err
+	}
+
+	files := make([]fileRow, 0, len(entries))
+	rows := make([][]string, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		file := newFileRow(info.Sys().(*drive.File), "")
+		files = append(files, file)
+		rows = append(rows, file.cells(file.Name))
+	}
+
+	return c.out.table(files, fileHeader, rows)
+}
+
+func runTree(c *cli, args []string) error {
+	rest, err := parseFlags(newFlags("tree"), args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	root := "."
+	if len(rest) == 1 {
+		root = drivePath(rest[0])
+	}
+
+	var (
+		files []fileRow
+		rows  [][]string
+	)
+	err = fs.WalkDir(c.vfs, root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == root {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		file := newFileRow(info.Sys().(*drive.File), "/"+name)
+		files = append(files, file)
+		rows = append(rows, file.cells(file.Path))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.out.table(files, fileHeader, rows)
+}
+
+func runMkdir(c *cli, args []string) error {
+	flags := newFlags("mkdir")
+	parents := flags.Bool("p", false, "create missing parent folders")
+	rest, err := parseFlags(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	name := drivePath(rest[0])
+	if *parents {
+		err = c.vfs.MkdirAll(name, fs.ModeDir)
+	} else {
+		err = c.vfs.Mkdir(name, fs.ModeDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	folder, err := c.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	return c.out.message(newFileRow(folder, "/"+name), "Created /%s (%s)", name, folder.Id)
+}
+
+func runPut(c *cli, args []string) error {
+	flags := newFlags("put")
+	name := flags.String("name", "", "name of the file in Drive, defaults to the local name")
+	public := flags.Bool("public", false, "share the file with anyone with the link")
+	rest, err := parseFlags(flags, args, 1, 2)
+	if err != nil {
+		return err
+	}
+
+	local, err := os.Open(rest[0])
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+
+	folderRef := "."
+	if len(rest) == 2 {
+		folderRef = rest[1]
+	}
+	folder, err := c.lookupFolder(folderRef)
+	if err != nil {
+		return err
+	}
+
+	if *name == "" {
+		*name = filepath.Base(rest[0])
+	}
+
+	permission := fundrive.PrivatePermission
+	if *public {
+		permission = fundrive.PublicPermission
+	}
+
+	file, err := c.service.UploadFile(c.ctx, &fundrive.UploadFileRequest{
+		UserID:     c.config.UserID,
+		Email:      c.email,
+		FileName:   *name,
+		FileData:   local,
+		Permission: permission,
+		Parents:    []string{folder.Id},
+	})
+	if err != nil && !errors.Is(err, fundrive.ErrCatalogUpdate) {
+		return err
+	}
+
+	return c.out.message(newFileRow(file, ""), "Uploaded %s (%s, %s)", file.Name, file.Id, formatSize(file.Size))
+}
+
+func runGet(c *cli, args []string) error {
+	rest, err := parseFlags(newFlags("get"), args, 1, 2)
+	if err != nil {
+		return err
+	}
+
+	file, err := c.lookup(rest[0])
+	if err != nil {
+		return err
+	}
+	if file.MimeType == folderMimeType {
+		return fmt.Errorf("%s is a folder", rest[0])
+	}
+
+	download, err := c.service.DownloadFile(c.ctx, &fundrive.DownloadFileRequest{UserID: c.config.UserID, Email: c.email, FileID: file.Id})
+	if err != nil {
+		return err
+	}
+	defer download.Response.Body.Close()
+
+	target := file.Name
+	if len(rest) == 2 {
+		target = rest[1]
+	}
+
+	if target == "-" {
+		_, err := io.Copy(c.out.w, download.Response.Body)
+		return err
+	}
+
+	written, err := writeLocalFile(target, download.Response.Body)
+	if err != nil {
+		return err
+	}
+
+	return c.out.message(map[string]any{"id": file.Id, "path": target, "size": written},
+		"Downloaded %s to %s (%s)", file.Name, target, formatSize(written))
+}
+
+// writeLocalFile writes r to a local file
+func writeLocalFile(target string, r io.Reader) (int64, error) {
+	local, err := os.Create(target)
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(local, r)
+	if closeErr := local.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(target)
+		return 0, err
+	}
+	return written, nil
+}
+
+func runMv(c *cli, args []string) error {
+	rest, err := parseFlags(newFlags("mv"), args, 2, 2)
+	if err != nil {
+		return err
+	}
+
+	oldName, newName := drivePath(rest[0]), drivePath(rest[1])
+
+	// moving into an existing folder keeps the name, like mv(1)
+	if info, err := c.vfs.Stat(newName); err == nil && info.IsDir() {
+		newName = path.Join(newName, path.Base(oldName))
+	}
+
+	if err := c.vfs.Rename(oldName, newName); err != nil {
+		return err
+	}
+
+	return c.out.message(map[string]string{"from": "/" + oldName, "to": "/" + newName}, "Moved /%s to /%s", oldName, newName)
+}
+
+func runCp(c *cli, args []string) error {
+	flags := newFlags("cp")
+	name := flags.String("name", "", "name of the copy")
+	rest, err := parseFlags(flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+
+	file, err := c.lookup(rest[0])
+	if err != nil {
+		return err
+	}
+	folder, err := c.lookupFolder(rest[1])
+	if err != nil {
+		return err
+	}
+
+	copied, err := c.service.CopyResource(c.ctx, &fundrive.CopyResourceRequest{
+		UserID:              c.config.UserID,
+		Email:               c.email,
+		ResourceID:          file.Id,
+		DestinationParentID: folder.Id,
+		NewName:             *name,
+	})
+	if err != nil && !errors.Is(err, fundrive.ErrCatalogUpdate) {
+		return err
+	}
+
+	return c.out.message(newFileRow(copied, ""), "Copied %s to %s (%s)", file.Name, copied.Name, copied.Id)
+}
+
+func runRm(c *cli, args []string) error {
+	flags := newFlags("rm")
+	recursive := flags.Bool("r", false, "delete folders and their contents")
+	rest, err := parseFlags(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	file, err := c.lookup(rest[0])
+	if err != nil {
+		return err
+	}
+	if file.MimeType == folderMimeType && !*recursive {
+		return fmt.Errorf("%s is a folder, use -r to delete it", rest[0])
+	}
+
+	err = c.service.Delete(c.ctx, &fundrive.DeleteResourceRequest{UserID: c.config.UserID, Email: c.email, ResourceID: file.Id})
+	if err != nil && !errors.Is(err, fundrive.ErrCatalogUpdate) {
+		return err
+	}
+
+	return c.out.message(map[string]string{"deleted": file.Id}, "Deleted %s (%s)", file.Name, file.Id)
+}
+
+func runTrash(c *cli, args []string) error {
+	flags := newFlags("trash")
+	empty := flags.Bool("empty", false, "permanently delete every file in the trash")
+	rest, err := parseFlags(flags, args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	if *empty {
+		if len(rest) != 0 {
+			return errUsage
+		}
+		if err := c.service.EmptyTrash(c.ctx, &fundrive.EmptyTrashRequest{UserID: c.config.UserID, Email: c.email}); err != nil {
+			return err
+		}
+		return c.out.message(map[string]bool{"emptied": true}, "Emptied the trash of %s", c.email)
+	}
+
+	if len(rest) != 1 {
+		return errUsage
+	}
+
+	name := drivePath(rest[0])
+	file, err := c.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	if err := c.vfs.RemoveAll(name); err != nil {
+		return err
+	}
+
+	return c.out.message(map[string]string{"trashed": file.Id},
+		"Moved %s to the trash, restore it with: fundrive restore %s", file.Name, file.Id)
+}
+
+func runRestore(c *cli, args []string) error {
+	rest, err := parseFlags(newFlags("restore"), args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	id := strings.TrimPrefix(rest[0], "id:")
+	if err := c.service.RestoreFromTrash(c.ctx, &fundrive.RestoreRequest{UserID: c.config.UserID, Email: c.email, ResourceID: id}); err != nil {
+		return err
+	}
+
+	return c.out.message(map[string]string{"restored": id}, "Restored %s", id)
+}
+
+func runShare(c *cli, args []string) error {
+	flags := newFlags("share")
+	role := flags.String("role", "reader", "reader, commenter or writer")
+	notify := flags.Bool("notify", false, "send a notification email")
+	public := flags.Bool("public", false, "share with anyone with the link")
+	rest, err := parseFlags(flags, args, 1, 2)
+	if err != nil {
+		return err
+	}
+
+	if *public {
+		if len(rest) != 1 {
+			return errUsage
+		}
+
+		name := drivePath(rest[0])
+		if err := c.vfs.Chmod(name, 0o644); err != nil {
+			return err
+		}
+		return c.out.message(map[string]string{"shared": "/" + name, "type": "anyone"}, "Shared /%s with anyone with the link", name)
+	}
+
+	if len(rest) != 2 {
+		return errUsage
+	}
+
+	file, err := c.lookup(rest[0])
+	if err != nil {
+		return err
+	}
+
+	err = c.service.UpdatePermissions(c.ctx, &fundrive.UpdatePermissionRequest{
+		UserID:       c.config.UserID,
+		Email:        c.email,
+		ResourceID:   file.Id,
+		EmailAddress: rest[1],
+		Role:         *role,
+		Type:         "user",
+		NotifyEmail:  *notify,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.out.message(map[string]string{"shared": file.Id, "email": rest[1], "role": *role},
+		"Shared %s with %s as %s", file.Name, rest[1], *role)
+}
+
+func runSearch(c *cli, args []string) error {
+	flags := newFlags("search")
+	mimeType := flags.String("mime", "", "only return files of this MIME type")
+	limit := flags.Int64("limit", 50, "maximum number of results")
+	rest, err := parseFlags(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	results, _, err := c.service.SearchResources(c.ctx, &fundrive.SearchResourcesRequest{
+		UserID:   c.config.UserID,
+		Email:    c.email,
+		Query:    strings.ReplaceAll(rest[0], "'", `\'`),
+		MimeType: *mimeType,
+		PageSize: *limit,
+	})
+	if err != nil {
+		return err
+	}
+
+	files := make([]fileRow, 0, len(results))
+	rows := make([][]string, 0, len(results))
+	for _, result := range results {
+		file := newFileRow(result, "")
+		files = append(files, file)
+		rows = append(rows, file.cells(file.Name))
+	}
+
+	return c.out.table(files, fileHeader, rows)
+}
+
+func runExport(c *cli, args []string) error {
+	rest, err := parseFlags(newFlags("export"), args, 2, 3)
+	if err != nil {
+		return err
+	}
+
+	file, err := c.lookup(rest[0])
+	if err != nil {
+		return err
+	}
+
+	exported, err := c.service.ExportFile(c.ctx, &fundrive.ExportFileRequest{
+		UserID:   c.config.UserID,
+		Email:    c.email,
+		FileID:   file.Id,
+		MimeType: rest[1],
+	})
+	if err != nil {
+		return err
+	}
+
+	target := file.Name
+	if extensions, _ := mime.ExtensionsByType(rest[1]); len(extensions) > 0 {
+		target += extensions[0]
+	}
+	if len(rest) == 3 {
+		target = rest[2]
+	}
+
+	if target == "-" {
+		_, err := c.out.w.Write(exported.Content)
+		return err
+	}
+
+	written, err := writeLocalFile(target, bytes.NewReader(exported.Content))
+	if err != nil {
+		return err
+	}
+
+	return c.out.message(map[string]any{"id": file.Id, "path": target, "size": written},
+		"Exported %s to %s (%s)", file.Name, target, formatSize(written))
+}
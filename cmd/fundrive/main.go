@@ -0,0 +1,186 @@
+// Command fundrive manages the Google Drive accounts connected to a fundrive
+// database from the command line.
+//
+// Usage:
+//
+//	fundrive [-config file] [-account email] [-o table|json] <command> [arguments]
+//
+// Drive paths are relative to My Drive, e.g. /projects/report.pdf. A file can also
+// be referenced by its ID with an id: prefix, e.g. id:1a2b3c.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	"github.com/semmidev/fundrive"
+)
+
+// command is a subcommand of the CLI
+type command struct {
+	usage   string
+	summary string
+
+	// offline commands run without a Drive account
+	offline bool
+
+	run func(c *cli, args []string) error
+}
+
+var commands = map[string]command{
+	"init":            {usage: "init -client-secret file -key key [-driver sqlite|mysql] [-dsn dsn]", summary: "write the config file", offline: true, run: runInit},
+	"auth login":      {usage: "auth login [-device] [-no-browser] [-profile file|readonly|full] [-email email]", summary: "connect an account", offline: true, run: runAuthLogin},
+	"accounts list":   {usage: "accounts list", summary: "list connected accounts", offline: true, run: runAccountsList},
+	"accounts remove": {usage: "accounts remove <email>", summary: "disconnect an account", offline: true, run: runAccountsRemove},
+	"accounts use":    {usage: "accounts use <email>", summary: "set the default account", offline: true, run: runAccountsUse},
+	"ls":              {usage: "ls [path]", summary: "list a folder", run: runLs},
+	"tree":            {usage: "tree [path]", summary: "list a folder recursively", run: runTree},
+	"mkdir":           {usage: "mkdir [-p] <path>", summary: "create a folder", run: runMkdir},
+	"put":             {usage: "put [-name name] [-public] <local file> [folder]", summary: "upload a file", run: runPut},
+	"get":             {usage: "get <path> [local file|-]", summary: "download a file", run: runGet},
+	"mv":              {usage: "mv <path> <new path>", summary: "rename or move a file or folder", run: runMv},
+	"cp":              {usage: "cp [-name name] <path> <folder>", summary: "copy a file", run: runCp},
+	"rm":              {usage: "rm [-r] <path>", summary: "delete a file permanently", run: runRm},
+	"trash":           {usage: "trash [-empty] [path]", summary: "move a file to the trash, or empty it", run: runTrash},
+	"restore":         {usage: "restore <id>", summary: "restore a file from the trash", run: runRestore},
+	"share":           {usage: "share [-role role] [-notify] <path> <email> | share -public <path>", summary: "share a file", run: runShare},
+	"search":          {usage: "search [-mime type] [-limit n] <text>", summary: "search files by content and name", run: runSearch},
+	"export":          {usage: "export <path> <mime type> [local file|-]", summary: "export a Google Docs file", run: runExport},
+	"quota":           {usage: "quota [-refresh]", summary: "show the storage of every account", offline: true, run: runQuota},
+}
+
+// cli is the state shared by the commands
+type cli struct {
+	ctx     context.Context
+	config  *Config
+	out     *output
+	service *fundrive.GoogleDriveService
+	email   string
+	vfs     *fundrive.DriveVFS
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := run(ctx, os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "fundrive:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("fundrive", flag.ContinueOnError)
+	configPath := flags.String("config", defaultConfigPath(), "config file")
+	account := flags.String("account", "", "email of the account to use")
+	format := flags.String("o", "table", "output format, table or json")
+	flags.Usage = func() { printUsage(flags.Output()) }
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("unknown output format %q", *format)
+	}
+
+	name, cmd, rest, ok := findCommand(flags.Args())
+	if !ok {
+		printUsage(os.Stderr)
+		return errors.New("unknown command")
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	c := &cli{ctx: ctx, config: config, out: &output{w: stdout, json: *format == "json"}}
+
+	if name != "init" {
+		if c.service, err = config.openService(); err != nil {
+			return err
+		}
+	}
+
+	if !cmd.offline {
+		if c.email, err = config.account(ctx, c.service, *account); err != nil {
+			return err
+		}
+
+		c.vfs, err = c.service.VFS(ctx, &fundrive.VFSRequest{
+			FSRequest: fundrive.FSRequest{UserID: config.UserID, Email: c.email},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := cmd.run(c, rest); err != nil {
+		if errors.Is(err, errUsage) {
+			return fmt.Errorf("usage: fundrive %s", cmd.usage)
+		}
+		return err
+	}
+	return nil
+}
+
+// findCommand matches one or two leading arguments with a command
+func findCommand(args []string) (string, command, []string, bool) {
+	if len(args) >= 2 {
+		name := args[0] + " " + args[1]
+		if cmd, ok := commands[name]; ok {
+			return name, cmd, args[2:], true
+		}
+	}
+	if len(args) >= 1 {
+		if cmd, ok := commands[args[0]]; ok {
+			return args[0], cmd, args[1:], true
+		}
+	}
+	return "", command{}, nil, false
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: fundrive [-config file] [-account email] [-o table|json] <command> [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-16s %s\n", name, commands[name].summary)
+	}
+}
+
+// errUsage makes run print the usage of the command
+var errUsage = errors.New("invalid arguments")
+
+// parseFlags parses the flags of a command and checks the number of arguments
+func parseFlags(flags *flag.FlagSet, args []string, minArgs, maxArgs int) ([]string, error) {
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		return nil, errUsage
+	}
+
+	rest := flags.Args()
+	if len(rest) < minArgs || len(rest) > maxArgs {
+		return nil, errUsage
+	}
+	return rest, nil
+}
+
+// newFlags returns the flag set of a command
+func newFlags(name string) *flag.FlagSet {
+	return flag.NewFlagSet(strings.ReplaceAll(name, " ", "-"), flag.ContinueOnError)
+}
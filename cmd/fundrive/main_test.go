@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testClientSecret = `{"installed":{"client_id":"id.apps.googleusercontent.com","client_secret":"secret",` +
+	`"auth_uri":"https://accounts.google.com/o/oauth2/auth","token_uri":"https://oauth2.googleapis.com/token",` +
+	`"redirect_uris":["http://localhost"]}}`
+
+func TestLoadConfigDefaults(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"client_secret_file":"client.json"}`), 0o600))
+
+	config, err := loadConfig(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, "sqlite", config.Driver)
+	assert.Equal(t, filepath.Join(dir, "fundrive.db"), config.DSN)
+	assert.Equal(t, defaultUserID, config.UserID)
+	assert.Equal(t, filepath.Join(dir, "client.json"), config.ClientSecretFile)
+	assert.Error(t, config.validate())
+}
+
+func TestDrivePath(t *testing.T) {
+	assert.Equal(t, ".", drivePath(""))
+	assert.Equal(t, ".", drivePath("/"))
+	assert.Equal(t, "projects/report.pdf", drivePath("/projects/report.pdf"))
+	assert.Equal(t, "projects", drivePath("projects/"))
+	assert.Equal(t, "report.pdf", drivePath("/../projects/../report.pdf"))
+}
+
+func TestFindCommand(t *testing.T) {
+	name, _, rest, ok := findCommand([]string{"accounts", "use", "a@example.com"})
+	require.True(t, ok)
+	assert.Equal(t, "accounts use", name)
+	assert.Equal(t, []string{"a@example.com"}, rest)
+
+	name, _, rest, ok = findCommand([]string{"ls", "/projects"})
+	require.True(t, ok)
+	assert.Equal(t, "ls", name)
+	assert.Equal(t, []string{"/projects"}, rest)
+
+	_, _, _, ok = findCommand([]string{"accounts"})
+	assert.False(t, ok)
+}
+
+func TestRunInitAndAccounts(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "client.json"), []byte(testClientSecret), 0o600))
+
+	var stdout bytes.Buffer
+	err := run(context.Background(), []string{"-config", configPath, "init",
+		"-client-secret", "client.json", "-key", "12345678901234567890123456789012"}, &stdout)
+	require.NoError(t, err)
+	assert.FileExists(t, configPath)
+
+	stdout.Reset()
+	err = run(context.Background(), []string{"-config", configPath, "-o", "json", "accounts", "list"}, &stdout)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[]`, stdout.String())
+
+	err = run(context.Background(), []string{"-config", configPath, "ls"}, &stdout)
+	assert.ErrorContains(t, err, "no account connected")
+
+	err = run(context.Background(), []string{"-config", configPath, "accounts", "use"}, &stdout)
+	assert.ErrorContains(t, err, "usage: fundrive accounts use <email>")
+}
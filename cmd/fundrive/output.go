@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// output prints command results as a table or as JSON
+type output struct {
+	w    io.Writer
+	json bool
+}
+
+// table prints rows under a header, or value when the output is JSON
+func (o *output) table(value any, header []string, rows [][]string) error {
+	if o.json {
+		return o.value(value)
+	}
+
+	tw := tabwriter.NewWriter(o.w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// message prints a line, or value when the output is JSON
+func (o *output) message(value any, format string, args ...any) error {
+	if o.json {
+		return o.value(value)
+	}
+
+	_, err := fmt.Fprintf(o.w, format+"\n", args...)
+	return err
+}
+
+func (o *output) value(value any) error {
+	encoder := json.NewEncoder(o.w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// formatSize formats a byte count with a binary unit
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -20,7 +20,7 @@ func main() {
 	// create a fundrive service
 	fundriveService, err := fundrive.New(
 		fundrive.WithDB(db),
-		fundrive.WithServiceAccountFilePath("service-account.json"),
+		fundrive.WithClientSecretFilePath("client-secret.json"),
 		fundrive.WithEncryptionKey("12345678901234567890123456789012"),
 	)
 
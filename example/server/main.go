@@ -19,7 +19,7 @@ func main() {
 	// create a fundrive service
 	fundriveService, err := fundrive.New(
 		fundrive.WithDB(db),
-		fundrive.WithServiceAccountFilePath("service-account.json"),
+		fundrive.WithClientSecretFilePath("client-secret.json"),
 		fundrive.WithEncryptionKey("F7JI1y0TrkFnoeVMIONKIwAEshLrJqOy"),
 	)
 
@@ -1,9 +1,14 @@
 package fundrive
 
 import (
+	"context"
 	"fmt"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
 	"gorm.io/gorm"
+	"os"
+	"sync"
 )
 
 type GoogleDriveService struct {
@@ -12,6 +17,25 @@ type GoogleDriveService struct {
 	OauthConfig     *oauth2.Config
 	DB              *gorm.DB
 	IsUseBaseFolder bool
+	IsUseCatalog    bool
+	RetryPolicy     RetryPolicy
+	RateLimiter     *RateLimiter
+	Batch           BatchConfig
+	ClientOptions   []option.ClientOption
+
+	// ScopeProfile is the Drive access of the OAuth client and the service account
+	ScopeProfile ScopeProfile
+
+	// ServiceAccountKey authenticates the accounts resolved to AuthModeServiceAccount
+	ServiceAccountKey []byte
+	AuthModeResolver  AuthModeResolver
+
+	clientCache           *driveClientCache
+	serviceAccountClients *driveClientCache
+	storageReports        *storageReportCache
+
+	poolMu      sync.Mutex
+	poolCursors map[poolCursorKey]int
 }
 
 // New creates a new instance of IGoogleDriveService with the provided configuration
@@ -29,15 +53,39 @@ func New(opts ...GoogleDriveServiceConfigOption) (*GoogleDriveService, error) {
 		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
 
-	// Auto migrate database schema
-	if err := config.DB.AutoMigrate(&OAuthToken{}); err != nil {
-		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	// Apply the pending schema migrations
+	if config.AutoMigrate {
+		if err := Migrate(context.Background(), config.DB, WithMigrationTablePrefix(config.TablePrefix)); err != nil {
+			return nil, fmt.Errorf("failed to migrate database: %w", err)
+		}
 	}
 
-	// Initialize OAuth2 configuration
-	oauth2Config, err := NewOAuth2Config(config.ServiceAccountFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create OAuth config: %w", err)
+	// Initialize OAuth2 configuration, deployments using only a service account
+	// have no OAuth client and cannot connect user accounts
+	var err error
+	oauth2Config := &oauth2.Config{Endpoint: google.Endpoint}
+	if path := config.clientSecretFilePath(); path != "" {
+		oauth2Config, err = NewOAuth2Config(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OAuth config: %w", err)
+		}
+	}
+	if config.ScopeProfile != "" || config.clientSecretFilePath() == "" {
+		oauth2Config.Scopes = config.ScopeProfile.Scopes()
+	}
+
+	// Load the service account key
+	serviceAccountKey := config.ServiceAccountKey
+	if config.ServiceAccountKeyFilePath != "" {
+		serviceAccountKey, err = os.ReadFile(config.ServiceAccountKeyFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service account key: %w", err)
+		}
+	}
+	if len(serviceAccountKey) > 0 {
+		if _, err := google.JWTConfigFromJSON(serviceAccountKey); err != nil {
+			return nil, fmt.Errorf("failed to parse service account key: %w", err)
+		}
 	}
 
 	// Initialize token encryption
@@ -46,11 +94,32 @@ func New(opts ...GoogleDriveServiceConfigOption) (*GoogleDriveService, error) {
 		return nil, fmt.Errorf("failed to create token encryption: %w", err)
 	}
 
+	// Initialize the tenants
+	tenants, err := newTenants(config.Tenants, oauth2Config, tokenEncryptor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tenants: %w", err)
+	}
+
+	// Initialize Drive client and storage report caches
+	clientCache := newDriveClientCache(config.ClientCache)
+	serviceAccountClients := newDriveClientCache(config.ClientCache)
+	storageReports := newStorageReportCache(config.StorageReportTTL)
+
 	// Initialize OAuth config
 	oauthConfig := OAuthConfig{
 		DB:             config.DB,
 		OAuth2Config:   oauth2Config,
 		TokenEncryptor: tokenEncryptor,
+		TokenChangeHooks: []TokenChangeHook{
+			func(ctx context.Context, userID, email string) {
+				tenantID := TenantFromContext(ctx)
+				clientCache.invalidate(tenantID, userID, email)
+				storageReports.invalidate(tenantID, userID)
+			},
+		},
+		Tenants:        tenants,
+		TablePrefix:    config.TablePrefix,
+		ClientResolver: config.OAuthClientResolver,
 	}
 
 	// Initialize OAuth service
@@ -65,6 +134,23 @@ func New(opts ...GoogleDriveServiceConfigOption) (*GoogleDriveService, error) {
 		OauthConfig:    oauth2Config,
 		TokenEncryptor: tokenEncryptor,
 		DB:             config.DB,
+		IsUseCatalog:   config.UseCatalog,
+		RetryPolicy:    config.RetryPolicy,
+		Batch:          config.Batch,
+		ClientOptions:  config.ClientOptions,
+
+		ScopeProfile:      config.ScopeProfile,
+		ServiceAccountKey: serviceAccountKey,
+		AuthModeResolver:  config.AuthModeResolver,
+
+		clientCache:           clientCache,
+		serviceAccountClients: serviceAccountClients,
+		storageReports:        storageReports,
+	}
+
+	// Initialize client-side rate limiter
+	if config.RateLimit != nil {
+		service.RateLimiter = NewRateLimiter(*config.RateLimit)
 	}
 
 	return &service, nil
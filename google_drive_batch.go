@@ -0,0 +1,609 @@
+package fundrive
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// maxBatchSize is the maximum number of calls Drive accepts in one batch request
+const maxBatchSize = 100
+
+// BatchConfig configures bulk operations
+type BatchConfig struct {
+	// MaxBatchSize is the number of calls sent per batch request (at most 100)
+	MaxBatchSize int
+
+	// FallbackConcurrency bounds the individual calls made when batching is not possible
+	FallbackConcurrency int
+
+	// DisableBatching always uses individual calls instead of the batch endpoint
+	DisableBatching bool
+}
+
+// DefaultBatchConfig returns the batch configuration used when none is configured
+func DefaultBatchConfig() BatchConfig {
+	return BatchConfig{
+		MaxBatchSize:        maxBatchSize,
+		FallbackConcurrency: 8,
+	}
+}
+
+// ErrBatchOutcomeUnknown is the error of a batch item whose response was lost. Drive may
+// have applied the call, so it is not executed again
+var ErrBatchOutcomeUnknown = errors.New("batch item outcome unknown")
+
+// BatchItemError is the error of a single call inside a bulk operation
+type BatchItemError struct {
+	Index      int    `json:"index"`
+	ResourceID string `json:"resource_id"`
+	StatusCode int    `json:"status_code"`
+	Reason     string `json:"reason"`
+	Err        error  `json:"-"`
+}
+
+func (e *BatchItemError) Error() string {
+	return fmt.Sprintf("batch item %d (%s): %v", e.Index, e.ResourceID, e.Err)
+}
+
+func (e *BatchItemError) Unwrap() error {
+	return e.Err
+}
+
+// BatchResult is the outcome of a single call inside a bulk operation
+type BatchResult struct {
+	ResourceID string            `json:"resource_id"`
+	File       *drive.File       `json:"file,omitempty"`
+	Permission *drive.Permission `json:"permission,omitempty"`
+	Err        error             `json:"-"`
+}
+
+// Failed reports whether the call failed
+func (r *BatchResult) Failed() bool {
+	return r.Err != nil
+}
+
+// batchCall is a single Drive call that can be sent through the batch endpoint
+// or executed on its own
+type batchCall struct {
+	resourceID string
+	method     string
+	path       string
+	query      url.Values
+	body       interface{}
+
+	// decode stores a successful batch response in the result
+	decode func(body []byte, result *BatchResult) error
+
+	// fallback executes the call as an individual request
+	fallback func(ctx context.Context, result *BatchResult) error
+
+	// catalog records a successful batch response in the catalog, the fallback
+	// updates the catalog on its own
+	catalog func(ctx context.Context, result *BatchResult) error
+}
+
+// batchNotProcessedError marks a batch request that failed before it was sent
+type batchNotProcessedError struct {
+	err error
+}
+
+func (e *batchNotProcessedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *batchNotProcessedError) Unwrap() error {
+	return e.err
+}
+
+// isBatchNotProcessed reports whether Drive did not run any call of a failed batch: the
+// request was not sent, the client-side rate limiter rejected it, the connection was
+// refused or the envelope was rejected with a 4xx
+func isBatchNotProcessed(err error) bool {
+	var notProcessed *batchNotProcessedError
+	if errors.As(err, &notProcessed) {
+		return true
+	}
+
+	if errors.Is(err, ErrRateLimited) {
+		return true
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code >= 400 && apiErr.Code < 500
+	}
+
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+func newBatchItemError(index int, resourceID string, err error) *BatchItemError {
+	itemErr := &BatchItemError{
+		Index:      index,
+		ResourceID: resourceID,
+		Err:        err,
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		itemErr.StatusCode = apiErr.Code
+		if len(apiErr.Errors) > 0 {
+			itemErr.Reason = apiErr.Errors[0].Reason
+		}
+	}
+
+	return itemErr
+}
+
+// executeBatch runs the calls in groups through the batch endpoint and falls back
+// to bounded-concurrency individual calls when a group cannot be batched. Calls Drive
+// may have applied are never sent again, they fail with ErrBatchOutcomeUnknown
+func (service *GoogleDriveService) executeBatch(ctx context.Context, req *newDriveServiceRequest, calls []batchCall) ([]BatchResult, error) {
+	results := make([]BatchResult, len(calls))
+	for i, call := range calls {
+		results[i].ResourceID = call.resourceID
+	}
+
+	if len(calls) == 0 {
+		return results, nil
+	}
+
+	config := service.Batch
+	if config.MaxBatchSize <= 0 || config.MaxBatchSize > maxBatchSize {
+		config.MaxBatchSize = maxBatchSize
+	}
+
+	client, err := service.newDriveClient(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	// indexes of calls that have to be executed individually
+	var fallback []int
+
+	for start := 0; start < len(calls); start += config.MaxBatchSize {
+		end := start + config.MaxBatchSize
+		if end > len(calls) {
+			end = len(calls)
+		}
+
+		indexes := make([]int, 0, end-start)
+		for i := start; i < end; i++ {
+			indexes = append(indexes, i)
+		}
+
+		if config.DisableBatching {
+			fallback = append(fallback, indexes...)
+			continue
+		}
+
+		responses, err := retryCall(ctx, service.RetryPolicy, "batch", false, func() (map[int]*http.Response, error) {
+			return service.sendBatch(ctx, client, calls, indexes)
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if isBatchNotProcessed(err) {
+				fallback = append(fallback, indexes...)
+				continue
+			}
+
+			// replaying would duplicate permissions or fail deletes that were applied
+			for _, i := range indexes {
+				results[i].Err = newBatchItemError(i, calls[i].resourceID, fmt.Errorf("%w: %w", ErrBatchOutcomeUnknown, err))
+			}
+			continue
+		}
+
+		for _, i := range indexes {
+			response, ok := responses[i]
+			if !ok {
+				results[i].Err = newBatchItemError(i, calls[i].resourceID, fmt.Errorf("%w: no response for the item", ErrBatchOutcomeUnknown))
+				continue
+			}
+
+			err := service.readBatchResponse(response, calls[i], &results[i])
+			if err != nil && isRateLimitError(err) {
+				// throttled items are sent again individually with the retry policy
+				fallback = append(fallback, i)
+				continue
+			}
+
+			if err == nil && calls[i].catalog != nil {
+				err = calls[i].catalog(ctx, &results[i])
+			}
+
+			if err != nil {
+				results[i].Err = newBatchItemError(i, calls[i].resourceID, err)
+			}
+		}
+	}
+
+	if len(fallback) == 0 {
+		return results, nil
+	}
+
+	concurrency := config.FallbackConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+
+	for _, i := range fallback {
+		i := i
+
+		g.Go(func() error {
+			results[i] = BatchResult{ResourceID: calls[i].resourceID}
+			if err := calls[i].fallback(gCtx, &results[i]); err != nil {
+				results[i].Err = newBatchItemError(i, calls[i].resourceID, err)
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// batchURL returns the batch endpoint matching the service base path
+func batchURL(srv *drive.Service) string {
+	return strings.TrimSuffix(srv.BasePath, "drive/v3/") + "batch/drive/v3"
+}
+
+// sendBatch sends the calls as one multipart/mixed request and returns the
+// responses indexed by call position
+func (service *GoogleDriveService) sendBatch(
+	ctx context.Context,
+	client *driveClient,
+	calls []batchCall,
+	indexes []int,
+) (map[int]*http.Response, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	for _, i := range indexes {
+		call := calls[i]
+
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-ID":   {"<item-" + strconv.Itoa(i) + ">"},
+		})
+		if err != nil {
+			return nil, &batchNotProcessedError{err}
+		}
+
+		// every call supports items in shared drives, like the individual requests
+		query := url.Values{"supportsAllDrives": {"true"}}
+		for key, values := range call.query {
+			query[key] = values
+		}
+
+		target := "/drive/v3/" + call.path + "?" + query.Encode()
+
+		if _, err := fmt.Fprintf(part, "%s %s HTTP/1.1\r\n", call.method, target); err != nil {
+			return nil, &batchNotProcessedError{err}
+		}
+
+		if call.body == nil {
+			if _, err := io.WriteString(part, "\r\n"); err != nil {
+				return nil, &batchNotProcessedError{err}
+			}
+			continue
+		}
+
+		payload, err := json.Marshal(call.body)
+		if err != nil {
+			return nil, &batchNotProcessedError{err}
+		}
+
+		if _, err := fmt.Fprintf(part, "Content-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(payload), payload); err != nil {
+			return nil, &batchNotProcessedError{err}
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, &batchNotProcessedError{err}
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, batchURL(client.srv), &body)
+	if err != nil {
+		return nil, &batchNotProcessedError{err}
+	}
+	httpReq.Header.Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+
+	resp, err := client.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("unexpected batch response content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	responses := make(map[int]*http.Response, len(indexes))
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading batch response: %w", err)
+		}
+
+		contentID := strings.Trim(part.Header.Get("Content-ID"), "<>")
+		index, err := strconv.Atoi(strings.TrimPrefix(contentID, "response-item-"))
+		if err != nil {
+			continue
+		}
+
+		itemResp, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			return nil, fmt.Errorf("error reading batch item response: %w", err)
+		}
+
+		// the part reader is invalidated by the next part, so keep the body
+		itemBody, err := io.ReadAll(itemResp.Body)
+		itemResp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading batch item response: %w", err)
+		}
+		itemResp.Body = io.NopCloser(bytes.NewReader(itemBody))
+
+		responses[index] = itemResp
+	}
+
+	return responses, nil
+}
+
+// readBatchResponse stores a batch item response in its result
+func (service *GoogleDriveService) readBatchResponse(resp *http.Response, call batchCall, result *BatchResult) error {
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if call.decode == nil || len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
+	return call.decode(body, result)
+}
+
+func decodeBatchFile(body []byte, result *BatchResult) error {
+	var file drive.File
+	if err := json.Unmarshal(body, &file); err != nil {
+		return err
+	}
+	result.File = &file
+	return nil
+}
+
+func decodeBatchPermission(body []byte, result *BatchResult) error {
+	var permission drive.Permission
+	if err := json.Unmarshal(body, &permission); err != nil {
+		return err
+	}
+	result.Permission = &permission
+	return nil
+}
+
+type BatchDeleteRequest struct {
+	UserID      string   `json:"user_id" validate:"required"`
+	Email       string   `json:"email" validate:"required"`
+	ResourceIDs []string `json:"resource_ids" validate:"required"`
+}
+
+// BatchDelete permanently deletes the resources in groups of up to 100 per request
+func (service *GoogleDriveService) BatchDelete(ctx context.Context, req *BatchDeleteRequest) ([]BatchResult, error) {
+	calls := make([]batchCall, 0, len(req.ResourceIDs))
+
+	for _, resourceID := range req.ResourceIDs {
+		resourceID := resourceID
+
+		calls = append(calls, batchCall{
+			resourceID: resourceID,
+			method:     http.MethodDelete,
+			path:       "files/" + url.PathEscape(resourceID),
+			fallback: func(ctx context.Context, result *BatchResult) error {
+				return service.Delete(ctx, &DeleteResourceRequest{
+					UserID:     req.UserID,
+					Email:      req.Email,
+					ResourceID: resourceID,
+				})
+			},
+			catalog: func(ctx context.Context, result *BatchResult) error {
+				return service.catalogRemove(ctx, req.UserID, req.Email, resourceID)
+			},
+		})
+	}
+
+	return service.executeBatch(ctx, &newDriveServiceRequest{UserID: req.UserID, Email: req.Email}, calls)
+}
+
+type BatchMoveRequest struct {
+	UserID       string   `json:"user_id" validate:"required"`
+	Email        string   `json:"email" validate:"required"`
+	ResourceIDs  []string `json:"resource_ids" validate:"required"`
+	NewParentID  string   `json:"new_parent_id" validate:"required"`
+	OldParentIDs []string `json:"old_parent_ids,omitempty"`
+}
+
+// BatchMove moves the resources to a new parent in groups of up to 100 per request
+func (service *GoogleDriveService) BatchMove(ctx context.Context, req *BatchMoveRequest) ([]BatchResult, error) {
+	calls := make([]batchCall, 0, len(req.ResourceIDs))
+
+	query := url.Values{
+		"addParents": {req.NewParentID},
+		"fields":     {"id, name, parents, mimeType"},
+	}
+	if len(req.OldParentIDs) > 0 {
+		query.Set("removeParents", strings.Join(req.OldParentIDs, ","))
+	}
+
+	for _, resourceID := range req.ResourceIDs {
+		resourceID := resourceID
+
+		calls = append(calls, batchCall{
+			resourceID: resourceID,
+			method:     http.MethodPatch,
+			path:       "files/" + url.PathEscape(resourceID),
+			query:      query,
+			body:       &drive.File{},
+			decode:     decodeBatchFile,
+			fallback: func(ctx context.Context, result *BatchResult) error {
+				file, err := service.MoveResource(ctx, &MoveResourceRequest{
+					UserID:       req.UserID,
+					Email:        req.Email,
+					ResourceID:   resourceID,
+					NewParentID:  req.NewParentID,
+					OldParentIDs: req.OldParentIDs,
+				})
+				result.File = file
+				return err
+			},
+			catalog: func(ctx context.Context, result *BatchResult) error {
+				return service.catalogMove(ctx, req.UserID, req.Email, result.File)
+			},
+		})
+	}
+
+	return service.executeBatch(ctx, &newDriveServiceRequest{UserID: req.UserID, Email: req.Email}, calls)
+}
+
+type BatchRenameItem struct {
+	ResourceID string `json:"resource_id" validate:"required"`
+	NewName    string `json:"new_name" validate:"required"`
+}
+
+type BatchRenameRequest struct {
+	UserID string            `json:"user_id" validate:"required"`
+	Email  string            `json:"email" validate:"required"`
+	Items  []BatchRenameItem `json:"items" validate:"required"`
+}
+
+// BatchRename renames the resources in groups of up to 100 per request
+func (service *GoogleDriveService) BatchRename(ctx context.Context, req *BatchRenameRequest) ([]BatchResult, error) {
+	calls := make([]batchCall, 0, len(req.Items))
+
+	for _, item := range req.Items {
+		item := item
+
+		calls = append(calls, batchCall{
+			resourceID: item.ResourceID,
+			method:     http.MethodPatch,
+			path:       "files/" + url.PathEscape(item.ResourceID),
+			query:      url.Values{"fields": {"id, name, mimeType, modifiedTime"}},
+			body:       &drive.File{Name: item.NewName},
+			decode:     decodeBatchFile,
+			fallback: func(ctx context.Context, result *BatchResult) error {
+				file, err := service.RenameResource(ctx, &RenameResourceRequest{
+					UserID:     req.UserID,
+					Email:      req.Email,
+					ResourceID: item.ResourceID,
+					NewName:    item.NewName,
+				})
+				result.File = file
+				return err
+			},
+			catalog: func(ctx context.Context, result *BatchResult) error {
+				return service.catalogMove(ctx, req.UserID, req.Email, result.File)
+			},
+		})
+	}
+
+	return service.executeBatch(ctx, &newDriveServiceRequest{UserID: req.UserID, Email: req.Email}, calls)
+}
+
+type BatchUpdatePermissionsRequest struct {
+	UserID       string   `json:"user_id" validate:"required"`
+	Email        string   `json:"email" validate:"required"`
+	ResourceIDs  []string `json:"resource_ids" validate:"required"`
+	EmailAddress string   `json:"email_address" validate:"required,email"`
+	Role         string   `json:"role" validate:"required,oneof=reader commenter writer fileOrganizer organizer owner"`
+	Type         string   `json:"type" validate:"required,oneof=user group domain anyone"`
+	NotifyEmail  bool     `json:"notify_email"`
+}
+
+// BatchUpdatePermissions grants the same permission on every resource in groups
+// of up to 100 per request
+func (service *GoogleDriveService) BatchUpdatePermissions(ctx context.Context, req *BatchUpdatePermissionsRequest) ([]BatchResult, error) {
+	if !validPermissionRole(req.Role) {
+		return nil, fmt.Errorf("invalid role %q", req.Role)
+	}
+
+	calls := make([]batchCall, 0, len(req.ResourceIDs))
+
+	permission := &drive.Permission{
+		EmailAddress: req.EmailAddress,
+		Role:         req.Role,
+		Type:         req.Type,
+	}
+
+	query := url.Values{
+		"sendNotificationEmail": {strconv.FormatBool(req.NotifyEmail)},
+	}
+
+	for _, resourceID := range req.ResourceIDs {
+		resourceID := resourceID
+
+		calls = append(calls, batchCall{
+			resourceID: resourceID,
+			method:     http.MethodPost,
+			path:       "files/" + url.PathEscape(resourceID) + "/permissions",
+			query:      query,
+			body:       permission,
+			decode:     decodeBatchPermission,
+			fallback: func(ctx context.Context, result *BatchResult) error {
+				return service.UpdatePermissions(ctx, &UpdatePermissionRequest{
+					UserID:       req.UserID,
+					Email:        req.Email,
+					ResourceID:   resourceID,
+					EmailAddress: req.EmailAddress,
+					Role:         req.Role,
+					Type:         req.Type,
+					NotifyEmail:  req.NotifyEmail,
+				})
+			},
+		})
+	}
+
+	return service.executeBatch(ctx, &newDriveServiceRequest{UserID: req.UserID, Email: req.Email}, calls)
+}
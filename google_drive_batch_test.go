@@ -0,0 +1,337 @@
+package fundrive
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// fakeBatchServer answers Drive batch requests and individual file calls
+type fakeBatchServer struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	batchRequests int
+	batchSizes    []int
+	singleCalls   int
+	failBatch     bool
+	batchStatus   int
+}
+
+func newFakeBatchServer(t *testing.T) *fakeBatchServer {
+	fake := &fakeBatchServer{}
+
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/batch/drive/v3" {
+			fake.serveBatch(t, w, r)
+			return
+		}
+
+		fake.mu.Lock()
+		fake.singleCalls++
+		fake.mu.Unlock()
+
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			writeFakeAPIError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(fake.Close)
+
+	return fake
+}
+
+func writeFakeAPIError(w http.ResponseWriter, code int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":"%s","errors":[{"reason":"%s"}]}}`, code, reason, reason)
+}
+
+func (fake *fakeBatchServer) serveBatch(t *testing.T, w http.ResponseWriter, r *http.Request) {
+	fake.mu.Lock()
+	fake.batchRequests++
+	failBatch := fake.failBatch
+	batchStatus := fake.batchStatus
+	fake.mu.Unlock()
+
+	if failBatch {
+		writeFakeAPIError(w, http.StatusBadRequest, "batchNotSupported")
+		return
+	}
+	if batchStatus != 0 {
+		writeFakeAPIError(w, batchStatus, "backendError")
+		return
+	}
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	require.NoError(t, err)
+
+	// read the whole request before answering, the server closes the body
+	// once the response is written
+	payload, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+
+	reader := multipart.NewReader(bytes.NewReader(payload), params["boundary"])
+	writer := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+
+	var size int
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		size++
+
+		item, err := http.ReadRequest(bufio.NewReader(part))
+		require.NoError(t, err)
+
+		// the response of a lost item is left out of the envelope
+		if strings.HasSuffix(item.URL.Path, "/lost") {
+			continue
+		}
+
+		contentID := strings.Trim(part.Header.Get("Content-ID"), "<>")
+		out, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-ID":   {"<response-" + contentID + ">"},
+		})
+		require.NoError(t, err)
+
+		switch {
+		case strings.HasSuffix(item.URL.Path, "/missing"):
+			body := `{"error":{"code":404,"message":"File not found","errors":[{"reason":"notFound"}]}}`
+			fmt.Fprintf(out, "HTTP/1.1 404 Not Found\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		case strings.HasSuffix(item.URL.Path, "/throttled"):
+			body := `{"error":{"code":403,"message":"Rate limit","errors":[{"reason":"userRateLimitExceeded"}]}}`
+			fmt.Fprintf(out, "HTTP/1.1 403 Forbidden\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		case item.Method == http.MethodPatch:
+			var file map[string]interface{}
+			require.NoError(t, json.NewDecoder(item.Body).Decode(&file))
+			id := strings.TrimPrefix(item.URL.Path, "/drive/v3/files/")
+			body := fmt.Sprintf(`{"id":%q,"name":%q}`, id, file["name"])
+			fmt.Fprintf(out, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		default:
+			fmt.Fprint(out, "HTTP/1.1 204 No Content\r\n\r\n")
+		}
+	}
+	require.NoError(t, writer.Close())
+
+	fake.mu.Lock()
+	fake.batchSizes = append(fake.batchSizes, size)
+	fake.mu.Unlock()
+}
+
+func newBatchTestService(t *testing.T, fake *fakeBatchServer) *GoogleDriveService {
+	return &GoogleDriveService{
+		OAuthService:  newStubOAuthService(t),
+		RetryPolicy:   NoRetryPolicy(),
+		Batch:         DefaultBatchConfig(),
+		ClientOptions: []option.ClientOption{option.WithEndpoint(fake.URL + "/drive/v3/")},
+	}
+}
+
+func TestGoogleDriveService_BatchDelete(t *testing.T) {
+	fake := newFakeBatchServer(t)
+	service := newBatchTestService(t, fake)
+
+	ids := make([]string, 0, 150)
+	for i := 0; i < 149; i++ {
+		ids = append(ids, fmt.Sprintf("file-%d", i))
+	}
+	ids = append(ids, "missing")
+
+	results, err := service.BatchDelete(context.Background(), &BatchDeleteRequest{
+		UserID:      "user-1",
+		Email:       "a@example.com",
+		ResourceIDs: ids,
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 150)
+
+	assert.Equal(t, 2, fake.batchRequests)
+	assert.Equal(t, []int{100, 50}, fake.batchSizes)
+	assert.Equal(t, 0, fake.singleCalls)
+
+	for _, result := range results[:149] {
+		assert.False(t, result.Failed(), result.ResourceID)
+	}
+
+	last := results[149]
+	require.True(t, last.Failed())
+
+	var itemErr *BatchItemError
+	require.True(t, errors.As(last.Err, &itemErr))
+	assert.Equal(t, 149, itemErr.Index)
+	assert.Equal(t, "missing", itemErr.ResourceID)
+	assert.Equal(t, http.StatusNotFound, itemErr.StatusCode)
+	assert.Equal(t, "notFound", itemErr.Reason)
+
+	var apiErr *googleapi.Error
+	assert.True(t, errors.As(last.Err, &apiErr))
+}
+
+func TestGoogleDriveService_BatchDeleteFallback(t *testing.T) {
+	fake := newFakeBatchServer(t)
+	fake.failBatch = true
+	service := newBatchTestService(t, fake)
+
+	results, err := service.BatchDelete(context.Background(), &BatchDeleteRequest{
+		UserID:      "user-1",
+		Email:       "a@example.com",
+		ResourceIDs: []string{"file-1", "file-2", "missing"},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+
+	assert.Equal(t, 1, fake.batchRequests)
+	assert.Equal(t, 3, fake.singleCalls)
+	assert.False(t, results[0].Failed())
+	assert.False(t, results[1].Failed())
+	assert.True(t, results[2].Failed())
+}
+
+func TestGoogleDriveService_BatchOutcomeUnknown(t *testing.T) {
+	fake := newFakeBatchServer(t)
+	service := newBatchTestService(t, fake)
+
+	// a lost item response is reported, not replayed
+	results, err := service.BatchDelete(context.Background(), &BatchDeleteRequest{
+		UserID:      "user-1",
+		Email:       "a@example.com",
+		ResourceIDs: []string{"file-1", "lost"},
+	})
+	require.NoError(t, err)
+	assert.False(t, results[0].Failed())
+	assert.ErrorIs(t, results[1].Err, ErrBatchOutcomeUnknown)
+	assert.Equal(t, 0, fake.singleCalls)
+
+	// a failed envelope may have been applied, none of its items is replayed
+	fake.batchStatus = http.StatusInternalServerError
+	results, err = service.BatchDelete(context.Background(), &BatchDeleteRequest{
+		UserID:      "user-1",
+		Email:       "a@example.com",
+		ResourceIDs: []string{"file-1", "file-2"},
+	})
+	require.NoError(t, err)
+	for _, result := range results {
+		assert.ErrorIs(t, result.Err, ErrBatchOutcomeUnknown)
+	}
+	assert.Equal(t, 0, fake.singleCalls)
+}
+
+func TestGoogleDriveService_BatchThrottledItemsRetriedIndividually(t *testing.T) {
+	fake := newFakeBatchServer(t)
+	service := newBatchTestService(t, fake)
+
+	results, err := service.BatchDelete(context.Background(), &BatchDeleteRequest{
+		UserID:      "user-1",
+		Email:       "a@example.com",
+		ResourceIDs: []string{"file-1", "throttled"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, fake.singleCalls)
+	assert.False(t, results[0].Failed())
+	assert.False(t, results[1].Failed())
+}
+
+func TestGoogleDriveService_BatchRename(t *testing.T) {
+	fake := newFakeBatchServer(t)
+	service := newBatchTestService(t, fake)
+
+	results, err := service.BatchRename(context.Background(), &BatchRenameRequest{
+		UserID: "user-1",
+		Email:  "a@example.com",
+		Items: []BatchRenameItem{
+			{ResourceID: "file-1", NewName: "one.txt"},
+			{ResourceID: "file-2", NewName: "two.txt"},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+
+	require.NotNil(t, results[0].File)
+	assert.Equal(t, "file-1", results[0].File.Id)
+	assert.Equal(t, "one.txt", results[0].File.Name)
+	assert.Equal(t, "two.txt", results[1].File.Name)
+}
+
+func TestGoogleDriveService_BatchUpdatesCatalog(t *testing.T) {
+	fake := newFakeBatchServer(t)
+	service := newBatchTestService(t, fake)
+	service.DB = newTestDB(t, &CatalogEntry{})
+	service.IsUseCatalog = true
+
+	ctx := context.Background()
+	for _, id := range []string{"file-1", "file-2"} {
+		require.NoError(t, service.catalogFile(ctx, "user-1", "a@example.com", &drive.File{
+			Id:   id,
+			Name: id + ".txt",
+		}))
+	}
+
+	results, err := service.BatchRename(ctx, &BatchRenameRequest{
+		UserID: "user-1",
+		Email:  "a@example.com",
+		Items:  []BatchRenameItem{{ResourceID: "file-1", NewName: "one.txt"}},
+	})
+	require.NoError(t, err)
+	require.False(t, results[0].Failed())
+
+	results, err = service.BatchDelete(ctx, &BatchDeleteRequest{
+		UserID:      "user-1",
+		Email:       "a@example.com",
+		ResourceIDs: []string{"file-2"},
+	})
+	require.NoError(t, err)
+	require.False(t, results[0].Failed())
+	assert.Equal(t, 0, fake.singleCalls)
+
+	entries, _, err := service.ListCatalog(ctx, &ListCatalogRequest{UserID: "user-1"})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "file-1", entries[0].DriveFileID)
+	assert.Equal(t, "/one.txt", entries[0].Path)
+}
+
+func TestGoogleDriveService_BatchRateLimitedLocally(t *testing.T) {
+	fake := newFakeBatchServer(t)
+	service := newBatchTestService(t, fake)
+	service.RateLimiter = NewRateLimiter(RateLimitConfig{PerAccountQPS: 1000, PerAccountBurst: 1, FailFast: true})
+
+	// the batch request is rejected before it is sent, its items are sent individually
+	// and rejected again instead of being reported with an unknown outcome
+	require.NoError(t, service.RateLimiter.Wait(context.Background(), "", "user-1", "a@example.com"))
+
+	results, err := service.BatchDelete(context.Background(), &BatchDeleteRequest{
+		UserID:      "user-1",
+		Email:       "a@example.com",
+		ResourceIDs: []string{"file-1"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, fake.batchRequests)
+	assert.ErrorIs(t, results[0].Err, ErrRateLimited)
+	assert.NotErrorIs(t, results[0].Err, ErrBatchOutcomeUnknown)
+}
@@ -0,0 +1,387 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"google.golang.org/api/drive/v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrCatalogUpdate is returned together with the Drive result when the Drive
+	// operation succeeded but the catalog could not be updated
+	ErrCatalogUpdate       = errors.New("catalog update failed")
+	ErrCatalogDisabled     = errors.New("catalog is disabled")
+	ErrCatalogEntryMissing = errors.New("catalog entry not found")
+)
+
+// catalogFileFields are the Drive fields needed to record a file in the catalog
+const catalogFileFields = "id, name, mimeType, parents, size, md5Checksum"
+
+// CatalogEntry indexes a file or folder stored in one of the user's connected accounts
+type CatalogEntry struct {
+	ID          string    `json:"id" gorm:"column:id;type:char(26);primaryKey"`
+	TenantID    string    `json:"tenant_id" gorm:"column:tenant_id;type:varchar(64);not null;default:'';uniqueIndex:idx_fundrive_catalog_entries_file"`
+	UserID      string    `json:"user_id" gorm:"column:user_id;type:varchar(255);uniqueIndex:idx_fundrive_catalog_entries_file"`
+	Email       string    `json:"email" gorm:"column:email;type:varchar(255);uniqueIndex:idx_fundrive_catalog_entries_file"`
+	DriveFileID string    `json:"drive_file_id" gorm:"column:drive_file_id;type:varchar(255);uniqueIndex:idx_fundrive_catalog_entries_file"`
+	ParentID    string    `json:"parent_id" gorm:"column:parent_id;type:varchar(255)"`
+	Name        string    `json:"name" gorm:"column:name;type:varchar(1024)"`
+	Path        string    `json:"path" gorm:"column:path;type:varchar(2048)"`
+	ParentPath  string    `json:"parent_path" gorm:"column:parent_path;type:varchar(2048)"`
+	Size        int64     `json:"size" gorm:"column:size"`
+	MD5Checksum string    `json:"md5_checksum" gorm:"column:md5_checksum;type:varchar(32)"`
+	MimeType    string    `json:"mime_type" gorm:"column:mime_type;type:varchar(255)"`
+	IsFolder    bool      `json:"is_folder" gorm:"column:is_folder"`
+	CreatedAt   time.Time `json:"created_at" gorm:"column:created_at"`
+	UpdatedAt   time.Time `json:"updated_at" gorm:"column:updated_at"`
+}
+
+// TableName returns the table name
+func (c *CatalogEntry) TableName() string {
+	return "fundrive_catalog_entries"
+}
+
+// likeEscape is the escape character used with escapeLike. It is declared
+// explicitly with ESCAPE because dialects disagree on the default.
+const likeEscape = "!"
+
+// escapeLike escapes the LIKE wildcards of a literal pattern prefix
+func escapeLike(value string) string {
+	replacer := strings.NewReplacer(likeEscape, likeEscape+likeEscape, "%", likeEscape+"%", "_", likeEscape+"_")
+	return replacer.Replace(value)
+}
+
+// catalogParentPath returns the catalog path of the file's first parent,
+// or the account root when the parent is not catalogued
+func (service *GoogleDriveService) catalogParentPath(tx *gorm.DB, userID, email string, parents []string) (string, string, error) {
+	if len(parents) == 0 {
+		return "", "/", nil
+	}
+
+	var parent CatalogEntry
+	err := tx.
+		Scopes(tenantScope).
+		Where("user_id = ? AND email = ? AND drive_file_id = ?", userID, email, parents[0]).
+		First(&parent).
+		Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return parents[0], "/", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	return parents[0], parent.Path, nil
+}
+
+// catalogFile inserts or updates the catalog entry of a Drive file
+func (service *GoogleDriveService) catalogFile(ctx context.Context, userID, email string, file *drive.File) error {
+	if !service.IsUseCatalog || file == nil {
+		return nil
+	}
+
+	err := service.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		parentID, parentPath, err := service.catalogParentPath(tx, userID, email, file.Parents)
+		if err != nil {
+			return err
+		}
+
+		entry := CatalogEntry{
+			ID:          ulid.Make().String(),
+			TenantID:    TenantFromContext(ctx),
+			UserID:      userID,
+			Email:       email,
+			DriveFileID: file.Id,
+			ParentID:    parentID,
+			Name:        file.Name,
+			ParentPath:  parentPath,
+			Path:        path.Join(parentPath, file.Name),
+			Size:        file.Size,
+			MD5Checksum: file.Md5Checksum,
+			MimeType:    file.MimeType,
+			IsFolder:    file.MimeType == MimeTypeFolder,
+		}
+
+		// concurrent writers of the same file update a single entry
+		return tx.
+			Clauses(clause.OnConflict{
+				Columns: []clause.Column{{Name: "tenant_id"}, {Name: "user_id"}, {Name: "email"}, {Name: "drive_file_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{
+					"parent_id", "name", "path", "parent_path", "size", "md5_checksum", "mime_type", "is_folder", "updated_at",
+				}),
+			}).
+			Create(&entry).
+			Error
+	})
+
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCatalogUpdate, err)
+	}
+
+	return nil
+}
+
+// catalogMove updates the path of a moved or renamed entry and of everything below it
+func (service *GoogleDriveService) catalogMove(ctx context.Context, userID, email string, file *drive.File) error {
+	if !service.IsUseCatalog || file == nil {
+		return nil
+	}
+
+	var entry CatalogEntry
+	err := service.DB.WithContext(ctx).
+		Scopes(tenantScope).
+		Where("user_id = ? AND email = ? AND drive_file_id = ?", userID, email, file.Id).
+		First(&entry).
+		Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return service.catalogFile(ctx, userID, email, file)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCatalogUpdate, err)
+	}
+
+	oldPath := entry.Path
+
+	err = service.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if file.Name != "" {
+			entry.Name = file.Name
+		}
+
+		if file.Parents != nil {
+			parentID, parentPath, err := service.catalogParentPath(tx, userID, email, file.Parents)
+			if err != nil {
+				return err
+			}
+			entry.ParentID = parentID
+			entry.ParentPath = parentPath
+		}
+
+		entry.Path = path.Join(entry.ParentPath, entry.Name)
+		if err := tx.Save(&entry).Error; err != nil {
+			return err
+		}
+
+		if !entry.IsFolder || entry.Path == oldPath {
+			return nil
+		}
+
+		descendants := make([]CatalogEntry, 0)
+		err := tx.
+			Scopes(tenantScope).
+			Where("user_id = ? AND email = ? AND path LIKE ? ESCAPE '!'", userID, email, escapeLike(oldPath)+"/%").
+			Find(&descendants).
+			Error
+		if err != nil {
+			return err
+		}
+
+		for _, descendant := range descendants {
+			descendant.Path = entry.Path + strings.TrimPrefix(descendant.Path, oldPath)
+			descendant.ParentPath = entry.Path + strings.TrimPrefix(descendant.ParentPath, oldPath)
+			if err := tx.Save(&descendant).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCatalogUpdate, err)
+	}
+
+	return nil
+}
+
+// catalogRemove deletes the entry of a Drive file and everything below it
+func (service *GoogleDriveService) catalogRemove(ctx context.Context, userID, email, fileID string) error {
+	if !service.IsUseCatalog {
+		return nil
+	}
+
+	err := service.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var entry CatalogEntry
+		err := tx.
+			Scopes(tenantScope).
+			Where("user_id = ? AND email = ? AND drive_file_id = ?", userID, email, fileID).
+			First(&entry).
+			Error
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if entry.IsFolder {
+			err := tx.
+				Scopes(tenantScope).
+				Where("user_id = ? AND email = ? AND path LIKE ? ESCAPE '!'", userID, email, escapeLike(entry.Path)+"/%").
+				Delete(&CatalogEntry{}).
+				Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete(&entry).Error
+	})
+
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCatalogUpdate, err)
+	}
+
+	return nil
+}
+
+type ListCatalogRequest struct {
+	UserID string `json:"user_id" validate:"required"`
+
+	// Email restricts the listing to one account, all accounts when empty
+	Email string `json:"email"`
+
+	// ParentPath lists the direct children of a folder path, e.g. "/photos"
+	ParentPath string `json:"parent_path"`
+
+	MimeType string `json:"mime_type"`
+	Limit    int    `json:"limit"`
+	Offset   int    `json:"offset"`
+}
+
+func (r *ListCatalogRequest) Validate() error {
+	if r.UserID == "" {
+		return ErrInvalidUserID
+	}
+	return nil
+}
+
+// ListCatalog lists catalogued files across all of the user's accounts without calling Drive
+func (service *GoogleDriveService) ListCatalog(ctx context.Context, req *ListCatalogRequest) ([]CatalogEntry, int64, error) {
+	if !service.IsUseCatalog {
+		return nil, 0, ErrCatalogDisabled
+	}
+
+	if err := req.Validate(); err != nil {
+		return nil, 0, err
+	}
+
+	query := service.DB.WithContext(ctx).
+		Model(&CatalogEntry{}).
+		Scopes(tenantScope).
+		Where("user_id = ?", req.UserID)
+
+	if req.Email != "" {
+		query = query.Where("email = ?", req.Email)
+	}
+
+	if req.ParentPath != "" {
+		query = query.Where("parent_path = ?", path.Clean("/"+req.ParentPath))
+	}
+
+	if req.MimeType != "" {
+		query = query.Where("mime_type = ?", req.MimeType)
+	}
+
+	return findCatalogEntries(query, req.Limit, req.Offset)
+}
+
+type SearchCatalogRequest struct {
+	UserID   string `json:"user_id" validate:"required"`
+	Query    string `json:"query" validate:"required"`
+	MimeType string `json:"mime_type"`
+	Limit    int    `json:"limit"`
+	Offset   int    `json:"offset"`
+}
+
+func (r *SearchCatalogRequest) Validate() error {
+	if r.UserID == "" {
+		return ErrInvalidUserID
+	}
+	if r.Query == "" {
+		return fmt.Errorf("query is required")
+	}
+	return nil
+}
+
+// SearchCatalog finds catalogued files whose name contains the query across all of
+// the user's accounts without calling Drive
+func (service *GoogleDriveService) SearchCatalog(ctx context.Context, req *SearchCatalogRequest) ([]CatalogEntry, int64, error) {
+	if !service.IsUseCatalog {
+		return nil, 0, ErrCatalogDisabled
+	}
+
+	if err := req.Validate(); err != nil {
+		return nil, 0, err
+	}
+
+	query := service.DB.WithContext(ctx).
+		Model(&CatalogEntry{}).
+		Scopes(tenantScope).
+		Where("user_id = ? AND name LIKE ? ESCAPE '!'", req.UserID, "%"+escapeLike(req.Query)+"%")
+
+	if req.MimeType != "" {
+		query = query.Where("mime_type = ?", req.MimeType)
+	}
+
+	return findCatalogEntries(query, req.Limit, req.Offset)
+}
+
+type GetCatalogEntryRequest struct {
+	UserID string `json:"user_id" validate:"required"`
+	ID     string `json:"id" validate:"required"`
+}
+
+// GetCatalogEntry returns a catalog entry by its logical ID
+func (service *GoogleDriveService) GetCatalogEntry(ctx context.Context, req *GetCatalogEntryRequest) (*CatalogEntry, error) {
+	if !service.IsUseCatalog {
+		return nil, ErrCatalogDisabled
+	}
+
+	var entry CatalogEntry
+	err := service.DB.WithContext(ctx).
+		Scopes(tenantScope).
+		Where("user_id = ? AND id = ?", req.UserID, req.ID).
+		First(&entry).
+		Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrCatalogEntryMissing
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get catalog entry: %w", err)
+	}
+
+	return &entry, nil
+}
+
+func findCatalogEntries(query *gorm.DB, limit, offset int) ([]CatalogEntry, int64, error) {
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count catalog entries: %w", err)
+	}
+
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if offset > 0 {
+		query = query.Offset(offset)
+	}
+
+	entries := make([]CatalogEntry, 0)
+	if err := query.Order("path, email").Find(&entries).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to list catalog entries: %w", err)
+	}
+
+	return entries, total, nil
+}
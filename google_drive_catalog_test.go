@@ -0,0 +1,120 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestGoogleDriveService_Catalog(t *testing.T) {
+	service := &GoogleDriveService{
+		DB:           newTestDB(t, &CatalogEntry{}),
+		IsUseCatalog: true,
+	}
+
+	ctx := context.Background()
+
+	require.NoError(t, service.catalogFile(ctx, "user-1", "a@example.com", &drive.File{
+		Id:       "folder-1",
+		Name:     "photos",
+		MimeType: MimeTypeFolder,
+		Parents:  []string{"root-a"},
+	}))
+	require.NoError(t, service.catalogFile(ctx, "user-1", "a@example.com", &drive.File{
+		Id:          "file-1",
+		Name:        "cat_1.jpg",
+		MimeType:    "image/jpeg",
+		Parents:     []string{"folder-1"},
+		Size:        42,
+		Md5Checksum: "0123456789abcdef0123456789abcdef",
+	}))
+	require.NoError(t, service.catalogFile(ctx, "user-1", "b@example.com", &drive.File{
+		Id:       "file-2",
+		Name:     "notes.txt",
+		MimeType: "text/plain",
+	}))
+
+	entries, total, err := service.ListCatalog(ctx, &ListCatalogRequest{UserID: "user-1"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), total)
+	require.Len(t, entries, 3)
+	assert.Equal(t, "/notes.txt", entries[0].Path)
+	assert.Equal(t, "b@example.com", entries[0].Email)
+	assert.Equal(t, "/photos", entries[1].Path)
+	assert.Equal(t, "/photos/cat_1.jpg", entries[2].Path)
+	assert.Equal(t, int64(42), entries[2].Size)
+
+	entries, _, err = service.ListCatalog(ctx, &ListCatalogRequest{UserID: "user-1", ParentPath: "/photos"})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "file-1", entries[0].DriveFileID)
+
+	// the underscore must not act as a wildcard
+	entries, _, err = service.SearchCatalog(ctx, &SearchCatalogRequest{UserID: "user-1", Query: "t_1"})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "cat_1.jpg", entries[0].Name)
+
+	entries, _, err = service.SearchCatalog(ctx, &SearchCatalogRequest{UserID: "user-1", Query: "t%1"})
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// renaming the folder moves everything below it
+	require.NoError(t, service.catalogMove(ctx, "user-1", "a@example.com", &drive.File{
+		Id:   "folder-1",
+		Name: "pictures",
+	}))
+
+	entries, _, err = service.ListCatalog(ctx, &ListCatalogRequest{UserID: "user-1", Email: "a@example.com"})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "/pictures", entries[0].Path)
+	assert.Equal(t, "/pictures/cat_1.jpg", entries[1].Path)
+	assert.Equal(t, "/pictures", entries[1].ParentPath)
+
+	require.NoError(t, service.catalogRemove(ctx, "user-1", "a@example.com", "folder-1"))
+
+	entries, total, err = service.ListCatalog(ctx, &ListCatalogRequest{UserID: "user-1"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), total)
+	assert.Equal(t, "file-2", entries[0].DriveFileID)
+
+	entry, err := service.GetCatalogEntry(ctx, &GetCatalogEntryRequest{UserID: "user-1", ID: entries[0].ID})
+	require.NoError(t, err)
+	assert.Equal(t, "notes.txt", entry.Name)
+
+	// the same user and account of another tenant has its own catalog
+	acmeCtx := ContextWithTenant(ctx, "acme")
+	require.NoError(t, service.catalogFile(acmeCtx, "user-1", "b@example.com", &drive.File{
+		Id:       "file-2",
+		Name:     "acme.txt",
+		MimeType: "text/plain",
+	}))
+
+	entries, total, err = service.ListCatalog(ctx, &ListCatalogRequest{UserID: "user-1"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), total)
+	assert.Equal(t, "notes.txt", entries[0].Name)
+
+	entries, _, err = service.SearchCatalog(acmeCtx, &SearchCatalogRequest{UserID: "user-1", Query: "txt"})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "acme.txt", entries[0].Name)
+	assert.Equal(t, "acme", entries[0].TenantID)
+
+	_, err = service.GetCatalogEntry(acmeCtx, &GetCatalogEntryRequest{UserID: "user-1", ID: entry.ID})
+	assert.ErrorIs(t, err, ErrCatalogEntryMissing)
+}
+
+func TestGoogleDriveService_CatalogDisabled(t *testing.T) {
+	service := &GoogleDriveService{}
+
+	_, _, err := service.ListCatalog(context.Background(), &ListCatalogRequest{UserID: "user-1"})
+	assert.True(t, errors.Is(err, ErrCatalogDisabled))
+
+	assert.NoError(t, service.catalogFile(context.Background(), "user-1", "a@example.com", &drive.File{Id: "file-1"}))
+}
@@ -0,0 +1,439 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"google.golang.org/api/drive/v3"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrChangeTrackingNotStarted = errors.New("change tracking not started for this account")
+
+	// ErrChangesDone is returned by ChangeIterator.Next when every change was read
+	ErrChangesDone = errors.New("no more changes")
+)
+
+// changeFields are the Drive fields needed to classify a change
+const changeFields = "nextPageToken, newStartPageToken, " +
+	"changes(changeType, removed, fileId, time, " +
+	"file(id, name, mimeType, parents, trashed, md5Checksum, size, createdTime, modifiedTime))"
+
+// ChangeType is the kind of a change event
+type ChangeType string
+
+const (
+	ChangeTypeCreated  ChangeType = "created"
+	ChangeTypeModified ChangeType = "modified"
+	ChangeTypeTrashed  ChangeType = "trashed"
+	ChangeTypeRemoved  ChangeType = "removed"
+
+	// ChangeTypeMoved is reported when the parent or the name of a file changed
+	ChangeTypeMoved ChangeType = "moved"
+)
+
+// ChangeCursor persists the page token of the change feed of an account
+type ChangeCursor struct {
+	ID        string    `json:"id" gorm:"column:id;type:char(26);primaryKey"`
+	TenantID  string    `json:"tenant_id" gorm:"column:tenant_id;type:varchar(64);not null;default:'';index:idx_fundrive_change_cursors_tenant_account"`
+	UserID    string    `json:"user_id" gorm:"column:user_id;type:varchar(255);index:idx_fundrive_change_cursors_tenant_account"`
+	Email     string    `json:"email" gorm:"column:email;type:varchar(255);index:idx_fundrive_change_cursors_tenant_account"`
+	DriveID   string    `json:"drive_id" gorm:"column:drive_id;type:varchar(255);index:idx_fundrive_change_cursors_tenant_account"`
+	PageToken string    `json:"page_token" gorm:"column:page_token;type:varchar(255)"`
+	StartedAt time.Time `json:"started_at" gorm:"column:started_at"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"column:updated_at"`
+}
+
+// TableName returns the table name
+func (c *ChangeCursor) TableName() string {
+	return "fundrive_change_cursors"
+}
+
+// ChangeFileState is the last known state of a file, used to classify its next change
+type ChangeFileState struct {
+	ID          string `json:"id" gorm:"column:id;type:char(26);primaryKey"`
+	TenantID    string `json:"tenant_id" gorm:"column:tenant_id;type:varchar(64);not null;default:''"`
+	CursorID    string `json:"cursor_id" gorm:"column:cursor_id;type:char(26);index:idx_fundrive_change_file"`
+	DriveFileID string `json:"drive_file_id" gorm:"column:drive_file_id;type:varchar(255);index:idx_fundrive_change_file"`
+	ParentID    string `json:"parent_id" gorm:"column:parent_id;type:varchar(255)"`
+	Name        string `json:"name" gorm:"column:name;type:varchar(1024)"`
+	Trashed     bool   `json:"trashed" gorm:"column:trashed"`
+}
+
+// TableName returns the table name
+func (c *ChangeFileState) TableName() string {
+	return "fundrive_change_file_states"
+}
+
+// ChangeEvent is a typed change of a file
+type ChangeEvent struct {
+	Type   ChangeType `json:"type"`
+	FileID string     `json:"file_id"`
+
+	// File is nil for removed files
+	File *drive.File `json:"file,omitempty"`
+
+	// OldParentID and NewParentID are set for moved files
+	OldParentID string `json:"old_parent_id,omitempty"`
+	NewParentID string `json:"new_parent_id,omitempty"`
+
+	// OldName is set for renamed files
+	OldName string `json:"old_name,omitempty"`
+
+	Time time.Time `json:"time"`
+}
+
+type ChangeFeedRequest struct {
+	UserID string `json:"user_id" validate:"required"`
+	Email  string `json:"email" validate:"required"`
+
+	// DriveID follows the changes of a shared drive instead of the user's files
+	DriveID string `json:"drive_id"`
+}
+
+func (r *ChangeFeedRequest) Validate() error {
+	if r.UserID == "" {
+		return ErrInvalidUserID
+	}
+	if r.Email == "" {
+		return ErrInvalidEmail
+	}
+	return nil
+}
+
+// StartChangeTracking stores the current start page token of the account, changes
+// made from now on are returned by ListChanges. Starting again discards pending changes.
+func (service *GoogleDriveService) StartChangeTracking(ctx context.Context, req *ChangeFeedRequest) (*ChangeCursor, error) {
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid change feed request: %w", err)
+	}
+
+	srv, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: req.UserID, Email: req.Email})
+	if err != nil {
+		return nil, fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	call := srv.Changes.GetStartPageToken().SupportsAllDrives(true)
+	if req.DriveID != "" {
+		call = call.DriveId(req.DriveID)
+	}
+
+	token, err := retryCall(ctx, service.RetryPolicy, "changes.getStartPageToken", true, func() (*drive.StartPageToken, error) {
+		return call.Context(ctx).Do()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting start page token: %w", err)
+	}
+
+	var cursor ChangeCursor
+	err = service.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.
+			Scopes(tenantScope).
+			Where("user_id = ? AND email = ? AND drive_id = ?", req.UserID, req.Email, req.DriveID).
+			First(&cursor).
+			Error
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			cursor = ChangeCursor{
+				ID:       ulid.Make().String(),
+				TenantID: TenantFromContext(ctx),
+				UserID:   req.UserID,
+				Email:    req.Email,
+				DriveID:  req.DriveID,
+			}
+		} else if err != nil {
+			return err
+		}
+
+		if err := tx.Scopes(tenantScope).Where("cursor_id = ?", cursor.ID).Delete(&ChangeFileState{}).Error; err != nil {
+			return err
+		}
+
+		cursor.PageToken = token.StartPageToken
+		cursor.StartedAt = time.Now()
+		return tx.Save(&cursor).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save change cursor: %w", err)
+	}
+
+	return &cursor, nil
+}
+
+type ListChangesRequest struct {
+	ChangeFeedRequest
+	PageSize int64 `json:"page_size"`
+}
+
+// ListChangesResponse is a page of changes. The page is only marked as processed
+// once it is passed to AckChanges.
+type ListChangesResponse struct {
+	Events []ChangeEvent `json:"events"`
+
+	// HasMore is set when more changes are waiting after this page
+	HasMore bool `json:"has_more"`
+
+	cursor    ChangeCursor
+	nextToken string
+	states    []ChangeFileState
+	removed   []string
+}
+
+// ListChanges returns the next page of changes after the stored page token, each
+// classified against the last known state of the file. The stored token only moves
+// forward with AckChanges, so unacknowledged changes are returned again.
+func (service *GoogleDriveService) ListChanges(ctx context.Context, req *ListChangesRequest) (*ListChangesResponse, error) {
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid change feed request: %w", err)
+	}
+
+	var cursor ChangeCursor
+	err := service.DB.WithContext(ctx).
+		Scopes(tenantScope).
+		Where("user_id = ? AND email = ? AND drive_id = ?", req.UserID, req.Email, req.DriveID).
+		First(&cursor).
+		Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrChangeTrackingNotStarted
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get change cursor: %w", err)
+	}
+
+	srv, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: req.UserID, Email: req.Email})
+	if err != nil {
+		return nil, fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	call := srv.Changes.List(cursor.PageToken).
+		SupportsAllDrives(true).
+		IncludeItemsFromAllDrives(true).
+		IncludeRemoved(true).
+		Spaces("drive").
+		Fields(changeFields)
+
+	if req.DriveID != "" {
+		call = call.DriveId(req.DriveID)
+	}
+	if req.PageSize > 0 {
+		call = call.PageSize(req.PageSize)
+	}
+
+	changes, err := retryCall(ctx, service.RetryPolicy, "changes.list", true, func() (*drive.ChangeList, error) {
+		return call.Context(ctx).Do()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing changes: %w", err)
+	}
+
+	response := &ListChangesResponse{
+		cursor:  cursor,
+		HasMore: changes.NextPageToken != "",
+	}
+
+	response.nextToken = changes.NextPageToken
+	if response.nextToken == "" {
+		response.nextToken = changes.NewStartPageToken
+	}
+
+	known, err := service.changeFileStates(ctx, cursor.ID, changes.Changes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, change := range changes.Changes {
+		if change.ChangeType != "" && change.ChangeType != "file" {
+			continue
+		}
+
+		event, state := classifyChange(&cursor, change, known[change.FileId])
+		response.Events = append(response.Events, event)
+
+		if state == nil {
+			response.removed = append(response.removed, change.FileId)
+			delete(known, change.FileId)
+			continue
+		}
+
+		known[change.FileId] = state
+		response.states = append(response.states, *state)
+	}
+
+	return response, nil
+}
+
+// AckChanges stores the page token after the page and the new state of its files
+func (service *GoogleDriveService) AckChanges(ctx context.Context, page *ListChangesResponse) error {
+	err := service.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if len(page.removed) > 0 {
+			err := tx.
+				Scopes(tenantScope).
+				Where("cursor_id = ? AND drive_file_id IN ?", page.cursor.ID, page.removed).
+				Delete(&ChangeFileState{}).
+				Error
+			if err != nil {
+				return err
+			}
+		}
+
+		for i := range page.states {
+			if err := tx.Save(&page.states[i]).Error; err != nil {
+				return err
+			}
+		}
+
+		// a concurrent consumer that already moved the cursor wins
+		result := tx.Model(&ChangeCursor{}).
+			Scopes(tenantScope).
+			Where("id = ? AND page_token = ?", page.cursor.ID, page.cursor.PageToken).
+			Update("page_token", page.nextToken)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("change cursor was moved by another consumer")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to acknowledge changes: %w", err)
+	}
+
+	return nil
+}
+
+// changeFileStates loads the known state of the changed files
+func (service *GoogleDriveService) changeFileStates(ctx context.Context, cursorID string, changes []*drive.Change) (map[string]*ChangeFileState, error) {
+	known := make(map[string]*ChangeFileState, len(changes))
+	if len(changes) == 0 {
+		return known, nil
+	}
+
+	fileIDs := make([]string, 0, len(changes))
+	for _, change := range changes {
+		fileIDs = append(fileIDs, change.FileId)
+	}
+
+	states := make([]ChangeFileState, 0, len(fileIDs))
+	err := service.DB.WithContext(ctx).
+		Scopes(tenantScope).
+		Where("cursor_id = ? AND drive_file_id IN ?", cursorID, fileIDs).
+		Find(&states).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load change file states: %w", err)
+	}
+
+	for i := range states {
+		known[states[i].DriveFileID] = &states[i]
+	}
+
+	return known, nil
+}
+
+// classifyChange turns a Drive change into an event and returns the new state of the
+// file, nil when the file was removed. A file without known state was created after
+// tracking started, or modified when its creation time is older.
+func classifyChange(cursor *ChangeCursor, change *drive.Change, state *ChangeFileState) (ChangeEvent, *ChangeFileState) {
+	event := ChangeEvent{
+		FileID: change.FileId,
+		File:   change.File,
+	}
+	if changedAt, err := time.Parse(time.RFC3339, change.Time); err == nil {
+		event.Time = changedAt
+	}
+
+	if change.Removed || change.File == nil {
+		event.Type = ChangeTypeRemoved
+		event.File = nil
+		return event, nil
+	}
+
+	file := change.File
+	next := &ChangeFileState{
+		TenantID:    cursor.TenantID,
+		CursorID:    cursor.ID,
+		DriveFileID: file.Id,
+		Name:        file.Name,
+		Trashed:     file.Trashed,
+	}
+	if len(file.Parents) > 0 {
+		next.ParentID = file.Parents[0]
+	}
+
+	if state != nil {
+		next.ID = state.ID
+	} else {
+		next.ID = ulid.Make().String()
+	}
+
+	switch {
+	case file.Trashed && (state == nil || !state.Trashed):
+		event.Type = ChangeTypeTrashed
+	case state == nil:
+		event.Type = ChangeTypeCreated
+		if createdAt, err := time.Parse(time.RFC3339, file.CreatedTime); err == nil && createdAt.Before(cursor.StartedAt) {
+			event.Type = ChangeTypeModified
+		}
+	case state.ParentID != next.ParentID || state.Name != next.Name:
+		event.Type = ChangeTypeMoved
+		event.OldParentID = state.ParentID
+		event.NewParentID = next.ParentID
+		if state.Name != next.Name {
+			event.OldName = state.Name
+		}
+	default:
+		event.Type = ChangeTypeModified
+	}
+
+	return event, next
+}
+
+// ChangeIterator reads the change feed one event at a time. A page is acknowledged
+// when the next page is requested, so changes are delivered at least once.
+type ChangeIterator struct {
+	service *GoogleDriveService
+	req     ListChangesRequest
+	page    *ListChangesResponse
+	index   int
+}
+
+// Changes returns an iterator over the pending changes of the account
+func (service *GoogleDriveService) Changes(req *ListChangesRequest) *ChangeIterator {
+	return &ChangeIterator{service: service, req: *req}
+}
+
+// Next returns the next change event, or ErrChangesDone when the feed is caught up
+func (it *ChangeIterator) Next(ctx context.Context) (ChangeEvent, error) {
+	for {
+		if it.page != nil && it.index < len(it.page.Events) {
+			event := it.page.Events[it.index]
+			it.index++
+			return event, nil
+		}
+
+		if it.page != nil {
+			if err := it.service.AckChanges(ctx, it.page); err != nil {
+				return ChangeEvent{}, err
+			}
+
+			if !it.page.HasMore {
+				it.page = nil
+				return ChangeEvent{}, ErrChangesDone
+			}
+		}
+
+		page, err := it.service.ListChanges(ctx, &it.req)
+		if err != nil {
+			return ChangeEvent{}, err
+		}
+
+		it.page = page
+		it.index = 0
+	}
+}
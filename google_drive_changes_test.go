@@ -0,0 +1,103 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+func TestClassifyChange(t *testing.T) {
+	cursor := &ChangeCursor{ID: "cursor-1", StartedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	newFile := &drive.File{Id: "file-1", Name: "a.txt", Parents: []string{"folder-1"}, CreatedTime: "2024-02-01T00:00:00Z"}
+	event, state := classifyChange(cursor, &drive.Change{FileId: "file-1", File: newFile}, nil)
+	assert.Equal(t, ChangeTypeCreated, event.Type)
+	require.NotNil(t, state)
+
+	oldFile := &drive.File{Id: "file-2", Name: "b.txt", CreatedTime: "2023-06-01T00:00:00Z"}
+	event, _ = classifyChange(cursor, &drive.Change{FileId: "file-2", File: oldFile}, nil)
+	assert.Equal(t, ChangeTypeModified, event.Type)
+
+	moved := &drive.File{Id: "file-1", Name: "a.txt", Parents: []string{"folder-2"}}
+	event, _ = classifyChange(cursor, &drive.Change{FileId: "file-1", File: moved}, state)
+	assert.Equal(t, ChangeTypeMoved, event.Type)
+	assert.Equal(t, "folder-1", event.OldParentID)
+	assert.Equal(t, "folder-2", event.NewParentID)
+
+	trashed := &drive.File{Id: "file-1", Name: "a.txt", Parents: []string{"folder-1"}, Trashed: true}
+	event, next := classifyChange(cursor, &drive.Change{FileId: "file-1", File: trashed}, state)
+	assert.Equal(t, ChangeTypeTrashed, event.Type)
+	assert.Equal(t, state.ID, next.ID)
+
+	event, next = classifyChange(cursor, &drive.Change{FileId: "file-1", Removed: true}, state)
+	assert.Equal(t, ChangeTypeRemoved, event.Type)
+	assert.Nil(t, next)
+}
+
+func TestGoogleDriveService_ChangeIterator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/drive/v3/changes/startPageToken":
+			w.Write([]byte(`{"startPageToken":"1"}`))
+		case "/drive/v3/changes":
+			switch r.URL.Query().Get("pageToken") {
+			case "1":
+				w.Write([]byte(`{"nextPageToken":"2","changes":[
+					{"changeType":"file","fileId":"file-1","file":{"id":"file-1","name":"a.txt","parents":["root"],"createdTime":"2999-01-01T00:00:00Z"}}
+				]}`))
+			case "2":
+				w.Write([]byte(`{"newStartPageToken":"3","changes":[
+					{"changeType":"file","fileId":"file-1","file":{"id":"file-1","name":"b.txt","parents":["root"]}}
+				]}`))
+			default:
+				w.Write([]byte(`{"newStartPageToken":"3","changes":[]}`))
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	service := &GoogleDriveService{
+		OAuthService:  newStubOAuthService(t),
+		DB:            newTestDB(t, &ChangeCursor{}, &ChangeFileState{}),
+		RetryPolicy:   NoRetryPolicy(),
+		ClientOptions: []option.ClientOption{option.WithEndpoint(server.URL + "/drive/v3/")},
+	}
+
+	ctx := context.Background()
+	feed := ChangeFeedRequest{UserID: "user-1", Email: "a@example.com"}
+
+	_, err := service.ListChanges(ctx, &ListChangesRequest{ChangeFeedRequest: feed})
+	assert.ErrorIs(t, err, ErrChangeTrackingNotStarted)
+
+	_, err = service.StartChangeTracking(ctx, &feed)
+	require.NoError(t, err)
+
+	it := service.Changes(&ListChangesRequest{ChangeFeedRequest: feed})
+
+	var types []ChangeType
+	for {
+		event, err := it.Next(ctx)
+		if errors.Is(err, ErrChangesDone) {
+			break
+		}
+		require.NoError(t, err)
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []ChangeType{ChangeTypeCreated, ChangeTypeMoved}, types)
+
+	var cursor ChangeCursor
+	require.NoError(t, service.DB.First(&cursor).Error)
+	assert.Equal(t, "3", cursor.PageToken)
+}
@@ -0,0 +1,157 @@
+package fundrive
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// tokenExpirySkew makes cached clients expire before their access token does
+const tokenExpirySkew = time.Minute
+
+// ClientCacheConfig configures the per-account Drive client cache.
+// A MaxEntries of zero or less disables the cache.
+type ClientCacheConfig struct {
+	MaxEntries int
+	TTL        time.Duration
+}
+
+// DefaultClientCacheConfig returns the client cache configuration used when none is configured
+func DefaultClientCacheConfig() ClientCacheConfig {
+	return ClientCacheConfig{
+		MaxEntries: 1024,
+		TTL:        5 * time.Minute,
+	}
+}
+
+// driveClient is an authenticated Drive client for a single account
+type driveClient struct {
+	srv        *drive.Service
+	httpClient *http.Client
+}
+
+type driveClientCacheKey struct {
+	tenantID string
+	userID   string
+	email    string
+}
+
+type driveClientCacheEntry struct {
+	key       driveClientCacheKey
+	client    *driveClient
+	expiresAt time.Time
+}
+
+// driveClientCache is a bounded LRU cache of Drive clients with a TTL
+type driveClientCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	entries    map[driveClientCacheKey]*list.Element
+	order      *list.List
+	now        func() time.Time
+}
+
+func newDriveClientCache(config ClientCacheConfig) *driveClientCache {
+	if config.MaxEntries <= 0 {
+		return nil
+	}
+
+	return &driveClientCache{
+		maxEntries: config.MaxEntries,
+		ttl:        config.TTL,
+		entries:    make(map[driveClientCacheKey]*list.Element),
+		order:      list.New(),
+		now:        time.Now,
+	}
+}
+
+func (c *driveClientCache) get(tenantID, userID, email string) (*driveClient, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[driveClientCacheKey{tenantID: tenantID, userID: userID, email: email}]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*driveClientCacheEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.removeElement(element)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.client, true
+}
+
+// put stores a client until the TTL passes or its access token is about to expire
+func (c *driveClientCache) put(tenantID, userID, email string, client *driveClient, tokenExpiry time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := c.now().Add(c.ttl)
+	if !tokenExpiry.IsZero() && tokenExpiry.Add(-tokenExpirySkew).Before(expiresAt) {
+		expiresAt = tokenExpiry.Add(-tokenExpirySkew)
+	}
+
+	key := driveClientCacheKey{tenantID: tenantID, userID: userID, email: email}
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*driveClientCacheEntry)
+		entry.client = client
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&driveClientCacheEntry{
+		key:       key,
+		client:    client,
+		expiresAt: expiresAt,
+	})
+
+	for c.order.Len() > c.maxEntries {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *driveClientCache) invalidate(tenantID, userID, email string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[driveClientCacheKey{tenantID: tenantID, userID: userID, email: email}]; ok {
+		c.removeElement(element)
+	}
+}
+
+func (c *driveClientCache) len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *driveClientCache) removeElement(element *list.Element) {
+	entry := element.Value.(*driveClientCacheEntry)
+	delete(c.entries, entry.key)
+	c.order.Remove(element)
+}
@@ -0,0 +1,182 @@
+package fundrive
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// stubOAuthService serves a single encrypted token, decrypting it on every call
+// like OAuthService does after loading the row
+type stubOAuthService struct {
+	IOAuthService
+
+	encryptor    *TokenEncryption
+	accessToken  string
+	refreshToken string
+	expiry       time.Time
+	getCalls     atomic.Int32
+}
+
+func newStubOAuthService(t testing.TB) *stubOAuthService {
+	encryptor, err := NewTokenEncryption("12345678901234567890123456789012")
+	require.NoError(t, err)
+
+	accessToken, err := encryptor.Encrypt("access-token")
+	require.NoError(t, err)
+
+	refreshToken, err := encryptor.Encrypt("refresh-token")
+	require.NoError(t, err)
+
+	return &stubOAuthService{
+		encryptor:    encryptor,
+		accessToken:  accessToken,
+		refreshToken: refreshToken,
+		expiry:       time.Now().Add(time.Hour),
+	}
+}
+
+func (s *stubOAuthService) GetToken(ctx context.Context, req *GetTokenRequest) (*oauth2.Token, error) {
+	s.getCalls.Add(1)
+
+	row := OAuthToken{
+		UserID:       req.UserID,
+		Email:        req.Email,
+		AccessToken:  s.accessToken,
+		RefreshToken: s.refreshToken,
+		TokenType:    "Bearer",
+		Expiry:       s.expiry,
+	}
+
+	return row.ToOAuth2Token(s.encryptor)
+}
+
+func (s *stubOAuthService) GetUserToken(ctx context.Context, req *GetUserTokenRequest) (*OAuthToken, error) {
+	return &OAuthToken{ID: "token-" + req.Email, UserID: req.UserID, Email: req.Email}, nil
+}
+
+func TestDriveClientCache(t *testing.T) {
+	now := time.Now()
+	cache := newDriveClientCache(ClientCacheConfig{MaxEntries: 2, TTL: time.Minute})
+	cache.now = func() time.Time { return now }
+
+	clientA := &driveClient{}
+	clientB := &driveClient{}
+	clientC := &driveClient{}
+
+	cache.put("", "user-1", "a@example.com", clientA, time.Time{})
+	cache.put("", "user-1", "b@example.com", clientB, time.Time{})
+
+	got, ok := cache.get("", "user-1", "a@example.com")
+	require.True(t, ok)
+	assert.Same(t, clientA, got)
+
+	// the same account of another tenant has its own entry
+	_, ok = cache.get("acme", "user-1", "a@example.com")
+	assert.False(t, ok)
+
+	// b is now the least recently used entry and gets evicted
+	cache.put("", "user-1", "c@example.com", clientC, time.Time{})
+	assert.Equal(t, 2, cache.len())
+
+	_, ok = cache.get("", "user-1", "b@example.com")
+	assert.False(t, ok)
+
+	cache.invalidate("", "user-1", "a@example.com")
+	_, ok = cache.get("", "user-1", "a@example.com")
+	assert.False(t, ok)
+
+	now = now.Add(2 * time.Minute)
+	_, ok = cache.get("", "user-1", "c@example.com")
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.len())
+}
+
+func TestDriveClientCache_TokenExpiry(t *testing.T) {
+	now := time.Now()
+	cache := newDriveClientCache(ClientCacheConfig{MaxEntries: 10, TTL: time.Hour})
+	cache.now = func() time.Time { return now }
+
+	cache.put("", "user-1", "a@example.com", &driveClient{}, now.Add(5*time.Minute))
+
+	now = now.Add(3 * time.Minute)
+	_, ok := cache.get("", "user-1", "a@example.com")
+	assert.True(t, ok)
+
+	// expires one skew interval before the access token does
+	now = now.Add(time.Minute + time.Second)
+	_, ok = cache.get("", "user-1", "a@example.com")
+	assert.False(t, ok)
+}
+
+func TestDriveClientCache_Disabled(t *testing.T) {
+	cache := newDriveClientCache(ClientCacheConfig{})
+	assert.Nil(t, cache)
+
+	cache.put("", "user-1", "a@example.com", &driveClient{}, time.Time{})
+	_, ok := cache.get("", "user-1", "a@example.com")
+	assert.False(t, ok)
+}
+
+func TestGoogleDriveService_NewDriveClientCached(t *testing.T) {
+	oauthService := newStubOAuthService(t)
+	service := &GoogleDriveService{
+		OAuthService: oauthService,
+		clientCache:  newDriveClientCache(DefaultClientCacheConfig()),
+	}
+
+	req := &newDriveServiceRequest{UserID: "user-1", Email: "a@example.com"}
+	ctx := context.Background()
+
+	first, err := service.newDriveClient(ctx, req)
+	require.NoError(t, err)
+
+	second, err := service.newDriveClient(ctx, req)
+	require.NoError(t, err)
+
+	assert.Same(t, first, second)
+	assert.Equal(t, int32(1), oauthService.getCalls.Load())
+
+	service.InvalidateClient(ctx, "user-1", "a@example.com")
+
+	third, err := service.newDriveClient(ctx, req)
+	require.NoError(t, err)
+
+	assert.NotSame(t, first, third)
+	assert.Equal(t, int32(2), oauthService.getCalls.Load())
+}
+
+func BenchmarkNewDriveService(b *testing.B) {
+	req := &newDriveServiceRequest{UserID: "user-1", Email: "a@example.com"}
+	ctx := context.Background()
+
+	b.Run("uncached", func(b *testing.B) {
+		service := &GoogleDriveService{OAuthService: newStubOAuthService(b)}
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := service.newDriveService(ctx, req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		service := &GoogleDriveService{
+			OAuthService: newStubOAuthService(b),
+			clientCache:  newDriveClientCache(DefaultClientCacheConfig()),
+		}
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := service.newDriveService(ctx, req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
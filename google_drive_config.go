@@ -2,6 +2,9 @@ package fundrive
 
 import (
 	"fmt"
+	"time"
+
+	"google.golang.org/api/option"
 	"gorm.io/gorm"
 )
 
@@ -10,14 +13,46 @@ var (
 	ErrDBEmpty             = fmt.Errorf("error creating google drive service: db is empty")
 	ErrInvalidConfig       = fmt.Errorf("invalid configuration provided")
 	ErrServiceAccountEmpty = fmt.Errorf("service account file path is empty")
+	ErrCredentialsEmpty    = fmt.Errorf("client secret file or service account key is required")
+	ErrEncryptionKeyEmpty  = fmt.Errorf("encryption key is empty")
 )
 
 // GoogleDriveServiceConfig represents the configuration for the Google Drive service
 type GoogleDriveServiceConfig struct {
+	// ClientSecretFilePath is the OAuth client JSON used to connect user accounts
+	ClientSecretFilePath string
+
+	// Deprecated: use ClientSecretFilePath, the file is an OAuth client and not a
+	// service account key
 	ServiceAccountFilePath string
-	EncryptionKey          string
-	DB                     *gorm.DB
-	UseBaseFolder          bool
+
+	// ServiceAccountKey is the JSON key of a service account, used for the accounts
+	// resolved to AuthModeServiceAccount
+	ServiceAccountKey         []byte
+	ServiceAccountKeyFilePath string
+	AuthModeResolver          AuthModeResolver
+
+	EncryptionKey    string
+	DB               *gorm.DB
+	UseBaseFolder    bool
+	UseCatalog       bool
+	RetryPolicy      RetryPolicy
+	RateLimit        *RateLimitConfig
+	ClientCache      ClientCacheConfig
+	Batch            BatchConfig
+	ClientOptions    []option.ClientOption
+	StorageReportTTL time.Duration
+	ScopeProfile     ScopeProfile
+	AutoMigrate      bool
+
+	// Tenants are the OAuth clients and encryption keys of the tenants, requests of
+	// unregistered tenants fail with ErrUnknownTenant
+	Tenants     map[string]TenantConfig
+	TablePrefix string
+
+	// OAuthClientResolver supplies the OAuth clients of accounts connected with a
+	// client of their own, see OAuthClientResolver
+	OAuthClientResolver OAuthClientResolver
 }
 
 // GoogleDriveServiceConfigOption defines the function signature for optional configuration
@@ -25,13 +60,49 @@ type GoogleDriveServiceConfigOption func(*GoogleDriveServiceConfig)
 
 // DefaultGoogleDriveServiceConfig returns a Config with default values
 func DefaultGoogleDriveServiceConfig() *GoogleDriveServiceConfig {
-	return &GoogleDriveServiceConfig{}
+	return &GoogleDriveServiceConfig{
+		RetryPolicy:      DefaultRetryPolicy(),
+		ClientCache:      DefaultClientCacheConfig(),
+		Batch:            DefaultBatchConfig(),
+		StorageReportTTL: DefaultStorageReportTTL,
+		AutoMigrate:      true,
+	}
 }
 
-// WithServiceAccountFilePath sets the service account file path
+// WithClientSecretFilePath sets the OAuth client JSON downloaded from the Google Cloud console
+func WithClientSecretFilePath(path string) GoogleDriveServiceConfigOption {
+	return func(c *GoogleDriveServiceConfig) {
+		c.ClientSecretFilePath = path
+	}
+}
+
+// WithServiceAccountFilePath sets the OAuth client JSON path
+//
+// Deprecated: use WithClientSecretFilePath, or WithServiceAccountKeyFile for a real
+// service account key
 func WithServiceAccountFilePath(path string) GoogleDriveServiceConfigOption {
+	return WithClientSecretFilePath(path)
+}
+
+// WithServiceAccountKey sets the JSON key of the service account used by AuthModeServiceAccount
+func WithServiceAccountKey(key []byte) GoogleDriveServiceConfigOption {
 	return func(c *GoogleDriveServiceConfig) {
-		c.ServiceAccountFilePath = path
+		c.ServiceAccountKey = key
+	}
+}
+
+// WithServiceAccountKeyFile is WithServiceAccountKey with a key file read by New
+func WithServiceAccountKeyFile(path string) GoogleDriveServiceConfigOption {
+	return func(c *GoogleDriveServiceConfig) {
+		c.ServiceAccountKeyFilePath = path
+	}
+}
+
+// WithAuthModeResolver chooses the auth mode of every account, accounts use their
+// saved OAuth token by default
+func WithAuthModeResolver(resolver AuthModeResolver) GoogleDriveServiceConfigOption {
+	return func(c *GoogleDriveServiceConfig) {
+		c.AuthModeResolver = resolver
 	}
 }
 
@@ -55,19 +126,125 @@ func WithUseBaseFolder(useBaseFolder bool) GoogleDriveServiceConfigOption {
 	}
 }
 
+// WithUseCatalog records uploaded, created, moved, copied and deleted files in
+// the catalog table so they can be queried without calling Drive
+func WithUseCatalog(useCatalog bool) GoogleDriveServiceConfigOption {
+	return func(c *GoogleDriveServiceConfig) {
+		c.UseCatalog = useCatalog
+	}
+}
+
+// WithRetryPolicy sets the retry policy applied to every Drive request
+func WithRetryPolicy(policy RetryPolicy) GoogleDriveServiceConfigOption {
+	return func(c *GoogleDriveServiceConfig) {
+		c.RetryPolicy = policy
+	}
+}
+
+// WithRateLimit enables the client-side rate limiter for Drive requests
+func WithRateLimit(config RateLimitConfig) GoogleDriveServiceConfigOption {
+	return func(c *GoogleDriveServiceConfig) {
+		c.RateLimit = &config
+	}
+}
+
+// WithClientCache configures the per-account Drive client cache
+func WithClientCache(config ClientCacheConfig) GoogleDriveServiceConfigOption {
+	return func(c *GoogleDriveServiceConfig) {
+		c.ClientCache = config
+	}
+}
+
+// WithBatch configures bulk operations
+func WithBatch(config BatchConfig) GoogleDriveServiceConfigOption {
+	return func(c *GoogleDriveServiceConfig) {
+		c.Batch = config
+	}
+}
+
+// WithDriveClientOptions appends options used when building Drive clients,
+// e.g. a custom endpoint
+func WithDriveClientOptions(opts ...option.ClientOption) GoogleDriveServiceConfigOption {
+	return func(c *GoogleDriveServiceConfig) {
+		c.ClientOptions = append(c.ClientOptions, opts...)
+	}
+}
+
+// WithStorageReportTTL sets how long storage reports are cached, zero disables caching
+func WithStorageReportTTL(ttl time.Duration) GoogleDriveServiceConfigOption {
+	return func(c *GoogleDriveServiceConfig) {
+		c.StorageReportTTL = ttl
+	}
+}
+
+// WithScopeProfile sets the Drive access requested when connecting accounts,
+// defaults to ScopeProfileFull
+func WithScopeProfile(profile ScopeProfile) GoogleDriveServiceConfigOption {
+	return func(c *GoogleDriveServiceConfig) {
+		c.ScopeProfile = profile
+	}
+}
+
+// WithTenant registers a tenant, select it per request with ContextWithTenant
+func WithTenant(tenantID string, tenant TenantConfig) GoogleDriveServiceConfigOption {
+	return func(c *GoogleDriveServiceConfig) {
+		if c.Tenants == nil {
+			c.Tenants = make(map[string]TenantConfig)
+		}
+		c.Tenants[tenantID] = tenant
+	}
+}
+
+// WithTablePrefix sets the prefix of the token, OAuth client and schema migration
+// tables, defaults to DefaultTablePrefix. The data tables such as the catalog and the
+// pool uploads are not prefixed, they are always named fundrive_*
+func WithTablePrefix(prefix string) GoogleDriveServiceConfigOption {
+	return func(c *GoogleDriveServiceConfig) {
+		c.TablePrefix = prefix
+	}
+}
+
+// WithOAuthClientResolver sets the resolver of the registered OAuth clients, clients
+// it does not know are loaded from the clients saved with SaveOAuthClient
+func WithOAuthClientResolver(resolver OAuthClientResolver) GoogleDriveServiceConfigOption {
+	return func(c *GoogleDriveServiceConfig) {
+		c.OAuthClientResolver = resolver
+	}
+}
+
+// WithAutoMigrate sets whether New applies the pending schema migrations, disable it
+// to run Migrate from a deploy step instead
+func WithAutoMigrate(enabled bool) GoogleDriveServiceConfigOption {
+	return func(c *GoogleDriveServiceConfig) {
+		c.AutoMigrate = enabled
+	}
+}
+
 // validate checks if the configuration is valid
 func (c *GoogleDriveServiceConfig) validate() error {
 	if c.DB == nil {
 		return ErrDBEmpty
 	}
 
-	if c.ServiceAccountFilePath == "" {
-		return ErrServiceAccountEmpty
+	if c.clientSecretFilePath() == "" && len(c.ServiceAccountKey) == 0 && c.ServiceAccountKeyFilePath == "" {
+		return ErrCredentialsEmpty
 	}
 
 	if c.EncryptionKey == "" {
-		return ErrServiceAccountEmpty
+		return ErrEncryptionKeyEmpty
+	}
+
+	if err := c.ScopeProfile.Validate(); err != nil {
+		return err
 	}
 
 	return nil
 }
+
+// clientSecretFilePath returns the OAuth client path set by either field
+func (c *GoogleDriveServiceConfig) clientSecretFilePath() string {
+	if c.ClientSecretFilePath != "" {
+		return c.ClientSecretFilePath
+	}
+	return c.ServiceAccountFilePath
+}
@@ -0,0 +1,473 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// DefaultFSCacheTTL is how long a DriveFS keeps resolved paths and folder listings
+const DefaultFSCacheTTL = 30 * time.Second
+
+// fsFileFields are the Drive fields needed to describe a file as fs.FileInfo
+const fsFileFields = "id, name, mimeType, size, md5Checksum, modifiedTime"
+
+// ErrNotDownloadable is returned when reading a Google Docs file, which has no binary content
+var ErrNotDownloadable = errors.New("google docs files can only be exported")
+
+type FSRequest struct {
+	UserID string `json:"user_id" validate:"required"`
+	Email  string `json:"email" validate:"required"`
+
+	// FolderID is the root of the file system, defaults to the root of My Drive
+	FolderID string `json:"folder_id"`
+
+	// CacheTTL defaults to DefaultFSCacheTTL, a negative value disables the cache
+	CacheTTL time.Duration `json:"cache_ttl"`
+}
+
+func (r *FSRequest) Validate() error {
+	if r.UserID == "" {
+		return ErrInvalidUserID
+	}
+	if r.Email == "" {
+		return ErrInvalidEmail
+	}
+	return nil
+}
+
+// DriveFS is a read-only fs.FS over a Drive folder. Drive allows several files with
+// the same name in a folder, the first one listed is the one a path resolves to.
+// Files whose name contains a slash cannot be addressed and are left out.
+type DriveFS struct {
+	service *GoogleDriveService
+	srv     *drive.Service
+	ctx     context.Context
+	userID  string
+	email   string
+	rootID  string
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	paths map[string]fsCacheEntry
+	dirs  map[string]fsDirCacheEntry
+}
+
+type fsCacheEntry struct {
+	file      *drive.File
+	expiresAt time.Time
+}
+
+type fsDirCacheEntry struct {
+	children  []*drive.File
+	expiresAt time.Time
+}
+
+var (
+	_ fs.FS         = (*DriveFS)(nil)
+	_ fs.ReadDirFS  = (*DriveFS)(nil)
+	_ fs.StatFS     = (*DriveFS)(nil)
+	_ fs.ReadFileFS = (*DriveFS)(nil)
+)
+
+// FS returns a file system rooted at a Drive folder. The context is used for every
+// Drive request the file system makes, since fs.FS methods do not take one.
+func (service *GoogleDriveService) FS(ctx context.Context, req *FSRequest) (*DriveFS, error) {
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid fs request: %w", err)
+	}
+
+	srv, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: req.UserID, Email: req.Email})
+	if err != nil {
+		return nil, fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	rootID := req.FolderID
+	if rootID == "" {
+		rootID = "root"
+	}
+
+	ttl := req.CacheTTL
+	if ttl == 0 {
+		ttl = DefaultFSCacheTTL
+	}
+
+	return &DriveFS{
+		service: service,
+		srv:     srv,
+		ctx:     ctx,
+		userID:  req.UserID,
+		email:   req.Email,
+		rootID:  rootID,
+		ttl:     ttl,
+		paths:   make(map[string]fsCacheEntry),
+		dirs:    make(map[string]fsDirCacheEntry),
+	}, nil
+}
+
+// Invalidate drops the cached paths and folder listings
+func (fsys *DriveFS) Invalidate() {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	fsys.paths = make(map[string]fsCacheEntry)
+	fsys.dirs = make(map[string]fsDirCacheEntry)
+}
+
+// Open opens the named file or folder
+func (fsys *DriveFS) Open(name string) (fs.File, error) {
+	file, err := fsys.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if file.MimeType == MimeTypeFolder {
+		return &driveDir{fsys: fsys, name: name, file: file}, nil
+	}
+
+	return &driveFile{fsys: fsys, name: name, file: file}, nil
+}
+
+// Stat returns the fs.FileInfo of the named file or folder
+func (fsys *DriveFS) Stat(name string) (fs.FileInfo, error) {
+	file, err := fsys.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return driveFileInfo{file: file}, nil
+}
+
+// ReadDir lists the named folder sorted by name
+func (fsys *DriveFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	file, err := fsys.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if file.MimeType != MimeTypeFolder {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	children, err := fsys.children(file.Id)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, child := range children {
+		entries = append(entries, fs.FileInfoToDirEntry(driveFileInfo{file: child}))
+	}
+
+	return entries, nil
+}
+
+// ReadFile downloads the named file
+func (fsys *DriveFS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, ok := f.(*driveDir); ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// resolve returns the Drive file of a path, walking down from the root folder
+func (fsys *DriveFS) resolve(op, name string) (*drive.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	if file, ok := fsys.cachedPath(name); ok {
+		return file, nil
+	}
+
+	var file *drive.File
+	if name == "." {
+		root, err := retryCall(fsys.ctx, fsys.service.RetryPolicy, "files.get", true, func() (*drive.File, error) {
+			return fsys.srv.Files.Get(fsys.rootID).SupportsAllDrives(true).Fields(fsFileFields).Context(fsys.ctx).Do()
+		})
+		if err != nil {
+			if isNotFoundError(err) {
+				err = fs.ErrNotExist
+			}
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		// the root is named "." like the root of any fs.FS
+		file = &drive.File{Id: root.Id, Name: ".", MimeType: root.MimeType, ModifiedTime: root.ModifiedTime}
+	} else {
+		parent, err := fsys.resolve(op, path.Dir(name))
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errors.Unwrap(err)}
+		}
+		if parent.MimeType != MimeTypeFolder {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+
+		children, err := fsys.children(parent.Id)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+
+		base := path.Base(name)
+		index := sort.Search(len(children), func(i int) bool { return children[i].Name >= base })
+		if index == len(children) || children[index].Name != base {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		file = children[index]
+	}
+
+	fsys.cachePath(name, file)
+	return file, nil
+}
+
+// children lists a folder sorted by name, keeping the first file of duplicate names
+func (fsys *DriveFS) children(folderID string) ([]*drive.File, error) {
+	fsys.mu.Lock()
+	cached, ok := fsys.dirs[folderID]
+	fsys.mu.Unlock()
+
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.children, nil
+	}
+
+	listed, err := fsys.service.listFolderChildren(fsys.ctx, fsys.srv, folderID, fsFileFields, "")
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{}, len(listed))
+	children := make([]*drive.File, 0, len(listed))
+	for _, child := range listed {
+		if _, ok := seen[child.Name]; ok || child.Name == "" || child.Name == "." || child.Name == ".." || strings.Contains(child.Name, "/") {
+			continue
+		}
+		seen[child.Name] = struct{}{}
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name < children[j].Name })
+
+	if fsys.ttl > 0 {
+		fsys.mu.Lock()
+		fsys.dirs[folderID] = fsDirCacheEntry{children: children, expiresAt: time.Now().Add(fsys.ttl)}
+		fsys.mu.Unlock()
+	}
+
+	return children, nil
+}
+
+func (fsys *DriveFS) cachedPath(name string) (*drive.File, bool) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	entry, ok := fsys.paths[name]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+	return entry.file, true
+}
+
+func (fsys *DriveFS) cachePath(name string, file *drive.File) {
+	if fsys.ttl <= 0 {
+		return
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	fsys.paths[name] = fsCacheEntry{file: file, expiresAt: time.Now().Add(fsys.ttl)}
+}
+
+// driveFileInfo maps a Drive file to fs.FileInfo
+type driveFileInfo struct {
+	file *drive.File
+}
+
+func (i driveFileInfo) Name() string {
+	return i.file.Name
+}
+
+func (i driveFileInfo) Size() int64 {
+	return i.file.Size
+}
+
+func (i driveFileInfo) Mode() fs.FileMode {
+	if i.IsDir() {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+func (i driveFileInfo) ModTime() time.Time {
+	modifiedAt, _ := time.Parse(time.RFC3339, i.file.ModifiedTime)
+	return modifiedAt
+}
+
+func (i driveFileInfo) IsDir() bool {
+	return i.file.MimeType == MimeTypeFolder
+}
+
+// Sys returns the underlying *drive.File
+func (i driveFileInfo) Sys() any {
+	return i.file
+}
+
+// driveDir is an open Drive folder
+type driveDir struct {
+	fsys    *DriveFS
+	name    string
+	file    *drive.File
+	entries []fs.DirEntry
+	offset  int
+	listed  bool
+}
+
+func (d *driveDir) Stat() (fs.FileInfo, error) {
+	return driveFileInfo{file: d.file}, nil
+}
+
+func (d *driveDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *driveDir) Close() error {
+	return nil
+}
+
+func (d *driveDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.listed {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		d.listed = true
+	}
+
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
+
+// driveFile is an open Drive file. The content is downloaded lazily from the current
+// offset, seeking drops the download and the next read resumes with a range request.
+type driveFile struct {
+	fsys   *DriveFS
+	name   string
+	file   *drive.File
+	body   io.ReadCloser
+	offset int64
+	closed bool
+}
+
+func (f *driveFile) Stat() (fs.FileInfo, error) {
+	return driveFileInfo{file: f.file}, nil
+}
+
+func (f *driveFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	if isGoogleAppsMimeType(f.file.MimeType) {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: ErrNotDownloadable}
+	}
+	if f.offset >= f.file.Size {
+		return 0, io.EOF
+	}
+
+	if f.body == nil {
+		if err := f.open(); err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.name, Err: err}
+		}
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *driveFile) open() error {
+	response, err := retryCall(f.fsys.ctx, f.fsys.service.RetryPolicy, "files.get", true, func() (*http.Response, error) {
+		call := f.fsys.srv.Files.Get(f.file.Id).SupportsAllDrives(true).Context(f.fsys.ctx)
+		if f.offset > 0 {
+			call.Header().Set("Range", fmt.Sprintf("bytes=%d-", f.offset))
+		}
+		return call.Download(googleapi.QueryParameter("alt", "media"))
+	})
+	if err != nil {
+		return err
+	}
+
+	f.body = response.Body
+	return nil
+}
+
+func (f *driveFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.file.Size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *driveFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
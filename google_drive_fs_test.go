@@ -0,0 +1,222 @@
+package fundrive
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// fakeDrive serves a small in-memory Drive: listing, metadata, media downloads,
+// multipart uploads, folder creation, copies, permissions and metadata updates
+type fakeDrive struct {
+	mu      sync.Mutex
+	files   []*drive.File
+	content map[string]string
+	nextID  int
+
+	// intercept serves a request instead of the fake when it returns true
+	intercept func(w http.ResponseWriter, r *http.Request) bool
+}
+
+func newFakeDrive(t *testing.T, files []*drive.File, content map[string]string) (*fakeDrive, *GoogleDriveService) {
+	fake := &fakeDrive{files: files, content: content}
+
+	server := httptest.NewServer(http.HandlerFunc(fake.serve))
+	t.Cleanup(server.Close)
+
+	return fake, &GoogleDriveService{
+		OAuthService:  newStubOAuthService(t),
+		RetryPolicy:   NoRetryPolicy(),
+		ClientOptions: []option.ClientOption{option.WithEndpoint(server.URL + "/drive/v3/")},
+	}
+}
+
+var (
+	fakeDriveInParents = regexp.MustCompile(`'([^']+)' in parents`)
+	fakeDriveName      = regexp.MustCompile(`name = '([^']*)'`)
+)
+
+func (fake *fakeDrive) file(id string) *drive.File {
+	for _, file := range fake.files {
+		if file.Id == id {
+			return file
+		}
+	}
+	return nil
+}
+
+func (fake *fakeDrive) serve(w http.ResponseWriter, r *http.Request) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if fake.intercept != nil && fake.intercept(w, r) {
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/upload"), "/drive/v3/files")
+	id = strings.TrimPrefix(id, "/")
+
+	if id == "" && r.Method == http.MethodGet {
+		q := r.URL.Query().Get("q")
+		parentID := fakeDriveInParents.FindStringSubmatch(q)[1]
+		name := fakeDriveName.FindStringSubmatch(q)
+		children := make([]*drive.File, 0)
+		for _, file := range fake.files {
+			if name != nil && file.Name != name[1] {
+				continue
+			}
+			if !file.Trashed && len(file.Parents) > 0 && file.Parents[0] == parentID {
+				children = append(children, file)
+			}
+		}
+		json.NewEncoder(w).Encode(&drive.FileList{Files: children})
+		return
+	}
+
+	if fileID, ok := strings.CutSuffix(id, "/permissions"); ok && fake.file(fileID) != nil {
+		var permission drive.Permission
+		json.NewDecoder(r.Body).Decode(&permission)
+
+		// like Drive, the owner role cannot be granted to anyone
+		if permission.Type == "anyone" && permission.Role == "owner" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"code":400,"message":"invalid permission"}}`))
+			return
+		}
+
+		permission.Id = permission.Type
+		json.NewEncoder(w).Encode(&permission)
+		return
+	}
+
+	if sourceID, ok := strings.CutSuffix(id, "/copy"); ok {
+		source := fake.file(sourceID)
+		fake.nextID++
+		copied := *source
+		copied.Id = fmt.Sprintf("new-%d", fake.nextID)
+		json.NewDecoder(r.Body).Decode(&copied)
+		fake.content[copied.Id] = fake.content[source.Id]
+		fake.files = append(fake.files, &copied)
+		json.NewEncoder(w).Encode(&copied)
+		return
+	}
+
+	var file *drive.File
+	if id == "" {
+		fake.nextID++
+		file = &drive.File{Id: fmt.Sprintf("new-%d", fake.nextID)}
+		fake.files = append(fake.files, file)
+	} else if file = fake.file(id); file == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"code":404,"message":"File not found"}}`))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("alt") == "media" {
+			http.ServeContent(w, r, file.Name, time.Time{}, strings.NewReader(fake.content[file.Id]))
+			return
+		}
+	case http.MethodPost, http.MethodPatch:
+		var update drive.File
+		if strings.HasPrefix(r.URL.Path, "/upload/") {
+			_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			parts := multipart.NewReader(r.Body, params["boundary"])
+			metadata, _ := parts.NextPart()
+			json.NewDecoder(metadata).Decode(&update)
+			media, _ := parts.NextPart()
+			data, _ := io.ReadAll(media)
+			fake.content[file.Id] = string(data)
+			file.Size = int64(len(data))
+			file.Md5Checksum = fmt.Sprintf("%x", md5.Sum(data))
+		} else {
+			json.NewDecoder(r.Body).Decode(&update)
+		}
+
+		if update.Name != "" {
+			file.Name = update.Name
+		}
+		if update.MimeType != "" {
+			file.MimeType = update.MimeType
+		}
+		if update.Parents != nil && r.Method == http.MethodPost {
+			file.Parents = update.Parents
+		}
+		if update.Trashed {
+			file.Trashed = true
+		}
+		if parentID := r.URL.Query().Get("addParents"); parentID != "" {
+			file.Parents = []string{parentID}
+		}
+		file.ModifiedTime = time.Now().UTC().Format(time.RFC3339)
+	case http.MethodDelete:
+		file.Trashed = true
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	json.NewEncoder(w).Encode(file)
+}
+
+func TestDriveFS(t *testing.T) {
+	modified := "2024-05-01T10:00:00Z"
+	files := []*drive.File{
+		{Id: "root-id", Name: "Projects", MimeType: MimeTypeFolder, ModifiedTime: modified},
+		{Id: "readme", Name: "README.md", MimeType: "text/markdown", Size: 8, ModifiedTime: modified, Parents: []string{"root-id"}},
+		{Id: "docs", Name: "docs", MimeType: MimeTypeFolder, ModifiedTime: modified, Parents: []string{"root-id"}},
+		{Id: "guide", Name: "guide.txt", MimeType: "text/plain", Size: 11, ModifiedTime: modified, Parents: []string{"docs"}},
+		{Id: "guide-copy", Name: "guide.txt", MimeType: "text/plain", Size: 4, ModifiedTime: modified, Parents: []string{"docs"}},
+		{Id: "slash", Name: "a/b", MimeType: "text/plain", ModifiedTime: modified, Parents: []string{"docs"}},
+	}
+	_, service := newFakeDrive(t, files, map[string]string{
+		"readme":     "# hello\n",
+		"guide":      "read me now",
+		"guide-copy": "copy",
+	})
+
+	fsys, err := service.FS(context.Background(), &FSRequest{UserID: "user-1", Email: "a@example.com", FolderID: "root-id"})
+	require.NoError(t, err)
+
+	require.NoError(t, fstest.TestFS(fsys, "README.md", "docs/guide.txt"))
+
+	data, err := fsys.ReadFile("docs/guide.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "read me now", string(data))
+
+	info, err := fsys.Stat("docs/guide.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), info.Size())
+	assert.Equal(t, time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), info.ModTime().UTC())
+
+	// http.FileServer seeks to sniff the content type and to serve ranges
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/README.md", nil)
+	request.Header.Set("Range", "bytes=2-6")
+	http.FileServer(http.FS(fsys)).ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusPartialContent, recorder.Code)
+	assert.Equal(t, "hello", recorder.Body.String())
+
+	_, err = fsys.Stat("docs/missing.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
@@ -0,0 +1,1105 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrMigrationJobNotFound = errors.New("migration job not found")
+	ErrMigrationCompleted   = errors.New("migration job already completed")
+)
+
+// MigrationMode selects how files are transferred between accounts
+type MigrationMode string
+
+const (
+	// MigrationModeStream downloads every file from the source account and uploads
+	// it to the target account. Google Docs files, which cannot be downloaded, are
+	// shared with the target account and copied server side.
+	MigrationModeStream MigrationMode = "stream"
+
+	// MigrationModeTransferOwnership makes the target account the owner of every
+	// file. Drive only allows this between accounts of the same Workspace domain.
+	MigrationModeTransferOwnership MigrationMode = "transfer_ownership"
+)
+
+// MigrationStatus is the state of a migration job or item
+type MigrationStatus string
+
+const (
+	MigrationStatusPending     MigrationStatus = "pending"
+	MigrationStatusEnumerating MigrationStatus = "enumerating"
+	MigrationStatusRunning     MigrationStatus = "running"
+	MigrationStatusCompleted   MigrationStatus = "completed"
+	MigrationStatusFailed      MigrationStatus = "failed"
+)
+
+// migrationFileFields are the Drive fields needed to migrate a file
+const migrationFileFields = "id, name, mimeType, parents, size"
+
+// MigrationJob tracks the progress of moving files from one connected account to another
+type MigrationJob struct {
+	ID             string          `json:"id" gorm:"column:id;type:char(26);primaryKey"`
+	TenantID       string          `json:"tenant_id" gorm:"column:tenant_id;type:varchar(64);not null;default:'';index:idx_fundrive_migration_jobs_tenant_user"`
+	UserID         string          `json:"user_id" gorm:"column:user_id;type:varchar(255);index:idx_fundrive_migration_jobs_tenant_user"`
+	SourceEmail    string          `json:"source_email" gorm:"column:source_email;type:varchar(255)"`
+	TargetEmail    string          `json:"target_email" gorm:"column:target_email;type:varchar(255)"`
+	SourceFolderID string          `json:"source_folder_id" gorm:"column:source_folder_id;type:varchar(255)"`
+	TargetParentID string          `json:"target_parent_id" gorm:"column:target_parent_id;type:varchar(255)"`
+	FileIDs        string          `json:"file_ids" gorm:"column:file_ids;type:text"`
+	Mode           MigrationMode   `json:"mode" gorm:"column:mode;type:varchar(32)"`
+	DeleteSource   bool            `json:"delete_source" gorm:"column:delete_source"`
+	Status         MigrationStatus `json:"status" gorm:"column:status;type:varchar(32)"`
+	TotalItems     int             `json:"total_items" gorm:"column:total_items"`
+	DoneItems      int             `json:"done_items" gorm:"column:done_items"`
+	FailedItems    int             `json:"failed_items" gorm:"column:failed_items"`
+	Error          string          `json:"error" gorm:"column:error;type:text"`
+
+	// EnumeratedAt is set once every item of the job is recorded, a job without it is
+	// enumerated again when resumed
+	EnumeratedAt *time.Time `json:"enumerated_at" gorm:"column:enumerated_at"`
+
+	CreatedAt time.Time `json:"created_at" gorm:"column:created_at"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"column:updated_at"`
+}
+
+// TableName returns the table name
+func (m *MigrationJob) TableName() string {
+	return "fundrive_migration_jobs"
+}
+
+// MigrationItem is a single file or folder of a migration job
+type MigrationItem struct {
+	ID             string          `json:"id" gorm:"column:id;type:char(26);primaryKey"`
+	TenantID       string          `json:"tenant_id" gorm:"column:tenant_id;type:varchar(64);not null;default:''"`
+	JobID          string          `json:"job_id" gorm:"column:job_id;type:char(26);index"`
+	SourceFileID   string          `json:"source_file_id" gorm:"column:source_file_id;type:varchar(255)"`
+	SourceParentID string          `json:"source_parent_id" gorm:"column:source_parent_id;type:varchar(255)"`
+	TargetFileID   string          `json:"target_file_id" gorm:"column:target_file_id;type:varchar(255)"`
+	Name           string          `json:"name" gorm:"column:name;type:varchar(1024)"`
+	MimeType       string          `json:"mime_type" gorm:"column:mime_type;type:varchar(255)"`
+	Size           int64           `json:"size" gorm:"column:size"`
+	Depth          int             `json:"depth" gorm:"column:depth"`
+	IsFolder       bool            `json:"is_folder" gorm:"column:is_folder"`
+	IsAncestor     bool            `json:"is_ancestor" gorm:"column:is_ancestor"`
+	Status         MigrationStatus `json:"status" gorm:"column:status;type:varchar(32)"`
+	Error          string          `json:"error" gorm:"column:error;type:text"`
+}
+
+// TableName returns the table name
+func (m *MigrationItem) TableName() string {
+	return "fundrive_migration_items"
+}
+
+type MigrateAccountRequest struct {
+	UserID      string `json:"user_id" validate:"required"`
+	SourceEmail string `json:"source_email" validate:"required"`
+	TargetEmail string `json:"target_email" validate:"required"`
+
+	// SourceFolderID is the folder migrated with everything below it, the whole
+	// account when empty
+	SourceFolderID string `json:"source_folder_id"`
+
+	// FileIDs migrates only these files instead of a folder tree. Their ancestor
+	// folders are recreated in the target account.
+	FileIDs []string `json:"file_ids"`
+
+	// TargetParentID is the folder receiving the files, the target root when empty
+	TargetParentID string `json:"target_parent_id"`
+
+	// Mode defaults to MigrationModeStream
+	Mode MigrationMode `json:"mode"`
+
+	// DeleteSource removes the migrated files from the source account
+	DeleteSource bool `json:"delete_source"`
+
+	// Concurrency is the number of files transferred at once, defaults to 4
+	Concurrency int `json:"concurrency"`
+}
+
+func (r *MigrateAccountRequest) Validate() error {
+	if r.UserID == "" {
+		return ErrInvalidUserID
+	}
+	if r.SourceEmail == "" || r.TargetEmail == "" {
+		return fmt.Errorf("source and target email are required")
+	}
+	if r.SourceEmail == r.TargetEmail {
+		return fmt.Errorf("source and target email must differ")
+	}
+	if r.SourceFolderID != "" && len(r.FileIDs) > 0 {
+		return fmt.Errorf("source folder and file ids are mutually exclusive")
+	}
+	switch r.Mode {
+	case "", MigrationModeStream, MigrationModeTransferOwnership:
+	default:
+		return fmt.Errorf("unknown migration mode %q", r.Mode)
+	}
+	return nil
+}
+
+// MigrateAccount moves files from one connected account to another, preserving the
+// folder structure and updating the stored catalog, pool and striped file references.
+// Progress is persisted, an interrupted job continues with ResumeMigration.
+func (service *GoogleDriveService) MigrateAccount(ctx context.Context, req *MigrateAccountRequest) (*MigrationJob, error) {
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid migrate account request: %w", err)
+	}
+
+	mode := req.Mode
+	if mode == "" {
+		mode = MigrationModeStream
+	}
+
+	sourceFolderID := req.SourceFolderID
+	if sourceFolderID == "" && len(req.FileIDs) == 0 {
+		sourceFolderID = "root"
+	}
+
+	targetParentID := req.TargetParentID
+	if targetParentID == "" {
+		targetParentID = "root"
+	}
+
+	job := MigrationJob{
+		ID:             ulid.Make().String(),
+		TenantID:       TenantFromContext(ctx),
+		UserID:         req.UserID,
+		SourceEmail:    req.SourceEmail,
+		TargetEmail:    req.TargetEmail,
+		SourceFolderID: sourceFolderID,
+		TargetParentID: targetParentID,
+		FileIDs:        strings.Join(req.FileIDs, ","),
+		Mode:           mode,
+		DeleteSource:   req.DeleteSource,
+		Status:         MigrationStatusPending,
+	}
+
+	if err := service.DB.WithContext(ctx).Create(&job).Error; err != nil {
+		return nil, fmt.Errorf("failed to create migration job: %w", err)
+	}
+
+	return service.runMigration(ctx, &job, req.Concurrency)
+}
+
+type ResumeMigrationRequest struct {
+	UserID string `json:"user_id" validate:"required"`
+	JobID  string `json:"job_id" validate:"required"`
+
+	// Concurrency is the number of files transferred at once, defaults to 4
+	Concurrency int `json:"concurrency"`
+
+	// RetryFailed sends the items that failed before again
+	RetryFailed bool `json:"retry_failed"`
+}
+
+// ResumeMigration continues an interrupted or failed migration job. A job stopped before
+// its enumeration finished is enumerated again, items that were transferred but not yet
+// recorded when the job stopped are transferred again.
+func (service *GoogleDriveService) ResumeMigration(ctx context.Context, req *ResumeMigrationRequest) (*MigrationJob, error) {
+	job, err := service.GetMigrationJob(ctx, &GetMigrationJobRequest{UserID: req.UserID, JobID: req.JobID})
+	if err != nil {
+		return nil, err
+	}
+
+	if job.Status == MigrationStatusCompleted {
+		return job, ErrMigrationCompleted
+	}
+
+	if req.RetryFailed {
+		err := service.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			err := tx.Model(&MigrationItem{}).
+				Scopes(tenantScope).
+				Where("job_id = ? AND status = ?", job.ID, MigrationStatusFailed).
+				Updates(map[string]interface{}{"status": MigrationStatusPending, "error": ""}).
+				Error
+			if err != nil {
+				return err
+			}
+
+			job.FailedItems = 0
+			return tx.Model(job).Update("failed_items", 0).Error
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to reset migration items: %w", err)
+		}
+	}
+
+	return service.runMigration(ctx, job, req.Concurrency)
+}
+
+type GetMigrationJobRequest struct {
+	UserID string `json:"user_id" validate:"required"`
+	JobID  string `json:"job_id" validate:"required"`
+}
+
+// GetMigrationJob returns a migration job with its progress counters
+func (service *GoogleDriveService) GetMigrationJob(ctx context.Context, req *GetMigrationJobRequest) (*MigrationJob, error) {
+	var job MigrationJob
+
+	err := service.DB.WithContext(ctx).
+		Scopes(tenantScope).
+		Where("user_id = ? AND id = ?", req.UserID, req.JobID).
+		First(&job).
+		Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrMigrationJobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get migration job: %w", err)
+	}
+
+	return &job, nil
+}
+
+// runMigration enumerates the job when needed and transfers its pending items
+// level by level, so folders exist before their children are transferred. The
+// sources are deleted once the items are recorded
+func (service *GoogleDriveService) runMigration(ctx context.Context, job *MigrationJob, concurrency int) (*MigrationJob, error) {
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+
+	// the accounts and rows of the job are read in the tenant that created it
+	ctx = ContextWithTenant(ctx, job.TenantID)
+
+	if job.EnumeratedAt == nil {
+		if err := service.enumerateMigration(ctx, job); err != nil {
+			return job, service.failMigration(ctx, job, err)
+		}
+	}
+
+	if err := service.setMigrationStatus(ctx, job, MigrationStatusRunning); err != nil {
+		return job, err
+	}
+
+	var depths []int
+	err := service.DB.WithContext(ctx).
+		Model(&MigrationItem{}).
+		Scopes(tenantScope).
+		Where("job_id = ? AND status = ?", job.ID, MigrationStatusPending).
+		Distinct("depth").
+		Order("depth").
+		Pluck("depth", &depths).
+		Error
+	if err != nil {
+		return job, fmt.Errorf("failed to list migration levels: %w", err)
+	}
+
+	for _, depth := range depths {
+		items := make([]MigrationItem, 0)
+		err := service.DB.WithContext(ctx).
+			Scopes(tenantScope).
+			Where("job_id = ? AND status = ? AND depth = ?", job.ID, MigrationStatusPending, depth).
+			Order("id").
+			Find(&items).
+			Error
+		if err != nil {
+			return job, fmt.Errorf("failed to list migration items: %w", err)
+		}
+
+		g, gCtx := errgroup.WithContext(ctx)
+		g.SetLimit(concurrency)
+
+		for i := range items {
+			item := &items[i]
+			g.Go(func() error {
+				return service.migrateItem(gCtx, job, item)
+			})
+		}
+
+		if err := g.Wait(); err != nil {
+			return job, service.failMigration(ctx, job, err)
+		}
+	}
+
+	if err := service.DB.WithContext(ctx).Scopes(tenantScope).First(job, "id = ?", job.ID).Error; err != nil {
+		return job, fmt.Errorf("failed to reload migration job: %w", err)
+	}
+
+	if job.DeleteSource && job.Mode == MigrationModeStream {
+		if err := service.deleteMigratedFiles(ctx, job); err != nil {
+			return job, service.failMigration(ctx, job, err)
+		}
+	}
+
+	if job.FailedItems > 0 {
+		return job, service.failMigration(ctx, job, fmt.Errorf("%d items failed", job.FailedItems))
+	}
+
+	if job.DeleteSource && job.Mode == MigrationModeStream {
+		if err := service.deleteMigratedFolders(ctx, job); err != nil {
+			return job, service.failMigration(ctx, job, err)
+		}
+	}
+
+	if err := service.setMigrationStatus(ctx, job, MigrationStatusCompleted); err != nil {
+		return job, err
+	}
+
+	return job, nil
+}
+
+func (service *GoogleDriveService) setMigrationStatus(ctx context.Context, job *MigrationJob, status MigrationStatus) error {
+	job.Status = status
+	if err := service.DB.WithContext(ctx).Model(job).Update("status", status).Error; err != nil {
+		return fmt.Errorf("failed to update migration job: %w", err)
+	}
+	return nil
+}
+
+// failMigration records the error on the job and returns it
+func (service *GoogleDriveService) failMigration(ctx context.Context, job *MigrationJob, cause error) error {
+	job.Status = MigrationStatusFailed
+	job.Error = cause.Error()
+
+	// the job is recorded even when the caller's context is cancelled
+	err := service.DB.WithContext(context.WithoutCancel(ctx)).
+		Model(job).
+		Updates(map[string]interface{}{"status": job.Status, "error": job.Error}).
+		Error
+	if err != nil {
+		return fmt.Errorf("error migrating account: %w (failed to record failure: %v)", cause, err)
+	}
+
+	return fmt.Errorf("error migrating account: %w", cause)
+}
+
+// enumerateMigration records every file and folder of the job. An interrupted
+// enumeration is started over.
+func (service *GoogleDriveService) enumerateMigration(ctx context.Context, job *MigrationJob) error {
+	if err := service.setMigrationStatus(ctx, job, MigrationStatusEnumerating); err != nil {
+		return err
+	}
+
+	srv, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: job.UserID, Email: job.SourceEmail})
+	if err != nil {
+		return fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	var items []MigrationItem
+	if job.FileIDs != "" {
+		items, err = service.enumerateMigrationFiles(ctx, srv, job, strings.Split(job.FileIDs, ","))
+	} else {
+		items, err = service.enumerateMigrationTree(ctx, srv, job)
+	}
+	if err != nil {
+		return err
+	}
+
+	return service.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Scopes(tenantScope).Where("job_id = ?", job.ID).Delete(&MigrationItem{}).Error; err != nil {
+			return err
+		}
+
+		if len(items) > 0 {
+			if err := tx.CreateInBatches(items, 100).Error; err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		job.TotalItems = len(items)
+		job.DoneItems = 0
+		job.FailedItems = 0
+		job.EnumeratedAt = &now
+		return tx.Model(job).Updates(map[string]interface{}{
+			"total_items":   job.TotalItems,
+			"done_items":    0,
+			"failed_items":  0,
+			"enumerated_at": now,
+		}).Error
+	})
+}
+
+// enumerateMigrationTree walks the source folder breadth first
+func (service *GoogleDriveService) enumerateMigrationTree(ctx context.Context, srv *drive.Service, job *MigrationJob) ([]MigrationItem, error) {
+	items := make([]MigrationItem, 0)
+
+	type folder struct {
+		id    string
+		depth int
+	}
+	queue := []folder{{id: job.SourceFolderID}}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		// only files owned by the account count against its storage
+		children, err := service.listFolderChildren(ctx, srv, current.id, migrationFileFields, "'me' in owners")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, child := range children {
+			item := newMigrationItem(job, child, current.id, current.depth)
+			items = append(items, item)
+
+			if item.IsFolder {
+				queue = append(queue, folder{id: child.Id, depth: current.depth + 1})
+			}
+		}
+	}
+
+	return items, nil
+}
+
+// enumerateMigrationFiles records the selected files and the folders above them
+func (service *GoogleDriveService) enumerateMigrationFiles(ctx context.Context, srv *drive.Service, job *MigrationJob, fileIDs []string) ([]MigrationItem, error) {
+	files := make(map[string]*drive.File)
+
+	get := func(id string) (*drive.File, error) {
+		if file, ok := files[id]; ok {
+			return file, nil
+		}
+
+		file, err := retryCall(ctx, service.RetryPolicy, "files.get", true, func() (*drive.File, error) {
+			return srv.Files.Get(id).
+				SupportsAllDrives(true).
+				Fields(migrationFileFields).
+				Context(ctx).
+				Do()
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error getting file %s: %w", id, err)
+		}
+
+		files[id] = file
+		return file, nil
+	}
+
+	root, err := get("root")
+	if err != nil {
+		return nil, err
+	}
+
+	// chain returns the ancestors of a file from the top, the root excluded
+	chain := func(file *drive.File) ([]*drive.File, error) {
+		var ancestors []*drive.File
+		for current := file; len(current.Parents) > 0 && current.Parents[0] != root.Id; {
+			parent, err := get(current.Parents[0])
+			if err != nil {
+				return nil, err
+			}
+			ancestors = append([]*drive.File{parent}, ancestors...)
+			current = parent
+		}
+		return ancestors, nil
+	}
+
+	items := make([]MigrationItem, 0, len(fileIDs))
+	seen := make(map[string]bool)
+
+	for _, id := range fileIDs {
+		file, err := get(id)
+		if err != nil {
+			return nil, err
+		}
+
+		ancestors, err := chain(file)
+		if err != nil {
+			return nil, err
+		}
+
+		parentID := root.Id
+		for depth, ancestor := range ancestors {
+			if !seen[ancestor.Id] {
+				seen[ancestor.Id] = true
+				item := newMigrationItem(job, ancestor, parentID, depth)
+				item.IsAncestor = true
+				items = append(items, item)
+			}
+			parentID = ancestor.Id
+		}
+
+		if !seen[file.Id] {
+			seen[file.Id] = true
+			items = append(items, newMigrationItem(job, file, parentID, len(ancestors)))
+		}
+	}
+
+	return items, nil
+}
+
+func newMigrationItem(job *MigrationJob, file *drive.File, parentID string, depth int) MigrationItem {
+	return MigrationItem{
+		ID:             ulid.Make().String(),
+		TenantID:       job.TenantID,
+		JobID:          job.ID,
+		SourceFileID:   file.Id,
+		SourceParentID: parentID,
+		Name:           file.Name,
+		MimeType:       file.MimeType,
+		Size:           file.Size,
+		Depth:          depth,
+		IsFolder:       file.MimeType == MimeTypeFolder,
+		Status:         MigrationStatusPending,
+	}
+}
+
+// listFolderChildren lists every file and folder in a folder with the given fields,
+// an extra query narrows the listing
+func (service *GoogleDriveService) listFolderChildren(ctx context.Context, srv *drive.Service, folderID, fields, extra string) ([]*drive.File, error) {
+	q := fmt.Sprintf("'%s' in parents and trashed = false", folderID)
+	if extra != "" {
+		q += " and " + extra
+	}
+
+	files := make([]*drive.File, 0)
+	pageToken := ""
+
+	for {
+		request := srv.Files.List().SupportsAllDrives(true).IncludeItemsFromAllDrives(true).Q(q).
+			Spaces("drive").
+			Fields(googleapi.Field("nextPageToken, files(" + fields + ")")).
+			PageSize(1000)
+
+		if pageToken != "" {
+			request = request.PageToken(pageToken)
+		}
+
+		response, err := retryCall(ctx, service.RetryPolicy, "files.list", true, func() (*drive.FileList, error) {
+			return request.Context(ctx).Do()
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error listing folder %s: %w", folderID, err)
+		}
+
+		files = append(files, response.Files...)
+
+		if response.NextPageToken == "" {
+			return files, nil
+		}
+		pageToken = response.NextPageToken
+	}
+}
+
+// migrationTargetParent returns the target folder that receives an item
+func (service *GoogleDriveService) migrationTargetParent(ctx context.Context, job *MigrationJob, item *MigrationItem) (string, error) {
+	if item.Depth == 0 {
+		return job.TargetParentID, nil
+	}
+
+	var parent MigrationItem
+	err := service.DB.WithContext(ctx).
+		Scopes(tenantScope).
+		Where("job_id = ? AND source_file_id = ?", job.ID, item.SourceParentID).
+		First(&parent).
+		Error
+	if err != nil {
+		return "", fmt.Errorf("failed to find parent of %s: %w", item.Name, err)
+	}
+
+	if parent.TargetFileID == "" {
+		return "", fmt.Errorf("parent folder %s was not migrated", parent.Name)
+	}
+
+	return parent.TargetFileID, nil
+}
+
+// migrateItem transfers one item and records the outcome. Errors of the item are
+// recorded on it; only database errors are returned.
+func (service *GoogleDriveService) migrateItem(ctx context.Context, job *MigrationJob, item *MigrationItem) error {
+	targetID, err := service.transferMigrationItem(ctx, job, item)
+
+	if ctx.Err() != nil {
+		// the job was interrupted, the item stays pending for ResumeMigration
+		return ctx.Err()
+	}
+
+	return service.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		counter := "done_items"
+		updates := map[string]interface{}{"status": MigrationStatusCompleted, "target_file_id": targetID}
+
+		if err != nil {
+			counter = "failed_items"
+			updates = map[string]interface{}{"status": MigrationStatusFailed, "error": err.Error()}
+		} else if !item.IsFolder {
+			if err := migrateReferences(tx, job, item.SourceFileID, targetID); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Model(item).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(job).Update(counter, gorm.Expr(counter+" + 1")).Error
+	})
+}
+
+// transferMigrationItem creates the item in the target account and returns its ID
+func (service *GoogleDriveService) transferMigrationItem(ctx context.Context, job *MigrationJob, item *MigrationItem) (string, error) {
+	parentID, err := service.migrationTargetParent(ctx, job, item)
+	if err != nil {
+		return "", err
+	}
+
+	if item.IsFolder {
+		return service.findOrCreateFolder(ctx, job.UserID, job.TargetEmail, item.Name, parentID)
+	}
+
+	var file *drive.File
+	switch {
+	case job.Mode == MigrationModeTransferOwnership:
+		file, err = service.transferOwnership(ctx, job, item, parentID)
+	case isGoogleAppsMimeType(item.MimeType):
+		file, err = service.copyShared(ctx, job, item, parentID)
+	default:
+		file, err = service.streamCopy(ctx, job, item, parentID)
+	}
+	if err != nil && !errors.Is(err, ErrCatalogUpdate) {
+		return "", err
+	}
+
+	return file.Id, nil
+}
+
+// findOrCreateFolder reuses a folder with the same name in the parent, so resumed
+// and repeated migrations do not duplicate folders
+func (service *GoogleDriveService) findOrCreateFolder(ctx context.Context, userID, email, name, parentID string) (string, error) {
+	srv, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: userID, Email: email})
+	if err != nil {
+		return "", fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	q := fmt.Sprintf("mimeType = '%s' and name = '%s' and '%s' in parents and trashed = false",
+		MimeTypeFolder, strings.ReplaceAll(name, "'", "\\'"), parentID)
+
+	response, err := retryCall(ctx, service.RetryPolicy, "files.list", true, func() (*drive.FileList, error) {
+		return srv.Files.List().Q(q).
+			SupportsAllDrives(true).
+			IncludeItemsFromAllDrives(true).
+			Spaces("drive").
+			Fields("files(id)").
+			PageSize(1).
+			Context(ctx).
+			Do()
+	})
+	if err != nil {
+		return "", fmt.Errorf("error searching folder: %w", err)
+	}
+
+	if len(response.Files) > 0 {
+		return response.Files[0].Id, nil
+	}
+
+	folder, err := service.CreateFolder(ctx, &CreateFolderRequest{
+		UserID:     userID,
+		Email:      email,
+		Name:       name,
+		Parents:    []string{parentID},
+		Permission: PrivatePermission,
+	})
+	if err != nil && !errors.Is(err, ErrCatalogUpdate) {
+		return "", err
+	}
+
+	return folder.Id, nil
+}
+
+// streamCopy downloads the file from the source account and uploads it to the target
+func (service *GoogleDriveService) streamCopy(ctx context.Context, job *MigrationJob, item *MigrationItem, parentID string) (*drive.File, error) {
+	download, err := service.DownloadFile(ctx, &DownloadFileRequest{
+		UserID: job.UserID,
+		Email:  job.SourceEmail,
+		FileID: item.SourceFileID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error downloading file: %w", err)
+	}
+	defer download.Response.Body.Close()
+
+	return service.UploadFile(ctx, &UploadFileRequest{
+		UserID:     job.UserID,
+		Email:      job.TargetEmail,
+		FileName:   item.Name,
+		MimeType:   item.MimeType,
+		FileData:   download.Response.Body,
+		Permission: PrivatePermission,
+		Parents:    []string{parentID},
+	})
+}
+
+// copyShared shares the file with the target account, which copies it server side
+func (service *GoogleDriveService) copyShared(ctx context.Context, job *MigrationJob, item *MigrationItem, parentID string) (*drive.File, error) {
+	source, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: job.UserID, Email: job.SourceEmail})
+	if err != nil {
+		return nil, fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	target, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: job.UserID, Email: job.TargetEmail})
+	if err != nil {
+		return nil, fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	permission, err := retryCall(ctx, service.RetryPolicy, "permissions.create", false, func() (*drive.Permission, error) {
+		return source.Permissions.Create(item.SourceFileID, &drive.Permission{
+			Type:         "user",
+			Role:         "reader",
+			EmailAddress: job.TargetEmail,
+		}).SupportsAllDrives(true).SendNotificationEmail(false).Context(ctx).Do()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error sharing file with target account: %w", err)
+	}
+
+	defer func() {
+		_ = retryDo(ctx, service.RetryPolicy, "permissions.delete", true, func() error {
+			return source.Permissions.Delete(item.SourceFileID, permission.Id).
+				SupportsAllDrives(true).
+				Context(ctx).
+				Do()
+		})
+	}()
+
+	file, err := retryCall(ctx, service.RetryPolicy, "files.copy", false, func() (*drive.File, error) {
+		return target.Files.Copy(item.SourceFileID, &drive.File{
+			Name:    item.Name,
+			Parents: []string{parentID},
+		}).SupportsAllDrives(true).Fields(catalogFileFields).Context(ctx).Do()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error copying file: %w", err)
+	}
+
+	if err := service.catalogFile(ctx, job.UserID, job.TargetEmail, file); err != nil {
+		return file, err
+	}
+
+	return file, nil
+}
+
+// transferOwnership makes the target account the owner of the file and moves it
+// into the target folder
+func (service *GoogleDriveService) transferOwnership(ctx context.Context, job *MigrationJob, item *MigrationItem, parentID string) (*drive.File, error) {
+	source, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: job.UserID, Email: job.SourceEmail})
+	if err != nil {
+		return nil, fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	target, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: job.UserID, Email: job.TargetEmail})
+	if err != nil {
+		return nil, fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	_, err = retryCall(ctx, service.RetryPolicy, "permissions.create", true, func() (*drive.Permission, error) {
+		return source.Permissions.Create(item.SourceFileID, &drive.Permission{
+			Type:         "user",
+			Role:         "owner",
+			EmailAddress: job.TargetEmail,
+		}).SupportsAllDrives(true).TransferOwnership(true).Context(ctx).Do()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error transferring ownership: %w", err)
+	}
+
+	file, err := retryCall(ctx, service.RetryPolicy, "files.update", true, func() (*drive.File, error) {
+		return target.Files.Update(item.SourceFileID, &drive.File{}).SupportsAllDrives(true).
+			AddParents(parentID).
+			RemoveParents(item.SourceParentID).
+			Fields(catalogFileFields).
+			Context(ctx).
+			Do()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error moving transferred file: %w", err)
+	}
+
+	if err := service.catalogRemove(ctx, job.UserID, job.SourceEmail, item.SourceFileID); err != nil {
+		return file, err
+	}
+
+	if err := service.catalogFile(ctx, job.UserID, job.TargetEmail, file); err != nil {
+		return file, err
+	}
+
+	return file, nil
+}
+
+// migrateReferences points the stored pool uploads and striped parts at the migrated file
+func migrateReferences(tx *gorm.DB, job *MigrationJob, sourceID, targetID string) error {
+	err := tx.Model(&PoolUpload{}).
+		Scopes(tenantScope).
+		Where("user_id = ? AND email = ? AND file_id = ?", job.UserID, job.SourceEmail, sourceID).
+		Updates(map[string]interface{}{"email": job.TargetEmail, "file_id": targetID}).
+		Error
+	if err != nil {
+		return err
+	}
+
+	return tx.Model(&StripedPart{}).
+		Scopes(tenantScope).
+		Where("email = ? AND drive_file_id = ? AND striped_file_id IN (?)",
+			job.SourceEmail, sourceID,
+			tx.Model(&StripedFile{}).Select("id").Where("tenant_id = ? AND user_id = ?", job.TenantID, job.UserID),
+		).
+		Updates(map[string]interface{}{"email": job.TargetEmail, "drive_file_id": targetID}).
+		Error
+}
+
+// deleteMigratedFiles removes the migrated files from the source account. It runs
+// after the items and their references are recorded, so a source is never deleted
+// before the job knows its copy
+func (service *GoogleDriveService) deleteMigratedFiles(ctx context.Context, job *MigrationJob) error {
+	files := make([]MigrationItem, 0)
+	err := service.DB.WithContext(ctx).
+		Scopes(tenantScope).
+		Where("job_id = ? AND is_folder = ? AND status = ?", job.ID, false, MigrationStatusCompleted).
+		Order("id").
+		Find(&files).
+		Error
+	if err != nil {
+		return fmt.Errorf("failed to list migrated files: %w", err)
+	}
+
+	for _, file := range files {
+		err := service.Delete(ctx, &DeleteResourceRequest{
+			UserID:     job.UserID,
+			Email:      job.SourceEmail,
+			ResourceID: file.SourceFileID,
+		})
+		if err != nil && !errors.Is(err, ErrCatalogUpdate) && !isNotFoundError(err) {
+			return fmt.Errorf("error deleting source file %s: %w", file.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteMigratedFolders removes the migrated folders from the source account,
+// deepest first. Folders that were only recreated as ancestors are kept.
+func (service *GoogleDriveService) deleteMigratedFolders(ctx context.Context, job *MigrationJob) error {
+	folders := make([]MigrationItem, 0)
+	err := service.DB.WithContext(ctx).
+		Scopes(tenantScope).
+		Where("job_id = ? AND is_folder = ? AND is_ancestor = ?", job.ID, true, false).
+		Order("depth DESC").
+		Find(&folders).
+		Error
+	if err != nil {
+		return fmt.Errorf("failed to list migrated folders: %w", err)
+	}
+
+	for _, folder := range folders {
+		err := service.Delete(ctx, &DeleteResourceRequest{
+			UserID:     job.UserID,
+			Email:      job.SourceEmail,
+			ResourceID: folder.SourceFileID,
+		})
+		if err != nil && !errors.Is(err, ErrCatalogUpdate) && !isNotFoundError(err) {
+			return fmt.Errorf("error deleting source folder %s: %w", folder.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// RebalanceMove is a file moved from a full account to one with free space
+type RebalanceMove struct {
+	SourceEmail string `json:"source_email"`
+	TargetEmail string `json:"target_email"`
+	FileID      string `json:"file_id"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+}
+
+type RebalanceRequest struct {
+	UserID string `json:"user_id" validate:"required"`
+
+	// MaxUsagePercentage is the usage every account is brought under, defaults to
+	// the average usage across the accounts
+	MaxUsagePercentage float64 `json:"max_usage_percentage"`
+
+	// DryRun only plans the moves
+	DryRun bool `json:"dry_run"`
+
+	Mode        MigrationMode `json:"mode"`
+	Concurrency int           `json:"concurrency"`
+}
+
+type RebalanceResponse struct {
+	Moves []RebalanceMove `json:"moves"`
+	Jobs  []*MigrationJob `json:"jobs"`
+}
+
+// Rebalance moves files from the fullest accounts of the user to the emptiest,
+// until no account is above the usage threshold. Every source and target pair runs
+// as a migration job that deletes the moved files from the source.
+func (service *GoogleDriveService) Rebalance(ctx context.Context, req *RebalanceRequest) (*RebalanceResponse, error) {
+	if req.UserID == "" {
+		return nil, ErrInvalidUserID
+	}
+
+	accounts, err := service.listPoolAccounts(ctx, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]*drive.File, len(accounts))
+	for _, account := range accounts {
+		if account.StorageInfo.IsUnlimited || account.StorageInfo.Limit == 0 {
+			continue
+		}
+
+		list, err := service.listLargestFiles(ctx, req.UserID, account.Email)
+		if err != nil {
+			return nil, err
+		}
+		files[account.Email] = list
+	}
+
+	response := &RebalanceResponse{
+		Moves: planRebalance(accounts, files, req.MaxUsagePercentage),
+	}
+
+	if req.DryRun {
+		return response, nil
+	}
+
+	type pair struct{ source, target string }
+	grouped := make(map[pair][]string)
+	pairs := make([]pair, 0)
+
+	for _, move := range response.Moves {
+		key := pair{source: move.SourceEmail, target: move.TargetEmail}
+		if _, ok := grouped[key]; !ok {
+			pairs = append(pairs, key)
+		}
+		grouped[key] = append(grouped[key], move.FileID)
+	}
+
+	for _, key := range pairs {
+		job, err := service.MigrateAccount(ctx, &MigrateAccountRequest{
+			UserID:       req.UserID,
+			SourceEmail:  key.source,
+			TargetEmail:  key.target,
+			FileIDs:      grouped[key],
+			Mode:         req.Mode,
+			DeleteSource: true,
+			Concurrency:  req.Concurrency,
+		})
+		if job != nil {
+			response.Jobs = append(response.Jobs, job)
+		}
+		if err != nil {
+			return response, err
+		}
+	}
+
+	return response, nil
+}
+
+// listLargestFiles lists the files owned by the account that use storage, largest first
+func (service *GoogleDriveService) listLargestFiles(ctx context.Context, userID, email string) ([]*drive.File, error) {
+	srv, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: userID, Email: email})
+	if err != nil {
+		return nil, fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	q := fmt.Sprintf("'me' in owners and trashed = false and mimeType != '%s'", MimeTypeFolder)
+
+	response, err := retryCall(ctx, service.RetryPolicy, "files.list", true, func() (*drive.FileList, error) {
+		return srv.Files.List().SupportsAllDrives(true).IncludeItemsFromAllDrives(true).Q(q).
+			Spaces("drive").
+			OrderBy("quotaBytesUsed desc").
+			Fields("files(" + migrationFileFields + ")").
+			PageSize(1000).
+			Context(ctx).
+			Do()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing files of %s: %w", email, err)
+	}
+
+	return response.Files, nil
+}
+
+// planRebalance picks the largest files of every account above the threshold and
+// assigns each to the account with the most free space that stays under it
+func planRebalance(accounts []PoolAccount, files map[string][]*drive.File, maxUsagePercentage float64) []RebalanceMove {
+	usage := make(map[string]int64, len(accounts))
+	limits := make(map[string]int64, len(accounts))
+
+	var totalUsage, totalLimit int64
+	for _, account := range accounts {
+		if account.StorageInfo.IsUnlimited || account.StorageInfo.Limit == 0 {
+			continue
+		}
+		usage[account.Email] = account.StorageInfo.Usage
+		limits[account.Email] = account.StorageInfo.Limit
+		totalUsage += account.StorageInfo.Usage
+		totalLimit += account.StorageInfo.Limit
+	}
+
+	if totalLimit == 0 {
+		return nil
+	}
+
+	threshold := maxUsagePercentage / 100
+	if threshold <= 0 {
+		threshold = float64(totalUsage) / float64(totalLimit)
+	}
+
+	ceiling := func(email string) int64 {
+		return int64(threshold * float64(limits[email]))
+	}
+
+	emails := make([]string, 0, len(usage))
+	for email := range usage {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+
+	moves := make([]RebalanceMove, 0)
+	for _, source := range emails {
+		for _, file := range files[source] {
+			if usage[source] <= ceiling(source) {
+				break
+			}
+			if file.Size == 0 {
+				continue
+			}
+
+			var target string
+			var targetRoom int64
+			for _, candidate := range emails {
+				if candidate == source {
+					continue
+				}
+				if room := ceiling(candidate) - usage[candidate]; room >= file.Size && room > targetRoom {
+					target, targetRoom = candidate, room
+				}
+			}
+
+			if target == "" {
+				continue
+			}
+
+			usage[source] -= file.Size
+			usage[target] += file.Size
+			moves = append(moves, RebalanceMove{
+				SourceEmail: source,
+				TargetEmail: target,
+				FileID:      file.Id,
+				Name:        file.Name,
+				Size:        file.Size,
+			})
+		}
+	}
+
+	return moves
+}
@@ -0,0 +1,184 @@
+package fundrive
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/drive/v3"
+)
+
+// newMigrationFakeDrive serves a source folder with a file and a subfolder, and an
+// empty target folder
+func newMigrationFakeDrive(t *testing.T) (*fakeDrive, *GoogleDriveService) {
+	fake, service := newFakeDrive(t, []*drive.File{
+		{Id: "src", Name: "src", MimeType: MimeTypeFolder},
+		{Id: "dst", Name: "dst", MimeType: MimeTypeFolder},
+		{Id: "a", Name: "a.txt", MimeType: "text/plain", Parents: []string{"src"}},
+		{Id: "sub", Name: "sub", MimeType: MimeTypeFolder, Parents: []string{"src"}},
+		{Id: "b", Name: "b.txt", MimeType: "text/plain", Parents: []string{"sub"}},
+	}, map[string]string{"a": "alpha", "b": "bravo"})
+
+	service.DB = newTestDB(t, &MigrationJob{}, &MigrationItem{}, &PoolUpload{}, &StripedFile{}, &StripedPart{})
+	return fake, service
+}
+
+// migratedContent returns the content of the files below a target folder by path
+func (fake *fakeDrive) migratedContent(parentID, prefix string) map[string]string {
+	content := make(map[string]string)
+	for _, file := range fake.files {
+		if file.Trashed || len(file.Parents) == 0 || file.Parents[0] != parentID {
+			continue
+		}
+		if file.MimeType == MimeTypeFolder {
+			for name, data := range fake.migratedContent(file.Id, prefix+file.Name+"/") {
+				content[name] = data
+			}
+			continue
+		}
+		content[prefix+file.Name] = fake.content[file.Id]
+	}
+	return content
+}
+
+func TestPlanRebalance(t *testing.T) {
+	accounts := []PoolAccount{
+		{Email: "full@example.com", StorageInfo: StorageInfo{Limit: 100, Usage: 90}},
+		{Email: "empty@example.com", StorageInfo: StorageInfo{Limit: 100, Usage: 10}},
+	}
+
+	files := map[string][]*drive.File{
+		"full@example.com": {
+			{Id: "big", Name: "big.iso", Size: 70},
+			{Id: "medium", Name: "medium.zip", Size: 30},
+			{Id: "small", Name: "small.txt", Size: 5},
+			{Id: "doc", Name: "notes", Size: 0},
+		},
+	}
+
+	moves := planRebalance(accounts, files, 0)
+
+	// the average usage is 50%, the 70 byte file does not fit under it on the target
+	require.Len(t, moves, 2)
+	assert.Equal(t, RebalanceMove{
+		SourceEmail: "full@example.com",
+		TargetEmail: "empty@example.com",
+		FileID:      "medium",
+		Name:        "medium.zip",
+		Size:        30,
+	}, moves[0])
+	assert.Equal(t, "small", moves[1].FileID)
+
+	assert.Empty(t, planRebalance(accounts, files, 95))
+}
+
+func TestMigrateReferences(t *testing.T) {
+	db := newTestDB(t, &PoolUpload{}, &StripedFile{}, &StripedPart{})
+
+	require.NoError(t, db.Create(&PoolUpload{ID: "upload-1", UserID: "user-1", Email: "a@example.com", FileID: "file-1"}).Error)
+	require.NoError(t, db.Create(&StripedFile{ID: "striped-1", UserID: "user-1"}).Error)
+	require.NoError(t, db.Create(&StripedPart{ID: "part-1", StripedFileID: "striped-1", Email: "a@example.com", DriveFileID: "file-1"}).Error)
+
+	job := &MigrationJob{UserID: "user-1", SourceEmail: "a@example.com", TargetEmail: "b@example.com"}
+	require.NoError(t, migrateReferences(db, job, "file-1", "file-2"))
+
+	var upload PoolUpload
+	require.NoError(t, db.First(&upload, "id = ?", "upload-1").Error)
+	assert.Equal(t, "b@example.com", upload.Email)
+	assert.Equal(t, "file-2", upload.FileID)
+
+	var part StripedPart
+	require.NoError(t, db.First(&part, "id = ?", "part-1").Error)
+	assert.Equal(t, "b@example.com", part.Email)
+	assert.Equal(t, "file-2", part.DriveFileID)
+}
+
+func TestGoogleDriveService_MigrateAccount_DeleteSource(t *testing.T) {
+	fake, service := newMigrationFakeDrive(t)
+
+	// a source is only deleted once its item is recorded as completed
+	var deleted []string
+	fake.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodDelete {
+			id := strings.TrimPrefix(r.URL.Path, "/drive/v3/files/")
+			var item MigrationItem
+			require.NoError(t, service.DB.First(&item, "source_file_id = ?", id).Error)
+			assert.Equal(t, MigrationStatusCompleted, item.Status)
+			assert.NotEmpty(t, item.TargetFileID)
+			deleted = append(deleted, id)
+		}
+		return false
+	}
+
+	job, err := service.MigrateAccount(context.Background(), &MigrateAccountRequest{
+		UserID:         "user-1",
+		SourceEmail:    "a@example.com",
+		TargetEmail:    "b@example.com",
+		SourceFolderID: "src",
+		TargetParentID: "dst",
+		DeleteSource:   true,
+		Concurrency:    1,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, MigrationStatusCompleted, job.Status)
+	assert.Equal(t, 3, job.DoneItems)
+
+	// files go first, folders deepest first once every item is migrated
+	assert.Equal(t, []string{"a", "b", "sub"}, deleted)
+	assert.Equal(t, map[string]string{"a.txt": "alpha", "sub/b.txt": "bravo"}, fake.migratedContent("dst", ""))
+	assert.Empty(t, fake.migratedContent("src", ""))
+}
+
+func TestGoogleDriveService_ResumeMigration(t *testing.T) {
+	fake, service := newMigrationFakeDrive(t)
+	ctx := ContextWithTenant(context.Background(), "acme")
+
+	// listing the subfolder fails, the enumeration stops halfway
+	fake.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.Contains(r.URL.Query().Get("q"), "'sub' in parents") {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":{"code":500,"message":"backend error"}}`))
+			return true
+		}
+		return false
+	}
+
+	req := &MigrateAccountRequest{
+		UserID:         "user-1",
+		SourceEmail:    "a@example.com",
+		TargetEmail:    "b@example.com",
+		SourceFolderID: "src",
+		TargetParentID: "dst",
+	}
+	job, err := service.MigrateAccount(ctx, req)
+	require.Error(t, err)
+	assert.Equal(t, MigrationStatusFailed, job.Status)
+	assert.Nil(t, job.EnumeratedAt)
+	assert.Equal(t, "acme", job.TenantID)
+
+	// the job belongs to the tenant that started it
+	_, err = service.ResumeMigration(context.Background(), &ResumeMigrationRequest{UserID: "user-1", JobID: job.ID})
+	assert.ErrorIs(t, err, ErrMigrationJobNotFound)
+
+	// the resumed job enumerates again instead of completing without items
+	fake.intercept = nil
+	job, err = service.ResumeMigration(ctx, &ResumeMigrationRequest{UserID: "user-1", JobID: job.ID})
+	require.NoError(t, err)
+	assert.Equal(t, MigrationStatusCompleted, job.Status)
+	assert.NotNil(t, job.EnumeratedAt)
+	assert.Equal(t, 3, job.TotalItems)
+	assert.Equal(t, 3, job.DoneItems)
+
+	var items int64
+	require.NoError(t, service.DB.Model(&MigrationItem{}).Where("tenant_id = ?", "acme").Count(&items).Error)
+	assert.Equal(t, int64(3), items)
+
+	assert.Equal(t, map[string]string{"a.txt": "alpha", "sub/b.txt": "bravo"}, fake.migratedContent("dst", ""))
+	assert.Equal(t, map[string]string{"a.txt": "alpha", "sub/b.txt": "bravo"}, fake.migratedContent("src", ""))
+
+	_, err = service.ResumeMigration(ctx, &ResumeMigrationRequest{UserID: "user-1", JobID: job.ID})
+	assert.ErrorIs(t, err, ErrMigrationCompleted)
+}
@@ -12,13 +12,10 @@ const (
 )
 
 // getPermission returns the permission based on the permission type
-// default permission is public
+// default permission is public, private files get no extra permission
 func getPermission(permission Permission) *drive.Permission {
 	if permission == PrivatePermission {
-		return &drive.Permission{
-			Type: "anyone",
-			Role: "owner",
-		}
+		return nil
 	}
 	return &drive.Permission{
 		AllowFileDiscovery: true,
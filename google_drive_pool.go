@@ -0,0 +1,422 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	ErrNoPoolAccount = errors.New("no connected account can receive the upload")
+)
+
+// PoolPolicy selects the account that receives a pooled upload
+type PoolPolicy string
+
+const (
+	PoolPolicyMostFreeSpace     PoolPolicy = "most_free_space"
+	PoolPolicyRoundRobin        PoolPolicy = "round_robin"
+	PoolPolicyLeastRecentlyUsed PoolPolicy = "least_recently_used"
+)
+
+// PoolAccount is a connected account that can receive a pooled upload
+type PoolAccount struct {
+	Email       string      `json:"email"`
+	StorageInfo StorageInfo `json:"storage_info"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+}
+
+// HasRoomFor reports whether the account has enough free space for size bytes
+func (a *PoolAccount) HasRoomFor(size int64) bool {
+	return a.StorageInfo.IsUnlimited || a.StorageInfo.Remaining >= size
+}
+
+// PoolStrategy orders the candidate accounts of a pooled upload.
+// The upload is tried on the returned accounts in order.
+type PoolStrategy interface {
+	Rank(ctx context.Context, userID string, accounts []PoolAccount) ([]PoolAccount, error)
+}
+
+// PoolStrategyFunc adapts a function to PoolStrategy
+type PoolStrategyFunc func(ctx context.Context, userID string, accounts []PoolAccount) ([]PoolAccount, error)
+
+func (f PoolStrategyFunc) Rank(ctx context.Context, userID string, accounts []PoolAccount) ([]PoolAccount, error) {
+	return f(ctx, userID, accounts)
+}
+
+// PoolUpload records which account received a pooled upload
+type PoolUpload struct {
+	ID        string    `json:"id" gorm:"column:id;type:char(26);primaryKey"`
+	TenantID  string    `json:"tenant_id" gorm:"column:tenant_id;type:varchar(64);not null;default:'';index:idx_fundrive_pool_uploads_tenant_user"`
+	UserID    string    `json:"user_id" gorm:"column:user_id;type:varchar(255);index:idx_fundrive_pool_uploads_tenant_user"`
+	Email     string    `json:"email" gorm:"column:email;type:varchar(255)"`
+	FileID    string    `json:"file_id" gorm:"column:file_id;type:varchar(255)"`
+	FileName  string    `json:"file_name" gorm:"column:file_name;type:text"`
+	Size      int64     `json:"size" gorm:"column:size"`
+	CreatedAt time.Time `json:"created_at" gorm:"column:created_at"`
+}
+
+// TableName returns the table name
+func (p *PoolUpload) TableName() string {
+	return "fundrive_pool_uploads"
+}
+
+type UploadToPoolRequest struct {
+	UserID     string     `json:"user_id" validate:"required"`
+	FileName   string     `json:"file_name" validate:"required"`
+	MimeType   string     `json:"mime_type"`
+	FileData   io.Reader  `json:"file_data"`
+	FileSize   int64      `json:"file_size"`
+	Permission Permission `json:"permission"`
+
+	// Policy selects the account, defaults to PoolPolicyMostFreeSpace
+	Policy PoolPolicy `json:"policy"`
+
+	// Strategy overrides Policy with a custom selection
+	Strategy PoolStrategy `json:"-"`
+}
+
+func (r *UploadToPoolRequest) Validate() error {
+	if r.UserID == "" {
+		return ErrInvalidUserID
+	}
+	if r.FileName == "" {
+		return fmt.Errorf("file name is required")
+	}
+	if r.FileData == nil {
+		return fmt.Errorf("file data is required")
+	}
+	return nil
+}
+
+type UploadToPoolResponse struct {
+	Email    string      `json:"email"`
+	File     *drive.File `json:"file"`
+	UploadID string      `json:"upload_id"`
+}
+
+// isStorageQuotaError reports whether the upload failed because the account is full
+func isStorageQuotaError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+		return false
+	}
+
+	for _, item := range apiErr.Errors {
+		if item.Reason == "storageQuotaExceeded" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isNotFoundError reports whether the Drive resource does not exist
+func isNotFoundError(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// UploadToPool uploads a file to one of the user's connected accounts, selected by
+// the request policy. When the selected account runs out of storage, the upload
+// fails over to the next account; this requires FileData to be an io.Seeker.
+func (service *GoogleDriveService) UploadToPool(ctx context.Context, req *UploadToPoolRequest) (*UploadToPoolResponse, error) {
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid upload to pool request: %w", err)
+	}
+
+	accounts, err := service.listPoolAccounts(ctx, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]PoolAccount, 0, len(accounts))
+	for _, account := range accounts {
+		if account.HasRoomFor(req.FileSize) {
+			candidates = append(candidates, account)
+		}
+	}
+
+	strategy := req.Strategy
+	if strategy == nil {
+		strategy = service.poolStrategy(req.Policy)
+	}
+
+	ranked, err := strategy.Rank(ctx, req.UserID, candidates)
+	if err != nil {
+		return nil, fmt.Errorf("error ranking pool accounts: %w", err)
+	}
+
+	if len(ranked) == 0 {
+		return nil, ErrNoPoolAccount
+	}
+
+	// remember where the data starts so it can be sent again to the next account
+	seeker, seekable := req.FileData.(io.Seeker)
+	var offset int64
+	if seekable {
+		if offset, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seekable = false
+		}
+	}
+
+	var lastErr error
+	for i, account := range ranked {
+		if i > 0 {
+			if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+				return nil, fmt.Errorf("error rewinding file data: %w", err)
+			}
+		}
+
+		file, err := service.UploadFile(ctx, &UploadFileRequest{
+			UserID:     req.UserID,
+			Email:      account.Email,
+			FileName:   req.FileName,
+			MimeType:   req.MimeType,
+			FileData:   req.FileData,
+			Permission: req.Permission,
+		})
+		// the file is stored when only the catalog could not be updated
+		if err == nil || errors.Is(err, ErrCatalogUpdate) {
+			upload := PoolUpload{
+				ID:       ulid.Make().String(),
+				TenantID: TenantFromContext(ctx),
+				UserID:   req.UserID,
+				Email:    account.Email,
+				FileID:   file.Id,
+				FileName: file.Name,
+				Size:     req.FileSize,
+			}
+
+			if err := service.DB.WithContext(ctx).Create(&upload).Error; err != nil {
+				return nil, fmt.Errorf("failed to record pool upload: %w", err)
+			}
+
+			return &UploadToPoolResponse{
+				Email:    account.Email,
+				File:     file,
+				UploadID: upload.ID,
+			}, nil
+		}
+
+		lastErr = err
+		if !isStorageQuotaError(err) || !seekable {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("error uploading to pool: %w", lastErr)
+}
+
+// listPoolAccounts returns every connected account of the user with its storage info.
+// Accounts whose storage info cannot be read are skipped.
+func (service *GoogleDriveService) listPoolAccounts(ctx context.Context, userID string) ([]PoolAccount, error) {
+	tokens, err := service.OAuthService.ListUserTokens(ctx, &ListUserTokensRequest{UserID: userID})
+	if err != nil {
+		return nil, err
+	}
+
+	lastUsed, err := service.poolLastUsed(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mu       sync.Mutex
+		accounts = make([]PoolAccount, 0, len(tokens))
+	)
+
+	g, gCtx := errgroup.WithContext(ctx)
+
+	for _, token := range tokens {
+		email := token.Email
+
+		g.Go(func() error {
+			storageInfo, err := service.GetStorageInfo(gCtx, &GetStorageInfoRequest{
+				UserID: userID,
+				Email:  email,
+			})
+			if err != nil {
+				return nil
+			}
+
+			account := PoolAccount{
+				Email:       email,
+				StorageInfo: *storageInfo,
+			}
+			if usedAt, ok := lastUsed[email]; ok {
+				account.LastUsedAt = &usedAt
+			}
+
+			mu.Lock()
+			accounts = append(accounts, account)
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Email < accounts[j].Email
+	})
+
+	return accounts, nil
+}
+
+// poolLastUsed returns the time of the latest pooled upload per account
+func (service *GoogleDriveService) poolLastUsed(ctx context.Context, userID string) (map[string]time.Time, error) {
+	rows, err := service.DB.WithContext(ctx).
+		Model(&PoolUpload{}).
+		Select("email, MAX(created_at)").
+		Scopes(tenantScope).
+		Where("user_id = ?", userID).
+		Group("email").
+		Rows()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pool uploads: %w", err)
+	}
+	defer rows.Close()
+
+	lastUsed := make(map[string]time.Time)
+	for rows.Next() {
+		var (
+			email   string
+			created aggregateTime
+		)
+		if err := rows.Scan(&email, &created); err != nil {
+			return nil, fmt.Errorf("failed to read pool uploads: %w", err)
+		}
+		lastUsed[email] = created.Time
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read pool uploads: %w", err)
+	}
+
+	return lastUsed, nil
+}
+
+// aggregateTime scans the result of an aggregate on a time column, drivers like SQLite
+// return MAX(created_at) as a string instead of a time
+type aggregateTime struct {
+	time.Time
+}
+
+// aggregateTimeLayouts are the layouts drivers use for times returned as text
+var aggregateTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	time.RFC3339Nano,
+}
+
+func (t *aggregateTime) Scan(value any) error {
+	switch v := value.(type) {
+	case nil:
+		t.Time = time.Time{}
+		return nil
+	case time.Time:
+		t.Time = v
+		return nil
+	case []byte:
+		return t.parse(string(v))
+	case string:
+		return t.parse(v)
+	default:
+		return fmt.Errorf("unsupported time value %T", value)
+	}
+}
+
+func (t *aggregateTime) parse(value string) error {
+	for _, layout := range aggregateTimeLayouts {
+		parsed, err := time.Parse(layout, value)
+		if err == nil {
+			t.Time = parsed
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid time value %q", value)
+}
+
+func (service *GoogleDriveService) poolStrategy(policy PoolPolicy) PoolStrategy {
+	switch policy {
+	case PoolPolicyRoundRobin:
+		return PoolStrategyFunc(service.rankRoundRobin)
+	case PoolPolicyLeastRecentlyUsed:
+		return PoolStrategyFunc(rankLeastRecentlyUsed)
+	default:
+		return PoolStrategyFunc(rankMostFreeSpace)
+	}
+}
+
+// rankMostFreeSpace puts the account with the most remaining storage first
+func rankMostFreeSpace(_ context.Context, _ string, accounts []PoolAccount) ([]PoolAccount, error) {
+	ranked := append([]PoolAccount(nil), accounts...)
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i].StorageInfo, ranked[j].StorageInfo
+		if a.IsUnlimited != b.IsUnlimited {
+			return a.IsUnlimited
+		}
+		return a.Remaining > b.Remaining
+	})
+
+	return ranked, nil
+}
+
+// rankLeastRecentlyUsed puts the account that received a pooled upload the longest
+// time ago first, accounts that never received one come before all others
+func rankLeastRecentlyUsed(_ context.Context, _ string, accounts []PoolAccount) ([]PoolAccount, error) {
+	ranked := append([]PoolAccount(nil), accounts...)
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i].LastUsedAt, ranked[j].LastUsedAt
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		return a.Before(*b)
+	})
+
+	return ranked, nil
+}
+
+// poolCursorKey identifies the round robin cursor of a user of a tenant
+type poolCursorKey struct {
+	tenantID string
+	userID   string
+}
+
+// rankRoundRobin rotates the accounts of the user on every upload
+func (service *GoogleDriveService) rankRoundRobin(ctx context.Context, userID string, accounts []PoolAccount) ([]PoolAccount, error) {
+	if len(accounts) == 0 {
+		return accounts, nil
+	}
+
+	key := poolCursorKey{tenantID: TenantFromContext(ctx), userID: userID}
+
+	service.poolMu.Lock()
+	if service.poolCursors == nil {
+		service.poolCursors = make(map[poolCursorKey]int)
+	}
+	start := service.poolCursors[key] % len(accounts)
+	service.poolCursors[key] = start + 1
+	service.poolMu.Unlock()
+
+	ranked := make([]PoolAccount, 0, len(accounts))
+	ranked = append(ranked, accounts[start:]...)
+	ranked = append(ranked, accounts[:start]...)
+
+	return ranked, nil
+}
@@ -0,0 +1,184 @@
+package fundrive
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+func poolEmails(accounts []PoolAccount) []string {
+	emails := make([]string, 0, len(accounts))
+	for _, account := range accounts {
+		emails = append(emails, account.Email)
+	}
+	return emails
+}
+
+func TestPoolStrategies(t *testing.T) {
+	older := time.Now().Add(-time.Hour)
+	newer := time.Now()
+
+	accounts := []PoolAccount{
+		{Email: "a@example.com", StorageInfo: StorageInfo{Remaining: 100}, LastUsedAt: &newer},
+		{Email: "b@example.com", StorageInfo: StorageInfo{Remaining: 300}, LastUsedAt: &older},
+		{Email: "c@example.com", StorageInfo: StorageInfo{Remaining: 200}},
+	}
+
+	ctx := context.Background()
+
+	ranked, err := rankMostFreeSpace(ctx, "user-1", accounts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b@example.com", "c@example.com", "a@example.com"}, poolEmails(ranked))
+
+	ranked, err = rankLeastRecentlyUsed(ctx, "user-1", accounts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c@example.com", "b@example.com", "a@example.com"}, poolEmails(ranked))
+
+	service := &GoogleDriveService{}
+	strategy := service.poolStrategy(PoolPolicyRoundRobin)
+
+	var firsts []string
+	for i := 0; i < 4; i++ {
+		ranked, err := strategy.Rank(ctx, "user-1", accounts)
+		require.NoError(t, err)
+		require.Len(t, ranked, 3)
+		firsts = append(firsts, ranked[0].Email)
+	}
+	assert.Equal(t, []string{"a@example.com", "b@example.com", "c@example.com", "a@example.com"}, firsts)
+}
+
+func TestPoolAccount_HasRoomFor(t *testing.T) {
+	account := PoolAccount{StorageInfo: StorageInfo{Remaining: 10}}
+	assert.True(t, account.HasRoomFor(10))
+	assert.False(t, account.HasRoomFor(11))
+
+	unlimited := PoolAccount{StorageInfo: StorageInfo{IsUnlimited: true}}
+	assert.True(t, unlimited.HasRoomFor(1<<40))
+}
+
+func TestIsStorageQuotaError(t *testing.T) {
+	assert.True(t, isStorageQuotaError(&googleapi.Error{
+		Code:   http.StatusForbidden,
+		Errors: []googleapi.ErrorItem{{Reason: "storageQuotaExceeded"}},
+	}))
+	assert.False(t, isStorageQuotaError(&googleapi.Error{
+		Code:   http.StatusForbidden,
+		Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}},
+	}))
+}
+
+func TestGoogleDriveService_UploadToPool_LeastRecentlyUsed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/about"):
+			w.Write([]byte(`{"storageQuota":{"limit":"100","usage":"10"}}`))
+		case strings.HasSuffix(r.URL.Path, "/permissions"):
+			w.Write([]byte(`{"id":"anyone"}`))
+		default:
+			w.Write([]byte(`{"id":"file-1","name":"report.txt"}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	service := &GoogleDriveService{
+		OAuthService: &reportOAuthService{
+			stubOAuthService: newStubOAuthService(t),
+			emails:           []string{"a@example.com", "b@example.com"},
+		},
+		DB:            newTestDB(t, &PoolUpload{}),
+		RetryPolicy:   NoRetryPolicy(),
+		ClientOptions: []option.ClientOption{option.WithEndpoint(server.URL + "/drive/v3/")},
+	}
+	ctx := context.Background()
+
+	// the second upload reads the time of the first one back from the database
+	var emails []string
+	for range 2 {
+		response, err := service.UploadToPool(ctx, &UploadToPoolRequest{
+			UserID:   "user-1",
+			FileName: "report.txt",
+			FileData: strings.NewReader("data"),
+			FileSize: 4,
+			Policy:   PoolPolicyLeastRecentlyUsed,
+		})
+		require.NoError(t, err)
+		emails = append(emails, response.Email)
+	}
+	assert.ElementsMatch(t, []string{"a@example.com", "b@example.com"}, emails)
+
+	lastUsed, err := service.poolLastUsed(ctx, "user-1")
+	require.NoError(t, err)
+	require.Len(t, lastUsed, 2)
+	assert.False(t, lastUsed["a@example.com"].IsZero())
+
+	// the same user of another tenant has no pool history
+	lastUsed, err = service.poolLastUsed(ContextWithTenant(ctx, "acme"), "user-1")
+	require.NoError(t, err)
+	assert.Empty(t, lastUsed)
+}
+
+func TestGoogleDriveService_UploadToPool_CatalogFailure(t *testing.T) {
+	var uploads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/about"):
+			w.Write([]byte(`{"storageQuota":{"limit":"100","usage":"10"}}`))
+		case strings.HasSuffix(r.URL.Path, "/permissions"):
+			w.Write([]byte(`{"id":"anyone"}`))
+		default:
+			uploads.Add(1)
+			w.Write([]byte(`{"id":"file-1","name":"report.txt"}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	// the catalog table is missing, every catalog update fails
+	service := &GoogleDriveService{
+		OAuthService: &reportOAuthService{
+			stubOAuthService: newStubOAuthService(t),
+			emails:           []string{"a@example.com", "b@example.com"},
+		},
+		DB:            newTestDB(t, &PoolUpload{}),
+		IsUseCatalog:  true,
+		RetryPolicy:   NoRetryPolicy(),
+		ClientOptions: []option.ClientOption{option.WithEndpoint(server.URL + "/drive/v3/")},
+	}
+
+	response, err := service.UploadToPool(context.Background(), &UploadToPoolRequest{
+		UserID:   "user-1",
+		FileName: "report.txt",
+		FileData: strings.NewReader("data"),
+		FileSize: 4,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "file-1", response.File.Id)
+	assert.Equal(t, int32(1), uploads.Load())
+
+	var upload PoolUpload
+	require.NoError(t, service.DB.First(&upload, "id = ?", response.UploadID).Error)
+	assert.Equal(t, "file-1", upload.FileID)
+}
+
+func TestAggregateTime_Scan(t *testing.T) {
+	want := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+
+	for _, value := range []any{want, "2024-05-01 10:30:00+00:00", []byte("2024-05-01T10:30:00Z")} {
+		var got aggregateTime
+		require.NoError(t, got.Scan(value))
+		assert.True(t, want.Equal(got.Time), "%v", value)
+	}
+
+	var got aggregateTime
+	assert.Error(t, got.Scan("yesterday"))
+}
@@ -0,0 +1,231 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrRateLimited is returned when a request would exceed the client-side rate
+// limit and RateLimitConfig.FailFast is enabled
+var ErrRateLimited = errors.New("client-side rate limit exceeded")
+
+// RateLimitScope identifies which bucket delayed or rejected a request
+type RateLimitScope string
+
+const (
+	RateLimitScopeAccount RateLimitScope = "account"
+	RateLimitScopeGlobal  RateLimitScope = "global"
+)
+
+// RateLimitConfig configures the token buckets applied to every Drive request.
+// A zero QPS disables the corresponding bucket.
+type RateLimitConfig struct {
+	// PerAccountQPS limits requests per connected account (user_id, email)
+	PerAccountQPS   float64
+	PerAccountBurst int
+
+	// GlobalQPS limits requests per OAuth client across all accounts, accounts of the
+	// service account share its own limit
+	GlobalQPS   float64
+	GlobalBurst int
+
+	// FailFast returns ErrRateLimited instead of waiting for a token
+	FailFast bool
+
+	// OnWait is called whenever a request has to wait or is rejected
+	OnWait func(event RateLimitEvent)
+}
+
+// RateLimitEvent describes a request delayed or rejected by the rate limiter
+type RateLimitEvent struct {
+	ClientID string         `json:"client_id"`
+	UserID   string         `json:"user_id"`
+	Email    string         `json:"email"`
+	Scope    RateLimitScope `json:"scope"`
+	Wait     time.Duration  `json:"wait"`
+	Rejected bool           `json:"rejected"`
+}
+
+// RateLimitStats contains aggregated rate limiter metrics
+type RateLimitStats struct {
+	Requests  int64         `json:"requests"`
+	Waited    int64         `json:"waited"`
+	Rejected  int64         `json:"rejected"`
+	TotalWait time.Duration `json:"total_wait"`
+	MaxWait   time.Duration `json:"max_wait"`
+}
+
+// RateLimiter holds the per-account and per-client token buckets
+type RateLimiter struct {
+	config RateLimitConfig
+
+	mu       sync.Mutex
+	accounts map[string]*rate.Limiter
+	clients  map[string]*rate.Limiter
+	stats    RateLimitStats
+}
+
+// NewRateLimiter creates a new rate limiter
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		config:   config,
+		accounts: make(map[string]*rate.Limiter),
+		clients:  make(map[string]*rate.Limiter),
+	}
+}
+
+// Stats returns a snapshot of the limiter metrics
+func (l *RateLimiter) Stats() RateLimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.stats
+}
+
+func newBucket(qps float64, burst int) *rate.Limiter {
+	if burst <= 0 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(qps), burst)
+}
+
+// reserve takes a token from every configured bucket for the account
+func (l *RateLimiter) reserve(clientID, userID, email string) (map[RateLimitScope]*rate.Reservation, time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	reservations := make(map[RateLimitScope]*rate.Reservation, 2)
+
+	if l.config.PerAccountQPS > 0 {
+		key := userID + "\x00" + email
+		bucket, ok := l.accounts[key]
+		if !ok {
+			bucket = newBucket(l.config.PerAccountQPS, l.config.PerAccountBurst)
+			l.accounts[key] = bucket
+		}
+		reservations[RateLimitScopeAccount] = bucket.ReserveN(now, 1)
+	}
+
+	if l.config.GlobalQPS > 0 {
+		bucket, ok := l.clients[clientID]
+		if !ok {
+			bucket = newBucket(l.config.GlobalQPS, l.config.GlobalBurst)
+			l.clients[clientID] = bucket
+		}
+		reservations[RateLimitScopeGlobal] = bucket.ReserveN(now, 1)
+	}
+
+	return reservations, now
+}
+
+func (l *RateLimiter) record(wait time.Duration, rejected bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stats.Requests++
+	if rejected {
+		l.stats.Rejected++
+		return
+	}
+
+	if wait > 0 {
+		l.stats.Waited++
+		l.stats.TotalWait += wait
+		if wait > l.stats.MaxWait {
+			l.stats.MaxWait = wait
+		}
+	}
+}
+
+// Wait blocks until the account and its OAuth client may send another request
+func (l *RateLimiter) Wait(ctx context.Context, clientID, userID, email string) error {
+	reservations, now := l.reserve(clientID, userID, email)
+
+	var (
+		wait  time.Duration
+		scope RateLimitScope
+	)
+
+	for s, reservation := range reservations {
+		if !reservation.OK() {
+			l.cancel(reservations, now)
+			l.record(0, true)
+			return ErrRateLimited
+		}
+
+		if delay := reservation.DelayFrom(now); delay > wait {
+			wait = delay
+			scope = s
+		}
+	}
+
+	if wait == 0 {
+		l.record(0, false)
+		return nil
+	}
+
+	event := RateLimitEvent{
+		ClientID: clientID,
+		UserID:   userID,
+		Email:    email,
+		Scope:    scope,
+		Wait:     wait,
+		Rejected: l.config.FailFast,
+	}
+
+	if l.config.OnWait != nil {
+		l.config.OnWait(event)
+	}
+
+	if l.config.FailFast {
+		l.cancel(reservations, now)
+		l.record(0, true)
+		return ErrRateLimited
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		l.cancel(reservations, now)
+		l.record(0, true)
+		return ctx.Err()
+	case <-timer.C:
+	}
+
+	l.record(wait, false)
+	return nil
+}
+
+func (l *RateLimiter) cancel(reservations map[RateLimitScope]*rate.Reservation, now time.Time) {
+	for _, reservation := range reservations {
+		reservation.CancelAt(now)
+	}
+}
+
+// rateLimitTransport applies the rate limiter before every Drive HTTP request
+type rateLimitTransport struct {
+	base     http.RoundTripper
+	limiter  *RateLimiter
+	clientID string
+	userID   string
+	email    string
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context(), t.clientID, t.userID, t.email); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	return t.base.RoundTrip(req)
+}
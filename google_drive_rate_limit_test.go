@@ -0,0 +1,114 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestRateLimiter_FailFast(t *testing.T) {
+	var events []RateLimitEvent
+
+	limiter := NewRateLimiter(RateLimitConfig{
+		PerAccountQPS:   1,
+		PerAccountBurst: 1,
+		FailFast:        true,
+		OnWait: func(event RateLimitEvent) {
+			events = append(events, event)
+		},
+	})
+
+	ctx := context.Background()
+
+	require.NoError(t, limiter.Wait(ctx, "client", "user-1", "a@example.com"))
+
+	err := limiter.Wait(ctx, "client", "user-1", "a@example.com")
+	assert.True(t, errors.Is(err, ErrRateLimited))
+
+	// other accounts have their own bucket
+	require.NoError(t, limiter.Wait(ctx, "client", "user-1", "b@example.com"))
+
+	require.Len(t, events, 1)
+	assert.Equal(t, RateLimitScopeAccount, events[0].Scope)
+	assert.True(t, events[0].Rejected)
+
+	stats := limiter.Stats()
+	assert.Equal(t, int64(3), stats.Requests)
+	assert.Equal(t, int64(1), stats.Rejected)
+}
+
+func TestRateLimiter_GlobalWait(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{
+		GlobalQPS:   50,
+		GlobalBurst: 1,
+	})
+
+	ctx := context.Background()
+
+	start := time.Now()
+	require.NoError(t, limiter.Wait(ctx, "client", "user-1", "a@example.com"))
+	require.NoError(t, limiter.Wait(ctx, "client", "user-2", "b@example.com"))
+	assert.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+
+	stats := limiter.Stats()
+	assert.Equal(t, int64(2), stats.Requests)
+	assert.Equal(t, int64(1), stats.Waited)
+	assert.Greater(t, stats.TotalWait, time.Duration(0))
+}
+
+func TestRateLimiter_ContextCanceled(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{
+		PerAccountQPS:   0.001,
+		PerAccountBurst: 1,
+	})
+
+	require.NoError(t, limiter.Wait(context.Background(), "client", "user-1", "a@example.com"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := limiter.Wait(ctx, "client", "user-1", "a@example.com")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestGoogleDriveService_RateLimitPerOAuthClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+
+	service := &GoogleDriveService{
+		OauthConfig: &oauth2.Config{ClientID: "default-client"},
+		RateLimiter: NewRateLimiter(RateLimitConfig{GlobalQPS: 0.001, GlobalBurst: 1, FailFast: true}),
+	}
+	ctx := context.Background()
+
+	send := func(email, clientID string) error {
+		token := &oauth2.Token{AccessToken: "access-token", Expiry: time.Now().Add(time.Hour)}
+		if clientID != "" {
+			token = token.WithExtra(map[string]any{tokenClientIDExtra: clientID})
+		}
+
+		client, err := service.newTokenClient(ctx, &newTokenServiceRequest{UserID: "user-1", Email: email, Token: token})
+		require.NoError(t, err)
+
+		resp, err := client.httpClient.Get(server.URL)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	// the accounts of each OAuth client share the global bucket of the client
+	require.NoError(t, send("a@example.com", "byo-client"))
+	require.NoError(t, send("b@example.com", ""))
+	assert.ErrorIs(t, send("c@example.com", "byo-client"), ErrRateLimited)
+	assert.ErrorIs(t, send("d@example.com", "default-client"), ErrRateLimited)
+}
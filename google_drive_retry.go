@@ -0,0 +1,257 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// RetryPolicy controls how Drive requests are retried on transient failures
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	// A value of 1 or less disables retries.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the computed backoff delay
+	MaxBackoff time.Duration
+
+	// Multiplier is applied to the backoff after every attempt
+	Multiplier float64
+
+	// Jitter randomizes the delay by up to the given fraction (0..1)
+	Jitter float64
+
+	// RetryNonIdempotent allows non-idempotent requests (e.g. files.create) to be
+	// retried on server errors. Rate limit errors are always retried because
+	// Google rejects those requests before processing them.
+	RetryNonIdempotent bool
+
+	// OnRetry is called before sleeping for the next attempt
+	OnRetry func(event RetryEvent)
+}
+
+// RetryEvent describes a retry that is about to happen
+type RetryEvent struct {
+	Operation string        `json:"operation"`
+	Attempt   int           `json:"attempt"`
+	Delay     time.Duration `json:"delay"`
+	Err       error         `json:"-"`
+}
+
+// DefaultRetryPolicy returns the retry policy used when none is configured
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// NoRetryPolicy returns a policy that never retries
+func NoRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 1}
+}
+
+// backoff returns the delay before the given retry attempt (1-based)
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		delay *= p.Multiplier
+		if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+			delay = float64(p.MaxBackoff)
+			break
+		}
+	}
+
+	if p.Jitter > 0 {
+		delay -= delay * p.Jitter * rand.Float64()
+	}
+
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+
+	return time.Duration(delay)
+}
+
+// isRateLimitError reports whether Google rejected the request because of a quota
+func isRateLimitError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	if apiErr.Code == http.StatusTooManyRequests {
+		return true
+	}
+
+	if apiErr.Code == http.StatusForbidden {
+		for _, item := range apiErr.Errors {
+			switch item.Reason {
+			case "userRateLimitExceeded", "rateLimitExceeded":
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isTransientError reports whether the request may succeed when sent again
+func isTransientError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if errors.Is(err, ErrRateLimited) {
+		return false
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryAfter returns the delay requested by the server through the Retry-After header
+func retryAfter(err error) (time.Duration, bool) {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Header == nil {
+		return 0, false
+	}
+
+	value := apiErr.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+
+	return 0, false
+}
+
+// shouldRetry decides if a failed call can be sent again
+func (p RetryPolicy) shouldRetry(err error, idempotent bool) bool {
+	if isRateLimitError(err) {
+		return true
+	}
+
+	if !idempotent && !p.RetryNonIdempotent {
+		return false
+	}
+
+	return isTransientError(err)
+}
+
+// retryCall executes call and retries it according to the policy.
+// Idempotent marks requests that are safe to send more than once.
+func retryCall[T any](
+	ctx context.Context,
+	policy RetryPolicy,
+	operation string,
+	idempotent bool,
+	call func() (T, error),
+) (T, error) {
+	var attempt int
+
+	for {
+		attempt++
+
+		result, err := call()
+		if err == nil {
+			return result, nil
+		}
+
+		if attempt >= policy.MaxAttempts || !policy.shouldRetry(err, idempotent) {
+			return result, wrapScopeError(err)
+		}
+
+		delay := policy.backoff(attempt)
+		if after, ok := retryAfter(err); ok {
+			delay = after
+		}
+
+		if policy.OnRetry != nil {
+			policy.OnRetry(RetryEvent{
+				Operation: operation,
+				Attempt:   attempt,
+				Delay:     delay,
+				Err:       err,
+			})
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result, err
+		case <-timer.C:
+		}
+	}
+}
+
+// retryDo is retryCall for requests without a response body
+func retryDo(ctx context.Context, policy RetryPolicy, operation string, idempotent bool, call func() error) error {
+	_, err := retryCall(ctx, policy, operation, idempotent, func() (struct{}, error) {
+		return struct{}{}, call()
+	})
+	return err
+}
+
+// replayableBody prepares a request body for retries. The returned function
+// moves the body back to its current position before every attempt. Retries are
+// disabled when the body cannot be replayed.
+func replayableBody(policy RetryPolicy, body io.Reader) (RetryPolicy, func() error) {
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		policy.MaxAttempts = 1
+		return policy, func() error { return nil }
+	}
+
+	offset, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		policy.MaxAttempts = 1
+		return policy, func() error { return nil }
+	}
+
+	return policy, func() error {
+		_, err := seeker.Seek(offset, io.SeekStart)
+		return err
+	}
+}
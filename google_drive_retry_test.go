@@ -0,0 +1,166 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+)
+
+func testRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		Multiplier:     2,
+	}
+}
+
+func TestRetryCall(t *testing.T) {
+	rateLimited := &googleapi.Error{
+		Code:   http.StatusForbidden,
+		Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}},
+	}
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	notFound := &googleapi.Error{Code: http.StatusNotFound}
+
+	tests := []struct {
+		name         string
+		idempotent   bool
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{
+			name:         "success on first attempt",
+			idempotent:   true,
+			errs:         []error{nil},
+			wantAttempts: 1,
+		},
+		{
+			name:         "idempotent request retried on server error",
+			idempotent:   true,
+			errs:         []error{unavailable, unavailable, nil},
+			wantAttempts: 3,
+		},
+		{
+			name:         "non-idempotent request not retried on server error",
+			idempotent:   false,
+			errs:         []error{unavailable, nil},
+			wantAttempts: 1,
+			wantErr:      unavailable,
+		},
+		{
+			name:         "non-idempotent request retried on rate limit",
+			idempotent:   false,
+			errs:         []error{rateLimited, nil},
+			wantAttempts: 2,
+		},
+		{
+			name:         "permanent error not retried",
+			idempotent:   true,
+			errs:         []error{notFound, nil},
+			wantAttempts: 1,
+			wantErr:      notFound,
+		},
+		{
+			name:         "gives up after max attempts",
+			idempotent:   true,
+			errs:         []error{unavailable, unavailable, unavailable, nil},
+			wantAttempts: 3,
+			wantErr:      unavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				attempts int
+				retries  []RetryEvent
+			)
+
+			policy := testRetryPolicy()
+			policy.OnRetry = func(event RetryEvent) {
+				retries = append(retries, event)
+			}
+
+			result, err := retryCall(context.Background(), policy, "files.get", tt.idempotent, func() (string, error) {
+				err := tt.errs[attempts]
+				attempts++
+				if err != nil {
+					return "", err
+				}
+				return "ok", nil
+			})
+
+			assert.Equal(t, tt.wantAttempts, attempts)
+			assert.Len(t, retries, tt.wantAttempts-1)
+
+			if tt.wantErr != nil {
+				require.Error(t, err)
+				assert.True(t, errors.Is(err, tt.wantErr))
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "ok", result)
+		})
+	}
+}
+
+func TestRetryCall_ContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	policy := testRetryPolicy()
+	policy.InitialBackoff = time.Hour
+	policy.OnRetry = func(RetryEvent) { cancel() }
+
+	var attempts int
+	err := retryDo(ctx, policy, "files.list", true, func() error {
+		attempts++
+		return &googleapi.Error{Code: http.StatusInternalServerError}
+	})
+
+	require.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryAfter(t *testing.T) {
+	delay, ok := retryAfter(&googleapi.Error{
+		Code:   http.StatusTooManyRequests,
+		Header: http.Header{"Retry-After": []string{"7"}},
+	})
+	require.True(t, ok)
+	assert.Equal(t, 7*time.Second, delay)
+
+	_, ok = retryAfter(&googleapi.Error{Code: http.StatusTooManyRequests})
+	assert.False(t, ok)
+
+	_, ok = retryAfter(errors.New("plain error"))
+	assert.False(t, ok)
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+
+	assert.Equal(t, 100*time.Millisecond, policy.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, policy.backoff(2))
+	assert.Equal(t, 400*time.Millisecond, policy.backoff(3))
+	assert.Equal(t, time.Second, policy.backoff(10))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 20; i++ {
+		delay := policy.backoff(2)
+		assert.GreaterOrEqual(t, delay, 100*time.Millisecond)
+		assert.LessOrEqual(t, delay, 200*time.Millisecond)
+	}
+}
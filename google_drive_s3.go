@@ -0,0 +1,1043 @@
+package fundrive
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	s3Namespace       = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+	s3MaxKeys         = 1000
+
+	// s3MaxClockSkew is how far the request date may be from the gateway clock
+	s3MaxClockSkew = 15 * time.Minute
+)
+
+// DefaultS3UploadTTL is how long an incomplete multipart upload is kept
+const DefaultS3UploadTTL = 24 * time.Hour
+
+// ErrS3AccessKeyNotFound is returned by an S3CredentialsProvider for an unknown access key
+var ErrS3AccessKeyNotFound = errors.New("s3 access key not found")
+
+// S3Credentials are the keys of an S3 client and the Drive account they give access to
+type S3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	UserID          string
+	Email           string
+
+	// RootFolderID is the folder whose subfolders are the buckets, defaults to the root of My Drive
+	RootFolderID string
+}
+
+// S3CredentialsProvider returns the credentials of an access key, or ErrS3AccessKeyNotFound
+type S3CredentialsProvider func(ctx context.Context, accessKeyID string) (*S3Credentials, error)
+
+// S3Gateway serves a subset of the S3 API over the Drive account of the signing
+// credentials. Buckets are the folders below the root folder and object keys are
+// paths inside them, so keys must be valid slash separated paths. Requests are
+// authenticated with AWS Signature Version 4 and must use path-style addressing,
+// with the gateway mounted at the root of its host. Multipart uploads are staged on
+// the local disk until they are completed or expire. Uploads are tracked in memory,
+// an upload started on another instance or before a restart is unknown.
+type S3Gateway struct {
+	service     *GoogleDriveService
+	credentials S3CredentialsProvider
+	uploadTTL   time.Duration
+	stagingDir  string
+
+	mu      sync.Mutex
+	uploads map[string]*s3MultipartUpload
+}
+
+type s3MultipartUpload struct {
+	owner     string
+	bucket    string
+	key       string
+	dir       string
+	parts     map[int]s3Part
+	createdAt time.Time
+}
+
+type s3Part struct {
+	etag string
+}
+
+// S3GatewayOption configures an S3Gateway
+type S3GatewayOption func(*S3Gateway)
+
+// WithS3UploadTTL sets how long an incomplete multipart upload is kept before its
+// parts are removed, defaults to DefaultS3UploadTTL
+func WithS3UploadTTL(ttl time.Duration) S3GatewayOption {
+	return func(gateway *S3Gateway) {
+		gateway.uploadTTL = ttl
+	}
+}
+
+// WithS3StagingDir sets the directory multipart uploads are staged in, defaults to
+// fundrive-s3 in the temporary directory
+func WithS3StagingDir(dir string) S3GatewayOption {
+	return func(gateway *S3Gateway) {
+		gateway.stagingDir = dir
+	}
+}
+
+// NewS3Gateway returns a gateway and removes the expired uploads a previous run
+// left in the staging directory
+func NewS3Gateway(service *GoogleDriveService, credentials S3CredentialsProvider, opts ...S3GatewayOption) *S3Gateway {
+	gateway := &S3Gateway{
+		service:     service,
+		credentials: credentials,
+		uploadTTL:   DefaultS3UploadTTL,
+		stagingDir:  filepath.Join(os.TempDir(), "fundrive-s3"),
+		uploads:     make(map[string]*s3MultipartUpload),
+	}
+	for _, opt := range opts {
+		opt(gateway)
+	}
+
+	gateway.removeStaleUploads()
+	return gateway
+}
+
+// removeStaleUploads removes the staged uploads not written to within the upload TTL.
+// The staging directory may be shared with other instances, so recent uploads are kept
+func (gateway *S3Gateway) removeStaleUploads() {
+	entries, err := os.ReadDir(gateway.stagingDir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err == nil && time.Since(info.ModTime()) > gateway.uploadTTL {
+			os.RemoveAll(filepath.Join(gateway.stagingDir, entry.Name()))
+		}
+	}
+}
+
+// expireUploads forgets the uploads older than the upload TTL and returns their
+// staging directories. It must be called with the lock held
+func (gateway *S3Gateway) expireUploads(now time.Time) []string {
+	var dirs []string
+	for uploadID, upload := range gateway.uploads {
+		if now.Sub(upload.createdAt) > gateway.uploadTTL {
+			delete(gateway.uploads, uploadID)
+			dirs = append(dirs, upload.dir)
+		}
+	}
+	return dirs
+}
+
+// s3Error is an S3 error response
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Status   int      `xml:"-"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newS3Error(status int, code, message string) *s3Error {
+	return &s3Error{Status: status, Code: code, Message: message}
+}
+
+var (
+	errS3AccessDenied         = newS3Error(http.StatusForbidden, "AccessDenied", "Access Denied")
+	errS3InvalidAccessKeyID   = newS3Error(http.StatusForbidden, "InvalidAccessKeyId", "The access key does not exist")
+	errS3SignatureMismatch    = newS3Error(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature does not match")
+	errS3RequestTimeTooSkewed = newS3Error(http.StatusForbidden, "RequestTimeTooSkewed", "The request time is too far from the server time")
+	errS3DigestMismatch       = newS3Error(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The payload does not match x-amz-content-sha256")
+	errS3NoSuchBucket         = newS3Error(http.StatusNotFound, "NoSuchBucket", "The bucket does not exist")
+	errS3NoSuchKey            = newS3Error(http.StatusNotFound, "NoSuchKey", "The key does not exist")
+	errS3NoSuchUpload         = newS3Error(http.StatusNotFound, "NoSuchUpload", "The multipart upload does not exist")
+	errS3InvalidKey           = newS3Error(http.StatusBadRequest, "InvalidArgument", "Object keys must be slash separated paths")
+	errS3InvalidPart          = newS3Error(http.StatusBadRequest, "InvalidPart", "A part is missing or its ETag does not match")
+	errS3InvalidPartOrder     = newS3Error(http.StatusBadRequest, "InvalidPartOrder", "Parts must be listed in ascending order")
+	errS3MalformedXML         = newS3Error(http.StatusBadRequest, "MalformedXML", "The request body is not valid XML")
+	errS3BucketExists         = newS3Error(http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket already exists")
+	errS3NotImplemented       = newS3Error(http.StatusNotImplemented, "NotImplemented", "The request is not supported by the gateway")
+)
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	var s3Err *s3Error
+	switch {
+	case errors.As(err, &s3Err):
+	case errors.Is(err, fs.ErrNotExist):
+		s3Err = errS3NoSuchKey
+	default:
+		s3Err = newS3Error(http.StatusInternalServerError, "InternalError", err.Error())
+	}
+
+	response := *s3Err
+	response.Resource = r.URL.Path
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(response.Status)
+	if r.Method != http.MethodHead {
+		io.WriteString(w, xml.Header)
+		xml.NewEncoder(w).Encode(&response)
+	}
+}
+
+func writeS3XML(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(body)
+}
+
+// s3Request is an authenticated request with its bucket and key
+type s3Request struct {
+	*http.Request
+	credentials *S3Credentials
+	vfs         *DriveVFS
+	bucket      string
+	key         string
+	payloadHash string
+}
+
+func (gateway *S3Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := gateway.serve(w, r); err != nil {
+		writeS3Error(w, r, err)
+	}
+}
+
+func (gateway *S3Gateway) serve(w http.ResponseWriter, r *http.Request) error {
+	credentials, payloadHash, err := gateway.authenticate(r)
+	if err != nil {
+		return err
+	}
+
+	vfs, err := gateway.service.VFS(r.Context(), &VFSRequest{
+		FSRequest: FSRequest{UserID: credentials.UserID, Email: credentials.Email, FolderID: credentials.RootFolderID},
+	})
+	if err != nil {
+		return err
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	req := &s3Request{Request: r, credentials: credentials, vfs: vfs, bucket: bucket, key: key, payloadHash: payloadHash}
+
+	query := r.URL.Query()
+	switch {
+	case bucket == "":
+		if r.Method != http.MethodGet {
+			return errS3NotImplemented
+		}
+		return gateway.listBuckets(w, req)
+
+	case key == "":
+		switch r.Method {
+		case http.MethodGet:
+			return gateway.listObjects(w, req)
+		case http.MethodHead:
+			return gateway.headBucket(w, req)
+		case http.MethodPut:
+			return gateway.createBucket(w, req)
+		}
+
+	default:
+		if !fs.ValidPath(path.Join(bucket, key)) || path.Join(bucket, key) != bucket+"/"+key {
+			return errS3InvalidKey
+		}
+
+		switch {
+		case r.Method == http.MethodPost && query.Has("uploads"):
+			return gateway.createMultipartUpload(w, req)
+		case r.Method == http.MethodPut && query.Has("uploadId"):
+			return gateway.uploadPart(w, req)
+		case r.Method == http.MethodPost && query.Has("uploadId"):
+			return gateway.completeMultipartUpload(w, req)
+		case r.Method == http.MethodDelete && query.Has("uploadId"):
+			return gateway.abortMultipartUpload(w, req)
+		case r.Method == http.MethodGet, r.Method == http.MethodHead:
+			return gateway.getObject(w, req)
+		case r.Method == http.MethodPut:
+			return gateway.putObject(w, req)
+		case r.Method == http.MethodDelete:
+			return gateway.deleteObject(w, req)
+		}
+	}
+
+	return errS3NotImplemented
+}
+
+// authenticate verifies the Signature Version 4 Authorization header and returns the
+// credentials and the declared payload hash
+func (gateway *S3Gateway) authenticate(r *http.Request) (*S3Credentials, string, error) {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, s3Algorithm+" ") {
+		return nil, "", errS3AccessDenied
+	}
+
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(authorization, s3Algorithm+" "), ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		fields[key] = value
+	}
+
+	accessKeyID, scope, ok := strings.Cut(fields["Credential"], "/")
+	if !ok || fields["SignedHeaders"] == "" || fields["Signature"] == "" {
+		return nil, "", errS3AccessDenied
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	signedAt, err := time.Parse(s3TimeFormat, amzDate)
+	if err != nil || !strings.HasPrefix(scope, amzDate[:8]+"/") {
+		return nil, "", errS3AccessDenied
+	}
+	if skew := time.Since(signedAt); skew > s3MaxClockSkew || skew < -s3MaxClockSkew {
+		return nil, "", errS3RequestTimeTooSkewed
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if strings.HasPrefix(payloadHash, "STREAMING-") {
+		return nil, "", errS3NotImplemented
+	}
+	if payloadHash == "" {
+		return nil, "", errS3AccessDenied
+	}
+
+	credentials, err := gateway.credentials(r.Context(), accessKeyID)
+	if errors.Is(err, ErrS3AccessKeyNotFound) {
+		return nil, "", errS3InvalidAccessKeyID
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	signature := s3Signature(credentials.SecretAccessKey, r, signedHeaders, payloadHash, amzDate, scope)
+	if !hmac.Equal([]byte(signature), []byte(fields["Signature"])) {
+		return nil, "", errS3SignatureMismatch
+	}
+
+	return credentials, payloadHash, nil
+}
+
+// s3Signature computes the Signature Version 4 of a request
+func s3Signature(secret string, r *http.Request, signedHeaders []string, payloadHash, amzDate, scope string) string {
+	canonicalRequest := s3CanonicalRequest(r, signedHeaders, payloadHash)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(scope, "/") {
+		key = s3HMAC(key, part)
+	}
+
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3CanonicalRequest(r *http.Request, signedHeaders []string, payloadHash string) string {
+	uri := s3URIEncode(r.URL.Path, false)
+	if uri == "" {
+		uri = "/"
+	}
+
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	params := make([]string, 0, len(query))
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, s3URIEncode(key, true)+"="+s3URIEncode(value, true))
+		}
+	}
+
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = strconv.FormatInt(r.ContentLength, 10)
+		default:
+			value = strings.Join(r.Header.Values(name), ",")
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		uri,
+		strings.Join(params, "&"),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// s3URIEncode encodes everything but unreserved characters, and slashes unless encodeSlash is set
+func s3URIEncode(value string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// verifyPayload wraps the request body to compare its hash with x-amz-content-sha256
+type verifyPayload struct {
+	io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+func newVerifyPayload(req *s3Request) *verifyPayload {
+	h := sha256.New()
+	return &verifyPayload{Reader: io.TeeReader(req.Body, h), hash: h, expected: req.payloadHash}
+}
+
+func (v *verifyPayload) verify() error {
+	if v.expected == s3UnsignedPayload {
+		return nil
+	}
+	if hex.EncodeToString(v.hash.Sum(nil)) != v.expected {
+		return errS3DigestMismatch
+	}
+	return nil
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func (gateway *S3Gateway) listBuckets(w http.ResponseWriter, req *s3Request) error {
+	entries, err := req.vfs.ReadDir(".")
+	if err != nil {
+		return err
+	}
+
+	result := s3ListBucketsResult{
+		Xmlns:   s3Namespace,
+		Owner:   s3Owner{ID: req.credentials.UserID, DisplayName: req.credentials.Email},
+		Buckets: make([]s3Bucket, 0),
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		result.Buckets = append(result.Buckets, s3Bucket{Name: entry.Name(), CreationDate: s3Time(info.ModTime())})
+	}
+
+	writeS3XML(w, http.StatusOK, &result)
+	return nil
+}
+
+// bucketInfo returns the folder of the bucket, or errS3NoSuchBucket
+func (req *s3Request) bucketInfo() (fs.FileInfo, error) {
+	if !fs.ValidPath(req.bucket) || strings.Contains(req.bucket, "/") {
+		return nil, errS3NoSuchBucket
+	}
+
+	info, err := req.vfs.Stat(req.bucket)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !info.IsDir()) {
+		return nil, errS3NoSuchBucket
+	}
+	return info, err
+}
+
+func (gateway *S3Gateway) headBucket(w http.ResponseWriter, req *s3Request) error {
+	if _, err := req.bucketInfo(); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (gateway *S3Gateway) createBucket(w http.ResponseWriter, req *s3Request) error {
+	if !fs.ValidPath(req.bucket) {
+		return errS3InvalidKey
+	}
+
+	err := req.vfs.Mkdir(req.bucket, 0o755)
+	if errors.Is(err, fs.ErrExist) {
+		return errS3BucketExists
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Location", "/"+req.bucket)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListObjectsResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// s3ListEntry is an object or a common prefix, listed together in key order
+type s3ListEntry struct {
+	key    string
+	object *s3Object
+}
+
+func (gateway *S3Gateway) listObjects(w http.ResponseWriter, req *s3Request) error {
+	if _, err := req.bucketInfo(); err != nil {
+		return err
+	}
+
+	query := req.URL.Query()
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+
+	maxKeys := s3MaxKeys
+	if value := query.Get("max-keys"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return newS3Error(http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer")
+		}
+		maxKeys = min(parsed, s3MaxKeys)
+	}
+
+	marker := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return newS3Error(http.StatusBadRequest, "InvalidArgument", "The continuation token is not valid")
+		}
+		marker = string(decoded)
+	}
+
+	entries, err := gateway.listBucket(req, prefix, delimiter)
+	if err != nil {
+		return err
+	}
+
+	result := s3ListObjectsResult{
+		Xmlns:             s3Namespace,
+		Name:              req.bucket,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		ContinuationToken: query.Get("continuation-token"),
+		StartAfter:        query.Get("start-after"),
+		Contents:          make([]s3Object, 0),
+		CommonPrefixes:    make([]s3CommonPrefix, 0),
+	}
+
+	for _, entry := range entries {
+		if entry.key <= marker {
+			continue
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+
+		if entry.object != nil {
+			result.Contents = append(result.Contents, *entry.object)
+		} else {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: entry.key})
+		}
+		result.KeyCount++
+		marker = entry.key
+	}
+
+	if result.IsTruncated {
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(marker))
+	}
+
+	writeS3XML(w, http.StatusOK, &result)
+	return nil
+}
+
+// listBucket walks the bucket folder from the folder of the prefix and returns the
+// objects and common prefixes matching the prefix in key order. With the "/"
+// delimiter, folders below the prefix are reported as common prefixes without being
+// listed, even when they are empty.
+func (gateway *S3Gateway) listBucket(req *s3Request, prefix, delimiter string) ([]s3ListEntry, error) {
+	entries := make([]s3ListEntry, 0)
+	seen := make(map[string]struct{})
+
+	addPrefix := func(key string) {
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			entries = append(entries, s3ListEntry{key: key})
+		}
+	}
+
+	// keys below the prefix are inside the folder of its last complete segment
+	start := req.bucket
+	if index := strings.LastIndex(prefix, "/"); index > 0 {
+		start = req.bucket + "/" + prefix[:index]
+	}
+	if !fs.ValidPath(start) {
+		return entries, nil
+	}
+
+	err := fs.WalkDir(req.vfs, start, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == start && start != req.bucket && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if name == start {
+			return nil
+		}
+
+		key := strings.TrimPrefix(name, req.bucket+"/")
+
+		if d.IsDir() {
+			dirKey := key + "/"
+			if !strings.HasPrefix(dirKey, prefix) && !strings.HasPrefix(prefix, dirKey) {
+				return fs.SkipDir
+			}
+			if delimiter == "/" && strings.HasPrefix(dirKey, prefix) {
+				rest := dirKey[len(prefix):]
+				addPrefix(prefix + rest[:strings.Index(rest, "/")+1])
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		if delimiter != "" {
+			if index := strings.Index(key[len(prefix):], delimiter); index >= 0 {
+				addPrefix(key[:len(prefix)+index+len(delimiter)])
+				return nil
+			}
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, s3ListEntry{key: key, object: &s3Object{
+			Key:          key,
+			LastModified: s3Time(info.ModTime()),
+			ETag:         s3ETag(info),
+			Size:         info.Size(),
+			StorageClass: "STANDARD",
+		}})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, nil
+}
+
+// s3ETag returns the quoted MD5 checksum Drive computed for a file
+func s3ETag(info fs.FileInfo) string {
+	if file, ok := info.Sys().(*drive.File); ok && file.Md5Checksum != "" {
+		return `"` + file.Md5Checksum + `"`
+	}
+	return ""
+}
+
+func (req *s3Request) objectName() string {
+	return req.bucket + "/" + req.key
+}
+
+func (gateway *S3Gateway) getObject(w http.ResponseWriter, req *s3Request) error {
+	if _, err := req.bucketInfo(); err != nil {
+		return err
+	}
+
+	f, err := req.vfs.Open(req.objectName())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	content, ok := f.(io.ReadSeeker)
+	if info.IsDir() || !ok {
+		return errS3NoSuchKey
+	}
+
+	if file, ok := info.Sys().(*drive.File); ok && file.MimeType != "" {
+		w.Header().Set("Content-Type", file.MimeType)
+	}
+	w.Header().Set("ETag", s3ETag(info))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	http.ServeContent(w, req.Request, "", info.ModTime(), content)
+	return nil
+}
+
+// writeObject writes the content to a key, creating the folders of the key
+func (gateway *S3Gateway) writeObject(req *s3Request, content io.Reader, verify func() error) (string, error) {
+	if dir := path.Dir(req.objectName()); dir != req.bucket {
+		if err := req.vfs.MkdirAll(dir, 0o755); err != nil {
+			return "", err
+		}
+	}
+
+	f, err := req.vfs.Create(req.objectName())
+	if err != nil {
+		return "", err
+	}
+	file := f.(*driveWriteFile)
+
+	if _, err := io.Copy(file, content); err != nil {
+		file.abort()
+		return "", err
+	}
+	if err := verify(); err != nil {
+		file.abort()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+
+	info, err := req.vfs.Stat(req.objectName())
+	if err != nil {
+		return "", err
+	}
+
+	return s3ETag(info), nil
+}
+
+func (gateway *S3Gateway) putObject(w http.ResponseWriter, req *s3Request) error {
+	if _, err := req.bucketInfo(); err != nil {
+		return err
+	}
+
+	payload := newVerifyPayload(req)
+	etag, err := gateway.writeObject(req, payload, payload.verify)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (gateway *S3Gateway) deleteObject(w http.ResponseWriter, req *s3Request) error {
+	if _, err := req.bucketInfo(); err != nil {
+		return err
+	}
+
+	// deleting a missing key succeeds like on S3
+	if err := req.vfs.Remove(req.objectName()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func (req *s3Request) owner() string {
+	return req.credentials.UserID + "\x00" + req.credentials.Email + "\x00" + req.credentials.RootFolderID
+}
+
+func (gateway *S3Gateway) createMultipartUpload(w http.ResponseWriter, req *s3Request) error {
+	if _, err := req.bucketInfo(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(gateway.stagingDir, 0o700); err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp(gateway.stagingDir, "upload-*")
+	if err != nil {
+		return err
+	}
+
+	uploadID := ulid.Make().String()
+	now := time.Now()
+
+	gateway.mu.Lock()
+	expired := gateway.expireUploads(now)
+	gateway.uploads[uploadID] = &s3MultipartUpload{
+		owner:     req.owner(),
+		bucket:    req.bucket,
+		key:       req.key,
+		dir:       dir,
+		parts:     make(map[int]s3Part),
+		createdAt: now,
+	}
+	gateway.mu.Unlock()
+
+	for _, dir := range expired {
+		os.RemoveAll(dir)
+	}
+
+	writeS3XML(w, http.StatusOK, &s3InitiateMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Bucket:   req.bucket,
+		Key:      req.key,
+		UploadID: uploadID,
+	})
+	return nil
+}
+
+// upload returns the multipart upload of the request, which must belong to the same
+// account and key
+func (gateway *S3Gateway) upload(req *s3Request) (string, *s3MultipartUpload, error) {
+	uploadID := req.URL.Query().Get("uploadId")
+
+	gateway.mu.Lock()
+	expired := gateway.expireUploads(time.Now())
+	upload, ok := gateway.uploads[uploadID]
+	gateway.mu.Unlock()
+
+	for _, dir := range expired {
+		os.RemoveAll(dir)
+	}
+
+	if !ok || upload.owner != req.owner() || upload.bucket != req.bucket || upload.key != req.key {
+		return "", nil, errS3NoSuchUpload
+	}
+	return uploadID, upload, nil
+}
+
+func (gateway *S3Gateway) uploadPart(w http.ResponseWriter, req *s3Request) error {
+	_, upload, err := gateway.upload(req)
+	if err != nil {
+		return err
+	}
+
+	partNumber, err := strconv.Atoi(req.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > 10000 {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "partNumber must be between 1 and 10000")
+	}
+
+	partPath := filepath.Join(upload.dir, strconv.Itoa(partNumber))
+	file, err := os.Create(partPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	payload := newVerifyPayload(req)
+	digest := md5.New()
+	_, err = io.Copy(io.MultiWriter(file, digest), payload)
+	if err != nil {
+		return err
+	}
+	if err := payload.verify(); err != nil {
+		os.Remove(partPath)
+		return err
+	}
+
+	etag := `"` + hex.EncodeToString(digest.Sum(nil)) + `"`
+
+	gateway.mu.Lock()
+	upload.parts[partNumber] = s3Part{etag: etag}
+	gateway.mu.Unlock()
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (gateway *S3Gateway) completeMultipartUpload(w http.ResponseWriter, req *s3Request) error {
+	uploadID, upload, err := gateway.upload(req)
+	if err != nil {
+		return err
+	}
+
+	var complete s3CompleteMultipartUpload
+	if err := xml.NewDecoder(req.Body).Decode(&complete); err != nil || len(complete.Parts) == 0 {
+		return errS3MalformedXML
+	}
+
+	files := make([]io.Reader, 0, len(complete.Parts))
+	closers := make([]io.Closer, 0, len(complete.Parts))
+	defer func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}()
+
+	gateway.mu.Lock()
+	parts := make(map[int]s3Part, len(upload.parts))
+	for number, part := range upload.parts {
+		parts[number] = part
+	}
+	gateway.mu.Unlock()
+
+	previous := 0
+	for _, listed := range complete.Parts {
+		if listed.PartNumber <= previous {
+			return errS3InvalidPartOrder
+		}
+		previous = listed.PartNumber
+
+		part, ok := parts[listed.PartNumber]
+		if !ok || strings.Trim(listed.ETag, `"`) != strings.Trim(part.etag, `"`) {
+			return errS3InvalidPart
+		}
+
+		file, err := os.Open(filepath.Join(upload.dir, strconv.Itoa(listed.PartNumber)))
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+		closers = append(closers, file)
+	}
+
+	etag, err := gateway.writeObject(req, io.MultiReader(files...), func() error { return nil })
+	if err != nil {
+		return err
+	}
+
+	gateway.removeUpload(uploadID, upload)
+
+	writeS3XML(w, http.StatusOK, &s3CompleteMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Location: "/" + req.objectName(),
+		Bucket:   req.bucket,
+		Key:      req.key,
+		ETag:     etag,
+	})
+	return nil
+}
+
+func (gateway *S3Gateway) abortMultipartUpload(w http.ResponseWriter, req *s3Request) error {
+	uploadID, upload, err := gateway.upload(req)
+	if err != nil {
+		return err
+	}
+
+	gateway.removeUpload(uploadID, upload)
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (gateway *S3Gateway) removeUpload(uploadID string, upload *s3MultipartUpload) {
+	gateway.mu.Lock()
+	delete(gateway.uploads, uploadID)
+	gateway.mu.Unlock()
+
+	os.RemoveAll(upload.dir)
+}
@@ -0,0 +1,219 @@
+package fundrive
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/drive/v3"
+)
+
+// the GET Object example of the Signature Version 4 documentation
+func TestS3Signature(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://examplebucket.s3.amazonaws.com/test.txt", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	req.Header.Set("X-Amz-Content-Sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	req.Header.Set("X-Amz-Date", "20130524T000000Z")
+
+	signature := s3Signature(
+		"wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY",
+		req,
+		[]string{"host", "range", "x-amz-content-sha256", "x-amz-date"},
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"20130524T000000Z",
+		"20130524/us-east-1/s3/aws4_request",
+	)
+	assert.Equal(t, "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41", signature)
+}
+
+// signS3Request signs a request like an AWS SDK client
+func signS3Request(req *http.Request, body []byte, accessKeyID, secret string) {
+	now := time.Now().UTC()
+	amzDate := now.Format(s3TimeFormat)
+	scope := now.Format("20060102") + "/us-east-1/s3/aws4_request"
+
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	signature := s3Signature(secret, req, signedHeaders, hex.EncodeToString(payloadHash[:]), amzDate, scope)
+
+	req.Header.Set("Authorization", s3Algorithm+" Credential="+accessKeyID+"/"+scope+
+		", SignedHeaders="+strings.Join(signedHeaders, ";")+", Signature="+signature)
+}
+
+// s3TestClient sends a signed request to the gateway
+type s3TestClient func(method, target, body string, header map[string]string) *httptest.ResponseRecorder
+
+func newTestS3Gateway(t *testing.T, opts ...S3GatewayOption) (*fakeDrive, *S3Gateway, s3TestClient) {
+	fake, service := newFakeDrive(t, []*drive.File{
+		{Id: "root-id", Name: "Drive", MimeType: MimeTypeFolder},
+		{Id: "photos", Name: "photos", MimeType: MimeTypeFolder, Parents: []string{"root-id"}},
+	}, map[string]string{})
+
+	gateway := NewS3Gateway(service, func(ctx context.Context, accessKeyID string) (*S3Credentials, error) {
+		if accessKeyID != "AKIDEXAMPLE" {
+			return nil, ErrS3AccessKeyNotFound
+		}
+		return &S3Credentials{
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: "secret",
+			UserID:          "user-1",
+			Email:           "a@example.com",
+			RootFolderID:    "root-id",
+		}, nil
+	}, opts...)
+
+	do := func(method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		signS3Request(req, []byte(body), "AKIDEXAMPLE", "secret")
+
+		recorder := httptest.NewRecorder()
+		gateway.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	return fake, gateway, do
+}
+
+func TestS3Gateway(t *testing.T) {
+	fake, gateway, do := newTestS3Gateway(t, WithS3StagingDir(t.TempDir()))
+
+	resp := do(http.MethodGet, "/", "", nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), "<Name>photos</Name>")
+
+	resp = do(http.MethodPut, "/photos/2024/beach.jpg", "sand and sea", nil)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	assert.NotEmpty(t, resp.Header().Get("ETag"))
+
+	resp = do(http.MethodPut, "/photos/readme.txt", "hi", nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	resp = do(http.MethodGet, "/photos/2024/beach.jpg", "", map[string]string{"Range": "bytes=9-11"})
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "sea", resp.Body.String())
+
+	resp = do(http.MethodHead, "/photos/2024/beach.jpg", "", nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "12", resp.Header().Get("Content-Length"))
+
+	var list s3ListObjectsResult
+	resp = do(http.MethodGet, "/photos?list-type=2&delimiter=%2F", "", nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.NoError(t, xml.Unmarshal(resp.Body.Bytes(), &list))
+	assert.Equal(t, []s3CommonPrefix{{Prefix: "2024/"}}, list.CommonPrefixes)
+	require.Len(t, list.Contents, 1)
+	assert.Equal(t, "readme.txt", list.Contents[0].Key)
+
+	// the listing starts at the folder of the prefix
+	for _, prefix := range []string{"2024%2F", "2024%2Fbe", "2024"} {
+		list = s3ListObjectsResult{}
+		resp = do(http.MethodGet, "/photos?list-type=2&prefix="+prefix, "", nil)
+		require.NoError(t, xml.Unmarshal(resp.Body.Bytes(), &list))
+		require.Len(t, list.Contents, 1, prefix)
+		assert.Equal(t, "2024/beach.jpg", list.Contents[0].Key)
+	}
+
+	list = s3ListObjectsResult{}
+	resp = do(http.MethodGet, "/photos?list-type=2&prefix=2023%2F", "", nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.NoError(t, xml.Unmarshal(resp.Body.Bytes(), &list))
+	assert.Empty(t, list.Contents)
+
+	// multipart upload, parts are concatenated in order on completion
+	resp = do(http.MethodPost, "/photos/video.mp4?uploads", "", nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var initiated s3InitiateMultipartUploadResult
+	require.NoError(t, xml.Unmarshal(resp.Body.Bytes(), &initiated))
+
+	part2 := do(http.MethodPut, "/photos/video.mp4?partNumber=2&uploadId="+initiated.UploadID, "world", nil)
+	part1 := do(http.MethodPut, "/photos/video.mp4?partNumber=1&uploadId="+initiated.UploadID, "hello ", nil)
+	require.Equal(t, http.StatusOK, part1.Code)
+	require.Equal(t, http.StatusOK, part2.Code)
+
+	complete := "<CompleteMultipartUpload>" +
+		"<Part><PartNumber>1</PartNumber><ETag>" + part1.Header().Get("ETag") + "</ETag></Part>" +
+		"<Part><PartNumber>2</PartNumber><ETag>" + part2.Header().Get("ETag") + "</ETag></Part>" +
+		"</CompleteMultipartUpload>"
+	resp = do(http.MethodPost, "/photos/video.mp4?uploadId="+initiated.UploadID, complete, nil)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+	resp = do(http.MethodGet, "/photos/video.mp4", "", nil)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "hello world", string(body))
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/photos/readme.txt", "", nil).Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/photos/readme.txt", "", nil).Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/videos?list-type=2", "", nil).Code)
+
+	// a body that does not match the signed payload hash is not uploaded
+	files := len(fake.files)
+	req := httptest.NewRequest(http.MethodPut, "/photos/tampered.txt", bytes.NewReader([]byte("tampered")))
+	signS3Request(req, []byte("original"), "AKIDEXAMPLE", "secret")
+	recorder := httptest.NewRecorder()
+	gateway.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Len(t, fake.files, files)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	signS3Request(req, nil, "AKIDEXAMPLE", "wrong")
+	recorder = httptest.NewRecorder()
+	gateway.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "SignatureDoesNotMatch")
+}
+
+func TestS3Gateway_UploadExpiry(t *testing.T) {
+	staging := t.TempDir()
+
+	// a previous run left an abandoned upload and another instance has a recent one
+	stale := filepath.Join(staging, "upload-stale")
+	require.NoError(t, os.Mkdir(stale, 0o700))
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(stale, old, old))
+	require.NoError(t, os.Mkdir(filepath.Join(staging, "upload-recent"), 0o700))
+
+	_, gateway, do := newTestS3Gateway(t, WithS3StagingDir(staging), WithS3UploadTTL(time.Hour))
+
+	_, err := os.Stat(stale)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.DirExists(t, filepath.Join(staging, "upload-recent"))
+
+	resp := do(http.MethodPost, "/photos/video.mp4?uploads", "", nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var initiated s3InitiateMultipartUploadResult
+	require.NoError(t, xml.Unmarshal(resp.Body.Bytes(), &initiated))
+
+	resp = do(http.MethodPut, "/photos/video.mp4?partNumber=1&uploadId="+initiated.UploadID, "hello", nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	// an upload older than the TTL is gone with its parts
+	gateway.mu.Lock()
+	upload := gateway.uploads[initiated.UploadID]
+	upload.createdAt = old
+	gateway.mu.Unlock()
+
+	resp = do(http.MethodPut, "/photos/video.mp4?partNumber=2&uploadId="+initiated.UploadID, "world", nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Contains(t, resp.Body.String(), "NoSuchUpload")
+	_, err = os.Stat(upload.dir)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
@@ -0,0 +1,411 @@
+package fundrive
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SchemaMigration records a schema migration applied to the database
+type SchemaMigration struct {
+	Version   int64     `json:"version" gorm:"column:version;primaryKey;autoIncrement:false"`
+	Name      string    `json:"name" gorm:"column:name;size:255"`
+	AppliedAt time.Time `json:"applied_at" gorm:"column:applied_at"`
+}
+
+// TableName returns the table name
+func (m *SchemaMigration) TableName() string {
+	return "fundrive_schema_migrations"
+}
+
+// schemaMigration is a versioned change of the fundrive tables. Applied versions never
+// change, a new schema change adds a migration. Migrations are idempotent so databases
+// created by AutoMigrate before versioning can adopt them
+type schemaMigration struct {
+	version int64
+	name    string
+	up      func(tx *gorm.DB, config *migrateConfig) error
+}
+
+var schemaMigrations = []schemaMigration{
+	{version: 1, name: "create tables", up: migrateCreateTables},
+	{version: 2, name: "unique oauth token account", up: migrateOAuthTokenAccount},
+	{version: 3, name: "oauth token tenant", up: migrateOAuthTokenTenant},
+	{version: 4, name: "oauth clients", up: migrateOAuthClients},
+	{version: 5, name: "migration job enumeration", up: migrateMigrationJobEnumeration},
+	{version: 6, name: "data tenant", up: migrateDataTenant},
+	{version: 7, name: "unique catalog entry file", up: migrateCatalogEntryFile},
+	{version: 8, name: "data tenant indexes", up: migrateDataTenantIndexes},
+}
+
+// MigrateOption configures Migrate
+type MigrateOption func(*migrateConfig)
+
+type migrateConfig struct {
+	tablePrefix string
+}
+
+// WithMigrationTablePrefix sets the prefix of the token, OAuth client and schema
+// migration tables, it must match the prefix of the service. The data tables are
+// not prefixed
+func WithMigrationTablePrefix(prefix string) MigrateOption {
+	return func(c *migrateConfig) {
+		c.tablePrefix = prefix
+	}
+}
+
+func (c *migrateConfig) tokenTable() string {
+	return tablePrefix(c.tablePrefix) + "oauth_tokens"
+}
+
+func (c *migrateConfig) clientTable() string {
+	return tablePrefix(c.tablePrefix) + "oauth_clients"
+}
+
+func (c *migrateConfig) migrationTable() string {
+	return tablePrefix(c.tablePrefix) + "schema_migrations"
+}
+
+// oauthTokenV2 adds the timestamps
+type oauthTokenV2 struct {
+	oauthTokenV1
+	CreatedAt time.Time `gorm:"column:created_at"`
+	UpdatedAt time.Time `gorm:"column:updated_at"`
+}
+
+func migrateOAuthTokenAccount(tx *gorm.DB, config *migrateConfig) error {
+	table := config.tokenTable()
+	migrator := tx.Table(table).Migrator()
+
+	// v1 created the token table without a prefix, a prefixed table is created by v3
+	if !migrator.HasTable(table) {
+		return nil
+	}
+
+	for _, column := range []string{"CreatedAt", "UpdatedAt"} {
+		if migrator.HasColumn(&oauthTokenV2{}, column) {
+			continue
+		}
+		if err := migrator.AddColumn(&oauthTokenV2{}, column); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	err := tx.Table(table).Where("created_at IS NULL").
+		UpdateColumns(map[string]any{"created_at": now, "updated_at": now}).Error
+	if err != nil {
+		return err
+	}
+
+	// keep the latest row of each account, IDs are ULIDs sorted by creation time. The
+	// derived table lets MySQL delete from the table it reads
+	err = tx.Exec(
+		"DELETE FROM ? WHERE id NOT IN (SELECT id FROM (SELECT MAX(id) AS id FROM ? GROUP BY user_id, email) AS latest)",
+		clause.Table{Name: table}, clause.Table{Name: table},
+	).Error
+	if err != nil {
+		return err
+	}
+
+	return createUniqueIndex(tx, table, "idx_"+table+"_account", "user_id", "email")
+}
+
+// oauthTokenV3 adds the tenant
+type oauthTokenV3 struct {
+	oauthTokenV2
+	TenantID string `gorm:"column:tenant_id;size:64;not null;default:''"`
+}
+
+func migrateOAuthTokenTenant(tx *gorm.DB, config *migrateConfig) error {
+	table := config.tokenTable()
+	migrator := tx.Table(table).Migrator()
+
+	// a prefixed table is created here with the changes of v1 and v2
+	if !migrator.HasTable(table) {
+		if err := tx.Table(table).AutoMigrate(&oauthTokenV1{}); err != nil {
+			return err
+		}
+		if err := migrateOAuthTokenAccount(tx, config); err != nil {
+			return err
+		}
+	}
+
+	if !migrator.HasColumn(&oauthTokenV3{}, "TenantID") {
+		if err := migrator.AddColumn(&oauthTokenV3{}, "TenantID"); err != nil {
+			return err
+		}
+	}
+
+	// existing accounts belong to the default tenant, the account index is replaced
+	// by one including the tenant
+	if migrator.HasIndex(&oauthTokenV3{}, "idx_"+table+"_account") {
+		if err := migrator.DropIndex(&oauthTokenV3{}, "idx_"+table+"_account"); err != nil {
+			return err
+		}
+	}
+
+	return createUniqueIndex(tx, table, "idx_"+table+"_tenant_account", "tenant_id", "user_id", "email")
+}
+
+// oauthTokenV4 adds the OAuth client of the account
+type oauthTokenV4 struct {
+	oauthTokenV3
+	ClientName string `gorm:"column:client_name;size:64;not null;default:''"`
+}
+
+func migrateOAuthClients(tx *gorm.DB, config *migrateConfig) error {
+	if err := tx.Table(config.clientTable()).AutoMigrate(&OAuthClient{}); err != nil {
+		return err
+	}
+
+	migrator := tx.Table(config.tokenTable()).Migrator()
+	if migrator.HasColumn(&oauthTokenV4{}, "ClientName") {
+		return nil
+	}
+	return migrator.AddColumn(&oauthTokenV4{}, "ClientName")
+}
+
+// migrationJobV5 records when the items of a job were enumerated
+type migrationJobV5 struct {
+	migrationJobV1
+	EnumeratedAt *time.Time `gorm:"column:enumerated_at"`
+}
+
+func migrateMigrationJobEnumeration(tx *gorm.DB, _ *migrateConfig) error {
+	migrator := tx.Migrator()
+	if !migrator.HasColumn(&migrationJobV5{}, "EnumeratedAt") {
+		if err := migrator.AddColumn(&migrationJobV5{}, "EnumeratedAt"); err != nil {
+			return err
+		}
+	}
+
+	// jobs that transferred items were enumerated, the others enumerate again on resume
+	return tx.Model(&migrationJobV5{}).
+		Where("enumerated_at IS NULL AND (status IN ? OR done_items + failed_items > 0)",
+			[]MigrationStatus{MigrationStatusRunning, MigrationStatusCompleted}).
+		UpdateColumn("enumerated_at", gorm.Expr("updated_at")).
+		Error
+}
+
+// The v6 structs add the tenant to the data tables
+type (
+	poolUploadV6 struct {
+		poolUploadV1
+		TenantID string `gorm:"column:tenant_id;type:varchar(64);not null;default:''"`
+	}
+	catalogEntryV6 struct {
+		catalogEntryV1
+		TenantID string `gorm:"column:tenant_id;type:varchar(64);not null;default:''"`
+	}
+	stripedFileV6 struct {
+		stripedFileV1
+		TenantID string `gorm:"column:tenant_id;type:varchar(64);not null;default:''"`
+	}
+	stripedPartV6 struct {
+		stripedPartV1
+		TenantID string `gorm:"column:tenant_id;type:varchar(64);not null;default:''"`
+	}
+	migrationJobV6 struct {
+		migrationJobV1
+		TenantID string `gorm:"column:tenant_id;type:varchar(64);not null;default:''"`
+	}
+	migrationItemV6 struct {
+		migrationItemV1
+		TenantID string `gorm:"column:tenant_id;type:varchar(64);not null;default:''"`
+	}
+	changeCursorV6 struct {
+		changeCursorV1
+		TenantID string `gorm:"column:tenant_id;type:varchar(64);not null;default:''"`
+	}
+	changeFileStateV6 struct {
+		changeFileStateV1
+		TenantID string `gorm:"column:tenant_id;type:varchar(64);not null;default:''"`
+	}
+	watchChannelV6 struct {
+		watchChannelV1
+		TenantID string `gorm:"column:tenant_id;type:varchar(64);not null;default:''"`
+	}
+	syncStateV6 struct {
+		syncStateV1
+		TenantID string `gorm:"column:tenant_id;type:varchar(64);not null;default:''"`
+	}
+)
+
+// migrateDataTenant adds the tenant to the data tables, existing rows belong to the
+// default tenant
+func migrateDataTenant(tx *gorm.DB, _ *migrateConfig) error {
+	migrator := tx.Migrator()
+
+	models := []any{
+		&poolUploadV6{},
+		&catalogEntryV6{},
+		&stripedFileV6{},
+		&stripedPartV6{},
+		&migrationJobV6{},
+		&migrationItemV6{},
+		&changeCursorV6{},
+		&changeFileStateV6{},
+		&watchChannelV6{},
+		&syncStateV6{},
+	}
+	for _, model := range models {
+		if migrator.HasColumn(model, "TenantID") {
+			continue
+		}
+		if err := migrator.AddColumn(model, "TenantID"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateCatalogEntryFile makes the Drive file of a catalog entry unique per account so
+// concurrent writers upsert the same row
+func migrateCatalogEntryFile(tx *gorm.DB, _ *migrateConfig) error {
+	table := (&CatalogEntry{}).TableName()
+
+	// keep the latest entry of each file, IDs are ULIDs sorted by creation time
+	err := tx.Exec(
+		"DELETE FROM ? WHERE id NOT IN (SELECT id FROM (SELECT MAX(id) AS id FROM ? GROUP BY tenant_id, user_id, email, drive_file_id) AS latest)",
+		clause.Table{Name: table}, clause.Table{Name: table},
+	).Error
+	if err != nil {
+		return err
+	}
+
+	// the unique index replaces the lookup index
+	migrator := tx.Migrator()
+	if migrator.HasIndex(&catalogEntryV6{}, "idx_fundrive_catalog_file") {
+		if err := migrator.DropIndex(&catalogEntryV6{}, "idx_fundrive_catalog_file"); err != nil {
+			return err
+		}
+	}
+
+	return createUniqueIndex(tx, table, "idx_"+table+"_file", "tenant_id", "user_id", "email", "drive_file_id")
+}
+
+// dataTenantIndex replaces a lookup index of a data table by one leading with the tenant
+type dataTenantIndex struct {
+	model   any
+	table   string
+	old     string
+	name    string
+	columns []string
+}
+
+// migrateDataTenantIndexes adds the tenant to the lookup indexes of the data tables,
+// every query of a tenant filters on it first
+func migrateDataTenantIndexes(tx *gorm.DB, _ *migrateConfig) error {
+	migrator := tx.Migrator()
+
+	indexes := []dataTenantIndex{
+		{&poolUploadV6{}, "fundrive_pool_uploads", "idx_fundrive_pool_uploads_user_id", "tenant_user", []string{"user_id"}},
+		{&stripedFileV6{}, "fundrive_striped_files", "idx_fundrive_striped_files_user_id", "tenant_user", []string{"user_id"}},
+		{&migrationJobV6{}, "fundrive_migration_jobs", "idx_fundrive_migration_jobs_user_id", "tenant_user", []string{"user_id"}},
+		{&watchChannelV6{}, "fundrive_watch_channels", "idx_fundrive_watch_channels_user_id", "tenant_user", []string{"user_id"}},
+		{&changeCursorV6{}, "fundrive_change_cursors", "idx_fundrive_change_cursor", "tenant_account", []string{"user_id", "email", "drive_id"}},
+		{&syncStateV6{}, "fundrive_sync_states", "idx_fundrive_sync_pair", "tenant_pair", []string{"user_id", "email", "folder_id", "local_root"}},
+	}
+	for _, index := range indexes {
+		if migrator.HasIndex(index.model, index.old) {
+			if err := migrator.DropIndex(index.model, index.old); err != nil {
+				return err
+			}
+		}
+
+		columns := append([]string{"tenant_id"}, index.columns...)
+		if err := createIndex(tx, false, index.table, "idx_"+index.table+"_"+index.name, columns...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createUniqueIndex creates the unique index unless it exists
+func createUniqueIndex(tx *gorm.DB, table, name string, columns ...string) error {
+	return createIndex(tx, true, table, name, columns...)
+}
+
+// createIndex creates the index unless it exists, the name includes the table because
+// PostgreSQL index names are unique per schema
+func createIndex(tx *gorm.DB, unique bool, table, name string, columns ...string) error {
+	if tx.Table(table).Migrator().HasIndex(&oauthTokenV1{}, name) {
+		return nil
+	}
+
+	indexColumns := make([]clause.Column, 0, len(columns))
+	for _, column := range columns {
+		indexColumns = append(indexColumns, clause.Column{Name: column})
+	}
+
+	statement := "CREATE INDEX ? ON ? ?"
+	if unique {
+		statement = "CREATE UNIQUE INDEX ? ON ? ?"
+	}
+
+	return tx.Exec(statement, clause.Table{Name: name}, clause.Table{Name: table}, indexColumns).Error
+}
+
+// Migrate applies the pending schema migrations, New runs it unless WithAutoMigrate disables it
+func Migrate(ctx context.Context, db *gorm.DB, opts ...MigrateOption) error {
+	config := &migrateConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	db = db.WithContext(ctx)
+
+	if err := db.Table(config.migrationTable()).AutoMigrate(&SchemaMigration{}); err != nil {
+		return fmt.Errorf("error creating schema migrations table: %w", err)
+	}
+
+	var applied []int64
+	if err := db.Table(config.migrationTable()).Pluck("version", &applied).Error; err != nil {
+		return fmt.Errorf("error listing schema migrations: %w", err)
+	}
+
+	for _, migration := range schemaMigrations {
+		if slices.Contains(applied, migration.version) {
+			continue
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.up(tx, config); err != nil {
+				return err
+			}
+
+			return tx.Table(config.migrationTable()).Create(&SchemaMigration{
+				Version:   migration.version,
+				Name:      migration.name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("error applying schema migration %d %s: %w", migration.version, migration.name, err)
+		}
+	}
+
+	return nil
+}
+
+// SchemaVersion returns the latest schema migration applied to the database
+func SchemaVersion(ctx context.Context, db *gorm.DB, opts ...MigrateOption) (int64, error) {
+	config := &migrateConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	var version int64
+	err := db.WithContext(ctx).Table(config.migrationTable()).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	if err != nil {
+		return 0, fmt.Errorf("error reading schema version: %w", err)
+	}
+	return version, nil
+}
@@ -0,0 +1,233 @@
+package fundrive
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	require.NoError(t, Migrate(ctx, db))
+	require.NoError(t, Migrate(ctx, db))
+
+	version, err := SchemaVersion(ctx, db)
+	require.NoError(t, err)
+	assert.Equal(t, schemaMigrations[len(schemaMigrations)-1].version, version)
+
+	var applied int64
+	require.NoError(t, db.Model(&SchemaMigration{}).Count(&applied).Error)
+	assert.Equal(t, int64(len(schemaMigrations)), applied)
+
+	require.NoError(t, db.Create(&OAuthToken{ID: "01", UserID: "user-1", Email: "a@example.com"}).Error)
+	assert.Error(t, db.Create(&OAuthToken{ID: "02", UserID: "user-1", Email: "a@example.com"}).Error)
+	require.NoError(t, db.Create(&OAuthToken{ID: "03", UserID: "user-1", Email: "b@example.com"}).Error)
+
+	var token OAuthToken
+	require.NoError(t, db.First(&token, "id = ?", "01").Error)
+	assert.False(t, token.CreatedAt.IsZero())
+}
+
+func TestMigrate_LegacyTable(t *testing.T) {
+	ctx := context.Background()
+
+	// a database created by AutoMigrate before versioning, with duplicate accounts
+	db := newTestDB(t, &oauthTokenV1{})
+	require.NoError(t, db.Create([]oauthTokenV1{
+		{ID: "01A", UserID: "user-1", Email: "a@example.com", AccessToken: "old"},
+		{ID: "01B", UserID: "user-1", Email: "a@example.com", AccessToken: "new"},
+		{ID: "01C", UserID: "user-2", Email: "a@example.com", AccessToken: "other"},
+	}).Error)
+
+	require.NoError(t, Migrate(ctx, db))
+
+	var tokens []OAuthToken
+	require.NoError(t, db.Order("id").Find(&tokens).Error)
+	require.Len(t, tokens, 2)
+	assert.Equal(t, "new", tokens[0].AccessToken)
+	assert.Equal(t, "other", tokens[1].AccessToken)
+	assert.False(t, tokens[0].UpdatedAt.IsZero())
+
+	assert.Equal(t, "", tokens[0].TenantID)
+	assert.False(t, db.Migrator().HasIndex(&OAuthToken{}, "idx_fundrive_oauth_tokens_account"))
+	assert.True(t, db.Migrator().HasIndex(&OAuthToken{}, "idx_fundrive_oauth_tokens_tenant_account"))
+}
+
+func TestMigrate_MigrationJobEnumeration(t *testing.T) {
+	ctx := context.Background()
+
+	db := newTestDB(t, &migrationJobV1{})
+	require.NoError(t, db.Create([]migrationJobV1{
+		{ID: "01A", Status: string(MigrationStatusRunning)},
+		{ID: "01B", Status: string(MigrationStatusFailed), DoneItems: 2},
+		{ID: "01C", Status: string(MigrationStatusFailed)},
+	}).Error)
+
+	require.NoError(t, Migrate(ctx, db))
+
+	var jobs []MigrationJob
+	require.NoError(t, db.Order("id").Find(&jobs).Error)
+	require.Len(t, jobs, 3)
+	assert.NotNil(t, jobs[0].EnumeratedAt)
+	assert.NotNil(t, jobs[1].EnumeratedAt)
+	assert.Nil(t, jobs[2].EnumeratedAt)
+}
+
+func TestMigrate_DataTenant(t *testing.T) {
+	ctx := context.Background()
+
+	db := newTestDB(t, &catalogEntryV1{})
+	require.NoError(t, db.Create(&catalogEntryV1{ID: "01A", UserID: "user-1", Name: "notes.txt"}).Error)
+
+	require.NoError(t, Migrate(ctx, db))
+
+	// existing rows belong to the default tenant
+	var entry CatalogEntry
+	require.NoError(t, db.First(&entry, "id = ?", "01A").Error)
+	assert.Equal(t, "", entry.TenantID)
+
+	for _, model := range []any{
+		&PoolUpload{}, &CatalogEntry{}, &StripedFile{}, &StripedPart{}, &MigrationJob{},
+		&MigrationItem{}, &ChangeCursor{}, &ChangeFileState{}, &WatchChannel{}, &SyncState{},
+	} {
+		assert.True(t, db.Migrator().HasColumn(model, "TenantID"))
+	}
+
+	// the lookup indexes lead with the tenant
+	for model, indexes := range map[any][2]string{
+		&PoolUpload{}:   {"idx_fundrive_pool_uploads_user_id", "idx_fundrive_pool_uploads_tenant_user"},
+		&StripedFile{}:  {"idx_fundrive_striped_files_user_id", "idx_fundrive_striped_files_tenant_user"},
+		&MigrationJob{}: {"idx_fundrive_migration_jobs_user_id", "idx_fundrive_migration_jobs_tenant_user"},
+		&WatchChannel{}: {"idx_fundrive_watch_channels_user_id", "idx_fundrive_watch_channels_tenant_user"},
+		&ChangeCursor{}: {"idx_fundrive_change_cursor", "idx_fundrive_change_cursors_tenant_account"},
+		&SyncState{}:    {"idx_fundrive_sync_pair", "idx_fundrive_sync_states_tenant_pair"},
+	} {
+		assert.False(t, db.Migrator().HasIndex(model, indexes[0]), indexes[0])
+		assert.True(t, db.Migrator().HasIndex(model, indexes[1]), indexes[1])
+	}
+}
+
+func TestMigrate_CatalogEntryFile(t *testing.T) {
+	ctx := context.Background()
+
+	// concurrent writers could catalog a file twice before the unique index
+	db := newTestDB(t, &catalogEntryV1{})
+	require.NoError(t, db.Create([]catalogEntryV1{
+		{ID: "01A", UserID: "user-1", Email: "a@example.com", DriveFileID: "file-1", Name: "old.txt"},
+		{ID: "01B", UserID: "user-1", Email: "a@example.com", DriveFileID: "file-1", Name: "new.txt"},
+		{ID: "01C", UserID: "user-1", Email: "a@example.com", DriveFileID: "file-2", Name: "notes.txt"},
+	}).Error)
+
+	require.NoError(t, Migrate(ctx, db))
+
+	var entries []CatalogEntry
+	require.NoError(t, db.Order("id").Find(&entries).Error)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "new.txt", entries[0].Name)
+	assert.Equal(t, "notes.txt", entries[1].Name)
+
+	assert.False(t, db.Migrator().HasIndex(&CatalogEntry{}, "idx_fundrive_catalog_file"))
+	assert.True(t, db.Migrator().HasIndex(&CatalogEntry{}, "idx_fundrive_catalog_entries_file"))
+	assert.Error(t, db.Create(&CatalogEntry{ID: "01D", UserID: "user-1", Email: "a@example.com", DriveFileID: "file-2"}).Error)
+	assert.NoError(t, db.Create(&CatalogEntry{ID: "01E", TenantID: "acme", UserID: "user-1", Email: "a@example.com", DriveFileID: "file-2"}).Error)
+}
+
+func TestMigrate_TablePrefix(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	require.NoError(t, Migrate(ctx, db, WithMigrationTablePrefix("acme_")))
+	assert.True(t, db.Migrator().HasTable("acme_oauth_tokens"))
+	assert.True(t, db.Migrator().HasTable("acme_schema_migrations"))
+	assert.True(t, db.Table("acme_oauth_tokens").Migrator().HasIndex(&OAuthToken{}, "idx_acme_oauth_tokens_tenant_account"))
+	assert.True(t, db.Table("acme_oauth_tokens").Migrator().HasColumn(&OAuthToken{}, "ClientName"))
+
+	version, err := SchemaVersion(ctx, db, WithMigrationTablePrefix("acme_"))
+	require.NoError(t, err)
+	assert.Equal(t, schemaMigrations[len(schemaMigrations)-1].version, version)
+
+	// another prefix in the same database gets its own tables
+	require.NoError(t, Migrate(ctx, db))
+	assert.True(t, db.Migrator().HasIndex(&OAuthToken{}, "idx_fundrive_oauth_tokens_tenant_account"))
+}
+
+func TestNew_WithAutoMigrate(t *testing.T) {
+	db := newTestDB(t)
+
+	_, err := New(
+		WithDB(db),
+		WithServiceAccountKey(newTestServiceAccountKey(t, "https://oauth2.googleapis.com/token")),
+		WithEncryptionKey("12345678901234567890123456789012"),
+		WithAutoMigrate(false),
+	)
+	require.NoError(t, err)
+	assert.False(t, db.Migrator().HasTable(&SchemaMigration{}))
+	assert.False(t, db.Migrator().HasTable(&OAuthToken{}))
+}
+
+// ddlLogger captures the statements of a dry run session
+type ddlLogger struct {
+	logger.Interface
+
+	mu         sync.Mutex
+	statements []string
+}
+
+func (l *ddlLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	sql, _ := fc()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.statements = append(l.statements, sql)
+}
+
+func TestSchema_PostgresTypes(t *testing.T) {
+	capture := &ddlLogger{Interface: logger.Default.LogMode(logger.Silent)}
+
+	// the dry run renders the statements without a server
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost dbname=fundrive"}), &gorm.Config{
+		DryRun:               true,
+		DisableAutomaticPing: true,
+		Logger:               capture,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Migrator().CreateTable(&OAuthToken{}))
+
+	ddl := strings.Join(capture.statements, "\n")
+	assert.Contains(t, ddl, `CREATE TABLE "fundrive_oauth_tokens"`)
+	assert.Contains(t, ddl, `"access_token" text`)
+	assert.Contains(t, ddl, `"created_at" timestamptz`)
+	assert.Contains(t, ddl, `CREATE UNIQUE INDEX IF NOT EXISTS "idx_fundrive_oauth_tokens_tenant_account"`)
+	assert.NotContains(t, ddl, "longtext")
+}
+
+func TestMigrate_Postgres(t *testing.T) {
+	dsn := os.Getenv("FUNDRIVE_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("FUNDRIVE_TEST_POSTGRES_DSN is not set")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, Migrate(ctx, db))
+	require.NoError(t, Migrate(ctx, db))
+
+	require.NoError(t, db.Where("user_id = ?", t.Name()).Delete(&OAuthToken{}).Error)
+	require.NoError(t, db.Create(&OAuthToken{ID: "01PG", UserID: t.Name(), Email: "a@example.com"}).Error)
+	assert.Error(t, db.Create(&OAuthToken{ID: "02PG", UserID: t.Name(), Email: "a@example.com"}).Error)
+	require.NoError(t, db.Where("user_id = ?", t.Name()).Delete(&OAuthToken{}).Error)
+}
@@ -0,0 +1,220 @@
+package fundrive
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// The v1 structs freeze the tables as they were before versioning, later changes to
+// the models are applied by their own migrations
+
+// oauthTokenV1 is the token table before versioning
+type oauthTokenV1 struct {
+	ID              string    `gorm:"column:id;size:26;primaryKey"`
+	UserID          string    `gorm:"column:user_id;size:255"`
+	Email           string    `gorm:"column:email;size:255"`
+	AccessToken     string    `gorm:"column:access_token"`
+	RefreshToken    string    `gorm:"column:refresh_token"`
+	TokenType       string    `gorm:"column:token_type;size:50"`
+	Expiry          time.Time `gorm:"column:expiry"`
+	Scopes          string    `gorm:"column:scopes"`
+	ExpiryTimestamp *string   `gorm:"column:expiry_timestamp"`
+	BaseFolderID    *string   `gorm:"column:base_folder_id"`
+}
+
+func (t *oauthTokenV1) TableName() string {
+	return "fundrive_oauth_tokens"
+}
+
+type poolUploadV1 struct {
+	ID        string    `gorm:"column:id;type:char(26);primaryKey"`
+	UserID    string    `gorm:"column:user_id;type:varchar(255);index"`
+	Email     string    `gorm:"column:email;type:varchar(255)"`
+	FileID    string    `gorm:"column:file_id;type:varchar(255)"`
+	FileName  string    `gorm:"column:file_name;type:text"`
+	Size      int64     `gorm:"column:size"`
+	CreatedAt time.Time `gorm:"column:created_at"`
+}
+
+func (p *poolUploadV1) TableName() string {
+	return "fundrive_pool_uploads"
+}
+
+type catalogEntryV1 struct {
+	ID          string    `gorm:"column:id;type:char(26);primaryKey"`
+	UserID      string    `gorm:"column:user_id;type:varchar(255);index:idx_fundrive_catalog_file"`
+	Email       string    `gorm:"column:email;type:varchar(255);index:idx_fundrive_catalog_file"`
+	DriveFileID string    `gorm:"column:drive_file_id;type:varchar(255);index:idx_fundrive_catalog_file"`
+	ParentID    string    `gorm:"column:parent_id;type:varchar(255)"`
+	Name        string    `gorm:"column:name;type:varchar(1024)"`
+	Path        string    `gorm:"column:path;type:varchar(2048)"`
+	ParentPath  string    `gorm:"column:parent_path;type:varchar(2048)"`
+	Size        int64     `gorm:"column:size"`
+	MD5Checksum string    `gorm:"column:md5_checksum;type:varchar(32)"`
+	MimeType    string    `gorm:"column:mime_type;type:varchar(255)"`
+	IsFolder    bool      `gorm:"column:is_folder"`
+	CreatedAt   time.Time `gorm:"column:created_at"`
+	UpdatedAt   time.Time `gorm:"column:updated_at"`
+}
+
+func (c *catalogEntryV1) TableName() string {
+	return "fundrive_catalog_entries"
+}
+
+type stripedFileV1 struct {
+	ID        string          `gorm:"column:id;type:char(26);primaryKey"`
+	UserID    string          `gorm:"column:user_id;type:varchar(255);index"`
+	Name      string          `gorm:"column:name;type:varchar(1024)"`
+	MimeType  string          `gorm:"column:mime_type;type:varchar(255)"`
+	Size      int64           `gorm:"column:size"`
+	PartSize  int64           `gorm:"column:part_size"`
+	PartCount int             `gorm:"column:part_count"`
+	SHA256    string          `gorm:"column:sha256;type:char(64)"`
+	CreatedAt time.Time       `gorm:"column:created_at"`
+	Parts     []stripedPartV1 `gorm:"foreignKey:StripedFileID"`
+}
+
+func (s *stripedFileV1) TableName() string {
+	return "fundrive_striped_files"
+}
+
+type stripedPartV1 struct {
+	ID            string `gorm:"column:id;type:char(26);primaryKey"`
+	StripedFileID string `gorm:"column:striped_file_id;type:char(26);index"`
+	PartIndex     int    `gorm:"column:part_index"`
+	Email         string `gorm:"column:email;type:varchar(255)"`
+	DriveFileID   string `gorm:"column:drive_file_id;type:varchar(255)"`
+	Offset        int64  `gorm:"column:offset"`
+	Size          int64  `gorm:"column:size"`
+	SHA256        string `gorm:"column:sha256;type:char(64)"`
+}
+
+func (s *stripedPartV1) TableName() string {
+	return "fundrive_striped_parts"
+}
+
+type migrationJobV1 struct {
+	ID             string    `gorm:"column:id;type:char(26);primaryKey"`
+	UserID         string    `gorm:"column:user_id;type:varchar(255);index"`
+	SourceEmail    string    `gorm:"column:source_email;type:varchar(255)"`
+	TargetEmail    string    `gorm:"column:target_email;type:varchar(255)"`
+	SourceFolderID string    `gorm:"column:source_folder_id;type:varchar(255)"`
+	TargetParentID string    `gorm:"column:target_parent_id;type:varchar(255)"`
+	FileIDs        string    `gorm:"column:file_ids;type:text"`
+	Mode           string    `gorm:"column:mode;type:varchar(32)"`
+	DeleteSource   bool      `gorm:"column:delete_source"`
+	Status         string    `gorm:"column:status;type:varchar(32)"`
+	TotalItems     int       `gorm:"column:total_items"`
+	DoneItems      int       `gorm:"column:done_items"`
+	FailedItems    int       `gorm:"column:failed_items"`
+	Error          string    `gorm:"column:error;type:text"`
+	CreatedAt      time.Time `gorm:"column:created_at"`
+	UpdatedAt      time.Time `gorm:"column:updated_at"`
+}
+
+func (m *migrationJobV1) TableName() string {
+	return "fundrive_migration_jobs"
+}
+
+type migrationItemV1 struct {
+	ID             string `gorm:"column:id;type:char(26);primaryKey"`
+	JobID          string `gorm:"column:job_id;type:char(26);index"`
+	SourceFileID   string `gorm:"column:source_file_id;type:varchar(255)"`
+	SourceParentID string `gorm:"column:source_parent_id;type:varchar(255)"`
+	TargetFileID   string `gorm:"column:target_file_id;type:varchar(255)"`
+	Name           string `gorm:"column:name;type:varchar(1024)"`
+	MimeType       string `gorm:"column:mime_type;type:varchar(255)"`
+	Size           int64  `gorm:"column:size"`
+	Depth          int    `gorm:"column:depth"`
+	IsFolder       bool   `gorm:"column:is_folder"`
+	IsAncestor     bool   `gorm:"column:is_ancestor"`
+	Status         string `gorm:"column:status;type:varchar(32)"`
+	Error          string `gorm:"column:error;type:text"`
+}
+
+func (m *migrationItemV1) TableName() string {
+	return "fundrive_migration_items"
+}
+
+type changeCursorV1 struct {
+	ID        string    `gorm:"column:id;type:char(26);primaryKey"`
+	UserID    string    `gorm:"column:user_id;type:varchar(255);index:idx_fundrive_change_cursor"`
+	Email     string    `gorm:"column:email;type:varchar(255);index:idx_fundrive_change_cursor"`
+	DriveID   string    `gorm:"column:drive_id;type:varchar(255);index:idx_fundrive_change_cursor"`
+	PageToken string    `gorm:"column:page_token;type:varchar(255)"`
+	StartedAt time.Time `gorm:"column:started_at"`
+	UpdatedAt time.Time `gorm:"column:updated_at"`
+}
+
+func (c *changeCursorV1) TableName() string {
+	return "fundrive_change_cursors"
+}
+
+type changeFileStateV1 struct {
+	ID          string `gorm:"column:id;type:char(26);primaryKey"`
+	CursorID    string `gorm:"column:cursor_id;type:char(26);index:idx_fundrive_change_file"`
+	DriveFileID string `gorm:"column:drive_file_id;type:varchar(255);index:idx_fundrive_change_file"`
+	ParentID    string `gorm:"column:parent_id;type:varchar(255)"`
+	Name        string `gorm:"column:name;type:varchar(1024)"`
+	Trashed     bool   `gorm:"column:trashed"`
+}
+
+func (c *changeFileStateV1) TableName() string {
+	return "fundrive_change_file_states"
+}
+
+type watchChannelV1 struct {
+	ID         string    `gorm:"column:id;type:char(26);primaryKey"`
+	UserID     string    `gorm:"column:user_id;type:varchar(255);index"`
+	Email      string    `gorm:"column:email;type:varchar(255)"`
+	Kind       string    `gorm:"column:kind;type:varchar(32)"`
+	FileID     string    `gorm:"column:file_id;type:varchar(255)"`
+	DriveID    string    `gorm:"column:drive_id;type:varchar(255)"`
+	ResourceID string    `gorm:"column:resource_id;type:varchar(255)"`
+	Address    string    `gorm:"column:address;type:varchar(2048)"`
+	Token      string    `gorm:"column:token;type:varchar(64)"`
+	Expiration time.Time `gorm:"column:expiration;index"`
+	CreatedAt  time.Time `gorm:"column:created_at"`
+	UpdatedAt  time.Time `gorm:"column:updated_at"`
+}
+
+func (w *watchChannelV1) TableName() string {
+	return "fundrive_watch_channels"
+}
+
+type syncStateV1 struct {
+	ID            string    `gorm:"column:id;type:char(26);primaryKey"`
+	UserID        string    `gorm:"column:user_id;type:varchar(255);index:idx_fundrive_sync_pair"`
+	Email         string    `gorm:"column:email;type:varchar(255);index:idx_fundrive_sync_pair"`
+	FolderID      string    `gorm:"column:folder_id;type:varchar(255);index:idx_fundrive_sync_pair"`
+	LocalRoot     string    `gorm:"column:local_root;type:varchar(1024);index:idx_fundrive_sync_pair"`
+	Path          string    `gorm:"column:path;type:varchar(2048)"`
+	LocalSize     int64     `gorm:"column:local_size"`
+	LocalModTime  time.Time `gorm:"column:local_mod_time"`
+	LocalMD5      string    `gorm:"column:local_md5;type:varchar(32)"`
+	RemoteID      string    `gorm:"column:remote_id;type:varchar(255)"`
+	RemoteMD5     string    `gorm:"column:remote_md5;type:varchar(32)"`
+	RemoteModTime time.Time `gorm:"column:remote_mod_time"`
+	SyncedAt      time.Time `gorm:"column:synced_at"`
+}
+
+func (s *syncStateV1) TableName() string {
+	return "fundrive_sync_states"
+}
+
+func migrateCreateTables(tx *gorm.DB, _ *migrateConfig) error {
+	return tx.AutoMigrate(
+		&oauthTokenV1{},
+		&poolUploadV1{},
+		&catalogEntryV1{},
+		&stripedFileV1{},
+		&stripedPartV1{},
+		&migrationJobV1{},
+		&migrationItemV1{},
+		&changeCursorV1{},
+		&changeFileStateV1{},
+		&watchChannelV1{},
+		&syncStateV1{},
+	)
+}
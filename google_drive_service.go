@@ -2,12 +2,14 @@ package fundrive
 
 import (
     "context"
+    "errors"
     "fmt"
     "golang.org/x/sync/errgroup"
     "google.golang.org/api/drive/v3"
     "google.golang.org/api/googleapi"
     "io"
     "net/http"
+    "sort"
     "strings"
     "sync"
     "time"
@@ -20,6 +22,9 @@ type CreateFolderRequest struct {
     Description string     `json:"description"`
     Permission  Permission `json:"permission"`
     Parents     []string   `json:"parents"`
+
+    // DriveID creates the folder at the root of a shared drive when Parents is empty
+    DriveID string `json:"drive_id"`
 }
 
 func (service *GoogleDriveService) CreateFolder(ctx context.Context, req *CreateFolderRequest) (*drive.File, error) {
@@ -37,18 +42,27 @@ func (service *GoogleDriveService) CreateFolder(ctx context.Context, req *Create
         MimeType:    MimeTypeFolder,
         Name:        req.Name,
         Description: req.Description,
-        Parents:     req.Parents,
+        Parents:     driveParents(req.Parents, req.DriveID),
     }
 
-    response, err := srv.Files.Create(request).Do()
+    response, err := retryCall(ctx, service.RetryPolicy, "files.create", false, func() (*drive.File, error) {
+        return srv.Files.Create(request).SupportsAllDrives(true).Fields(catalogFileFields).Context(ctx).Do()
+    })
     if err != nil {
         return nil, fmt.Errorf("error creating folder: %w", err)
     }
 
-    permission := getPermission(req.Permission)
-    _, err = srv.Permissions.Create(response.Id, permission).Do()
-    if err != nil {
-        return nil, err
+    if permission := getPermission(req.Permission); permission != nil {
+        _, err = retryCall(ctx, service.RetryPolicy, "permissions.create", false, func() (*drive.Permission, error) {
+            return srv.Permissions.Create(response.Id, permission).SupportsAllDrives(true).Context(ctx).Do()
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    if err := service.catalogFile(ctx, req.UserID, req.Email, response); err != nil {
+        return response, err
     }
 
     return response, nil
@@ -59,6 +73,9 @@ type ListFoldersRequest struct {
     Email     string `json:"email" validate:"required"`
     PageSize  int64  `json:"page_size"`
     PageToken string `json:"page_token"`
+
+    // DriveID lists the folders of a shared drive
+    DriveID string `json:"drive_id"`
 }
 
 func (l *ListFoldersRequest) HasPageToken() bool {
@@ -82,10 +99,12 @@ func (service *GoogleDriveService) ListFolders(ctx context.Context, req *ListFol
 
     q := fmt.Sprintf("mimeType = '%s'", MimeTypeFolder)
 
-    request := srv.Files.List().Q(q).
+    request := srv.Files.List().SupportsAllDrives(true).IncludeItemsFromAllDrives(true).Q(q).
         Spaces("drive").
         Fields("nextPageToken, files(id, name, mimeType, parents)")
 
+    request = withDriveCorpora(request, req.DriveID, "")
+
     if req.HasPageToken() {
         request = request.PageToken(req.PageToken)
     }
@@ -94,7 +113,9 @@ func (service *GoogleDriveService) ListFolders(ctx context.Context, req *ListFol
         request = request.PageSize(req.PageSize)
     }
 
-    response, err := request.Do()
+    response, err := retryCall(ctx, service.RetryPolicy, "files.list", true, func() (*drive.FileList, error) {
+        return request.Context(ctx).Do()
+    })
     if err != nil {
         return nil, "", fmt.Errorf("error listing folders: %w", err)
     }
@@ -110,6 +131,9 @@ type UploadFileRequest struct {
     FileData   io.Reader  `json:"file_data"`
     Permission Permission `json:"permission"`
     Parents    []string   `json:"parents"`
+
+    // DriveID uploads to the root of a shared drive when Parents is empty
+    DriveID string `json:"drive_id"`
 }
 
 func (u *UploadFileRequest) Sanitize() {
@@ -133,21 +157,40 @@ func (service *GoogleDriveService) UploadFile(ctx context.Context, req *UploadFi
 
     file := &drive.File{
         Name:    req.FileName,
-        Parents: req.Parents,
+        Parents: driveParents(req.Parents, req.DriveID),
     }
 
-    response, err := srv.Files.
-        Create(file).
-        Media(req.FileData).
-        Do()
+    // the file data can only be sent again when it is seekable
+    policy, rewindFileData := replayableBody(service.RetryPolicy, req.FileData)
+
+    response, err := retryCall(ctx, policy, "files.create", false, func() (*drive.File, error) {
+        if err := rewindFileData(); err != nil {
+            return nil, err
+        }
+
+        return srv.Files.
+            Create(file).
+            Media(req.FileData).
+            SupportsAllDrives(true).
+            Fields(catalogFileFields).
+            Context(ctx).
+            Do()
+    })
     if err != nil {
         return nil, err
     }
 
-    permission := getPermission(req.Permission)
-    _, err = srv.Permissions.Create(response.Id, permission).Do()
-    if err != nil {
-        return nil, err
+    if permission := getPermission(req.Permission); permission != nil {
+        _, err = retryCall(ctx, service.RetryPolicy, "permissions.create", false, func() (*drive.Permission, error) {
+            return srv.Permissions.Create(response.Id, permission).SupportsAllDrives(true).Context(ctx).Do()
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    if err := service.catalogFile(ctx, req.UserID, req.Email, response); err != nil {
+        return response, err
     }
 
     return response, nil
@@ -157,6 +200,9 @@ type ListFilesInFolderRequest struct {
     UserID   string `json:"user_id" validate:"required"`
     Email    string `json:"email" validate:"required"`
     FolderID string `json:"folder_id"`
+
+    // DriveID must be set when the folder is in a shared drive
+    DriveID string `json:"drive_id"`
 }
 
 func (service *GoogleDriveService) ListFilesInFolder(ctx context.Context, req *ListFilesInFolderRequest) ([]*drive.File, error) {
@@ -173,11 +219,15 @@ func (service *GoogleDriveService) ListFilesInFolder(ctx context.Context, req *L
 
     q := fmt.Sprintf("mimeType != '%s' and trashed = false and '%s' in parents", MimeTypeFolder, req.FolderID)
 
-    request := srv.Files.List().Q(q).Spaces("drive").
-        Fields("nextPageToken, files(id, name, mimeType)").
-        Corpora("user") // owned by the user.
+    request := srv.Files.List().SupportsAllDrives(true).IncludeItemsFromAllDrives(true).Q(q).Spaces("drive").
+        Fields("nextPageToken, files(id, name, mimeType)")
 
-    response, err := request.Do()
+    // owned by the user unless the folder is in a shared drive
+    request = withDriveCorpora(request, req.DriveID, "user")
+
+    response, err := retryCall(ctx, service.RetryPolicy, "files.list", true, func() (*drive.FileList, error) {
+        return request.Context(ctx).Do()
+    })
     if err != nil {
         return nil, fmt.Errorf("error listing files: %w", err)
     }
@@ -203,7 +253,14 @@ func (service *GoogleDriveService) Delete(ctx context.Context, req *DeleteResour
         return fmt.Errorf("error creating google drive service: %w", err)
     }
 
-    return srv.Files.Delete(req.ResourceID).Do()
+    err = retryDo(ctx, service.RetryPolicy, "files.delete", true, func() error {
+        return srv.Files.Delete(req.ResourceID).SupportsAllDrives(true).Context(ctx).Do()
+    })
+    if err != nil {
+        return err
+    }
+
+    return service.catalogRemove(ctx, req.UserID, req.Email, req.ResourceID)
 }
 
 type GetFileRequest struct {
@@ -224,7 +281,9 @@ func (service *GoogleDriveService) GetFile(ctx context.Context, req *GetFileRequ
         return nil, fmt.Errorf("error creating google drive service: %w", err)
     }
 
-    return srv.Files.Get(req.FileID).Do()
+    return retryCall(ctx, service.RetryPolicy, "files.get", true, func() (*drive.File, error) {
+        return srv.Files.Get(req.FileID).SupportsAllDrives(true).Context(ctx).Do()
+    })
 }
 
 func (service *GoogleDriveService) GetFileWithURL(ctx context.Context, req *GetFileRequest) (*drive.File, error) {
@@ -239,7 +298,9 @@ func (service *GoogleDriveService) GetFileWithURL(ctx context.Context, req *GetF
         return nil, fmt.Errorf("error creating google drive service: %w", err)
     }
 
-    return srv.Files.Get(req.FileID).Fields("webViewLink").Do()
+    return retryCall(ctx, service.RetryPolicy, "files.get", true, func() (*drive.File, error) {
+        return srv.Files.Get(req.FileID).SupportsAllDrives(true).Fields("webViewLink").Context(ctx).Do()
+    })
 }
 
 type DownloadFileRequest struct {
@@ -268,11 +329,18 @@ func (service *GoogleDriveService) DownloadFile(ctx context.Context, req *Downlo
         return nil, fmt.Errorf("error creating google drive service: %w", err)
     }
 
-    fileInfo, err := srv.Files.Get(req.FileID).Do(googleapi.QueryParameter("alt", "media"))
+    fileInfo, err := retryCall(ctx, service.RetryPolicy, "files.get", true, func() (*drive.File, error) {
+        return srv.Files.Get(req.FileID).SupportsAllDrives(true).Context(ctx).Do()
+    })
+    if err != nil {
+        return nil, err
+    }
 
-    file, err := srv.Files.Get(req.FileID).Download(
-        googleapi.QueryParameter("alt", "media"),
-    )
+    file, err := retryCall(ctx, service.RetryPolicy, "files.get", true, func() (*http.Response, error) {
+        return srv.Files.Get(req.FileID).SupportsAllDrives(true).Context(ctx).Download(
+            googleapi.QueryParameter("alt", "media"),
+        )
+    })
 
     if err != nil {
         return nil, err
@@ -298,27 +366,21 @@ type (
     }
 
     StorageInfo struct {
-        ID              string `json:"id"`
-        Limit           int64  `json:"limit"`
-        Usage           int64  `json:"usage"`
-        Remaining       int64  `json:"remaining"`
-        UsagePercentage int64  `json:"usage_percentage"`
-        IsUnlimited     bool   `json:"is_unlimited"`
+        ID                string `json:"id"`
+        Email             string `json:"email"`
+        Limit             int64  `json:"limit"`
+        Usage             int64  `json:"usage"`
+        UsageInDrive      int64  `json:"usage_in_drive"`
+        UsageInDriveTrash int64  `json:"usage_in_drive_trash"`
+        Remaining         int64  `json:"remaining"`
+        UsagePercentage   int64  `json:"usage_percentage"`
+        IsUnlimited       bool   `json:"is_unlimited"`
     }
 )
 
 func (service *GoogleDriveService) ListStorageInfo(ctx context.Context, req *ListStorageInfoRequest) ([]StorageInfo, error) {
-    type listUserEmailRequest struct {
-        Email string `json:"email"`
-    }
-
-    listUserEmail := make([]listUserEmailRequest, 0)
-    if err := service.DB.
-        Model(&OAuthToken{}).
-        Where("user_id = ?", req.UserID).
-        Select("email").
-        Scan(&listUserEmail).
-        Error; err != nil {
+    listUserEmail, err := service.OAuthService.ListUserTokens(ctx, &ListUserTokensRequest{UserID: req.UserID})
+    if err != nil {
         return nil, err
     }
 
@@ -353,6 +415,10 @@ func (service *GoogleDriveService) ListStorageInfo(ctx context.Context, req *Lis
         return nil, err
     }
 
+    sort.Slice(listStorage, func(i, j int) bool {
+        return listStorage[i].Email < listStorage[j].Email
+    })
+
     return listStorage, nil
 }
 
@@ -367,15 +433,22 @@ func (service *GoogleDriveService) GetStorageInfo(ctx context.Context, req *GetS
         return nil, fmt.Errorf("error creating Google Drive service: %w", err)
     }
 
-    var oauthToken OAuthToken
-
-    service.DB.
-        Model(&OAuthToken{}).
-        Where("user_id = ? AND email = ?", req.UserID, req.Email).
-        First(&oauthToken)
+    // accounts impersonated with the service account have no token row and no ID
+    oauthToken, err := service.OAuthService.GetUserToken(ctx, &GetUserTokenRequest{
+        UserID: req.UserID,
+        Email:  req.Email,
+    })
+    if errors.Is(err, ErrTokenNotFound) && service.authMode(ctx, req.UserID, req.Email) == AuthModeServiceAccount {
+        oauthToken, err = &OAuthToken{}, nil
+    }
+    if err != nil {
+        return nil, err
+    }
 
     about := srv.About.Get()
-    aboutResult, err := about.Fields("storageQuota").Do()
+    aboutResult, err := retryCall(ctx, service.RetryPolicy, "about.get", true, func() (*drive.About, error) {
+        return about.Fields("storageQuota").Context(ctx).Do()
+    })
     if err != nil {
         return nil, fmt.Errorf("unable to get About info: %w", err)
     }
@@ -383,9 +456,12 @@ func (service *GoogleDriveService) GetStorageInfo(ctx context.Context, req *GetS
     quota := aboutResult.StorageQuota
 
     info := &StorageInfo{
-        ID:    oauthToken.ID,
-        Limit: quota.Limit,
-        Usage: quota.Usage,
+        ID:                oauthToken.ID,
+        Email:             req.Email,
+        Limit:             quota.Limit,
+        Usage:             quota.Usage,
+        UsageInDrive:      quota.UsageInDrive,
+        UsageInDriveTrash: quota.UsageInDriveTrash,
     }
 
     if quota.Limit == 0 || quota.Limit == -1 {
@@ -438,7 +514,9 @@ func (service *GoogleDriveService) RenameResource(ctx context.Context, req *Rena
     }
 
     // Check if resource exists
-    _, err = srv.Files.Get(req.ResourceID).Fields("id, name, mimeType").Do()
+    _, err = retryCall(ctx, service.RetryPolicy, "files.get", true, func() (*drive.File, error) {
+        return srv.Files.Get(req.ResourceID).SupportsAllDrives(true).Fields("id, name, mimeType").Context(ctx).Do()
+    })
     if err != nil {
         return nil, fmt.Errorf("error getting resource: %w", err)
     }
@@ -449,13 +527,20 @@ func (service *GoogleDriveService) RenameResource(ctx context.Context, req *Rena
     }
 
     // Perform update
-    updatedFile, err := srv.Files.Update(req.ResourceID, updateFile).
-        Fields("id, name, mimeType, modifiedTime").
-        Do()
+    updatedFile, err := retryCall(ctx, service.RetryPolicy, "files.update", true, func() (*drive.File, error) {
+        return srv.Files.Update(req.ResourceID, updateFile).SupportsAllDrives(true).
+            Fields("id, name, mimeType, modifiedTime").
+            Context(ctx).
+            Do()
+    })
     if err != nil {
         return nil, fmt.Errorf("error renaming resource: %w", err)
     }
 
+    if err := service.catalogMove(ctx, req.UserID, req.Email, updatedFile); err != nil {
+        return updatedFile, err
+    }
+
     return updatedFile, nil
 }
 
@@ -489,16 +574,23 @@ func (service *GoogleDriveService) MoveResource(ctx context.Context, req *MoveRe
     }
 
     // Move the file to new parent
-    updatedFile, err := srv.Files.Update(req.ResourceID, file).
-        AddParents(req.NewParentID).
-        RemoveParents(strings.Join(req.OldParentIDs, ",")).
-        Fields("id, name, parents, mimeType").
-        Do()
+    updatedFile, err := retryCall(ctx, service.RetryPolicy, "files.update", true, func() (*drive.File, error) {
+        return srv.Files.Update(req.ResourceID, file).SupportsAllDrives(true).
+            AddParents(req.NewParentID).
+            RemoveParents(strings.Join(req.OldParentIDs, ",")).
+            Fields("id, name, parents, mimeType").
+            Context(ctx).
+            Do()
+    })
 
     if err != nil {
         return nil, fmt.Errorf("error moving resource: %w", err)
     }
 
+    if err := service.catalogMove(ctx, req.UserID, req.Email, updatedFile); err != nil {
+        return updatedFile, err
+    }
+
     return updatedFile, nil
 }
 
@@ -529,14 +621,21 @@ func (service *GoogleDriveService) CopyResource(ctx context.Context, req *CopyRe
     }
 
     // Perform copy operation
-    copiedFile, err := srv.Files.Copy(req.ResourceID, copyFile).
-        Fields("id, name, mimeType, parents").
-        Do()
+    copiedFile, err := retryCall(ctx, service.RetryPolicy, "files.copy", false, func() (*drive.File, error) {
+        return srv.Files.Copy(req.ResourceID, copyFile).SupportsAllDrives(true).
+            Fields(catalogFileFields).
+            Context(ctx).
+            Do()
+    })
 
     if err != nil {
         return nil, fmt.Errorf("error copying resource: %w", err)
     }
 
+    if err := service.catalogFile(ctx, req.UserID, req.Email, copiedFile); err != nil {
+        return copiedFile, err
+    }
+
     return copiedFile, nil
 }
 
@@ -548,6 +647,9 @@ type SearchResourcesRequest struct {
     PageSize  int64  `json:"page_size,omitempty"`
     MimeType  string `json:"mime_type,omitempty"`
     Trashed   bool   `json:"trashed,omitempty"`
+
+    // DriveID searches a shared drive
+    DriveID string `json:"drive_id,omitempty"`
 }
 
 func (service *GoogleDriveService) SearchResources(ctx context.Context, req *SearchResourcesRequest) ([]*drive.File, string, error) {
@@ -570,10 +672,12 @@ func (service *GoogleDriveService) SearchResources(ctx context.Context, req *Sea
     queryParts = append(queryParts, fmt.Sprintf("trashed = %t", req.Trashed))
 
     // Create list request
-    listReq := srv.Files.List().
+    listReq := srv.Files.List().SupportsAllDrives(true).IncludeItemsFromAllDrives(true).
         Q(strings.Join(queryParts, " and ")).
         Fields("nextPageToken, files(id, name, mimeType, parents, size, createdTime, modifiedTime)")
 
+    listReq = withDriveCorpora(listReq, req.DriveID, "")
+
     if req.PageToken != "" {
         listReq = listReq.PageToken(req.PageToken)
     }
@@ -582,7 +686,9 @@ func (service *GoogleDriveService) SearchResources(ctx context.Context, req *Sea
     }
 
     // Execute search
-    result, err := listReq.Do()
+    result, err := retryCall(ctx, service.RetryPolicy, "files.list", true, func() (*drive.FileList, error) {
+        return listReq.Context(ctx).Do()
+    })
     if err != nil {
         return nil, "", fmt.Errorf("error searching resources: %w", err)
     }
@@ -595,7 +701,7 @@ type UpdatePermissionRequest struct {
     Email        string `json:"email" validate:"required"`
     ResourceID   string `json:"resource_id" validate:"required"`
     EmailAddress string `json:"email_address" validate:"required,email"`
-    Role         string `json:"role" validate:"required,oneof=reader writer owner"`
+    Role         string `json:"role" validate:"required,oneof=reader commenter writer fileOrganizer organizer owner"`
     Type         string `json:"type" validate:"required,oneof=user group domain anyone"`
     NotifyEmail  bool   `json:"notify_email"`
 }
@@ -612,6 +718,10 @@ func (service *GoogleDriveService) UpdatePermissions(ctx context.Context, req *U
         return fmt.Errorf("error creating google drive service: %w", err)
     }
 
+    if !validPermissionRole(req.Role) {
+        return fmt.Errorf("error updating permissions: invalid role %q", req.Role)
+    }
+
     permission := &drive.Permission{
         EmailAddress: req.EmailAddress,
         Role:         req.Role,
@@ -619,9 +729,12 @@ func (service *GoogleDriveService) UpdatePermissions(ctx context.Context, req *U
     }
 
     // Create permission
-    _, err = srv.Permissions.Create(req.ResourceID, permission).
-        SendNotificationEmail(req.NotifyEmail).
-        Do()
+    _, err = retryCall(ctx, service.RetryPolicy, "permissions.create", false, func() (*drive.Permission, error) {
+        return srv.Permissions.Create(req.ResourceID, permission).SupportsAllDrives(true).
+            SendNotificationEmail(req.NotifyEmail).
+            Context(ctx).
+            Do()
+    })
 
     if err != nil {
         return fmt.Errorf("error updating permissions: %w", err)
@@ -664,9 +777,12 @@ func (service *GoogleDriveService) GetResourceMetadata(ctx context.Context, req
     if err != nil {
         return nil, fmt.Errorf("error creating google drive service: %w", err)
     }
-    file, err := srv.Files.Get(req.ResourceID).
-        Fields("id, name, mimeType, size, createdTime, modifiedTime, viewedByMeTime, owners, sharedWithMeTime, starred, trashed, webViewLink, iconLink, permissions").
-        Do()
+    file, err := retryCall(ctx, service.RetryPolicy, "files.get", true, func() (*drive.File, error) {
+        return srv.Files.Get(req.ResourceID).SupportsAllDrives(true).
+            Fields("id, name, mimeType, size, createdTime, modifiedTime, viewedByMeTime, owners, sharedWithMeTime, starred, trashed, webViewLink, iconLink, permissions").
+            Context(ctx).
+            Do()
+    })
 
     if err != nil {
         return nil, fmt.Errorf("error getting resource metadata: %w", err)
@@ -729,9 +845,13 @@ func (service *GoogleDriveService) RestoreFromTrash(ctx context.Context, req *Re
     }
 
     // Untrash the file
-    _, err = srv.Files.Update(req.ResourceID, &drive.File{
-        Trashed: false,
-    }).Do()
+    _, err = retryCall(ctx, service.RetryPolicy, "files.update", true, func() (*drive.File, error) {
+        // Trashed is false, which is omitted from the request unless forced
+        return srv.Files.Update(req.ResourceID, &drive.File{
+            Trashed:         false,
+            ForceSendFields: []string{"Trashed"},
+        }).SupportsAllDrives(true).Context(ctx).Do()
+    })
 
     if err != nil {
         return fmt.Errorf("error restoring resource from trash: %w", err)
@@ -757,7 +877,9 @@ func (service *GoogleDriveService) EmptyTrash(ctx context.Context, req *EmptyTra
         return fmt.Errorf("error creating google drive service: %w", err)
     }
 
-    err = srv.Files.EmptyTrash().Do()
+    err = retryDo(ctx, service.RetryPolicy, "files.emptyTrash", true, func() error {
+        return srv.Files.EmptyTrash().Context(ctx).Do()
+    })
     if err != nil {
         return fmt.Errorf("error emptying trash: %w", err)
     }
@@ -790,7 +912,9 @@ func (service *GoogleDriveService) ExportFile(ctx context.Context, req *ExportFi
         return nil, fmt.Errorf("error creating google drive service: %w", err)
     }
 
-    response, err := srv.Files.Export(req.FileID, req.MimeType).Download()
+    response, err := retryCall(ctx, service.RetryPolicy, "files.export", true, func() (*http.Response, error) {
+        return srv.Files.Export(req.FileID, req.MimeType).Context(ctx).Download()
+    })
     if err != nil {
         return nil, fmt.Errorf("error exporting file: %w", err)
     }
@@ -812,6 +936,9 @@ type GetFolderByNameRequest struct {
     UserID string `json:"user_id" validate:"required"`
     Email  string `json:"email" validate:"required"`
     Name   string `json:"name" validate:"required"`
+
+    // DriveID searches a shared drive instead of the folders owned by the user
+    DriveID string `json:"drive_id"`
 }
 
 func (service *GoogleDriveService) GetFolderByName(ctx context.Context, req *GetFolderByNameRequest) (*drive.File, error) {
@@ -826,13 +953,16 @@ func (service *GoogleDriveService) GetFolderByName(ctx context.Context, req *Get
     }
 
     q := fmt.Sprintf("mimeType = '%s' and name = '%s' and trashed = false", MimeTypeFolder, req.Name)
-    request := srv.Files.List().Q(q).
+    request := srv.Files.List().SupportsAllDrives(true).IncludeItemsFromAllDrives(true).Q(q).
         Spaces("drive").
         Fields("files(id, name, mimeType, parents)").
-        Corpora("user").
         PageSize(1) // Ambil satu folder yang cocok
 
-    response, err := request.Do()
+    request = withDriveCorpora(request, req.DriveID, "user")
+
+    response, err := retryCall(ctx, service.RetryPolicy, "files.list", true, func() (*drive.FileList, error) {
+        return request.Context(ctx).Do()
+    })
     if err != nil {
         return nil, fmt.Errorf("error searching folder: %w", err)
     }
@@ -0,0 +1,112 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// ErrServiceAccountKeyEmpty is returned when an account resolves to
+// AuthModeServiceAccount but no service account key is configured
+var ErrServiceAccountKeyEmpty = errors.New("service account key is not configured")
+
+// AuthMode selects how Drive requests authenticate as an account
+type AuthMode string
+
+const (
+	// AuthModeOAuth uses the token saved when the user connected the account
+	AuthModeOAuth AuthMode = "oauth"
+
+	// AuthModeServiceAccount signs requests with the service account key. The email
+	// of the request is impersonated with domain-wide delegation, unless it is the
+	// email of the service account itself. No token row is needed
+	AuthModeServiceAccount AuthMode = "service_account"
+)
+
+// AuthModeResolver chooses the auth mode of an account, an empty mode means AuthModeOAuth
+type AuthModeResolver func(userID, email string) AuthMode
+
+type authModeContextKey struct{}
+
+// ContextWithAuthMode selects the auth mode of every Drive request made with ctx,
+// it takes precedence over the AuthModeResolver
+func ContextWithAuthMode(ctx context.Context, mode AuthMode) context.Context {
+	return context.WithValue(ctx, authModeContextKey{}, mode)
+}
+
+// authMode resolves the auth mode of a request
+func (service *GoogleDriveService) authMode(ctx context.Context, userID, email string) AuthMode {
+	if mode, ok := ctx.Value(authModeContextKey{}).(AuthMode); ok && mode != "" {
+		return mode
+	}
+
+	if service.AuthModeResolver != nil {
+		if mode := service.AuthModeResolver(userID, email); mode != "" {
+			return mode
+		}
+	}
+
+	return AuthModeOAuth
+}
+
+// serviceAccountConfig returns the JWT config impersonating email
+func (service *GoogleDriveService) serviceAccountConfig(email string) (*jwt.Config, error) {
+	if len(service.ServiceAccountKey) == 0 {
+		return nil, ErrServiceAccountKeyEmpty
+	}
+
+	config, err := google.JWTConfigFromJSON(service.ServiceAccountKey, service.ScopeProfile.driveScope())
+	if err != nil {
+		return nil, fmt.Errorf("error parsing service account key: %w", err)
+	}
+
+	if email != "" && !strings.EqualFold(email, config.Email) {
+		config.Subject = email
+	}
+
+	return config, nil
+}
+
+// newServiceAccountClient returns the cached Drive client signed by the service account
+// for the account or builds a new one
+func (service *GoogleDriveService) newServiceAccountClient(ctx context.Context, req *newDriveServiceRequest) (*driveClient, error) {
+	tenantID := TenantFromContext(ctx)
+	if client, ok := service.serviceAccountClients.get(tenantID, req.UserID, req.Email); ok {
+		return client, nil
+	}
+
+	config, err := service.serviceAccountConfig(req.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	// the token source outlives the request, it fetches a new token when the current
+	// expires. Requests are rate limited per service account
+	httpClient := &http.Client{
+		Transport: &oauth2.Transport{
+			Source: oauth2.ReuseTokenSource(nil, config.TokenSource(context.Background())),
+			Base:   service.transport(config.Email, req.UserID, req.Email),
+		},
+	}
+
+	opt := []option.ClientOption{option.WithHTTPClient(httpClient)}
+	opt = append(opt, service.ClientOptions...)
+	srv, err := drive.NewService(ctx, opt...)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &driveClient{srv: srv, httpClient: httpClient}
+	service.serviceAccountClients.put(tenantID, req.UserID, req.Email, client, time.Time{})
+
+	return client, nil
+}
@@ -0,0 +1,195 @@
+package fundrive
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+const testServiceAccountEmail = "backup@project.iam.gserviceaccount.com"
+
+// newTestServiceAccountKey returns a service account key whose tokens are issued by tokenURL
+func newTestServiceAccountKey(t *testing.T, tokenURL string) []byte {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+
+	key, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "project",
+		"private_key_id": "key-id",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   testServiceAccountEmail,
+		"client_id":      "1234",
+		"token_uri":      tokenURL,
+	})
+	require.NoError(t, err)
+
+	return key
+}
+
+func TestGoogleDriveService_ServiceAccount(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		subjects []string
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+
+		// the assertion is a JWT signed with the key, its claims name the impersonated user
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		require.Len(t, parts, 3)
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		require.NoError(t, err)
+
+		var claims struct {
+			Iss   string `json:"iss"`
+			Sub   string `json:"sub"`
+			Scope string `json:"scope"`
+		}
+		require.NoError(t, json.Unmarshal(payload, &claims))
+		assert.Equal(t, testServiceAccountEmail, claims.Iss)
+		assert.Equal(t, drive.DriveReadonlyScope, claims.Scope)
+
+		mu.Lock()
+		subjects = append(subjects, claims.Sub)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "sa-token-" + claims.Sub,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	})
+	mux.HandleFunc("/drive/v3/files/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&drive.File{
+			Id:   strings.TrimPrefix(r.URL.Path, "/drive/v3/files/"),
+			Name: r.Header.Get("Authorization"),
+		})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	service := &GoogleDriveService{
+		OAuthService:          newStubOAuthService(t),
+		RetryPolicy:           NoRetryPolicy(),
+		ClientOptions:         []option.ClientOption{option.WithEndpoint(server.URL + "/drive/v3/")},
+		ScopeProfile:          ScopeProfileReadOnly,
+		ServiceAccountKey:     newTestServiceAccountKey(t, server.URL+"/token"),
+		serviceAccountClients: newDriveClientCache(DefaultClientCacheConfig()),
+		AuthModeResolver: func(userID, email string) AuthMode {
+			if strings.HasSuffix(email, "@corp.example.com") {
+				return AuthModeServiceAccount
+			}
+			return AuthModeOAuth
+		},
+	}
+	ctx := context.Background()
+
+	// resolved per account: the Workspace user is impersonated without a token row
+	file, err := service.GetFile(ctx, &GetFileRequest{UserID: "jobs", Email: "alice@corp.example.com", FileID: "f1"})
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer sa-token-alice@corp.example.com", file.Name)
+
+	// the cached client reuses its token
+	_, err = service.GetFile(ctx, &GetFileRequest{UserID: "jobs", Email: "alice@corp.example.com", FileID: "f2"})
+	require.NoError(t, err)
+
+	// selected per call: the service account acts as itself
+	saCtx := ContextWithAuthMode(ctx, AuthModeServiceAccount)
+	file, err = service.GetFile(saCtx, &GetFileRequest{UserID: "jobs", Email: testServiceAccountEmail, FileID: "f3"})
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer sa-token-", file.Name)
+
+	// other accounts keep their OAuth token
+	file, err = service.GetFile(ctx, &GetFileRequest{UserID: "user-1", Email: "bob@example.com", FileID: "f4"})
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer access-token", file.Name)
+
+	mu.Lock()
+	assert.Equal(t, []string{"alice@corp.example.com", ""}, subjects)
+	mu.Unlock()
+
+	// the mode is only available with a key
+	service.ServiceAccountKey = nil
+	service.InvalidateClient(ctx, "jobs", "alice@corp.example.com")
+	_, err = service.GetFile(ctx, &GetFileRequest{UserID: "jobs", Email: "alice@corp.example.com", FileID: "f1"})
+	assert.ErrorIs(t, err, ErrServiceAccountKeyEmpty)
+}
+
+func TestNew_ServiceAccountOnly(t *testing.T) {
+	key := newTestServiceAccountKey(t, "https://oauth2.googleapis.com/token")
+
+	service, err := New(
+		WithDB(newTestDB(t)),
+		WithServiceAccountKey(key),
+		WithEncryptionKey("12345678901234567890123456789012"),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, key, service.ServiceAccountKey)
+	assert.Equal(t, ScopeProfileFull.Scopes(), service.OauthConfig.Scopes)
+
+	_, err = New(WithDB(newTestDB(t)), WithEncryptionKey("12345678901234567890123456789012"))
+	assert.ErrorIs(t, err, ErrCredentialsEmpty)
+
+	_, err = New(WithDB(newTestDB(t)), WithServiceAccountKey([]byte("{}")), WithEncryptionKey("12345678901234567890123456789012"))
+	assert.Error(t, err)
+}
+
+func TestGoogleDriveService_GetStorageInfo_ServiceAccount(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"sa-token","token_type":"Bearer","expires_in":3600}`))
+	})
+	mux.HandleFunc("/drive/v3/about", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"storageQuota":{"limit":"100","usage":"40"}}`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	service := &GoogleDriveService{
+		// the impersonated account has no token row
+		OAuthService: &reportOAuthService{
+			stubOAuthService: newStubOAuthService(t),
+			revokedEmail:     "alice@corp.example.com",
+		},
+		RetryPolicy:           NoRetryPolicy(),
+		ClientOptions:         []option.ClientOption{option.WithEndpoint(server.URL + "/drive/v3/")},
+		ServiceAccountKey:     newTestServiceAccountKey(t, server.URL+"/token"),
+		serviceAccountClients: newDriveClientCache(DefaultClientCacheConfig()),
+		AuthModeResolver: func(userID, email string) AuthMode {
+			return AuthModeServiceAccount
+		},
+	}
+
+	info, err := service.GetStorageInfo(context.Background(), &GetStorageInfoRequest{UserID: "jobs", Email: "alice@corp.example.com"})
+	require.NoError(t, err)
+	assert.Empty(t, info.ID)
+	assert.Equal(t, int64(60), info.Remaining)
+
+	// an OAuth account without a token still fails
+	service.AuthModeResolver = nil
+	_, err = service.GetStorageInfo(context.Background(), &GetStorageInfoRequest{UserID: "jobs", Email: "alice@corp.example.com"})
+	assert.Error(t, err)
+}
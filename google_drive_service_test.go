@@ -0,0 +1,73 @@
+package fundrive
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+func TestGoogleDriveService_RestoreFromTrash(t *testing.T) {
+	var body map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPatch, r.Method)
+		assert.Equal(t, "/drive/v3/files/file-1", r.URL.Path)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"file-1","trashed":false}`))
+	}))
+	t.Cleanup(server.Close)
+
+	service := &GoogleDriveService{
+		OAuthService:  newStubOAuthService(t),
+		RetryPolicy:   NoRetryPolicy(),
+		ClientOptions: []option.ClientOption{option.WithEndpoint(server.URL + "/drive/v3/")},
+	}
+
+	err := service.RestoreFromTrash(context.Background(), &RestoreRequest{
+		UserID:     "user-1",
+		Email:      "a@example.com",
+		ResourceID: "file-1",
+	})
+	require.NoError(t, err)
+
+	// a false value is only sent when forced, an empty body would not untrash the file
+	assert.Equal(t, map[string]any{"trashed": false}, body)
+}
+
+func TestGoogleDriveService_UploadFile_SharedDrive(t *testing.T) {
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"file-1","name":"report.txt","parents":["drive-1"]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	service := &GoogleDriveService{
+		OAuthService:  newStubOAuthService(t),
+		RetryPolicy:   NoRetryPolicy(),
+		ClientOptions: []option.ClientOption{option.WithEndpoint(server.URL + "/drive/v3/")},
+	}
+
+	_, err := service.UploadFile(context.Background(), &UploadFileRequest{
+		UserID:     "user-1",
+		Email:      "a@example.com",
+		FileName:   "report.txt",
+		FileData:   strings.NewReader("data"),
+		Permission: PrivatePermission,
+		DriveID:    "drive-1",
+	})
+	require.NoError(t, err)
+
+	// Drive rejects a shared drive parent without the flag
+	assert.Equal(t, "true", query.Get("supportsAllDrives"))
+}
@@ -0,0 +1,178 @@
+package fundrive
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oklog/ulid/v2"
+	"google.golang.org/api/drive/v3"
+)
+
+// Permission roles accepted by Drive. RoleOrganizer and RoleFileOrganizer only
+// apply to shared drives and items inside them.
+const (
+	RoleOwner         = "owner"
+	RoleOrganizer     = "organizer"
+	RoleFileOrganizer = "fileOrganizer"
+	RoleWriter        = "writer"
+	RoleCommenter     = "commenter"
+	RoleReader        = "reader"
+)
+
+// validPermissionRole reports whether role can be granted on a file
+func validPermissionRole(role string) bool {
+	switch role {
+	case RoleOwner, RoleOrganizer, RoleFileOrganizer, RoleWriter, RoleCommenter, RoleReader:
+		return true
+	default:
+		return false
+	}
+}
+
+// withDriveCorpora scopes a list call to a shared drive when driveID is set,
+// otherwise to the given corpora, which is left unset when empty
+func withDriveCorpora(call *drive.FilesListCall, driveID, corpora string) *drive.FilesListCall {
+	if driveID != "" {
+		return call.Corpora("drive").DriveId(driveID)
+	}
+
+	if corpora != "" {
+		return call.Corpora(corpora)
+	}
+
+	return call
+}
+
+// driveParents places a new file at the root of the shared drive when no parent is given
+func driveParents(parents []string, driveID string) []string {
+	if len(parents) == 0 && driveID != "" {
+		return []string{driveID}
+	}
+	return parents
+}
+
+type ListSharedDrivesRequest struct {
+	UserID    string `json:"user_id" validate:"required"`
+	Email     string `json:"email" validate:"required"`
+	Query     string `json:"query"`
+	PageSize  int64  `json:"page_size"`
+	PageToken string `json:"page_token"`
+
+	// UseDomainAdminAccess lists every shared drive of the domain, the account
+	// must be a Workspace administrator
+	UseDomainAdminAccess bool `json:"use_domain_admin_access"`
+}
+
+// ListSharedDrives lists the shared drives the account is a member of
+func (service *GoogleDriveService) ListSharedDrives(ctx context.Context, req *ListSharedDrivesRequest) ([]*drive.Drive, string, error) {
+	srv, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: req.UserID, Email: req.Email})
+	if err != nil {
+		return nil, "", fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	request := srv.Drives.List().
+		Fields("nextPageToken, drives(id, name, createdTime, hidden)").
+		UseDomainAdminAccess(req.UseDomainAdminAccess)
+
+	if req.Query != "" {
+		request = request.Q(req.Query)
+	}
+	if req.PageSize > 0 {
+		request = request.PageSize(req.PageSize)
+	}
+	if req.PageToken != "" {
+		request = request.PageToken(req.PageToken)
+	}
+
+	response, err := retryCall(ctx, service.RetryPolicy, "drives.list", true, func() (*drive.DriveList, error) {
+		return request.Context(ctx).Do()
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing shared drives: %w", err)
+	}
+
+	return response.Drives, response.NextPageToken, nil
+}
+
+type CreateSharedDriveRequest struct {
+	UserID string `json:"user_id" validate:"required"`
+	Email  string `json:"email" validate:"required"`
+	Name   string `json:"name" validate:"required"`
+}
+
+func (r *CreateSharedDriveRequest) Validate() error {
+	if r.UserID == "" {
+		return ErrInvalidUserID
+	}
+	if r.Email == "" {
+		return ErrInvalidEmail
+	}
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	return nil
+}
+
+// CreateSharedDrive creates a shared drive, the account becomes its organizer
+func (service *GoogleDriveService) CreateSharedDrive(ctx context.Context, req *CreateSharedDriveRequest) (*drive.Drive, error) {
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid create shared drive request: %w", err)
+	}
+
+	srv, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: req.UserID, Email: req.Email})
+	if err != nil {
+		return nil, fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	// the request ID makes the creation idempotent, so it is safe to retry
+	requestID := ulid.Make().String()
+
+	response, err := retryCall(ctx, service.RetryPolicy, "drives.create", true, func() (*drive.Drive, error) {
+		return srv.Drives.Create(requestID, &drive.Drive{Name: req.Name}).Context(ctx).Do()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating shared drive: %w", err)
+	}
+
+	return response, nil
+}
+
+type GetSharedDriveRequest struct {
+	UserID  string `json:"user_id" validate:"required"`
+	Email   string `json:"email" validate:"required"`
+	DriveID string `json:"drive_id" validate:"required"`
+}
+
+// GetSharedDrive returns a shared drive by its ID
+func (service *GoogleDriveService) GetSharedDrive(ctx context.Context, req *GetSharedDriveRequest) (*drive.Drive, error) {
+	srv, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: req.UserID, Email: req.Email})
+	if err != nil {
+		return nil, fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	response, err := retryCall(ctx, service.RetryPolicy, "drives.get", true, func() (*drive.Drive, error) {
+		return srv.Drives.Get(req.DriveID).Context(ctx).Do()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting shared drive: %w", err)
+	}
+
+	return response, nil
+}
+
+// DeleteSharedDrive deletes an empty shared drive
+func (service *GoogleDriveService) DeleteSharedDrive(ctx context.Context, req *GetSharedDriveRequest) error {
+	srv, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: req.UserID, Email: req.Email})
+	if err != nil {
+		return fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	err = retryDo(ctx, service.RetryPolicy, "drives.delete", true, func() error {
+		return srv.Drives.Delete(req.DriveID).Context(ctx).Do()
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting shared drive: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package fundrive
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+func TestGoogleDriveService_ListFilesInFolderCorpora(t *testing.T) {
+	var queries []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"files":[]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	service := &GoogleDriveService{
+		OAuthService:  newStubOAuthService(t),
+		RetryPolicy:   NoRetryPolicy(),
+		ClientOptions: []option.ClientOption{option.WithEndpoint(server.URL + "/drive/v3/")},
+	}
+
+	ctx := context.Background()
+	_, err := service.ListFilesInFolder(ctx, &ListFilesInFolderRequest{UserID: "user-1", Email: "a@example.com", FolderID: "folder-1"})
+	require.NoError(t, err)
+
+	_, err = service.ListFilesInFolder(ctx, &ListFilesInFolderRequest{UserID: "user-1", Email: "a@example.com", FolderID: "folder-1", DriveID: "drive-1"})
+	require.NoError(t, err)
+
+	require.Len(t, queries, 2)
+	assert.Equal(t, "user", queries[0].Get("corpora"))
+	assert.Empty(t, queries[0].Get("driveId"))
+
+	assert.Equal(t, "drive", queries[1].Get("corpora"))
+	assert.Equal(t, "drive-1", queries[1].Get("driveId"))
+
+	for _, query := range queries {
+		assert.Equal(t, "true", query.Get("supportsAllDrives"))
+		assert.Equal(t, "true", query.Get("includeItemsFromAllDrives"))
+	}
+}
+
+func TestValidPermissionRole(t *testing.T) {
+	assert.True(t, validPermissionRole(RoleOrganizer))
+	assert.True(t, validPermissionRole(RoleFileOrganizer))
+	assert.False(t, validPermissionRole("admin"))
+}
@@ -0,0 +1,275 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/googleapi"
+)
+
+// DefaultStorageReportTTL is how long a storage report is cached when no TTL is configured
+const DefaultStorageReportTTL = time.Minute
+
+// nearlyFullPercentage is the usage from which an account is reported as nearly full
+const nearlyFullPercentage = 90
+
+// AccountStatus is the health of a connected account in a storage report
+type AccountStatus string
+
+const (
+	AccountStatusOK         AccountStatus = "ok"
+	AccountStatusNearlyFull AccountStatus = "nearly_full"
+	AccountStatusFull       AccountStatus = "full"
+
+	// AccountStatusUnauthorized means the stored token was revoked or expired and
+	// the account has to be connected again
+	AccountStatusUnauthorized AccountStatus = "unauthorized"
+	AccountStatusError        AccountStatus = "error"
+)
+
+// AccountStorage is the storage of a single connected account
+type AccountStorage struct {
+	StorageInfo
+	Status AccountStatus `json:"status"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// StorageTotals sums the storage of every account that reported it
+type StorageTotals struct {
+	Limit             int64 `json:"limit"`
+	Usage             int64 `json:"usage"`
+	UsageInDrive      int64 `json:"usage_in_drive"`
+	UsageInDriveTrash int64 `json:"usage_in_drive_trash"`
+	Remaining         int64 `json:"remaining"`
+	UsagePercentage   int64 `json:"usage_percentage"`
+
+	// IsUnlimited is set when any account has unlimited storage, Limit and
+	// Remaining then only cover the limited accounts
+	IsUnlimited bool `json:"is_unlimited"`
+}
+
+// StorageReport summarizes the storage of all connected accounts of a user
+type StorageReport struct {
+	UserID         string           `json:"user_id"`
+	Accounts       []AccountStorage `json:"accounts"`
+	Totals         StorageTotals    `json:"totals"`
+	FailedAccounts int              `json:"failed_accounts"`
+	GeneratedAt    time.Time        `json:"generated_at"`
+}
+
+// Partial reports whether some accounts are missing from the totals
+func (r *StorageReport) Partial() bool {
+	return r.FailedAccounts > 0
+}
+
+type GetStorageReportRequest struct {
+	UserID string `json:"user_id" validate:"required"`
+
+	// Refresh ignores the cached report
+	Refresh bool `json:"refresh"`
+}
+
+// GetStorageReport returns the storage of every connected account of the user with
+// totals. Accounts that fail are reported with an error status instead of failing
+// the whole report. Reports are cached for the configured TTL.
+func (service *GoogleDriveService) GetStorageReport(ctx context.Context, req *GetStorageReportRequest) (*StorageReport, error) {
+	if req.UserID == "" {
+		return nil, ErrInvalidUserID
+	}
+
+	if !req.Refresh {
+		if report, ok := service.storageReports.get(TenantFromContext(ctx), req.UserID); ok {
+			return report, nil
+		}
+	}
+
+	tokens, err := service.OAuthService.ListUserTokens(ctx, &ListUserTokensRequest{UserID: req.UserID})
+	if err != nil {
+		return nil, fmt.Errorf("error listing connected accounts: %w", err)
+	}
+
+	accounts := make([]AccountStorage, len(tokens))
+
+	g, gCtx := errgroup.WithContext(ctx)
+
+	for i, token := range tokens {
+		i, email := i, token.Email
+
+		g.Go(func() error {
+			storageInfo, err := service.GetStorageInfo(gCtx, &GetStorageInfoRequest{
+				UserID: req.UserID,
+				Email:  email,
+			})
+			if err != nil {
+				accounts[i] = AccountStorage{
+					StorageInfo: StorageInfo{Email: email},
+					Status:      accountErrorStatus(err),
+					Error:       err.Error(),
+				}
+				return nil
+			}
+
+			accounts[i] = AccountStorage{
+				StorageInfo: *storageInfo,
+				Status:      accountStorageStatus(storageInfo),
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	// a cancelled context makes every account fail, it is not a partial report
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Email < accounts[j].Email
+	})
+
+	report := newStorageReport(req.UserID, accounts)
+	service.storageReports.put(TenantFromContext(ctx), req.UserID, report)
+
+	return report, nil
+}
+
+func newStorageReport(userID string, accounts []AccountStorage) *StorageReport {
+	report := &StorageReport{
+		UserID:      userID,
+		Accounts:    accounts,
+		GeneratedAt: time.Now(),
+	}
+
+	totals := &report.Totals
+	for _, account := range accounts {
+		if account.Error != "" {
+			report.FailedAccounts++
+			continue
+		}
+
+		totals.Usage += account.Usage
+		totals.UsageInDrive += account.UsageInDrive
+		totals.UsageInDriveTrash += account.UsageInDriveTrash
+
+		if account.IsUnlimited {
+			totals.IsUnlimited = true
+			continue
+		}
+
+		totals.Limit += account.Limit
+		totals.Remaining += account.Remaining
+	}
+
+	if totals.Limit > 0 {
+		totals.UsagePercentage = (totals.Limit - totals.Remaining) * 100 / totals.Limit
+	}
+
+	return report
+}
+
+func accountStorageStatus(info *StorageInfo) AccountStatus {
+	switch {
+	case info.IsUnlimited:
+		return AccountStatusOK
+	case info.Remaining <= 0:
+		return AccountStatusFull
+	case info.UsagePercentage >= nearlyFullPercentage:
+		return AccountStatusNearlyFull
+	default:
+		return AccountStatusOK
+	}
+}
+
+func accountErrorStatus(err error) AccountStatus {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) || errors.Is(err, ErrTokenNotFound) {
+		return AccountStatusUnauthorized
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusUnauthorized {
+		return AccountStatusUnauthorized
+	}
+
+	return AccountStatusError
+}
+
+// storageReportCache keeps the latest storage report of each user for a TTL
+type storageReportCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	reports map[storageReportKey]*StorageReport
+	now     func() time.Time
+}
+
+type storageReportKey struct {
+	tenantID string
+	userID   string
+}
+
+// newStorageReportCache returns nil, which disables caching, when ttl is not positive
+func newStorageReportCache(ttl time.Duration) *storageReportCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &storageReportCache{
+		ttl:     ttl,
+		reports: make(map[storageReportKey]*StorageReport),
+		now:     time.Now,
+	}
+}
+
+func (c *storageReportCache) get(tenantID, userID string) (*StorageReport, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := storageReportKey{tenantID: tenantID, userID: userID}
+	report, ok := c.reports[key]
+	if !ok {
+		return nil, false
+	}
+
+	if c.now().Sub(report.GeneratedAt) >= c.ttl {
+		delete(c.reports, key)
+		return nil, false
+	}
+
+	return report, true
+}
+
+func (c *storageReportCache) put(tenantID, userID string, report *StorageReport) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reports[storageReportKey{tenantID: tenantID, userID: userID}] = report
+}
+
+func (c *storageReportCache) invalidate(tenantID, userID string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.reports, storageReportKey{tenantID: tenantID, userID: userID})
+}
@@ -0,0 +1,101 @@
+package fundrive
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+// reportOAuthService lists a fixed set of accounts, one of which has no token
+type reportOAuthService struct {
+	*stubOAuthService
+	emails       []string
+	revokedEmail string
+}
+
+func (s *reportOAuthService) ListUserTokens(ctx context.Context, req *ListUserTokensRequest) ([]OAuthToken, error) {
+	tokens := make([]OAuthToken, 0, len(s.emails))
+	for _, email := range s.emails {
+		tokens = append(tokens, OAuthToken{UserID: req.UserID, Email: email})
+	}
+	return tokens, nil
+}
+
+func (s *reportOAuthService) GetUserToken(ctx context.Context, req *GetUserTokenRequest) (*OAuthToken, error) {
+	if req.Email == s.revokedEmail {
+		return nil, ErrTokenNotFound
+	}
+	return s.stubOAuthService.GetUserToken(ctx, req)
+}
+
+func (s *reportOAuthService) GetToken(ctx context.Context, req *GetTokenRequest) (*oauth2.Token, error) {
+	if req.Email == s.revokedEmail {
+		return nil, ErrTokenNotFound
+	}
+	return s.stubOAuthService.GetToken(ctx, req)
+}
+
+func TestGoogleDriveService_GetStorageReport(t *testing.T) {
+	var aboutCalls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		aboutCalls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"storageQuota":{"limit":"100","usage":"95","usageInDrive":"80","usageInDriveTrash":"10"}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	service := &GoogleDriveService{
+		OAuthService: &reportOAuthService{
+			stubOAuthService: newStubOAuthService(t),
+			emails:           []string{"c@example.com", "a@example.com", "b@example.com"},
+			revokedEmail:     "b@example.com",
+		},
+		DB:             newTestDB(t, &OAuthToken{}),
+		RetryPolicy:    NoRetryPolicy(),
+		ClientOptions:  []option.ClientOption{option.WithEndpoint(server.URL + "/drive/v3/")},
+		storageReports: newStorageReportCache(time.Minute),
+	}
+
+	ctx := context.Background()
+	report, err := service.GetStorageReport(ctx, &GetStorageReportRequest{UserID: "user-1"})
+	require.NoError(t, err)
+
+	require.Len(t, report.Accounts, 3)
+	assert.Equal(t, "a@example.com", report.Accounts[0].Email)
+	assert.Equal(t, "token-a@example.com", report.Accounts[0].ID)
+	assert.Equal(t, AccountStatusNearlyFull, report.Accounts[0].Status)
+	assert.Equal(t, int64(80), report.Accounts[0].UsageInDrive)
+	assert.Equal(t, int64(10), report.Accounts[0].UsageInDriveTrash)
+
+	assert.Equal(t, "b@example.com", report.Accounts[1].Email)
+	assert.Equal(t, AccountStatusUnauthorized, report.Accounts[1].Status)
+	assert.NotEmpty(t, report.Accounts[1].Error)
+
+	assert.True(t, report.Partial())
+	assert.Equal(t, 1, report.FailedAccounts)
+	assert.Equal(t, StorageTotals{
+		Limit:             200,
+		Usage:             190,
+		UsageInDrive:      160,
+		UsageInDriveTrash: 20,
+		Remaining:         10,
+		UsagePercentage:   95,
+	}, report.Totals)
+
+	// the second report is served from the cache
+	_, err = service.GetStorageReport(ctx, &GetStorageReportRequest{UserID: "user-1"})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), aboutCalls.Load())
+
+	_, err = service.GetStorageReport(ctx, &GetStorageReportRequest{UserID: "user-1", Refresh: true})
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), aboutCalls.Load())
+}
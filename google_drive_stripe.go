@@ -0,0 +1,472 @@
+package fundrive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+)
+
+// DefaultStripePartSize is the part size used when UploadStripedRequest.PartSize is empty
+const DefaultStripePartSize int64 = 64 << 20
+
+var (
+	ErrInsufficientPoolSpace = errors.New("connected accounts do not have enough free space")
+	ErrStripedFileNotFound   = errors.New("striped file not found")
+	ErrStripeIntegrity       = errors.New("striped file integrity check failed")
+)
+
+// StripedFile is the manifest of a file split across several connected accounts
+type StripedFile struct {
+	ID        string        `json:"id" gorm:"column:id;type:char(26);primaryKey"`
+	TenantID  string        `json:"tenant_id" gorm:"column:tenant_id;type:varchar(64);not null;default:'';index:idx_fundrive_striped_files_tenant_user"`
+	UserID    string        `json:"user_id" gorm:"column:user_id;type:varchar(255);index:idx_fundrive_striped_files_tenant_user"`
+	Name      string        `json:"name" gorm:"column:name;type:varchar(1024)"`
+	MimeType  string        `json:"mime_type" gorm:"column:mime_type;type:varchar(255)"`
+	Size      int64         `json:"size" gorm:"column:size"`
+	PartSize  int64         `json:"part_size" gorm:"column:part_size"`
+	PartCount int           `json:"part_count" gorm:"column:part_count"`
+	SHA256    string        `json:"sha256" gorm:"column:sha256;type:char(64)"`
+	CreatedAt time.Time     `json:"created_at" gorm:"column:created_at"`
+	Parts     []StripedPart `json:"parts" gorm:"foreignKey:StripedFileID"`
+}
+
+// TableName returns the table name
+func (s *StripedFile) TableName() string {
+	return "fundrive_striped_files"
+}
+
+// StripedPart is a single part of a striped file stored in one account
+type StripedPart struct {
+	ID            string `json:"id" gorm:"column:id;type:char(26);primaryKey"`
+	TenantID      string `json:"tenant_id" gorm:"column:tenant_id;type:varchar(64);not null;default:''"`
+	StripedFileID string `json:"striped_file_id" gorm:"column:striped_file_id;type:char(26);index"`
+	PartIndex     int    `json:"part_index" gorm:"column:part_index"`
+	Email         string `json:"email" gorm:"column:email;type:varchar(255)"`
+	DriveFileID   string `json:"drive_file_id" gorm:"column:drive_file_id;type:varchar(255)"`
+	Offset        int64  `json:"offset" gorm:"column:offset"`
+	Size          int64  `json:"size" gorm:"column:size"`
+	SHA256        string `json:"sha256" gorm:"column:sha256;type:char(64)"`
+}
+
+// TableName returns the table name
+func (s *StripedPart) TableName() string {
+	return "fundrive_striped_parts"
+}
+
+// stripeAllocator hands out parts to the accounts with the most free space left
+type stripeAllocator struct {
+	accounts []PoolAccount
+	assigned map[string]int64
+	full     map[string]bool
+}
+
+func newStripeAllocator(accounts []PoolAccount) *stripeAllocator {
+	return &stripeAllocator{
+		accounts: accounts,
+		assigned: make(map[string]int64),
+		full:     make(map[string]bool),
+	}
+}
+
+// free returns the space left on the account after the assigned parts
+func (a *stripeAllocator) free(account PoolAccount) int64 {
+	return account.StorageInfo.Remaining - a.assigned[account.Email]
+}
+
+// next returns the account that receives a part of the given size
+func (a *stripeAllocator) next(size int64) (string, error) {
+	var (
+		best  *PoolAccount
+		bestF int64
+	)
+
+	for i := range a.accounts {
+		account := a.accounts[i]
+		if a.full[account.Email] {
+			continue
+		}
+
+		if account.StorageInfo.IsUnlimited {
+			return account.Email, nil
+		}
+
+		if free := a.free(account); free >= size && (best == nil || free > bestF) {
+			best = &a.accounts[i]
+			bestF = free
+		}
+	}
+
+	if best == nil {
+		return "", ErrInsufficientPoolSpace
+	}
+
+	return best.Email, nil
+}
+
+func (a *stripeAllocator) assign(email string, size int64) {
+	a.assigned[email] += size
+}
+
+// markFull excludes an account that rejected a part for lack of storage
+func (a *stripeAllocator) markFull(email string) {
+	a.full[email] = true
+}
+
+type UploadStripedRequest struct {
+	UserID     string     `json:"user_id" validate:"required"`
+	FileName   string     `json:"file_name" validate:"required"`
+	MimeType   string     `json:"mime_type"`
+	FileData   io.Reader  `json:"file_data"`
+	PartSize   int64      `json:"part_size"`
+	Permission Permission `json:"permission"`
+}
+
+func (r *UploadStripedRequest) Validate() error {
+	if r.UserID == "" {
+		return ErrInvalidUserID
+	}
+	if r.FileName == "" {
+		return fmt.Errorf("file name is required")
+	}
+	if r.FileData == nil {
+		return fmt.Errorf("file data is required")
+	}
+	if r.PartSize < 0 {
+		return fmt.Errorf("part size must not be negative")
+	}
+	return nil
+}
+
+// UploadStriped splits a stream into parts and distributes them across the user's
+// connected accounts by free space, so files larger than any single account can be
+// stored. Every part is staged in a temporary file before it is uploaded.
+func (service *GoogleDriveService) UploadStriped(ctx context.Context, req *UploadStripedRequest) (*StripedFile, error) {
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid striped upload request: %w", err)
+	}
+
+	partSize := req.PartSize
+	if partSize == 0 {
+		partSize = DefaultStripePartSize
+	}
+
+	accounts, err := service.listPoolAccounts(ctx, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := StripedFile{
+		ID:       ulid.Make().String(),
+		TenantID: TenantFromContext(ctx),
+		UserID:   req.UserID,
+		Name:     req.FileName,
+		MimeType: req.MimeType,
+		PartSize: partSize,
+	}
+
+	allocator := newStripeAllocator(accounts)
+	fileHash := sha256.New()
+	source := io.TeeReader(req.FileData, fileHash)
+
+	for index := 0; ; index++ {
+		part, err := service.uploadStripePart(ctx, req, allocator, source, &manifest, index)
+		if err != nil {
+			service.deleteStripeParts(ctx, req.UserID, manifest.Parts)
+			return nil, err
+		}
+
+		if part == nil {
+			break
+		}
+
+		manifest.Parts = append(manifest.Parts, *part)
+		manifest.Size += part.Size
+	}
+
+	manifest.PartCount = len(manifest.Parts)
+	manifest.SHA256 = hex.EncodeToString(fileHash.Sum(nil))
+
+	if err := service.DB.WithContext(ctx).Create(&manifest).Error; err != nil {
+		service.deleteStripeParts(ctx, req.UserID, manifest.Parts)
+		return nil, fmt.Errorf("failed to save striped file manifest: %w", err)
+	}
+
+	return &manifest, nil
+}
+
+// uploadStripePart stages the next part of the source and uploads it. It returns
+// nil when the source is exhausted.
+func (service *GoogleDriveService) uploadStripePart(
+	ctx context.Context,
+	req *UploadStripedRequest,
+	allocator *stripeAllocator,
+	source io.Reader,
+	manifest *StripedFile,
+	index int,
+) (*StripedPart, error) {
+	staging, err := os.CreateTemp("", "fundrive-stripe-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating part staging file: %w", err)
+	}
+	defer os.Remove(staging.Name())
+	defer staging.Close()
+
+	partHash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(staging, partHash), io.LimitReader(source, manifest.PartSize))
+	if err != nil {
+		return nil, fmt.Errorf("error reading part %d: %w", index, err)
+	}
+
+	// an empty file still gets a single empty part
+	if size == 0 && index > 0 {
+		return nil, nil
+	}
+
+	for {
+		email, err := allocator.next(size)
+		if err != nil {
+			return nil, fmt.Errorf("error allocating part %d: %w", index, err)
+		}
+
+		if _, err := staging.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("error rewinding part %d: %w", index, err)
+		}
+
+		file, err := service.UploadFile(ctx, &UploadFileRequest{
+			UserID:     req.UserID,
+			Email:      email,
+			FileName:   fmt.Sprintf("%s.part%04d", req.FileName, index),
+			MimeType:   "application/octet-stream",
+			FileData:   staging,
+			Permission: req.Permission,
+		})
+		if isStorageQuotaError(err) {
+			allocator.markFull(email)
+			continue
+		}
+
+		// the part is stored when only the catalog could not be updated
+		if err != nil && !errors.Is(err, ErrCatalogUpdate) {
+			return nil, fmt.Errorf("error uploading part %d: %w", index, err)
+		}
+
+		allocator.assign(email, size)
+
+		return &StripedPart{
+			ID:            ulid.Make().String(),
+			TenantID:      manifest.TenantID,
+			StripedFileID: manifest.ID,
+			PartIndex:     index,
+			Email:         email,
+			DriveFileID:   file.Id,
+			Offset:        manifest.Size,
+			Size:          size,
+			SHA256:        hex.EncodeToString(partHash.Sum(nil)),
+		}, nil
+	}
+}
+
+// deleteStripeParts removes uploaded parts, errors are ignored because the parts are
+// orphaned either way
+func (service *GoogleDriveService) deleteStripeParts(ctx context.Context, userID string, parts []StripedPart) {
+	for _, part := range parts {
+		_ = service.Delete(ctx, &DeleteResourceRequest{
+			UserID:     userID,
+			Email:      part.Email,
+			ResourceID: part.DriveFileID,
+		})
+	}
+}
+
+type GetStripedFileRequest struct {
+	UserID string `json:"user_id" validate:"required"`
+	ID     string `json:"id" validate:"required"`
+}
+
+// GetStripedFile returns the manifest of a striped file with its parts in order
+func (service *GoogleDriveService) GetStripedFile(ctx context.Context, req *GetStripedFileRequest) (*StripedFile, error) {
+	var manifest StripedFile
+
+	err := service.DB.WithContext(ctx).
+		Preload("Parts", func(db *gorm.DB) *gorm.DB {
+			return db.Scopes(tenantScope).Order("part_index")
+		}).
+		Scopes(tenantScope).
+		Where("user_id = ? AND id = ?", req.UserID, req.ID).
+		First(&manifest).
+		Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrStripedFileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get striped file: %w", err)
+	}
+
+	return &manifest, nil
+}
+
+// DeleteStripedFile deletes every part of a striped file and its manifest
+func (service *GoogleDriveService) DeleteStripedFile(ctx context.Context, req *GetStripedFileRequest) error {
+	manifest, err := service.GetStripedFile(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range manifest.Parts {
+		err := service.Delete(ctx, &DeleteResourceRequest{
+			UserID:     req.UserID,
+			Email:      part.Email,
+			ResourceID: part.DriveFileID,
+		})
+		if err != nil && !isNotFoundError(err) {
+			return fmt.Errorf("error deleting part %d: %w", part.PartIndex, err)
+		}
+	}
+
+	return service.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Scopes(tenantScope).Where("striped_file_id = ?", manifest.ID).Delete(&StripedPart{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(manifest).Error
+	})
+}
+
+// OpenStriped returns a reader that downloads the parts of a striped file in order
+// and verifies the checksum of every part and of the whole file. A checksum
+// mismatch surfaces as ErrStripeIntegrity from Read.
+func (service *GoogleDriveService) OpenStriped(ctx context.Context, req *GetStripedFileRequest) (*StripedFileReader, error) {
+	manifest, err := service.GetStripedFile(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(manifest.Parts) != manifest.PartCount {
+		return nil, fmt.Errorf("%w: manifest lists %d parts, found %d", ErrStripeIntegrity, manifest.PartCount, len(manifest.Parts))
+	}
+
+	return &StripedFileReader{
+		ctx:      ctx,
+		service:  service,
+		manifest: manifest,
+		fileHash: sha256.New(),
+	}, nil
+}
+
+// StripedFileReader streams a striped file part by part
+type StripedFileReader struct {
+	ctx      context.Context
+	service  *GoogleDriveService
+	manifest *StripedFile
+
+	index    int
+	current  io.ReadCloser
+	read     int64
+	partHash hash.Hash
+	fileHash hash.Hash
+}
+
+// Manifest returns the manifest of the file being read
+func (r *StripedFileReader) Manifest() *StripedFile {
+	return r.manifest
+}
+
+func (r *StripedFileReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.index >= len(r.manifest.Parts) {
+				return 0, r.verifyFile()
+			}
+
+			if err := r.openPart(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.current.Read(p)
+		if n > 0 {
+			r.read += int64(n)
+			r.partHash.Write(p[:n])
+			r.fileHash.Write(p[:n])
+		}
+
+		if err == io.EOF {
+			if err := r.closePart(); err != nil {
+				return n, err
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+
+		return n, err
+	}
+}
+
+func (r *StripedFileReader) openPart() error {
+	part := r.manifest.Parts[r.index]
+
+	if part.PartIndex != r.index {
+		return fmt.Errorf("%w: expected part %d, found %d", ErrStripeIntegrity, r.index, part.PartIndex)
+	}
+
+	download, err := r.service.DownloadFile(r.ctx, &DownloadFileRequest{
+		UserID: r.manifest.UserID,
+		Email:  part.Email,
+		FileID: part.DriveFileID,
+	})
+	if err != nil {
+		return fmt.Errorf("error downloading part %d: %w", part.PartIndex, err)
+	}
+
+	r.current = download.Response.Body
+	r.read = 0
+	r.partHash = sha256.New()
+
+	return nil
+}
+
+func (r *StripedFileReader) closePart() error {
+	part := r.manifest.Parts[r.index]
+
+	r.current.Close()
+	r.current = nil
+	r.index++
+
+	if r.read != part.Size {
+		return fmt.Errorf("%w: part %d has %d bytes, expected %d", ErrStripeIntegrity, part.PartIndex, r.read, part.Size)
+	}
+
+	if sum := hex.EncodeToString(r.partHash.Sum(nil)); sum != part.SHA256 {
+		return fmt.Errorf("%w: part %d checksum mismatch", ErrStripeIntegrity, part.PartIndex)
+	}
+
+	return nil
+}
+
+func (r *StripedFileReader) verifyFile() error {
+	if sum := hex.EncodeToString(r.fileHash.Sum(nil)); sum != r.manifest.SHA256 {
+		return fmt.Errorf("%w: file checksum mismatch", ErrStripeIntegrity)
+	}
+	return io.EOF
+}
+
+// Close releases the part currently being downloaded
+func (r *StripedFileReader) Close() error {
+	if r.current != nil {
+		err := r.current.Close()
+		r.current = nil
+		return err
+	}
+	return nil
+}
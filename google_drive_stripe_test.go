@@ -0,0 +1,148 @@
+package fundrive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+func TestStripeAllocator(t *testing.T) {
+	allocator := newStripeAllocator([]PoolAccount{
+		{Email: "a@example.com", StorageInfo: StorageInfo{Remaining: 25}},
+		{Email: "b@example.com", StorageInfo: StorageInfo{Remaining: 15}},
+	})
+
+	var emails []string
+	for i := 0; i < 3; i++ {
+		email, err := allocator.next(10)
+		require.NoError(t, err)
+		allocator.assign(email, 10)
+		emails = append(emails, email)
+	}
+
+	assert.Equal(t, []string{"a@example.com", "a@example.com", "b@example.com"}, emails)
+
+	// both accounts have 5 bytes left
+	_, err := allocator.next(10)
+	assert.ErrorIs(t, err, ErrInsufficientPoolSpace)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func newStripeTestService(t *testing.T, contents map[string]string) *GoogleDriveService {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/drive/v3/files/")
+		if r.URL.Query().Get("alt") == "media" {
+			io.WriteString(w, contents[id])
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/about") {
+			io.WriteString(w, `{"storageQuota":{"limit":"1000","usage":"0"}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"id":%q,"name":%q}`, id, id)
+	}))
+	t.Cleanup(server.Close)
+
+	return &GoogleDriveService{
+		OAuthService:  newStubOAuthService(t),
+		DB:            newTestDB(t, &StripedFile{}, &StripedPart{}),
+		RetryPolicy:   NoRetryPolicy(),
+		ClientOptions: []option.ClientOption{option.WithEndpoint(server.URL + "/drive/v3/")},
+	}
+}
+
+func createStripeManifest(t *testing.T, service *GoogleDriveService, parts map[string]string, order []string) *StripedFile {
+	manifest := StripedFile{ID: "01HSTRIPED0000000000000000", UserID: "user-1", Name: "big.bin", PartCount: len(order)}
+
+	var whole string
+	for i, id := range order {
+		manifest.Parts = append(manifest.Parts, StripedPart{
+			ID:            fmt.Sprintf("01HPART%019d", i),
+			StripedFileID: manifest.ID,
+			PartIndex:     i,
+			Email:         fmt.Sprintf("account-%d@example.com", i),
+			DriveFileID:   id,
+			Offset:        int64(len(whole)),
+			Size:          int64(len(parts[id])),
+			SHA256:        sha256Hex(parts[id]),
+		})
+		whole += parts[id]
+	}
+	manifest.Size = int64(len(whole))
+	manifest.SHA256 = sha256Hex(whole)
+
+	require.NoError(t, service.DB.Create(&manifest).Error)
+	return &manifest
+}
+
+func TestGoogleDriveService_OpenStriped(t *testing.T) {
+	contents := map[string]string{"part-0": "hello, ", "part-1": "striped ", "part-2": "world"}
+	service := newStripeTestService(t, contents)
+	manifest := createStripeManifest(t, service, contents, []string{"part-0", "part-1", "part-2"})
+
+	reader, err := service.OpenStriped(context.Background(), &GetStripedFileRequest{UserID: "user-1", ID: manifest.ID})
+	require.NoError(t, err)
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, striped world", string(data))
+}
+
+func TestGoogleDriveService_OpenStripedIntegrity(t *testing.T) {
+	contents := map[string]string{"part-0": "hello, ", "part-1": "world"}
+	service := newStripeTestService(t, contents)
+	manifest := createStripeManifest(t, service, contents, []string{"part-0", "part-1"})
+
+	// the stored part no longer matches the manifest
+	contents["part-1"] = "w0rld"
+
+	reader, err := service.OpenStriped(context.Background(), &GetStripedFileRequest{UserID: "user-1", ID: manifest.ID})
+	require.NoError(t, err)
+	defer reader.Close()
+
+	_, err = io.ReadAll(reader)
+	assert.ErrorIs(t, err, ErrStripeIntegrity)
+}
+
+func TestGoogleDriveService_UploadStriped_CatalogFailure(t *testing.T) {
+	service := newStripeTestService(t, nil)
+	service.OAuthService = &reportOAuthService{
+		stubOAuthService: newStubOAuthService(t),
+		emails:           []string{"a@example.com"},
+	}
+	require.NoError(t, service.DB.AutoMigrate(&PoolUpload{}))
+
+	// the catalog table is missing, every catalog update fails
+	service.IsUseCatalog = true
+
+	manifest, err := service.UploadStriped(context.Background(), &UploadStripedRequest{
+		UserID:     "user-1",
+		FileName:   "big.bin",
+		FileData:   strings.NewReader("hello, striped world"),
+		PartSize:   8,
+		Permission: PrivatePermission,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, manifest.PartCount)
+
+	stored, err := service.GetStripedFile(context.Background(), &GetStripedFileRequest{UserID: "user-1", ID: manifest.ID})
+	require.NoError(t, err)
+	require.Len(t, stored.Parts, 3)
+	assert.Equal(t, "a@example.com", stored.Parts[0].Email)
+}
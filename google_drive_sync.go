@@ -0,0 +1,862 @@
+package fundrive
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"google.golang.org/api/drive/v3"
+	"gorm.io/gorm"
+)
+
+// ErrUnsafeSyncPath is returned for a path that resolves outside the local directory
+var ErrUnsafeSyncPath = errors.New("sync path is outside the local directory")
+
+// syncFileFields are the Drive fields needed to compare a file with its local copy
+const syncFileFields = "id, name, mimeType, parents, md5Checksum, size, modifiedTime"
+
+// SyncMode is the direction of a sync
+type SyncMode string
+
+const (
+	// SyncModePush makes the Drive folder mirror the local directory
+	SyncModePush SyncMode = "push"
+
+	// SyncModePull makes the local directory mirror the Drive folder
+	SyncModePull SyncMode = "pull"
+
+	// SyncModeBidirectional applies changes made on either side to the other
+	SyncModeBidirectional SyncMode = "bidirectional"
+)
+
+// ConflictResolution decides a file changed on both sides since the last sync
+type ConflictResolution string
+
+const (
+	// ConflictSkip leaves both versions untouched and reports the conflict
+	ConflictSkip        ConflictResolution = "skip"
+	ConflictPreferLocal ConflictResolution = "prefer_local"
+	ConflictPreferDrive ConflictResolution = "prefer_drive"
+
+	// ConflictNewest keeps the version with the latest modification time
+	ConflictNewest ConflictResolution = "newest"
+
+	// ConflictKeepBoth uploads the local version next to the Drive file under a
+	// conflict name and replaces the local file with the Drive version
+	ConflictKeepBoth ConflictResolution = "keep_both"
+)
+
+// SyncAction is an operation of a sync plan
+type SyncAction string
+
+const (
+	SyncActionUpload       SyncAction = "upload"
+	SyncActionDownload     SyncAction = "download"
+	SyncActionDeleteLocal  SyncAction = "delete_local"
+	SyncActionDeleteRemote SyncAction = "delete_remote"
+	SyncActionKeepBoth     SyncAction = "keep_both"
+
+	// SyncActionConflict is a conflict left unresolved, it is never applied
+	SyncActionConflict SyncAction = "conflict"
+)
+
+// SyncState is the state of a file after it was last synced
+type SyncState struct {
+	ID            string    `json:"id" gorm:"column:id;type:char(26);primaryKey"`
+	TenantID      string    `json:"tenant_id" gorm:"column:tenant_id;type:varchar(64);not null;default:'';index:idx_fundrive_sync_states_tenant_pair"`
+	UserID        string    `json:"user_id" gorm:"column:user_id;type:varchar(255);index:idx_fundrive_sync_states_tenant_pair"`
+	Email         string    `json:"email" gorm:"column:email;type:varchar(255);index:idx_fundrive_sync_states_tenant_pair"`
+	FolderID      string    `json:"folder_id" gorm:"column:folder_id;type:varchar(255);index:idx_fundrive_sync_states_tenant_pair"`
+	LocalRoot     string    `json:"local_root" gorm:"column:local_root;type:varchar(1024);index:idx_fundrive_sync_states_tenant_pair"`
+	Path          string    `json:"path" gorm:"column:path;type:varchar(2048)"`
+	LocalSize     int64     `json:"local_size" gorm:"column:local_size"`
+	LocalModTime  time.Time `json:"local_mod_time" gorm:"column:local_mod_time"`
+	LocalMD5      string    `json:"local_md5" gorm:"column:local_md5;type:varchar(32)"`
+	RemoteID      string    `json:"remote_id" gorm:"column:remote_id;type:varchar(255)"`
+	RemoteMD5     string    `json:"remote_md5" gorm:"column:remote_md5;type:varchar(32)"`
+	RemoteModTime time.Time `json:"remote_mod_time" gorm:"column:remote_mod_time"`
+	SyncedAt      time.Time `json:"synced_at" gorm:"column:synced_at"`
+}
+
+// TableName returns the table name
+func (s *SyncState) TableName() string {
+	return "fundrive_sync_states"
+}
+
+type SyncRequest struct {
+	UserID string `json:"user_id" validate:"required"`
+	Email  string `json:"email" validate:"required"`
+
+	// LocalPath is the local directory, FolderID the Drive folder it is synced with
+	LocalPath string `json:"local_path" validate:"required"`
+	FolderID  string `json:"folder_id" validate:"required"`
+
+	// Mode defaults to SyncModeBidirectional
+	Mode SyncMode `json:"mode"`
+
+	// Conflict defaults to ConflictSkip
+	Conflict ConflictResolution `json:"conflict"`
+
+	// DryRun only returns the plan
+	DryRun bool `json:"dry_run"`
+}
+
+func (r *SyncRequest) Validate() error {
+	if r.UserID == "" {
+		return ErrInvalidUserID
+	}
+	if r.Email == "" {
+		return ErrInvalidEmail
+	}
+	if r.LocalPath == "" || r.FolderID == "" {
+		return fmt.Errorf("local path and folder id are required")
+	}
+	switch r.Mode {
+	case "", SyncModePush, SyncModePull, SyncModeBidirectional:
+	default:
+		return fmt.Errorf("unknown sync mode %q", r.Mode)
+	}
+	switch r.Conflict {
+	case "", ConflictSkip, ConflictPreferLocal, ConflictPreferDrive, ConflictNewest, ConflictKeepBoth:
+	default:
+		return fmt.Errorf("unknown conflict resolution %q", r.Conflict)
+	}
+	return nil
+}
+
+// SyncOperation is a single step of a sync plan. Paths are relative and slash separated.
+type SyncOperation struct {
+	Action SyncAction `json:"action"`
+	Path   string     `json:"path"`
+	Reason string     `json:"reason"`
+}
+
+// SyncPlan lists the operations needed to reconcile both sides
+type SyncPlan struct {
+	Operations []SyncOperation `json:"operations"`
+
+	// InSync is the number of files already identical on both sides
+	InSync int `json:"in_sync"`
+
+	local   map[string]*syncEntry
+	remote  map[string]*syncEntry
+	folders map[string]string
+}
+
+// Conflicts returns the conflicts left unresolved
+func (p *SyncPlan) Conflicts() []SyncOperation {
+	conflicts := make([]SyncOperation, 0)
+	for _, operation := range p.Operations {
+		if operation.Action == SyncActionConflict {
+			conflicts = append(conflicts, operation)
+		}
+	}
+	return conflicts
+}
+
+// String formats the plan one operation per line for dry-run output
+func (p *SyncPlan) String() string {
+	var b strings.Builder
+	for _, operation := range p.Operations {
+		fmt.Fprintf(&b, "%-13s %s (%s)\n", operation.Action, operation.Path, operation.Reason)
+	}
+	fmt.Fprintf(&b, "%d operations, %d files in sync\n", len(p.Operations), p.InSync)
+	return b.String()
+}
+
+// SyncFailure is an operation that could not be applied
+type SyncFailure struct {
+	Operation SyncOperation `json:"operation"`
+	Error     string        `json:"error"`
+}
+
+type SyncResult struct {
+	Plan     *SyncPlan     `json:"plan"`
+	Applied  int           `json:"applied"`
+	Failures []SyncFailure `json:"failures"`
+}
+
+// syncEntry is a file on one side of a sync
+type syncEntry struct {
+	Path     string
+	Size     int64
+	ModTime  time.Time
+	MD5      string
+	ID       string
+	ParentID string
+}
+
+// PlanSync compares the local directory with the Drive folder and returns the
+// operations Sync would apply
+func (service *GoogleDriveService) PlanSync(ctx context.Context, req *SyncRequest) (*SyncPlan, error) {
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid sync request: %w", err)
+	}
+
+	root, err := filepath.Abs(req.LocalPath)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving local path: %w", err)
+	}
+
+	states, err := service.loadSyncStates(ctx, req, root)
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := scanLocal(root, states)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, folders, err := service.scanRemote(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	plan := planSync(local, remote, states, syncMode(req.Mode), syncConflict(req.Conflict))
+	plan.local = local
+	plan.remote = remote
+	plan.folders = folders
+
+	return plan, nil
+}
+
+// Sync reconciles the local directory with the Drive folder. Files changed since
+// the last sync are detected with the persisted state, files seen for the first time
+// are compared by MD5 checksum. Empty directories are not synced.
+func (service *GoogleDriveService) Sync(ctx context.Context, req *SyncRequest) (*SyncResult, error) {
+	plan, err := service.PlanSync(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SyncResult{Plan: plan, Failures: make([]SyncFailure, 0)}
+	if req.DryRun {
+		return result, nil
+	}
+
+	root, _ := filepath.Abs(req.LocalPath)
+
+	applier := &syncApplier{
+		service: service,
+		req:     req,
+		root:    root,
+		folders: plan.folders,
+	}
+
+	// record files that are already identical, so later runs detect their changes
+	for relPath, local := range plan.local {
+		remote, ok := plan.remote[relPath]
+		if ok && local.MD5 != "" && local.MD5 == remote.MD5 {
+			if err := applier.saveState(ctx, relPath, local, remote); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	for _, operation := range plan.Operations {
+		if operation.Action == SyncActionConflict {
+			continue
+		}
+
+		if err := applier.apply(ctx, operation, plan); err != nil {
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			result.Failures = append(result.Failures, SyncFailure{Operation: operation, Error: err.Error()})
+			continue
+		}
+
+		result.Applied++
+	}
+
+	return result, nil
+}
+
+func syncMode(mode SyncMode) SyncMode {
+	if mode == "" {
+		return SyncModeBidirectional
+	}
+	return mode
+}
+
+func syncConflict(conflict ConflictResolution) ConflictResolution {
+	if conflict == "" {
+		return ConflictSkip
+	}
+	return conflict
+}
+
+func (service *GoogleDriveService) loadSyncStates(ctx context.Context, req *SyncRequest, root string) (map[string]*SyncState, error) {
+	rows := make([]SyncState, 0)
+	err := service.DB.WithContext(ctx).
+		Scopes(tenantScope).
+		Where("user_id = ? AND email = ? AND folder_id = ? AND local_root = ?", req.UserID, req.Email, req.FolderID, root).
+		Find(&rows).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sync state: %w", err)
+	}
+
+	states := make(map[string]*SyncState, len(rows))
+	for i := range rows {
+		states[rows[i].Path] = &rows[i]
+	}
+
+	return states, nil
+}
+
+// scanLocal lists the regular files below root. The MD5 checksum is only computed
+// for files whose size or modification time changed since the last sync.
+func scanLocal(root string, states map[string]*SyncState) (map[string]*syncEntry, error) {
+	entries := make(map[string]*syncEntry)
+
+	err := filepath.WalkDir(root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		entry := &syncEntry{
+			Path:    rel,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+
+		if state, ok := states[rel]; ok && state.LocalSize == entry.Size && state.LocalModTime.Equal(entry.ModTime) {
+			entry.MD5 = state.LocalMD5
+		} else if entry.MD5, err = fileMD5(filePath); err != nil {
+			return err
+		}
+
+		entries[rel] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning local directory: %w", err)
+	}
+
+	return entries, nil
+}
+
+func fileMD5(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// scanRemote lists the files below the Drive folder by relative path and returns the
+// IDs of its subfolders. Google Docs files, which cannot be downloaded, are skipped.
+func (service *GoogleDriveService) scanRemote(ctx context.Context, req *SyncRequest) (map[string]*syncEntry, map[string]string, error) {
+	srv, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: req.UserID, Email: req.Email})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	entries := make(map[string]*syncEntry)
+	folders := map[string]string{"": req.FolderID}
+
+	queue := []string{""}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+
+		children, err := service.listFolderChildren(ctx, srv, folders[dir], syncFileFields, "")
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, child := range children {
+			// Drive names are not paths, a name like ".." would leave the local directory
+			if !isSyncName(child.Name) {
+				continue
+			}
+			rel := path.Join(dir, child.Name)
+
+			if child.MimeType == MimeTypeFolder {
+				if _, ok := folders[rel]; !ok {
+					folders[rel] = child.Id
+					queue = append(queue, rel)
+				}
+				continue
+			}
+
+			// Drive allows several files with the same name, the first one is synced
+			if child.Md5Checksum == "" || entries[rel] != nil {
+				continue
+			}
+
+			entry := &syncEntry{
+				Path:     rel,
+				Size:     child.Size,
+				MD5:      child.Md5Checksum,
+				ID:       child.Id,
+				ParentID: folders[dir],
+			}
+			if modifiedAt, err := time.Parse(time.RFC3339, child.ModifiedTime); err == nil {
+				entry.ModTime = modifiedAt
+			}
+
+			entries[rel] = entry
+		}
+	}
+
+	return entries, folders, nil
+}
+
+// planSync decides the operation of every path from the local and remote files and
+// the state recorded after the last sync
+func planSync(local, remote map[string]*syncEntry, states map[string]*SyncState, mode SyncMode, conflict ConflictResolution) *SyncPlan {
+	paths := make(map[string]struct{}, len(local)+len(remote))
+	for p := range local {
+		paths[p] = struct{}{}
+	}
+	for p := range remote {
+		paths[p] = struct{}{}
+	}
+
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	plan := &SyncPlan{Operations: make([]SyncOperation, 0)}
+	add := func(action SyncAction, p, reason string) {
+		plan.Operations = append(plan.Operations, SyncOperation{Action: action, Path: p, Reason: reason})
+	}
+
+	for _, p := range sorted {
+		l, r, state := local[p], remote[p], states[p]
+
+		localChanged := l != nil && (state == nil || l.MD5 != state.LocalMD5)
+		remoteChanged := r != nil && (state == nil || r.MD5 != state.RemoteMD5)
+
+		switch {
+		case l != nil && r != nil:
+			if l.MD5 == r.MD5 {
+				plan.InSync++
+				continue
+			}
+
+			switch mode {
+			case SyncModePush:
+				add(SyncActionUpload, p, "local file differs")
+			case SyncModePull:
+				add(SyncActionDownload, p, "drive file differs")
+			default:
+				switch {
+				case localChanged && !remoteChanged:
+					add(SyncActionUpload, p, "changed locally")
+				case remoteChanged && !localChanged:
+					add(SyncActionDownload, p, "changed on drive")
+				default:
+					resolveConflict(add, p, "changed on both sides", conflict, l.ModTime.After(r.ModTime))
+				}
+			}
+
+		case l != nil:
+			switch {
+			case state == nil && mode != SyncModePull:
+				add(SyncActionUpload, p, "new local file")
+			case state == nil:
+				// a local file that was never synced is left alone when pulling
+			case mode == SyncModePush:
+				add(SyncActionUpload, p, "missing on drive")
+			case mode == SyncModePull || !localChanged:
+				add(SyncActionDeleteLocal, p, "deleted on drive")
+			case conflict == ConflictPreferDrive:
+				add(SyncActionDeleteLocal, p, "deleted on drive, changed locally")
+			case conflict == ConflictSkip:
+				add(SyncActionConflict, p, "deleted on drive, changed locally")
+			default:
+				add(SyncActionUpload, p, "deleted on drive, changed locally")
+			}
+
+		case r != nil:
+			switch {
+			case state == nil && mode != SyncModePush:
+				add(SyncActionDownload, p, "new drive file")
+			case state == nil:
+				// a drive file that was never synced is left alone when pushing
+			case mode == SyncModePull:
+				add(SyncActionDownload, p, "missing locally")
+			case mode == SyncModePush || !remoteChanged:
+				add(SyncActionDeleteRemote, p, "deleted locally")
+			case conflict == ConflictPreferLocal:
+				add(SyncActionDeleteRemote, p, "deleted locally, changed on drive")
+			case conflict == ConflictSkip:
+				add(SyncActionConflict, p, "deleted locally, changed on drive")
+			default:
+				add(SyncActionDownload, p, "deleted locally, changed on drive")
+			}
+		}
+	}
+
+	return plan
+}
+
+func resolveConflict(add func(SyncAction, string, string), p, reason string, conflict ConflictResolution, localIsNewer bool) {
+	switch conflict {
+	case ConflictPreferLocal:
+		add(SyncActionUpload, p, reason+", keeping local")
+	case ConflictPreferDrive:
+		add(SyncActionDownload, p, reason+", keeping drive")
+	case ConflictNewest:
+		if localIsNewer {
+			add(SyncActionUpload, p, reason+", local is newer")
+		} else {
+			add(SyncActionDownload, p, reason+", drive is newer")
+		}
+	case ConflictKeepBoth:
+		add(SyncActionKeepBoth, p, reason+", keeping both")
+	default:
+		add(SyncActionConflict, p, reason)
+	}
+}
+
+// conflictName returns the name the local version of a conflicting file is uploaded under
+func conflictName(name string, at time.Time) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s (conflict %s)%s", strings.TrimSuffix(name, ext), at.Format("2006-01-02 150405"), ext)
+}
+
+// syncApplier applies the operations of a plan and records the resulting state
+type syncApplier struct {
+	service *GoogleDriveService
+	req     *SyncRequest
+	root    string
+	folders map[string]string
+}
+
+// isSyncName reports whether a Drive name can be used as a local file name
+func isSyncName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// localPath returns the local path of a relative sync path, refusing paths that
+// resolve outside the local directory
+func (a *syncApplier) localPath(relPath string) (string, error) {
+	local := filepath.FromSlash(relPath)
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("%w: %s", ErrUnsafeSyncPath, relPath)
+	}
+	return filepath.Join(a.root, local), nil
+}
+
+func (a *syncApplier) apply(ctx context.Context, operation SyncOperation, plan *SyncPlan) error {
+	relPath := operation.Path
+
+	switch operation.Action {
+	case SyncActionUpload:
+		return a.upload(ctx, relPath, plan.remote[relPath])
+
+	case SyncActionDownload:
+		return a.download(ctx, relPath, plan.remote[relPath])
+
+	case SyncActionKeepBoth:
+		name := conflictName(path.Base(relPath), time.Now())
+		if err := a.upload(ctx, path.Join(path.Dir(relPath), name), nil, relPath); err != nil {
+			return err
+		}
+		return a.download(ctx, relPath, plan.remote[relPath])
+
+	case SyncActionDeleteLocal:
+		localPath, err := a.localPath(relPath)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(localPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("error deleting local file: %w", err)
+		}
+		return a.deleteState(ctx, relPath)
+
+	case SyncActionDeleteRemote:
+		err := a.service.Delete(ctx, &DeleteResourceRequest{
+			UserID:     a.req.UserID,
+			Email:      a.req.Email,
+			ResourceID: plan.remote[relPath].ID,
+		})
+		if err != nil && !errors.Is(err, ErrCatalogUpdate) && !isNotFoundError(err) {
+			return fmt.Errorf("error deleting drive file: %w", err)
+		}
+		return a.deleteState(ctx, relPath)
+	}
+
+	return fmt.Errorf("unknown sync action %q", operation.Action)
+}
+
+// upload sends a local file to Drive, replacing the content of existing when set.
+// The local file is read from source when given, otherwise from relPath.
+func (a *syncApplier) upload(ctx context.Context, relPath string, existing *syncEntry, source ...string) error {
+	sourcePath := relPath
+	if len(source) > 0 {
+		sourcePath = source[0]
+	}
+
+	localPath, err := a.localPath(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("error opening local file: %w", err)
+	}
+	defer file.Close()
+
+	var uploaded *drive.File
+	if existing != nil {
+		uploaded, err = a.service.updateFileContent(ctx, a.req.UserID, a.req.Email, existing.ID, file)
+	} else {
+		var parentID string
+		if parentID, err = a.ensureFolder(ctx, path.Dir(relPath)); err != nil {
+			return err
+		}
+
+		uploaded, err = a.service.UploadFile(ctx, &UploadFileRequest{
+			UserID:     a.req.UserID,
+			Email:      a.req.Email,
+			FileName:   path.Base(relPath),
+			FileData:   file,
+			Permission: PrivatePermission,
+			Parents:    []string{parentID},
+		})
+	}
+	if err != nil && !errors.Is(err, ErrCatalogUpdate) {
+		return fmt.Errorf("error uploading file: %w", err)
+	}
+
+	// the conflict copy is a new file on Drive only, it is synced back on the next run
+	if sourcePath != relPath {
+		return nil
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	local := &syncEntry{Size: info.Size(), ModTime: info.ModTime(), MD5: uploaded.Md5Checksum}
+	if local.MD5 == "" {
+		if local.MD5, err = fileMD5(localPath); err != nil {
+			return err
+		}
+	}
+
+	remote := &syncEntry{ID: uploaded.Id, MD5: uploaded.Md5Checksum}
+	if remote.MD5 == "" {
+		remote.MD5 = local.MD5
+	}
+
+	return a.saveState(ctx, relPath, local, remote)
+}
+
+// download writes a Drive file to the local directory through a temporary file,
+// so an interrupted download does not leave a partial file behind
+func (a *syncApplier) download(ctx context.Context, relPath string, remote *syncEntry) error {
+	target, err := a.localPath(relPath)
+	if err != nil {
+		return err
+	}
+
+	response, err := a.service.DownloadFile(ctx, &DownloadFileRequest{
+		UserID: a.req.UserID,
+		Email:  a.req.Email,
+		FileID: remote.ID,
+	})
+	if err != nil {
+		return fmt.Errorf("error downloading file: %w", err)
+	}
+	defer response.Response.Body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return fmt.Errorf("error creating local directory: %w", err)
+	}
+
+	staging, err := os.CreateTemp(filepath.Dir(target), ".fundrive-sync-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %w", err)
+	}
+	defer os.Remove(staging.Name())
+
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(staging, hash), response.Response.Body); err != nil {
+		staging.Close()
+		return fmt.Errorf("error writing local file: %w", err)
+	}
+	if err := staging.Close(); err != nil {
+		return fmt.Errorf("error writing local file: %w", err)
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != remote.MD5 {
+		return fmt.Errorf("downloaded file checksum %s does not match drive checksum %s", sum, remote.MD5)
+	}
+
+	if !remote.ModTime.IsZero() {
+		if err := os.Chtimes(staging.Name(), remote.ModTime, remote.ModTime); err != nil {
+			return fmt.Errorf("error setting modification time: %w", err)
+		}
+	}
+
+	if err := os.Rename(staging.Name(), target); err != nil {
+		return fmt.Errorf("error replacing local file: %w", err)
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+
+	local := &syncEntry{Size: info.Size(), ModTime: info.ModTime(), MD5: remote.MD5}
+	return a.saveState(ctx, relPath, local, remote)
+}
+
+// ensureFolder returns the Drive folder of a relative directory, creating missing folders
+func (a *syncApplier) ensureFolder(ctx context.Context, dir string) (string, error) {
+	if dir == "." {
+		dir = ""
+	}
+
+	if id, ok := a.folders[dir]; ok {
+		return id, nil
+	}
+
+	parentID, err := a.ensureFolder(ctx, path.Dir(dir))
+	if err != nil {
+		return "", err
+	}
+
+	folder, err := a.service.CreateFolder(ctx, &CreateFolderRequest{
+		UserID:     a.req.UserID,
+		Email:      a.req.Email,
+		Name:       path.Base(dir),
+		Parents:    []string{parentID},
+		Permission: PrivatePermission,
+	})
+	if err != nil && !errors.Is(err, ErrCatalogUpdate) {
+		return "", fmt.Errorf("error creating drive folder %s: %w", dir, err)
+	}
+
+	a.folders[dir] = folder.Id
+	return folder.Id, nil
+}
+
+func (a *syncApplier) saveState(ctx context.Context, relPath string, local, remote *syncEntry) error {
+	err := a.service.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var state SyncState
+		err := tx.
+			Scopes(tenantScope).
+			Where("user_id = ? AND email = ? AND folder_id = ? AND local_root = ? AND path = ?",
+				a.req.UserID, a.req.Email, a.req.FolderID, a.root, relPath).
+			First(&state).
+			Error
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			state = SyncState{
+				ID:        ulid.Make().String(),
+				TenantID:  TenantFromContext(ctx),
+				UserID:    a.req.UserID,
+				Email:     a.req.Email,
+				FolderID:  a.req.FolderID,
+				LocalRoot: a.root,
+				Path:      relPath,
+			}
+		} else if err != nil {
+			return err
+		}
+
+		state.LocalSize = local.Size
+		state.LocalModTime = local.ModTime
+		state.LocalMD5 = local.MD5
+		state.RemoteID = remote.ID
+		state.RemoteMD5 = remote.MD5
+		state.RemoteModTime = remote.ModTime
+		state.SyncedAt = time.Now()
+
+		return tx.Save(&state).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save sync state: %w", err)
+	}
+
+	return nil
+}
+
+func (a *syncApplier) deleteState(ctx context.Context, relPath string) error {
+	err := a.service.DB.WithContext(ctx).
+		Scopes(tenantScope).
+		Where("user_id = ? AND email = ? AND folder_id = ? AND local_root = ? AND path = ?",
+			a.req.UserID, a.req.Email, a.req.FolderID, a.root, relPath).
+		Delete(&SyncState{}).
+		Error
+	if err != nil {
+		return fmt.Errorf("failed to delete sync state: %w", err)
+	}
+
+	return nil
+}
+
+// updateFileContent replaces the content of an existing Drive file
+func (service *GoogleDriveService) updateFileContent(ctx context.Context, userID, email, fileID string, content io.Reader) (*drive.File, error) {
+	srv, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: userID, Email: email})
+	if err != nil {
+		return nil, fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	policy, rewind := replayableBody(service.RetryPolicy, content)
+
+	file, err := retryCall(ctx, policy, "files.update", false, func() (*drive.File, error) {
+		if err := rewind(); err != nil {
+			return nil, err
+		}
+
+		return srv.Files.Update(fileID, &drive.File{}).
+			SupportsAllDrives(true).
+			Media(content).
+			Fields(catalogFileFields).
+			Context(ctx).
+			Do()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := service.catalogFile(ctx, userID, email, file); err != nil {
+		return file, err
+	}
+
+	return file, nil
+}
@@ -0,0 +1,130 @@
+package fundrive
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestPlanSync(t *testing.T) {
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+
+	entry := func(p, md5 string, modTime time.Time) *syncEntry {
+		return &syncEntry{Path: p, MD5: md5, ModTime: modTime, ID: "id-" + p}
+	}
+	state := func(p, localMD5, remoteMD5 string) *SyncState {
+		return &SyncState{Path: p, LocalMD5: localMD5, RemoteMD5: remoteMD5}
+	}
+
+	tests := []struct {
+		name     string
+		local    *syncEntry
+		remote   *syncEntry
+		state    *SyncState
+		mode     SyncMode
+		conflict ConflictResolution
+		want     SyncAction
+	}{
+		{"new local file", entry("a", "1", older), nil, nil, SyncModeBidirectional, ConflictSkip, SyncActionUpload},
+		{"new drive file", nil, entry("a", "1", older), nil, SyncModeBidirectional, ConflictSkip, SyncActionDownload},
+		{"new drive file when pushing", nil, entry("a", "1", older), nil, SyncModePush, ConflictSkip, ""},
+		{"in sync", entry("a", "1", older), entry("a", "1", newer), nil, SyncModeBidirectional, ConflictSkip, ""},
+		{"changed locally", entry("a", "2", newer), entry("a", "1", older), state("a", "1", "1"), SyncModeBidirectional, ConflictSkip, SyncActionUpload},
+		{"changed on drive", entry("a", "1", older), entry("a", "2", newer), state("a", "1", "1"), SyncModeBidirectional, ConflictSkip, SyncActionDownload},
+		{"changed on drive when pushing", entry("a", "1", older), entry("a", "2", newer), state("a", "1", "1"), SyncModePush, ConflictSkip, SyncActionUpload},
+		{"deleted on drive", entry("a", "1", older), nil, state("a", "1", "1"), SyncModeBidirectional, ConflictSkip, SyncActionDeleteLocal},
+		{"deleted locally", nil, entry("a", "1", older), state("a", "1", "1"), SyncModeBidirectional, ConflictSkip, SyncActionDeleteRemote},
+		{"deleted locally when pulling", nil, entry("a", "1", older), state("a", "1", "1"), SyncModePull, ConflictSkip, SyncActionDownload},
+		{"deleted locally, changed on drive", nil, entry("a", "2", older), state("a", "1", "1"), SyncModeBidirectional, ConflictSkip, SyncActionConflict},
+		{"conflict skipped", entry("a", "2", older), entry("a", "3", newer), state("a", "1", "1"), SyncModeBidirectional, ConflictSkip, SyncActionConflict},
+		{"conflict prefer local", entry("a", "2", older), entry("a", "3", newer), state("a", "1", "1"), SyncModeBidirectional, ConflictPreferLocal, SyncActionUpload},
+		{"conflict newest", entry("a", "2", older), entry("a", "3", newer), state("a", "1", "1"), SyncModeBidirectional, ConflictNewest, SyncActionDownload},
+		{"conflict keep both", entry("a", "2", older), entry("a", "3", newer), nil, SyncModeBidirectional, ConflictKeepBoth, SyncActionKeepBoth},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local := map[string]*syncEntry{}
+			remote := map[string]*syncEntry{}
+			states := map[string]*SyncState{}
+			if tt.local != nil {
+				local["a"] = tt.local
+			}
+			if tt.remote != nil {
+				remote["a"] = tt.remote
+			}
+			if tt.state != nil {
+				states["a"] = tt.state
+			}
+
+			plan := planSync(local, remote, states, tt.mode, tt.conflict)
+			if tt.want == "" {
+				assert.Empty(t, plan.Operations)
+				return
+			}
+
+			if assert.Len(t, plan.Operations, 1) {
+				assert.Equal(t, tt.want, plan.Operations[0].Action)
+			}
+		})
+	}
+}
+
+func TestConflictName(t *testing.T) {
+	at := time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)
+	assert.Equal(t, "report (conflict 2024-03-04 050607).pdf", conflictName("report.pdf", at))
+}
+
+func TestGoogleDriveService_Sync_HostileNames(t *testing.T) {
+	checksum := func(data string) string {
+		return fmt.Sprintf("%x", md5.Sum([]byte(data)))
+	}
+
+	// Drive names may be anything, none of these may be written outside the directory
+	_, service := newFakeDrive(t, []*drive.File{
+		{Id: "folder", Name: "folder", MimeType: MimeTypeFolder},
+		{Id: "good", Name: "good.txt", MimeType: "text/plain", Md5Checksum: checksum("good"), Parents: []string{"folder"}},
+		{Id: "dotdot", Name: "..", MimeType: MimeTypeFolder, Parents: []string{"folder"}},
+		{Id: "escape", Name: "escape.txt", MimeType: "text/plain", Md5Checksum: checksum("escape"), Parents: []string{"dotdot"}},
+		{Id: "slash", Name: "../slash.txt", MimeType: "text/plain", Md5Checksum: checksum("slash"), Parents: []string{"folder"}},
+		{Id: "backslash", Name: `..\backslash.txt`, MimeType: "text/plain", Md5Checksum: checksum("backslash"), Parents: []string{"folder"}},
+	}, map[string]string{"good": "good", "escape": "escape", "slash": "slash", "backslash": "backslash"})
+	service.DB = newTestDB(t, &SyncState{})
+
+	base := t.TempDir()
+	local := filepath.Join(base, "local")
+	require.NoError(t, os.Mkdir(local, 0o755))
+
+	result, err := service.Sync(context.Background(), &SyncRequest{
+		UserID:    "user-1",
+		Email:     "a@example.com",
+		LocalPath: local,
+		FolderID:  "folder",
+		Mode:      SyncModePull,
+	})
+	require.NoError(t, err)
+	assert.Empty(t, result.Failures)
+	assert.Equal(t, 1, result.Applied)
+
+	data, err := os.ReadFile(filepath.Join(local, "good.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "good", string(data))
+
+	entries, err := os.ReadDir(base)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "local", entries[0].Name())
+
+	applier := &syncApplier{root: local}
+	_, err = applier.localPath("../escape.txt")
+	assert.ErrorIs(t, err, ErrUnsafeSyncPath)
+}
@@ -5,6 +5,7 @@ import (
 	"golang.org/x/oauth2"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
+	"net/http"
 )
 
 type newDriveServiceRequest struct {
@@ -13,6 +14,24 @@ type newDriveServiceRequest struct {
 }
 
 func (service *GoogleDriveService) newDriveService(ctx context.Context, req *newDriveServiceRequest) (*drive.Service, error) {
+	client, err := service.newDriveClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.srv, nil
+}
+
+// newDriveClient returns the cached Drive client for the account or builds a new one
+func (service *GoogleDriveService) newDriveClient(ctx context.Context, req *newDriveServiceRequest) (*driveClient, error) {
+	if service.authMode(ctx, req.UserID, req.Email) == AuthModeServiceAccount {
+		return service.newServiceAccountClient(ctx, req)
+	}
+
+	tenantID := TenantFromContext(ctx)
+	if client, ok := service.clientCache.get(tenantID, req.UserID, req.Email); ok {
+		return client, nil
+	}
 
 	getTokenReq := GetTokenRequest{
 		UserID: req.UserID,
@@ -30,12 +49,22 @@ func (service *GoogleDriveService) newDriveService(ctx context.Context, req *new
 		Token:  token,
 	}
 
-	srv, err := service.newTokenService(ctx, &newTokenServiceReq)
+	client, err := service.newTokenClient(ctx, &newTokenServiceReq)
 	if err != nil {
 		return nil, err
 	}
 
-	return srv, nil
+	service.clientCache.put(tenantID, req.UserID, req.Email, client, newTokenServiceReq.Token.Expiry)
+
+	return client, nil
+}
+
+// InvalidateClient drops the cached Drive client of an account of the tenant of ctx
+// so the next request reloads its token from the database
+func (service *GoogleDriveService) InvalidateClient(ctx context.Context, userID, email string) {
+	tenantID := TenantFromContext(ctx)
+	service.clientCache.invalidate(tenantID, userID, email)
+	service.serviceAccountClients.invalidate(tenantID, userID, email)
 }
 
 type newTokenServiceRequest struct {
@@ -44,12 +73,15 @@ type newTokenServiceRequest struct {
 	Token  *oauth2.Token `json:"token"`
 }
 
-// newTokenService creates a new Google Drive service using the provided token.
-// If the token is invalid, it will refresh the token and create a new service.
-func (service *GoogleDriveService) newTokenService(
+// newTokenClient creates a new Google Drive client using the provided token.
+// If the token is invalid, it will refresh the token and create a new client.
+func (service *GoogleDriveService) newTokenClient(
 	ctx context.Context,
 	req *newTokenServiceRequest,
-) (*drive.Service, error) {
+) (*driveClient, error) {
+
+	// the refreshed token does not carry the client of the account
+	clientID := service.clientID(req.Token)
 
 	if !req.Token.Valid() {
 		refreshedToken, err := service.OAuthService.RefreshToken(ctx, req.Token)
@@ -60,9 +92,10 @@ func (service *GoogleDriveService) newTokenService(
 		req.Token = refreshedToken
 
 		saveTokenReq := SaveTokenRequest{
-			UserID: req.UserID,
-			Email:  req.Email,
-			Token:  req.Token,
+			UserID:     req.UserID,
+			Email:      req.Email,
+			Token:      req.Token,
+			KeepClient: true,
 		}
 
 		if err = service.OAuthService.SaveToken(ctx, &saveTokenReq); err != nil {
@@ -70,9 +103,47 @@ func (service *GoogleDriveService) newTokenService(
 		}
 	}
 
-	tokenSource := oauth2.StaticTokenSource(req.Token)
-	opt := []option.ClientOption{option.WithTokenSource(tokenSource)}
+	httpClient := &http.Client{
+		Transport: &oauth2.Transport{
+			Source: oauth2.StaticTokenSource(req.Token),
+			Base:   service.transport(clientID, req.UserID, req.Email),
+		},
+	}
+
+	opt := []option.ClientOption{option.WithHTTPClient(httpClient)}
+	opt = append(opt, service.ClientOptions...)
 	srv, err := drive.NewService(ctx, opt...)
+	if err != nil {
+		return nil, err
+	}
 
-	return srv, err
+	return &driveClient{srv: srv, httpClient: httpClient}, nil
+}
+
+// transport returns the HTTP transport used for the account's Drive requests, the
+// requests of all accounts of clientID share its global rate limit
+func (service *GoogleDriveService) transport(clientID, userID, email string) http.RoundTripper {
+	if service.RateLimiter == nil {
+		return http.DefaultTransport
+	}
+
+	return &rateLimitTransport{
+		base:     http.DefaultTransport,
+		limiter:  service.RateLimiter,
+		clientID: clientID,
+		userID:   userID,
+		email:    email,
+	}
+}
+
+// clientID returns the ID of the OAuth client that issued the token, tokens of an
+// IOAuthService that does not record it use the client of the service
+func (service *GoogleDriveService) clientID(token *oauth2.Token) string {
+	if id := tokenClientID(token); id != "" {
+		return id
+	}
+	if service.OauthConfig == nil {
+		return ""
+	}
+	return service.OauthConfig.ClientID
 }
@@ -1,5 +1,7 @@
 package fundrive
 
+import "strings"
+
 // https://developers.google.com/drive/api/guides/mime-types
 
 const (
@@ -24,3 +26,8 @@ const (
 	MimeTypeVideo        = "application/vnd.google-apps.video"
 	MimeTypeVid          = "application/vnd.google-apps.vid"
 )
+
+// isGoogleAppsMimeType reports whether a file is a Google Workspace file, which has no binary content
+func isGoogleAppsMimeType(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "application/vnd.google-apps.")
+}
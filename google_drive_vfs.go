@@ -0,0 +1,613 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// VFSFile is an open file of a FileSystem. Files opened read-only fail on Write.
+type VFSFile interface {
+	fs.File
+	io.Writer
+}
+
+// FileSystem is an os-like file system, implemented by LocalFS for the local disk and
+// by DriveVFS for a Drive folder, so storage code can use either one. Names are slash
+// separated paths relative to the root, as accepted by fs.ValidPath.
+type FileSystem interface {
+	fs.StatFS
+	fs.ReadDirFS
+
+	Create(name string) (VFSFile, error)
+	OpenFile(name string, flag int, perm fs.FileMode) (VFSFile, error)
+	Mkdir(name string, perm fs.FileMode) error
+	MkdirAll(name string, perm fs.FileMode) error
+	Rename(oldName, newName string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+
+	// Chmod changes the permission bits, on Drive the world-readable bit shares the
+	// file with anyone who has the link
+	Chmod(name string, mode fs.FileMode) error
+}
+
+var (
+	_ FileSystem = (*LocalFS)(nil)
+	_ FileSystem = (*DriveVFS)(nil)
+)
+
+// LocalFS is a FileSystem rooted at a local directory
+type LocalFS struct {
+	root string
+}
+
+func NewLocalFS(root string) *LocalFS {
+	return &LocalFS{root: root}
+}
+
+func (l *LocalFS) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(l.root, filepath.FromSlash(name)), nil
+}
+
+func (l *LocalFS) Open(name string) (fs.File, error) {
+	return os.DirFS(l.root).Open(name)
+}
+
+func (l *LocalFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(os.DirFS(l.root), name)
+}
+
+func (l *LocalFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(os.DirFS(l.root), name)
+}
+
+func (l *LocalFS) Create(name string) (VFSFile, error) {
+	return l.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+}
+
+func (l *LocalFS) OpenFile(name string, flag int, perm fs.FileMode) (VFSFile, error) {
+	p, err := l.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, flag, perm)
+}
+
+func (l *LocalFS) Mkdir(name string, perm fs.FileMode) error {
+	p, err := l.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, perm)
+}
+
+func (l *LocalFS) MkdirAll(name string, perm fs.FileMode) error {
+	p, err := l.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, perm)
+}
+
+func (l *LocalFS) Rename(oldName, newName string) error {
+	oldPath, err := l.path("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := l.path("rename", newName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func (l *LocalFS) Remove(name string) error {
+	p, err := l.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (l *LocalFS) RemoveAll(name string) error {
+	p, err := l.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (l *LocalFS) Chmod(name string, mode fs.FileMode) error {
+	p, err := l.path("chmod", name)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(p, mode)
+}
+
+type VFSRequest struct {
+	FSRequest
+
+	// PermanentDelete deletes removed files instead of moving them to the trash
+	PermanentDelete bool `json:"permanent_delete"`
+}
+
+// DriveVFS is a writable FileSystem over a Drive folder. Written files are staged in a
+// temporary file and uploaded when closed.
+type DriveVFS struct {
+	*DriveFS
+
+	permanentDelete bool
+}
+
+// VFS returns a writable file system rooted at a Drive folder
+func (service *GoogleDriveService) VFS(ctx context.Context, req *VFSRequest) (*DriveVFS, error) {
+	fsys, err := service.FS(ctx, &req.FSRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DriveVFS{DriveFS: fsys, permanentDelete: req.PermanentDelete}, nil
+}
+
+func (v *DriveVFS) Create(name string) (VFSFile, error) {
+	return v.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+}
+
+// OpenFile opens a file like os.OpenFile. The permission bits are ignored, use Chmod
+// to share a file.
+func (v *DriveVFS) OpenFile(name string, flag int, _ fs.FileMode) (VFSFile, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		f, err := v.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		return readOnlyFile{File: f, name: name}, nil
+	}
+
+	parent, err := v.resolveDir("open", path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := v.resolve("open", name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if flag&os.O_CREATE == 0 {
+			return nil, err
+		}
+		existing = nil
+	case err != nil:
+		return nil, err
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case existing.MimeType == MimeTypeFolder:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case isGoogleAppsMimeType(existing.MimeType):
+		return nil, &fs.PathError{Op: "open", Path: name, Err: ErrNotDownloadable}
+	}
+
+	temp, err := os.CreateTemp("", "fundrive-vfs-*")
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	f := &driveWriteFile{vfs: v, name: name, parentID: parent.Id, existing: existing, temp: temp}
+
+	// keep the current content unless the file is truncated
+	if existing != nil && flag&os.O_TRUNC == 0 {
+		if err := f.load(); err != nil {
+			f.discard()
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		if flag&os.O_APPEND == 0 {
+			if _, err := temp.Seek(0, io.SeekStart); err != nil {
+				f.discard()
+				return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+			}
+		}
+	}
+
+	return f, nil
+}
+
+func (v *DriveVFS) Mkdir(name string, _ fs.FileMode) error {
+	if _, err := v.resolve("mkdir", name); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	parent, err := v.resolveDir("mkdir", path.Dir(name))
+	if err != nil {
+		return err
+	}
+
+	_, err = v.service.CreateFolder(v.ctx, &CreateFolderRequest{
+		UserID:     v.userID,
+		Email:      v.email,
+		Name:       path.Base(name),
+		Parents:    []string{parent.Id},
+		Permission: PrivatePermission,
+	})
+	v.Invalidate()
+	if err != nil && !errors.Is(err, ErrCatalogUpdate) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (v *DriveVFS) MkdirAll(name string, perm fs.FileMode) error {
+	file, err := v.resolve("mkdir", name)
+	if err == nil {
+		if file.MimeType != MimeTypeFolder {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if dir := path.Dir(name); dir != "." {
+		if err := v.MkdirAll(dir, perm); err != nil {
+			return err
+		}
+	}
+
+	return v.Mkdir(name, perm)
+}
+
+// Rename renames and moves a file like os.Rename, replacing an existing file at newName
+func (v *DriveVFS) Rename(oldName, newName string) error {
+	if oldName == "." || newName == "." {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrInvalid}
+	}
+
+	file, err := v.resolve("rename", oldName)
+	if err != nil {
+		return err
+	}
+	oldParent, err := v.resolveDir("rename", path.Dir(oldName))
+	if err != nil {
+		return err
+	}
+	newParent, err := v.resolveDir("rename", path.Dir(newName))
+	if err != nil {
+		return err
+	}
+
+	if target, err := v.resolve("rename", newName); err == nil {
+		if target.Id == file.Id {
+			return nil
+		}
+		if target.MimeType == MimeTypeFolder {
+			return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
+		}
+		if err := v.remove(target.Id); err != nil {
+			return &fs.PathError{Op: "rename", Path: newName, Err: err}
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	defer v.Invalidate()
+
+	if base := path.Base(newName); base != file.Name {
+		_, err := v.service.RenameResource(v.ctx, &RenameResourceRequest{
+			UserID:     v.userID,
+			Email:      v.email,
+			ResourceID: file.Id,
+			NewName:    base,
+		})
+		if err != nil && !errors.Is(err, ErrCatalogUpdate) {
+			return &fs.PathError{Op: "rename", Path: oldName, Err: err}
+		}
+	}
+
+	if newParent.Id != oldParent.Id {
+		_, err := v.service.MoveResource(v.ctx, &MoveResourceRequest{
+			UserID:       v.userID,
+			Email:        v.email,
+			ResourceID:   file.Id,
+			NewParentID:  newParent.Id,
+			OldParentIDs: []string{oldParent.Id},
+		})
+		if err != nil && !errors.Is(err, ErrCatalogUpdate) {
+			return &fs.PathError{Op: "rename", Path: oldName, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// Remove trashes a file or an empty folder, or deletes it when PermanentDelete is set
+func (v *DriveVFS) Remove(name string) error {
+	if name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+
+	file, err := v.resolve("remove", name)
+	if err != nil {
+		return err
+	}
+
+	if file.MimeType == MimeTypeFolder {
+		children, err := v.children(file.Id)
+		if err != nil {
+			return &fs.PathError{Op: "remove", Path: name, Err: err}
+		}
+		if len(children) > 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+
+	defer v.Invalidate()
+	if err := v.remove(file.Id); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// RemoveAll trashes a file or a folder with its content, or deletes it when
+// PermanentDelete is set. A missing path is not an error.
+func (v *DriveVFS) RemoveAll(name string) error {
+	if name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+
+	file, err := v.resolve("remove", name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	defer v.Invalidate()
+	if err := v.remove(file.Id); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (v *DriveVFS) remove(fileID string) error {
+	if v.permanentDelete {
+		err := v.service.Delete(v.ctx, &DeleteResourceRequest{UserID: v.userID, Email: v.email, ResourceID: fileID})
+		if err != nil && !errors.Is(err, ErrCatalogUpdate) {
+			return err
+		}
+		return nil
+	}
+
+	_, err := retryCall(v.ctx, v.service.RetryPolicy, "files.update", true, func() (*drive.File, error) {
+		return v.srv.Files.Update(fileID, &drive.File{Trashed: true}).SupportsAllDrives(true).Context(v.ctx).Do()
+	})
+	if err != nil {
+		return err
+	}
+
+	return v.service.catalogRemove(v.ctx, v.userID, v.email, fileID)
+}
+
+// Chmod shares the file with anyone who has the link when the mode is world-readable,
+// and removes that permission otherwise. Other permission bits have no Drive equivalent.
+func (v *DriveVFS) Chmod(name string, mode fs.FileMode) error {
+	file, err := v.resolve("chmod", name)
+	if err != nil {
+		return err
+	}
+
+	if mode&0o004 != 0 {
+		_, err = retryCall(v.ctx, v.service.RetryPolicy, "permissions.create", false, func() (*drive.Permission, error) {
+			return v.srv.Permissions.Create(file.Id, getPermission(PublicPermission)).SupportsAllDrives(true).Context(v.ctx).Do()
+		})
+	} else {
+		err = retryDo(v.ctx, v.service.RetryPolicy, "permissions.delete", true, func() error {
+			return v.srv.Permissions.Delete(file.Id, anyoneWithLinkPermissionID).SupportsAllDrives(true).Context(v.ctx).Do()
+		})
+		if isNotFoundError(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return &fs.PathError{Op: "chmod", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// Share grants a user access to a file with one of the Role constants
+func (v *DriveVFS) Share(name, emailAddress, role string) error {
+	file, err := v.resolve("share", name)
+	if err != nil {
+		return err
+	}
+
+	err = v.service.UpdatePermissions(v.ctx, &UpdatePermissionRequest{
+		UserID:       v.userID,
+		Email:        v.email,
+		ResourceID:   file.Id,
+		EmailAddress: emailAddress,
+		Role:         role,
+		Type:         "user",
+	})
+	if err != nil {
+		return &fs.PathError{Op: "share", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// resolveDir resolves a path that must be a folder
+func (v *DriveVFS) resolveDir(op, name string) (*drive.File, error) {
+	dir, err := v.resolve(op, name)
+	if err != nil {
+		return nil, err
+	}
+	if dir.MimeType != MimeTypeFolder {
+		return nil, &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return dir, nil
+}
+
+// anyoneWithLinkPermissionID is the fixed ID of the permission sharing a file by link
+const anyoneWithLinkPermissionID = "anyoneWithLink"
+
+// readOnlyFile is a file opened without write access
+type readOnlyFile struct {
+	fs.File
+	name string
+}
+
+func (f readOnlyFile) Write([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+}
+
+func (f readOnlyFile) Seek(offset int64, whence int) (int64, error) {
+	if seeker, ok := f.File.(io.Seeker); ok {
+		return seeker.Seek(offset, whence)
+	}
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errors.ErrUnsupported}
+}
+
+func (f readOnlyFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if dir, ok := f.File.(fs.ReadDirFile); ok {
+		return dir.ReadDir(n)
+	}
+	return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+}
+
+// driveWriteFile is a file opened for writing, staged in a temporary file until Close
+type driveWriteFile struct {
+	vfs      *DriveVFS
+	name     string
+	parentID string
+	existing *drive.File
+	temp     *os.File
+	closed   bool
+
+	// copyOf is a Drive file copied server side on Close instead of uploading
+	copyOf *drive.File
+}
+
+// load copies the current content of the Drive file into the temporary file
+func (f *driveWriteFile) load() error {
+	src := &driveFile{fsys: f.vfs.DriveFS, name: f.name, file: f.existing}
+	defer src.Close()
+
+	_, err := io.Copy(f.temp, src)
+	return err
+}
+
+func (f *driveWriteFile) Read(p []byte) (int, error) {
+	return f.temp.Read(p)
+}
+
+func (f *driveWriteFile) Write(p []byte) (int, error) {
+	return f.temp.Write(p)
+}
+
+func (f *driveWriteFile) Seek(offset int64, whence int) (int64, error) {
+	return f.temp.Seek(offset, whence)
+}
+
+func (f *driveWriteFile) Stat() (fs.FileInfo, error) {
+	info, err := f.temp.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return driveFileInfo{file: &drive.File{
+		Name:         path.Base(f.name),
+		Size:         info.Size(),
+		ModifiedTime: info.ModTime().UTC().Format(time.RFC3339),
+	}}, nil
+}
+
+// Close uploads the content, replacing the Drive file when it already existed
+func (f *driveWriteFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	defer f.discard()
+	defer f.vfs.Invalidate()
+
+	if _, err := f.temp.Seek(0, io.SeekStart); err != nil {
+		return &fs.PathError{Op: "close", Path: f.name, Err: err}
+	}
+
+	if f.copyOf != nil {
+		return f.copy()
+	}
+
+	var err error
+	if f.existing != nil {
+		_, err = f.vfs.service.updateFileContent(f.vfs.ctx, f.vfs.userID, f.vfs.email, f.existing.Id, f.temp)
+	} else {
+		_, err = f.vfs.service.UploadFile(f.vfs.ctx, &UploadFileRequest{
+			UserID:     f.vfs.userID,
+			Email:      f.vfs.email,
+			FileName:   path.Base(f.name),
+			FileData:   f.temp,
+			Permission: PrivatePermission,
+			Parents:    []string{f.parentID},
+		})
+	}
+	if err != nil && !errors.Is(err, ErrCatalogUpdate) {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fmt.Errorf("error uploading file: %w", err)}
+	}
+
+	return nil
+}
+
+// copy replaces the file with a server side copy of copyOf
+func (f *driveWriteFile) copy() error {
+	if f.existing != nil {
+		if err := f.vfs.remove(f.existing.Id); err != nil {
+			return &fs.PathError{Op: "close", Path: f.name, Err: err}
+		}
+	}
+
+	_, err := f.vfs.service.CopyResource(f.vfs.ctx, &CopyResourceRequest{
+		UserID:              f.vfs.userID,
+		Email:               f.vfs.email,
+		ResourceID:          f.copyOf.Id,
+		DestinationParentID: f.parentID,
+		NewName:             path.Base(f.name),
+	})
+	if err != nil && !errors.Is(err, ErrCatalogUpdate) {
+		return &fs.PathError{Op: "close", Path: f.name, Err: err}
+	}
+
+	return nil
+}
+
+// abort closes the file without uploading it
+func (f *driveWriteFile) abort() {
+	if !f.closed {
+		f.closed = true
+		f.discard()
+	}
+}
+
+func (f *driveWriteFile) discard() {
+	f.temp.Close()
+	os.Remove(f.temp.Name())
+}
@@ -0,0 +1,80 @@
+package fundrive
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/drive/v3"
+)
+
+// testFileSystem runs the same operations against every FileSystem implementation
+func testFileSystem(t *testing.T, fsys FileSystem) {
+	require.NoError(t, fsys.MkdirAll("docs/drafts", 0o755))
+	require.NoError(t, fsys.MkdirAll("docs", 0o755))
+
+	f, err := fsys.Create("docs/drafts/note.txt")
+	require.NoError(t, err)
+	_, err = io.WriteString(f, "hello")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	f, err = fsys.OpenFile("docs/drafts/note.txt", os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = io.WriteString(f, " world")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = fsys.OpenFile("docs/drafts/note.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	assert.ErrorIs(t, err, fs.ErrExist)
+
+	f, err = fsys.OpenFile("docs/drafts/note.txt", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("x"))
+	assert.Error(t, err)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, fsys.Rename("docs/drafts/note.txt", "docs/final.txt"))
+
+	data, err := fs.ReadFile(fsys, "docs/final.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+
+	_, err = fsys.Stat("docs/drafts/note.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.Error(t, fsys.Remove("docs"))
+	require.NoError(t, fsys.Remove("docs/drafts"))
+	require.NoError(t, fsys.RemoveAll("docs"))
+	require.NoError(t, fsys.RemoveAll("docs"))
+
+	_, err = fsys.Stat("docs/final.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestLocalFS(t *testing.T) {
+	testFileSystem(t, NewLocalFS(t.TempDir()))
+}
+
+func TestDriveVFS(t *testing.T) {
+	fake, service := newFakeDrive(t, []*drive.File{
+		{Id: "root-id", Name: "Projects", MimeType: MimeTypeFolder},
+	}, map[string]string{})
+
+	vfs, err := service.VFS(context.Background(), &VFSRequest{
+		FSRequest: FSRequest{UserID: "user-1", Email: "a@example.com", FolderID: "root-id"},
+	})
+	require.NoError(t, err)
+
+	testFileSystem(t, vfs)
+
+	// removed files are moved to the trash
+	docs := fake.file("new-1")
+	require.NotNil(t, docs)
+	assert.Equal(t, "docs", docs.Name)
+	assert.True(t, docs.Trashed)
+}
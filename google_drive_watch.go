@@ -0,0 +1,511 @@
+package fundrive
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oklog/ulid/v2"
+	"google.golang.org/api/drive/v3"
+	"gorm.io/gorm"
+)
+
+// DefaultWatchTTL is the requested lifetime of a channel, Drive may shorten it
+const DefaultWatchTTL = 24 * time.Hour
+
+var (
+	ErrWatchChannelNotFound = errors.New("watch channel not found")
+	ErrInvalidChannelToken  = errors.New("invalid watch channel token")
+)
+
+// WatchKind is what a channel watches
+type WatchKind string
+
+const (
+	WatchKindChanges WatchKind = "changes"
+	WatchKindFile    WatchKind = "file"
+)
+
+// WatchChannel is a push notification channel registered with Drive
+type WatchChannel struct {
+	ID         string    `json:"id" gorm:"column:id;type:char(26);primaryKey"`
+	TenantID   string    `json:"tenant_id" gorm:"column:tenant_id;type:varchar(64);not null;default:'';index:idx_fundrive_watch_channels_tenant_user"`
+	UserID     string    `json:"user_id" gorm:"column:user_id;type:varchar(255);index:idx_fundrive_watch_channels_tenant_user"`
+	Email      string    `json:"email" gorm:"column:email;type:varchar(255)"`
+	Kind       WatchKind `json:"kind" gorm:"column:kind;type:varchar(32)"`
+	FileID     string    `json:"file_id" gorm:"column:file_id;type:varchar(255)"`
+	DriveID    string    `json:"drive_id" gorm:"column:drive_id;type:varchar(255)"`
+	ResourceID string    `json:"resource_id" gorm:"column:resource_id;type:varchar(255)"`
+	Address    string    `json:"address" gorm:"column:address;type:varchar(2048)"`
+	Token      string    `json:"-" gorm:"column:token;type:varchar(64)"`
+	Expiration time.Time `json:"expiration" gorm:"column:expiration;index"`
+	CreatedAt  time.Time `json:"created_at" gorm:"column:created_at"`
+	UpdatedAt  time.Time `json:"updated_at" gorm:"column:updated_at"`
+}
+
+// TableName returns the table name
+func (w *WatchChannel) TableName() string {
+	return "fundrive_watch_channels"
+}
+
+type WatchRequest struct {
+	UserID string `json:"user_id" validate:"required"`
+	Email  string `json:"email" validate:"required"`
+
+	// Address is the HTTPS URL of the webhook receiver
+	Address string `json:"address" validate:"required"`
+
+	// TTL defaults to DefaultWatchTTL
+	TTL time.Duration `json:"ttl"`
+}
+
+func (r *WatchRequest) Validate() error {
+	if r.UserID == "" {
+		return ErrInvalidUserID
+	}
+	if r.Email == "" {
+		return ErrInvalidEmail
+	}
+	if r.Address == "" {
+		return fmt.Errorf("address is required")
+	}
+	return nil
+}
+
+type WatchChangesRequest struct {
+	WatchRequest
+
+	// DriveID watches a shared drive
+	DriveID string `json:"drive_id"`
+}
+
+// WatchChanges registers a channel notified of every change of the account. The
+// channel starts from the stored change cursor, change tracking is started when the
+// account has none.
+func (service *GoogleDriveService) WatchChanges(ctx context.Context, req *WatchChangesRequest) (*WatchChannel, error) {
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid watch request: %w", err)
+	}
+
+	channel := newWatchChannel(&req.WatchRequest, WatchKindChanges)
+	channel.DriveID = req.DriveID
+
+	if err := service.openWatchChannel(ctx, channel); err != nil {
+		return nil, err
+	}
+
+	return channel, nil
+}
+
+type WatchFileRequest struct {
+	WatchRequest
+	FileID string `json:"file_id" validate:"required"`
+}
+
+// WatchFile registers a channel notified of changes to a single file
+func (service *GoogleDriveService) WatchFile(ctx context.Context, req *WatchFileRequest) (*WatchChannel, error) {
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid watch request: %w", err)
+	}
+	if req.FileID == "" {
+		return nil, fmt.Errorf("invalid watch request: file id is required")
+	}
+
+	channel := newWatchChannel(&req.WatchRequest, WatchKindFile)
+	channel.FileID = req.FileID
+
+	if err := service.openWatchChannel(ctx, channel); err != nil {
+		return nil, err
+	}
+
+	return channel, nil
+}
+
+func newWatchChannel(req *WatchRequest, kind WatchKind) *WatchChannel {
+	ttl := req.TTL
+	if ttl <= 0 {
+		ttl = DefaultWatchTTL
+	}
+
+	return &WatchChannel{
+		UserID:     req.UserID,
+		Email:      req.Email,
+		Kind:       kind,
+		Address:    req.Address,
+		Expiration: time.Now().Add(ttl),
+	}
+}
+
+// openWatchChannel stores the channel and registers it with Drive. The row is saved
+// first because Drive sends the sync message before the watch call returns, and a
+// channel answered with 404 is never notified again
+func (service *GoogleDriveService) openWatchChannel(ctx context.Context, channel *WatchChannel) error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return fmt.Errorf("error generating channel token: %w", err)
+	}
+
+	channel.ID = ulid.Make().String()
+	channel.TenantID = TenantFromContext(ctx)
+	channel.Token = hex.EncodeToString(secret)
+
+	srv, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: channel.UserID, Email: channel.Email})
+	if err != nil {
+		return fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	if err := service.DB.WithContext(ctx).Create(channel).Error; err != nil {
+		return fmt.Errorf("failed to save watch channel: %w", err)
+	}
+
+	response, err := service.registerWatchChannel(ctx, srv, channel)
+	if err != nil {
+		// the row is removed even when the caller's context is cancelled
+		_ = service.DB.WithContext(context.WithoutCancel(ctx)).Delete(channel).Error
+		return err
+	}
+
+	channel.ResourceID = response.ResourceId
+	if response.Expiration > 0 {
+		channel.Expiration = time.UnixMilli(response.Expiration)
+	}
+
+	err = service.DB.WithContext(ctx).
+		Model(channel).
+		Updates(map[string]interface{}{"resource_id": channel.ResourceID, "expiration": channel.Expiration}).
+		Error
+	if err != nil {
+		// the stored expiration would be wrong for RenewChannels, stop the channel
+		_ = service.stopDriveChannel(ctx, channel)
+		_ = service.DB.WithContext(context.WithoutCancel(ctx)).Delete(channel).Error
+		return fmt.Errorf("failed to save watch channel: %w", err)
+	}
+
+	return nil
+}
+
+// registerWatchChannel starts the changes or file watch of the channel
+func (service *GoogleDriveService) registerWatchChannel(ctx context.Context, srv *drive.Service, channel *WatchChannel) (*drive.Channel, error) {
+	request := &drive.Channel{
+		Id:         channel.ID,
+		Type:       "web_hook",
+		Address:    channel.Address,
+		Token:      channel.Token,
+		Expiration: channel.Expiration.UnixMilli(),
+	}
+
+	var (
+		response *drive.Channel
+		err      error
+	)
+	switch channel.Kind {
+	case WatchKindChanges:
+		var pageToken string
+		if pageToken, err = service.watchPageToken(ctx, channel); err != nil {
+			return nil, err
+		}
+
+		call := srv.Changes.Watch(pageToken, request).
+			SupportsAllDrives(true).
+			IncludeItemsFromAllDrives(true)
+		if channel.DriveID != "" {
+			call = call.DriveId(channel.DriveID)
+		}
+
+		response, err = retryCall(ctx, service.RetryPolicy, "changes.watch", false, func() (*drive.Channel, error) {
+			return call.Context(ctx).Do()
+		})
+	default:
+		response, err = retryCall(ctx, service.RetryPolicy, "files.watch", false, func() (*drive.Channel, error) {
+			return srv.Files.Watch(channel.FileID, request).SupportsAllDrives(true).Context(ctx).Do()
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error registering watch channel: %w", err)
+	}
+
+	return response, nil
+}
+
+// watchPageToken returns the page token of the stored change cursor
+func (service *GoogleDriveService) watchPageToken(ctx context.Context, channel *WatchChannel) (string, error) {
+	var cursor ChangeCursor
+	err := service.DB.WithContext(ctx).
+		Scopes(tenantScope).
+		Where("user_id = ? AND email = ? AND drive_id = ?", channel.UserID, channel.Email, channel.DriveID).
+		First(&cursor).
+		Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		started, err := service.StartChangeTracking(ctx, &ChangeFeedRequest{
+			UserID:  channel.UserID,
+			Email:   channel.Email,
+			DriveID: channel.DriveID,
+		})
+		if err != nil {
+			return "", err
+		}
+		return started.PageToken, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get change cursor: %w", err)
+	}
+
+	return cursor.PageToken, nil
+}
+
+func (service *GoogleDriveService) stopDriveChannel(ctx context.Context, channel *WatchChannel) error {
+	srv, err := service.newDriveService(ctx, &newDriveServiceRequest{UserID: channel.UserID, Email: channel.Email})
+	if err != nil {
+		return fmt.Errorf("error creating google drive service: %w", err)
+	}
+
+	return retryDo(ctx, service.RetryPolicy, "channels.stop", true, func() error {
+		return srv.Channels.Stop(&drive.Channel{Id: channel.ID, ResourceId: channel.ResourceID}).Context(ctx).Do()
+	})
+}
+
+type StopChannelRequest struct {
+	UserID    string `json:"user_id" validate:"required"`
+	ChannelID string `json:"channel_id" validate:"required"`
+}
+
+// StopChannel stops a channel and removes it
+func (service *GoogleDriveService) StopChannel(ctx context.Context, req *StopChannelRequest) error {
+	var channel WatchChannel
+	err := service.DB.WithContext(ctx).
+		Scopes(tenantScope).
+		Where("user_id = ? AND id = ?", req.UserID, req.ChannelID).
+		First(&channel).
+		Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrWatchChannelNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get watch channel: %w", err)
+	}
+
+	// an expired or unknown channel is already gone on the Drive side
+	if err := service.stopDriveChannel(ctx, &channel); err != nil && !isNotFoundError(err) {
+		return fmt.Errorf("error stopping watch channel: %w", err)
+	}
+
+	if err := service.DB.WithContext(ctx).Delete(&channel).Error; err != nil {
+		return fmt.Errorf("failed to delete watch channel: %w", err)
+	}
+
+	return nil
+}
+
+// RenewChannels replaces every channel that expires within the window with a new
+// one and stops the old channel. Channels of every tenant are renewed, each in its
+// own tenant. It returns the number of renewed channels.
+func (service *GoogleDriveService) RenewChannels(ctx context.Context, window time.Duration) (int, error) {
+	channels := make([]WatchChannel, 0)
+	err := service.DB.WithContext(ctx).
+		Where("expiration < ?", time.Now().Add(window)).
+		Find(&channels).
+		Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to list expiring watch channels: %w", err)
+	}
+
+	var (
+		renewed int
+		errs    []error
+	)
+
+	for i := range channels {
+		old := channels[i]
+		channelCtx := ContextWithTenant(ctx, old.TenantID)
+
+		renewal := old
+		renewal.Expiration = time.Now().Add(DefaultWatchTTL)
+		renewal.CreatedAt = time.Time{}
+		renewal.UpdatedAt = time.Time{}
+
+		if err := service.openWatchChannel(channelCtx, &renewal); err != nil {
+			errs = append(errs, fmt.Errorf("error renewing channel %s: %w", old.ID, err))
+			continue
+		}
+
+		if err := service.stopDriveChannel(channelCtx, &old); err != nil && !isNotFoundError(err) {
+			errs = append(errs, fmt.Errorf("error stopping channel %s: %w", old.ID, err))
+		}
+
+		if err := service.DB.WithContext(channelCtx).Delete(&old).Error; err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete channel %s: %w", old.ID, err))
+		}
+
+		renewed++
+	}
+
+	return renewed, errors.Join(errs...)
+}
+
+// StartChannelRenewer renews expiring channels every interval until ctx is done.
+// Channels are renewed when they expire within twice the interval.
+func (service *GoogleDriveService) StartChannelRenewer(ctx context.Context, interval time.Duration, onError func(error)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := service.RenewChannels(ctx, 2*interval); err != nil && onError != nil {
+				onError(err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// WebhookNotification is a push notification received on a watch channel
+type WebhookNotification struct {
+	Channel *WatchChannel `json:"channel"`
+
+	// ResourceState is sync for the first message of a channel, then add, remove,
+	// update, trash, untrash or change
+	ResourceState string `json:"resource_state"`
+
+	// Changed lists what changed on an update, e.g. "content,properties"
+	Changed       string `json:"changed"`
+	ResourceID    string `json:"resource_id"`
+	ResourceURI   string `json:"resource_uri"`
+	MessageNumber int64  `json:"message_number"`
+}
+
+// WebhookCallback handles a notification. Returning an error makes Drive deliver
+// the notification again.
+type WebhookCallback func(ctx context.Context, notification *WebhookNotification) error
+
+// WebhookHandler receives Drive push notifications, validates them against the
+// stored channels and dispatches them to the registered callbacks
+type WebhookHandler struct {
+	service *GoogleDriveService
+
+	mu        sync.RWMutex
+	callbacks []WebhookCallback
+}
+
+func NewWebhookHandler(service *GoogleDriveService) *WebhookHandler {
+	return &WebhookHandler{service: service}
+}
+
+// OnNotification registers a callback called for every valid notification
+func (handler *WebhookHandler) OnNotification(callback WebhookCallback) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+
+	handler.callbacks = append(handler.callbacks, callback)
+}
+
+// Route registers the receiver on a Fiber app
+func (handler *WebhookHandler) Route(app *fiber.App, path string) {
+	app.Post(path, handler.FiberHandler)
+}
+
+// FiberHandler receives notifications in a Fiber app
+func (handler *WebhookHandler) FiberHandler(c *fiber.Ctx) error {
+	status := handler.handle(c.UserContext(), func(key string) string {
+		return c.Get(key)
+	})
+	return c.SendStatus(status)
+}
+
+// ServeHTTP receives notifications with net/http
+func (handler *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.WriteHeader(handler.handle(r.Context(), r.Header.Get))
+}
+
+// handle validates the notification headers and returns the response status
+func (handler *WebhookHandler) handle(ctx context.Context, header func(key string) string) int {
+	notification, err := handler.validate(ctx, header)
+	switch {
+	case errors.Is(err, ErrWatchChannelNotFound):
+		// Drive stops delivering to a channel answered with 404
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidChannelToken):
+		return http.StatusUnauthorized
+	case err != nil:
+		return http.StatusInternalServerError
+	}
+
+	// the sync message only confirms the channel
+	if notification.ResourceState == "sync" {
+		return http.StatusOK
+	}
+
+	// the callbacks run in the tenant of the channel
+	ctx = ContextWithTenant(ctx, notification.Channel.TenantID)
+
+	handler.mu.RLock()
+	callbacks := append([]WebhookCallback(nil), handler.callbacks...)
+	handler.mu.RUnlock()
+
+	for _, callback := range callbacks {
+		if err := callback(ctx, notification); err != nil {
+			return http.StatusInternalServerError
+		}
+	}
+
+	return http.StatusOK
+}
+
+func (handler *WebhookHandler) validate(ctx context.Context, header func(key string) string) (*WebhookNotification, error) {
+	channelID := header("X-Goog-Channel-ID")
+	if channelID == "" {
+		return nil, ErrWatchChannelNotFound
+	}
+
+	// Drive does not send the tenant, the channel ID is unique across tenants
+	var channel WatchChannel
+	err := handler.service.DB.WithContext(ctx).
+		Where("id = ?", channelID).
+		First(&channel).
+		Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrWatchChannelNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	token := header("X-Goog-Channel-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(channel.Token)) != 1 {
+		return nil, ErrInvalidChannelToken
+	}
+
+	resourceID := header("X-Goog-Resource-ID")
+	if channel.ResourceID != "" && resourceID != channel.ResourceID {
+		return nil, ErrInvalidChannelToken
+	}
+
+	messageNumber, _ := strconv.ParseInt(header("X-Goog-Message-Number"), 10, 64)
+
+	return &WebhookNotification{
+		Channel:       &channel,
+		ResourceState: header("X-Goog-Resource-State"),
+		Changed:       header("X-Goog-Changed"),
+		ResourceID:    resourceID,
+		ResourceURI:   header("X-Goog-Resource-URI"),
+		MessageNumber: messageNumber,
+	}, nil
+}
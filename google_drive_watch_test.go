@@ -0,0 +1,150 @@
+package fundrive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+func newWebhookRequest(channelID, token, state string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/drive/webhook", nil)
+	req.Header.Set("X-Goog-Channel-ID", channelID)
+	req.Header.Set("X-Goog-Channel-Token", token)
+	req.Header.Set("X-Goog-Resource-ID", "resource-1")
+	req.Header.Set("X-Goog-Resource-State", state)
+	req.Header.Set("X-Goog-Message-Number", "7")
+	return req
+}
+
+func TestWebhookHandler(t *testing.T) {
+	service := &GoogleDriveService{DB: newTestDB(t, &WatchChannel{})}
+	require.NoError(t, service.DB.Create(&WatchChannel{
+		ID:         "channel-1",
+		TenantID:   "acme",
+		UserID:     "user-1",
+		Email:      "a@example.com",
+		Kind:       WatchKindChanges,
+		ResourceID: "resource-1",
+		Token:      "secret",
+		Expiration: time.Now().Add(time.Hour),
+	}).Error)
+
+	handler := NewWebhookHandler(service)
+
+	var (
+		received []*WebhookNotification
+		tenants  []string
+	)
+	handler.OnNotification(func(ctx context.Context, notification *WebhookNotification) error {
+		received = append(received, notification)
+		tenants = append(tenants, TenantFromContext(ctx))
+		return nil
+	})
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"sync", newWebhookRequest("channel-1", "secret", "sync"), http.StatusOK},
+		{"change", newWebhookRequest("channel-1", "secret", "change"), http.StatusOK},
+		{"wrong token", newWebhookRequest("channel-1", "guess", "change"), http.StatusUnauthorized},
+		{"unknown channel", newWebhookRequest("channel-2", "secret", "change"), http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, tt.req)
+			assert.Equal(t, tt.status, recorder.Code)
+		})
+	}
+
+	// only the change reaches the callback, the sync message confirms the channel
+	require.Len(t, received, 1)
+	assert.Equal(t, "change", received[0].ResourceState)
+	assert.Equal(t, int64(7), received[0].MessageNumber)
+	assert.Equal(t, "a@example.com", received[0].Channel.Email)
+
+	// the callback runs in the tenant of the channel
+	assert.Equal(t, []string{"acme"}, tenants)
+
+	// a failing callback asks Drive to deliver again, also through Fiber
+	handler.OnNotification(func(ctx context.Context, notification *WebhookNotification) error {
+		return errors.New("queue unavailable")
+	})
+
+	app := fiber.New()
+	handler.Route(app, "/drive/webhook")
+
+	resp, err := app.Test(newWebhookRequest("channel-1", "secret", "change"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
+
+func TestGoogleDriveService_WatchFile(t *testing.T) {
+	service := &GoogleDriveService{
+		OAuthService: newStubOAuthService(t),
+		DB:           newTestDB(t, &WatchChannel{}),
+		RetryPolicy:  NoRetryPolicy(),
+	}
+	handler := NewWebhookHandler(service)
+
+	var (
+		syncStatus int
+		fail       bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var channel drive.Channel
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&channel))
+
+		if fail {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"code":400,"message":"invalid address"}}`))
+			return
+		}
+
+		// Drive confirms the channel before the watch call returns
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newWebhookRequest(channel.Id, channel.Token, "sync"))
+		syncStatus = recorder.Code
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&drive.Channel{Id: channel.Id, ResourceId: "resource-1", Expiration: channel.Expiration})
+	}))
+	t.Cleanup(server.Close)
+	service.ClientOptions = []option.ClientOption{option.WithEndpoint(server.URL + "/drive/v3/")}
+
+	ctx := context.Background()
+	req := &WatchFileRequest{
+		WatchRequest: WatchRequest{UserID: "user-1", Email: "a@example.com", Address: "https://example.com/drive/webhook"},
+		FileID:       "file-1",
+	}
+
+	channel, err := service.WatchFile(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, syncStatus)
+
+	var stored WatchChannel
+	require.NoError(t, service.DB.First(&stored, "id = ?", channel.ID).Error)
+	assert.Equal(t, "resource-1", stored.ResourceID)
+
+	// a channel Drive refused leaves no row behind
+	fail = true
+	_, err = service.WatchFile(ctx, req)
+	require.Error(t, err)
+
+	var count int64
+	require.NoError(t, service.DB.Model(&WatchChannel{}).Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+}
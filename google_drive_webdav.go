@@ -0,0 +1,206 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/webdav"
+)
+
+// ErrWebDAVUnauthorized is returned by a WebDAVAuthenticator for missing or wrong credentials
+var ErrWebDAVUnauthorized = errors.New("webdav credentials are missing or invalid")
+
+// WebDAVAccount is the Drive folder served to an authenticated WebDAV user
+type WebDAVAccount struct {
+	UserID string
+	Email  string
+
+	// FolderID is the root of the WebDAV share, defaults to the root of My Drive
+	FolderID string
+}
+
+// WebDAVAuthenticator returns the account of a WebDAV request, or ErrWebDAVUnauthorized
+type WebDAVAuthenticator func(r *http.Request) (*WebDAVAccount, error)
+
+// BasicAuthenticator authenticates WebDAV requests with HTTP basic credentials, which
+// is what most desktop clients send
+func BasicAuthenticator(verify func(ctx context.Context, username, password string) (*WebDAVAccount, error)) WebDAVAuthenticator {
+	return func(r *http.Request) (*WebDAVAccount, error) {
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			return nil, ErrWebDAVUnauthorized
+		}
+		return verify(r.Context(), username, password)
+	}
+}
+
+// WebDAVHandler serves the Drive folder of the authenticated user over WebDAV. Files
+// are listed with PROPFIND, read with GET including ranges, uploaded with PUT, moved
+// with RenameResource and MoveResource, copied with CopyResource and deleted files
+// are moved to the trash.
+type WebDAVHandler struct {
+	service      *GoogleDriveService
+	prefix       string
+	authenticate WebDAVAuthenticator
+
+	mu    sync.Mutex
+	locks map[string]webdav.LockSystem
+
+	// Logger is called with every request and the error it failed with, if any
+	Logger func(r *http.Request, err error)
+}
+
+// NewWebDAVHandler returns a handler serving WebDAV under the URL path prefix
+func NewWebDAVHandler(service *GoogleDriveService, prefix string, authenticate WebDAVAuthenticator) *WebDAVHandler {
+	return &WebDAVHandler{
+		service:      service,
+		prefix:       prefix,
+		authenticate: authenticate,
+		locks:        make(map[string]webdav.LockSystem),
+	}
+}
+
+func (handler *WebDAVHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	account, err := handler.authenticate(r)
+	if errors.Is(err, ErrWebDAVUnauthorized) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fundrive"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	vfs, err := handler.service.VFS(r.Context(), &VFSRequest{
+		FSRequest: FSRequest{UserID: account.UserID, Email: account.Email, FolderID: account.FolderID},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dav := &webdav.Handler{
+		Prefix:     handler.prefix,
+		FileSystem: webdavFS{vfs: vfs},
+		LockSystem: handler.lockSystem(account),
+		Logger:     handler.Logger,
+	}
+	dav.ServeHTTP(w, r)
+}
+
+// lockSystem returns the locks of an account, kept in memory across requests
+func (handler *WebDAVHandler) lockSystem(account *WebDAVAccount) webdav.LockSystem {
+	key := account.UserID + "\x00" + account.Email + "\x00" + account.FolderID
+
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+
+	locks, ok := handler.locks[key]
+	if !ok {
+		locks = webdav.NewMemLS()
+		handler.locks[key] = locks
+	}
+	return locks
+}
+
+// webdavFS adapts a DriveVFS to webdav.FileSystem, whose names are rooted at "/"
+type webdavFS struct {
+	vfs *DriveVFS
+}
+
+func webdavName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func (d webdavFS) Mkdir(_ context.Context, name string, perm os.FileMode) error {
+	return d.vfs.Mkdir(webdavName(name), perm)
+}
+
+func (d webdavFS) OpenFile(_ context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := d.vfs.OpenFile(webdavName(name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &webdavFile{VFSFile: f, name: name}, nil
+}
+
+func (d webdavFS) RemoveAll(_ context.Context, name string) error {
+	return d.vfs.RemoveAll(webdavName(name))
+}
+
+func (d webdavFS) Rename(_ context.Context, oldName, newName string) error {
+	return d.vfs.Rename(webdavName(oldName), webdavName(newName))
+}
+
+func (d webdavFS) Stat(_ context.Context, name string) (os.FileInfo, error) {
+	return d.vfs.Stat(webdavName(name))
+}
+
+// webdavFile adapts a VFSFile to webdav.File
+type webdavFile struct {
+	VFSFile
+	name string
+}
+
+func (f *webdavFile) Seek(offset int64, whence int) (int64, error) {
+	if seeker, ok := f.VFSFile.(io.Seeker); ok {
+		return seeker.Seek(offset, whence)
+	}
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errors.ErrUnsupported}
+}
+
+func (f *webdavFile) Readdir(count int) ([]fs.FileInfo, error) {
+	dir, ok := f.VFSFile.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+	}
+
+	entries, err := dir.ReadDir(count)
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, infoErr := entry.Info()
+		if infoErr != nil {
+			return infos, infoErr
+		}
+		infos = append(infos, info)
+	}
+	return infos, err
+}
+
+// ReadFrom turns the COPY of a Drive file into a server side copy, the WebDAV handler
+// copies files by reading the source into the destination
+func (f *webdavFile) ReadFrom(r io.Reader) (int64, error) {
+	if dst, ok := f.VFSFile.(*driveWriteFile); ok {
+		if src, ok := r.(*webdavFile); ok {
+			if readOnly, ok := src.VFSFile.(readOnlyFile); ok {
+				if file, ok := readOnly.File.(*driveFile); ok && file.fsys == dst.vfs.DriveFS {
+					dst.copyOf = file.file
+					return file.file.Size, nil
+				}
+			}
+		}
+	}
+
+	return io.Copy(f.VFSFile, r)
+}
+
+// ContentType returns the Drive MIME type, so PROPFIND does not download files to
+// detect it
+func (i driveFileInfo) ContentType(context.Context) (string, error) {
+	if i.file.MimeType == "" || i.IsDir() {
+		return "", webdav.ErrNotImplemented
+	}
+	return i.file.MimeType, nil
+}
@@ -0,0 +1,76 @@
+package fundrive
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestWebDAVHandler(t *testing.T) {
+	fake, service := newFakeDrive(t, []*drive.File{
+		{Id: "root-id", Name: "Projects", MimeType: MimeTypeFolder},
+	}, map[string]string{})
+
+	handler := NewWebDAVHandler(service, "/dav", BasicAuthenticator(func(ctx context.Context, username, password string) (*WebDAVAccount, error) {
+		if username != "alice" || password != "secret" {
+			return nil, ErrWebDAVUnauthorized
+		}
+		return &WebDAVAccount{UserID: "user-1", Email: "alice@example.com", FolderID: "root-id"}, nil
+	}))
+
+	do := func(method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth("alice", "secret")
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusCreated, do("MKCOL", "/dav/docs", "", nil).Code)
+	assert.Equal(t, http.StatusCreated, do(http.MethodPut, "/dav/docs/a.txt", "hello world", nil).Code)
+
+	resp := do(http.MethodGet, "/dav/docs/a.txt", "", map[string]string{"Range": "bytes=6-10"})
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "world", resp.Body.String())
+
+	resp = do("PROPFIND", "/dav/docs/", "", map[string]string{"Depth": "1"})
+	assert.Equal(t, http.StatusMultiStatus, resp.Code)
+	assert.Contains(t, resp.Body.String(), "/dav/docs/a.txt")
+
+	// COPY is a server side copy, the content is never uploaded again
+	resp = do("COPY", "/dav/docs/a.txt", "", map[string]string{"Destination": "/dav/b.txt"})
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	resp = do("MOVE", "/dav/b.txt", "", map[string]string{"Destination": "/dav/docs/c.txt"})
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	resp = do(http.MethodGet, "/dav/docs/c.txt", "", nil)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "hello world", string(body))
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/dav/docs", "", nil).Code)
+	assert.Equal(t, http.StatusNotFound, do("PROPFIND", "/dav/docs/", "", map[string]string{"Depth": "0"}).Code)
+
+	docs := fake.file("new-1")
+	require.NotNil(t, docs)
+	assert.True(t, docs.Trashed)
+
+	// root, docs, a.txt and its copy
+	assert.Len(t, fake.files, 4)
+
+	req := httptest.NewRequest("PROPFIND", "/dav/", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.NotEmpty(t, recorder.Header().Get("WWW-Authenticate"))
+}
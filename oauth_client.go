@@ -0,0 +1,237 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrOAuthClientNotFound is returned for an account issued by an unregistered OAuth client
+var ErrOAuthClientNotFound = errors.New("oauth client not found")
+
+// tokenClientExtra is the token extra field naming the OAuth client of the account,
+// GetToken sets it so RefreshToken uses the client that issued the token
+const tokenClientExtra = "fundrive_oauth_client"
+
+// tokenClientIDExtra is the token extra field holding the ID of the OAuth client of the
+// account, Drive requests are rate limited per client ID
+const tokenClientIDExtra = "fundrive_oauth_client_id"
+
+// OAuthClient is an OAuth client registered by a tenant, e.g. a customer bringing
+// its own Google Cloud project. The client secret is encrypted with the tenant key
+type OAuthClient struct {
+	TenantID     string `json:"tenant_id" gorm:"column:tenant_id;size:64;primaryKey"`
+	Name         string `json:"name" gorm:"column:name;size:64;primaryKey"`
+	ClientID     string `json:"client_id" gorm:"column:client_id;size:255"`
+	ClientSecret string `json:"-" gorm:"column:client_secret"`
+	RedirectURL  string `json:"redirect_url" gorm:"column:redirect_url"`
+
+	// AuthURL and TokenURL default to the Google endpoint
+	AuthURL  string `json:"auth_url" gorm:"column:auth_url"`
+	TokenURL string `json:"token_url" gorm:"column:token_url"`
+
+	// Scopes are space separated, empty uses the scopes of the tenant client
+	Scopes string `json:"scopes" gorm:"column:scopes"`
+
+	CreatedAt time.Time `json:"created_at" gorm:"column:created_at"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"column:updated_at"`
+}
+
+// TableName returns the table name
+func (c *OAuthClient) TableName() string {
+	return "fundrive_oauth_clients"
+}
+
+// OAuthClientResolver returns the OAuth client registered under name for the tenant,
+// a nil config falls back to the clients saved with SaveOAuthClient
+type OAuthClientResolver func(ctx context.Context, tenantID, name string) (*oauth2.Config, error)
+
+type SaveOAuthClientRequest struct {
+	// TenantID defaults to the tenant of the context
+	TenantID     string   `json:"tenant_id"`
+	Name         string   `json:"name"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	AuthURL      string   `json:"auth_url"`
+	TokenURL     string   `json:"token_url"`
+	Scopes       []string `json:"scopes"`
+}
+
+func (r *SaveOAuthClientRequest) Validate() error {
+	if r.Name == "" {
+		return errors.New("oauth client name is required")
+	}
+
+	if r.ClientID == "" {
+		return ErrClientIDEmpty
+	}
+
+	if r.ClientSecret == "" {
+		return ErrClientSecretEmpty
+	}
+
+	return nil
+}
+
+// SaveOAuthClient registers or replaces an OAuth client of the tenant
+func (s *OAuthService) SaveOAuthClient(ctx context.Context, req *SaveOAuthClientRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+
+	tenantID := tenantID(ctx, req.TenantID)
+	tenant, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	clientSecret, err := tenant.TokenEncryptor.Encrypt(req.ClientSecret)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt client secret: %w", err)
+	}
+
+	client := OAuthClient{
+		TenantID:     tenantID,
+		Name:         req.Name,
+		ClientID:     req.ClientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  req.RedirectURL,
+		AuthURL:      req.AuthURL,
+		TokenURL:     req.TokenURL,
+		Scopes:       strings.Join(req.Scopes, " "),
+	}
+
+	err = s.DB.WithContext(ctx).
+		Table(s.clientTable()).
+		Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "tenant_id"}, {Name: "name"}},
+			DoUpdates: clause.AssignmentColumns([]string{
+				"client_id", "client_secret", "redirect_url", "auth_url", "token_url", "scopes", "updated_at",
+			}),
+		}).
+		Create(&client).
+		Error
+	if err != nil {
+		return fmt.Errorf("failed to save oauth client: %w", err)
+	}
+
+	return nil
+}
+
+type DeleteOAuthClientRequest struct {
+	// TenantID defaults to the tenant of the context
+	TenantID string `json:"tenant_id"`
+	Name     string `json:"name"`
+}
+
+func (r *DeleteOAuthClientRequest) Validate() error {
+	if r.Name == "" {
+		return errors.New("oauth client name is required")
+	}
+
+	return nil
+}
+
+// DeleteOAuthClient removes an OAuth client of the tenant, the accounts it issued can
+// no longer refresh their token
+func (s *OAuthService) DeleteOAuthClient(ctx context.Context, req *DeleteOAuthClientRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+
+	err := s.DB.WithContext(ctx).
+		Table(s.clientTable()).
+		Where("tenant_id = ? AND name = ?", tenantID(ctx, req.TenantID), req.Name).
+		Delete(&OAuthClient{}).
+		Error
+	if err != nil {
+		return fmt.Errorf("failed to delete oauth client: %w", err)
+	}
+
+	return nil
+}
+
+// clientTable returns the name of the OAuth client table
+func (s *OAuthService) clientTable() string {
+	return tablePrefix(s.TablePrefix) + "oauth_clients"
+}
+
+// oauthClient returns the OAuth client registered under name for the tenant, the
+// empty name is the client of the tenant
+func (s *OAuthService) oauthClient(ctx context.Context, tenantID, name string) (*oauth2.Config, error) {
+	tenant, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		return tenant.OauthConfig, nil
+	}
+
+	if s.ClientResolver != nil {
+		config, err := s.ClientResolver(ctx, tenantID, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve oauth client %s: %w", name, err)
+		}
+		if config != nil {
+			return config, nil
+		}
+	}
+
+	var client OAuthClient
+	err = s.DB.WithContext(ctx).
+		Table(s.clientTable()).
+		Where("tenant_id = ? AND name = ?", tenantID, name).
+		First(&client).
+		Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: %s", ErrOAuthClientNotFound, name)
+		}
+		return nil, fmt.Errorf("failed to get oauth client: %w", err)
+	}
+
+	clientSecret, err := tenant.TokenEncryptor.Decrypt(client.ClientSecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt client secret: %w", err)
+	}
+
+	config := &oauth2.Config{
+		ClientID:     client.ClientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  client.RedirectURL,
+		Endpoint:     google.Endpoint,
+		Scopes:       strings.Fields(client.Scopes),
+	}
+	if client.AuthURL != "" {
+		config.Endpoint.AuthURL = client.AuthURL
+	}
+	if client.TokenURL != "" {
+		config.Endpoint.TokenURL = client.TokenURL
+	}
+	if len(config.Scopes) == 0 && tenant.OauthConfig != nil {
+		config.Scopes = tenant.OauthConfig.Scopes
+	}
+
+	return config, nil
+}
+
+// tokenClient returns the name of the OAuth client recorded on a token by GetToken
+func tokenClient(token *oauth2.Token) string {
+	name, _ := token.Extra(tokenClientExtra).(string)
+	return name
+}
+
+// tokenClientID returns the ID of the OAuth client recorded on a token by GetToken
+func tokenClientID(token *oauth2.Token) string {
+	id, _ := token.Extra(tokenClientIDExtra).(string)
+	return id
+}
@@ -0,0 +1,133 @@
+package fundrive
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestOAuthService_OAuthClients(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		clients []string
+	)
+
+	// the token endpoint records the client of every grant
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		clientID, _, ok := r.BasicAuth()
+		if !ok {
+			clientID = r.Form.Get("client_id")
+		}
+
+		mu.Lock()
+		clients = append(clients, r.Form.Get("grant_type")+":"+clientID)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	encryptor, err := NewTokenEncryption("12345678901234567890123456789012")
+	require.NoError(t, err)
+
+	service := &OAuthService{
+		DB: newTestDB(t, &OAuthToken{}, &OAuthClient{}),
+		OauthConfig: &oauth2.Config{
+			ClientID: "default-client",
+			Scopes:   ScopeProfileFull.Scopes(),
+			Endpoint: oauth2.Endpoint{AuthURL: "https://accounts.example.com/auth", TokenURL: server.URL},
+		},
+		TokenEncryptor: encryptor,
+		ClientResolver: func(ctx context.Context, tenantID, name string) (*oauth2.Config, error) {
+			if name != "resolved" {
+				return nil, nil
+			}
+			return &oauth2.Config{
+				ClientID: "resolved-client",
+				Endpoint: oauth2.Endpoint{AuthURL: "https://accounts.example.com/auth", TokenURL: server.URL},
+			}, nil
+		},
+	}
+	ctx := context.Background()
+
+	require.NoError(t, service.SaveOAuthClient(ctx, &SaveOAuthClientRequest{
+		Name:         "byo",
+		ClientID:     "byo-client",
+		ClientSecret: "byo-secret",
+		AuthURL:      "https://accounts.example.com/auth",
+		TokenURL:     server.URL,
+	}))
+
+	var row OAuthClient
+	require.NoError(t, service.DB.First(&row, "name = ?", "byo").Error)
+	assert.NotContains(t, row.ClientSecret, "byo-secret")
+
+	clientID := func(req *AuthCodeURLRequest) string {
+		authURL, err := service.AuthCodeURL(req)
+		require.NoError(t, err)
+		parsed, err := url.Parse(authURL)
+		require.NoError(t, err)
+		return parsed.Query().Get("client_id")
+	}
+	assert.Equal(t, "byo-client", clientID(&AuthCodeURLRequest{State: "state", ClientName: "byo"}))
+	assert.Equal(t, "resolved-client", clientID(&AuthCodeURLRequest{State: "state", ClientName: "resolved"}))
+	assert.Equal(t, "default-client", clientID(&AuthCodeURLRequest{State: "state"}))
+
+	_, err = service.AuthCodeURL(&AuthCodeURLRequest{State: "state", ClientName: "unknown"})
+	assert.ErrorIs(t, err, ErrOAuthClientNotFound)
+
+	// the code is exchanged with the client of the consent page
+	token, err := service.ExchangeToken(ctx, &ExchangeTokenRequest{UserID: "user-1", AuthorizationCode: "code", ClientName: "byo"})
+	require.NoError(t, err)
+
+	token.Expiry = time.Now().Add(-time.Hour)
+	token.RefreshToken = "refresh-token"
+	require.NoError(t, service.SaveToken(ctx, &SaveTokenRequest{UserID: "user-1", Email: "a@example.com", ClientName: "byo", Token: token}))
+
+	// the account refreshes with the client that issued its token
+	saved, err := service.GetToken(ctx, &GetTokenRequest{UserID: "user-1", Email: "a@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "byo-client", tokenClientID(saved))
+	refreshed, err := service.RefreshToken(ctx, saved)
+	require.NoError(t, err)
+
+	// saving the refreshed token keeps the client
+	require.NoError(t, service.SaveToken(ctx, &SaveTokenRequest{UserID: "user-1", Email: "a@example.com", Token: refreshed, KeepClient: true}))
+	var account OAuthToken
+	require.NoError(t, service.DB.First(&account, "user_id = ?", "user-1").Error)
+	assert.Equal(t, "byo", account.ClientName)
+
+	mu.Lock()
+	assert.Equal(t, []string{"authorization_code:byo-client", "refresh_token:byo-client"}, clients)
+	mu.Unlock()
+
+	require.NoError(t, service.DeleteOAuthClient(ctx, &DeleteOAuthClientRequest{Name: "byo"}))
+	_, err = service.RefreshToken(ctx, saved)
+	assert.ErrorIs(t, err, ErrOAuthClientNotFound)
+
+	// consenting again with the tenant client replaces the client of the account
+	token, err = service.ExchangeToken(ctx, &ExchangeTokenRequest{UserID: "user-1", AuthorizationCode: "code"})
+	require.NoError(t, err)
+	require.NoError(t, service.SaveToken(ctx, &SaveTokenRequest{UserID: "user-1", Email: "a@example.com", Token: token}))
+	require.NoError(t, service.DB.First(&account, "user_id = ?", "user-1").Error)
+	assert.Equal(t, "", account.ClientName)
+
+	saved, err = service.GetToken(ctx, &GetTokenRequest{UserID: "user-1", Email: "a@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "default-client", tokenClientID(saved))
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
-	"google.golang.org/api/drive/v3"
 	"os"
 	"strings"
 )
@@ -23,24 +22,13 @@ var userScopes = []string{
 	"https://www.googleapis.com/auth/userinfo.profile",
 }
 
-// driveScopes defines the OAuth scopes required for Google Drive access
-var driveScopes = []string{
-	drive.DriveScope,
-	drive.DriveReadonlyScope,
-	drive.DriveMetadataReadonlyScope,
-	drive.DriveMetadataScope,
-	drive.DriveFileScope,
-	drive.DriveScriptsScope,
-}
-
 // createConfig creates an OAuth2 config from service account JSON data
 func createConfig(data []byte) (*oauth2.Config, error) {
 	if len(data) == 0 {
 		return nil, fmt.Errorf("error read service account file: %w", ErrServiceAccountFileEmpty)
 	}
 
-	scopes := append(userScopes, driveScopes...)
-	oauth2Config, err := google.ConfigFromJSON(data, scopes...)
+	oauth2Config, err := google.ConfigFromJSON(data, ScopeProfileFull.Scopes()...)
 	if err != nil {
 		return nil, fmt.Errorf("error set up oauth config from json: %w", err)
 	}
@@ -67,6 +55,9 @@ type OAuthCredentials struct {
 	ClientID     string
 	ClientSecret string
 	RedirectURL  string
+
+	// ScopeProfile defaults to ScopeProfileFull
+	ScopeProfile ScopeProfile
 }
 
 // NewOAuth2ConfigFromCredentials creates a new OAuth2 config using manual credentials
@@ -78,13 +69,15 @@ func NewOAuth2ConfigFromCredentials(cred OAuthCredentials) (*oauth2.Config, erro
 		return nil, fmt.Errorf("error creating oauth config: %w", ErrClientSecretEmpty)
 	}
 
-	scopes := append(userScopes, driveScopes...)
+	if err := cred.ScopeProfile.Validate(); err != nil {
+		return nil, fmt.Errorf("error creating oauth config: %w", err)
+	}
 
 	config := &oauth2.Config{
 		ClientID:     cred.ClientID,
 		ClientSecret: cred.ClientSecret,
 		RedirectURL:  cred.RedirectURL,
-		Scopes:       scopes,
+		Scopes:       cred.ScopeProfile.Scopes(),
 		Endpoint:     google.Endpoint,
 	}
 
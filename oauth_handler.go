@@ -7,6 +7,7 @@ import (
     "log"
     "net/http"
     "net/url"
+    "strings"
 )
 
 type OAuthHandler struct {
@@ -51,10 +52,18 @@ func (handler *OAuthHandler) AuthorizeHandler(c *fiber.Ctx) error {
         "redirect_url": {redirectURL},
     }
 
-    // https://medium.com/starthinker/google-oauth-2-0-access-token-and-refresh-token-explained-cccf2fc0a6d9
-    authCodeOpt := []oauth2.AuthCodeOption{
-        oauth2.AccessTypeOffline, // obtain the refresh token
-        oauth2.ApprovalForce,     // forces the users to view the consent dialog
+    // email and scope_profile upgrade a connected account to a wider scope profile
+    authCodeOpt := authCodeOptions(c.Query("email"))
+    if profile := ScopeProfile(c.Query("scope_profile")); profile != "" {
+        if err := profile.Validate(); err != nil {
+            return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+                "code":    http.StatusBadRequest,
+                "success": false,
+                "message": http.StatusText(http.StatusBadRequest),
+                "details": err.Error(),
+            })
+        }
+        authCodeOpt = append(authCodeOpt, oauth2.SetAuthURLParam("scope", strings.Join(profile.Scopes(), " ")))
     }
 
     loginUrl := handler.oauth2Config.AuthCodeURL(queryParams.Encode(), authCodeOpt...)
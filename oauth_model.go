@@ -3,23 +3,37 @@ package fundrive
 import (
 	"fmt"
 	"golang.org/x/oauth2"
+	"strings"
 	"time"
 )
 
+// OAuthToken is the token of a connected account. Column types are left to the
+// dialect: strings without a size are longtext on MySQL and text elsewhere
 type OAuthToken struct {
-	ID     string `json:"id" gorm:"column:id;type:char(26);primaryKey"`
-	UserID string `json:"user_id" gorm:"column:user_id;type:char(255)"`
-	Email  string `json:"email" gorm:"column:email;type:varchar(255)"`
+	ID       string `json:"id" gorm:"column:id;size:26;primaryKey"`
+	TenantID string `json:"tenant_id" gorm:"column:tenant_id;size:64;not null;default:'';uniqueIndex:idx_fundrive_oauth_tokens_tenant_account"`
+	UserID   string `json:"user_id" gorm:"column:user_id;size:255;uniqueIndex:idx_fundrive_oauth_tokens_tenant_account"`
+	Email    string `json:"email" gorm:"column:email;size:255;uniqueIndex:idx_fundrive_oauth_tokens_tenant_account"`
+
+	// ClientName is the registered OAuth client that issued the token, empty for the
+	// client of the tenant
+	ClientName string `json:"client_name" gorm:"column:client_name;size:64;not null;default:''"`
 
 	// provided by google
-	AccessToken  string    `json:"access_token" gorm:"column:access_token;type:longtext"`
-	RefreshToken string    `json:"refresh_token" gorm:"column:refresh_token;type:longtext"`
-	TokenType    string    `json:"token_type" gorm:"column:token_type;type:varchar(50)"`
-	Expiry       time.Time `json:"expiry" gorm:"column:expiry;type:timestamp"`
+	AccessToken  string    `json:"access_token" gorm:"column:access_token"`
+	RefreshToken string    `json:"refresh_token" gorm:"column:refresh_token"`
+	TokenType    string    `json:"token_type" gorm:"column:token_type;size:50"`
+	Expiry       time.Time `json:"expiry" gorm:"column:expiry"`
+
+	// Scopes are the space separated scopes granted to the token
+	Scopes string `json:"scopes" gorm:"column:scopes"`
 
 	// Etc
-	ExpiryTimestamp *string `json:"expiry_timestamp" gorm:"column:expiry_timestamp;type:text"`
-	BaseFolderID    *string `json:"base_folder_id" gorm:"column:base_folder_id;type:longtext"`
+	ExpiryTimestamp *string `json:"expiry_timestamp" gorm:"column:expiry_timestamp"`
+	BaseFolderID    *string `json:"base_folder_id" gorm:"column:base_folder_id"`
+
+	CreatedAt time.Time `json:"created_at" gorm:"column:created_at"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"column:updated_at"`
 }
 
 // TableName returns the table name
@@ -31,6 +45,18 @@ func (o *OAuthToken) HasBaseFolderID() bool {
 	return o.BaseFolderID != nil
 }
 
+// GrantedScopes returns the scopes granted to the token, empty for tokens saved
+// before scopes were recorded
+func (o *OAuthToken) GrantedScopes() []string {
+	return strings.Fields(o.Scopes)
+}
+
+// HasScopes reports whether the token was granted every scope, wider scopes like
+// full Drive access cover the narrower ones
+func (o *OAuthToken) HasScopes(scopes ...string) bool {
+	return hasScopes(o.GrantedScopes(), scopes...)
+}
+
 // ToOAuth2Token converts OAuthToken to oauth2.Token
 func (o *OAuthToken) ToOAuth2Token(encryption *TokenEncryption) (*oauth2.Token, error) {
 	accessToken, err := encryption.Decrypt(o.AccessToken)
@@ -74,6 +100,11 @@ func (o *OAuthToken) FromOAuth2Token(token *oauth2.Token, encryption *TokenEncry
 	o.TokenType = token.TokenType
 	o.Expiry = token.Expiry
 
+	// refresh responses may omit the scope, the grant does not change then
+	if scope, ok := token.Extra("scope").(string); ok && scope != "" {
+		o.Scopes = scope
+	}
+
 	return nil
 }
 
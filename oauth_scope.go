@@ -0,0 +1,114 @@
+package fundrive
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrInsufficientScope is returned when the token of an account was not granted a
+// scope the operation needs. Upgrade the account with incremental authorization
+var ErrInsufficientScope = errors.New("insufficient OAuth scope, authorize the account again with a wider scope profile")
+
+// ScopeProfile selects the Drive access requested on the consent screen
+type ScopeProfile string
+
+const (
+	// ScopeProfileFile only grants access to files created or opened with the app,
+	// it does not require Google verification
+	ScopeProfileFile ScopeProfile = "file"
+
+	// ScopeProfileReadOnly grants read access to every file
+	ScopeProfileReadOnly ScopeProfile = "readonly"
+
+	// ScopeProfileFull grants read and write access to every file
+	ScopeProfileFull ScopeProfile = "full"
+)
+
+// Scopes returns the OAuth scopes of the profile, including the scopes needed to
+// resolve the email of the account
+func (p ScopeProfile) Scopes() []string {
+	return append(slices.Clone(userScopes), p.driveScope())
+}
+
+// driveScope returns the Drive scope of the profile
+func (p ScopeProfile) driveScope() string {
+	switch p {
+	case ScopeProfileFile:
+		return drive.DriveFileScope
+	case ScopeProfileReadOnly:
+		return drive.DriveReadonlyScope
+	}
+
+	return drive.DriveScope
+}
+
+// Validate checks the profile is known, the empty profile means ScopeProfileFull
+func (p ScopeProfile) Validate() error {
+	switch p {
+	case "", ScopeProfileFile, ScopeProfileReadOnly, ScopeProfileFull:
+		return nil
+	}
+
+	return fmt.Errorf("unknown scope profile %q", p)
+}
+
+// impliedScopes lists the scopes granted implicitly by a wider scope
+var impliedScopes = map[string][]string{
+	drive.DriveScope: {
+		drive.DriveReadonlyScope,
+		drive.DriveFileScope,
+		drive.DriveMetadataScope,
+		drive.DriveMetadataReadonlyScope,
+	},
+	drive.DriveReadonlyScope: {drive.DriveMetadataReadonlyScope},
+	drive.DriveMetadataScope: {drive.DriveMetadataReadonlyScope},
+}
+
+// hasScopes reports whether the granted scopes cover every required scope
+func hasScopes(granted []string, required ...string) bool {
+	for _, scope := range required {
+		covered := slices.ContainsFunc(granted, func(grantedScope string) bool {
+			return grantedScope == scope || slices.Contains(impliedScopes[grantedScope], scope)
+		})
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
+
+// isInsufficientScopeError reports whether Google rejected the request because the
+// access token lacks a scope, as opposed to the account lacking access to the file
+func isInsufficientScopeError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+		return false
+	}
+
+	if apiErr.Header != nil && strings.Contains(apiErr.Header.Get("WWW-Authenticate"), "insufficient_scope") {
+		return true
+	}
+
+	for _, item := range apiErr.Errors {
+		if item.Reason == "insufficientPermissions" && strings.Contains(item.Message, "scope") {
+			return true
+		}
+	}
+
+	return strings.Contains(apiErr.Message, "insufficient authentication scopes")
+}
+
+// wrapScopeError turns an insufficient scope response into ErrInsufficientScope,
+// the Google error stays available through errors.As
+func wrapScopeError(err error) error {
+	if isInsufficientScopeError(err) {
+		return fmt.Errorf("%w: %w", ErrInsufficientScope, err)
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+package fundrive
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+func TestScopeProfile(t *testing.T) {
+	assert.Contains(t, ScopeProfileFile.Scopes(), drive.DriveFileScope)
+	assert.NotContains(t, ScopeProfileFile.Scopes(), drive.DriveScope)
+	assert.Contains(t, ScopeProfileReadOnly.Scopes(), drive.DriveReadonlyScope)
+	assert.Contains(t, ScopeProfileFull.Scopes(), drive.DriveScope)
+	assert.NotContains(t, ScopeProfileFull.Scopes(), drive.DriveScriptsScope)
+
+	// the shared user scopes must not be modified by the profiles
+	assert.Len(t, ScopeProfileFile.Scopes(), len(userScopes)+1)
+
+	assert.NoError(t, ScopeProfile("").Validate())
+	assert.Error(t, ScopeProfile("admin").Validate())
+}
+
+func TestOAuthToken_Scopes(t *testing.T) {
+	encryptor, err := NewTokenEncryption("12345678901234567890123456789012")
+	require.NoError(t, err)
+
+	token := (&oauth2.Token{AccessToken: "a"}).WithExtra(map[string]any{
+		"scope": "openid " + drive.DriveReadonlyScope,
+	})
+
+	var row OAuthToken
+	require.NoError(t, row.FromOAuth2Token(token, encryptor))
+	assert.Equal(t, []string{"openid", drive.DriveReadonlyScope}, row.GrantedScopes())
+	assert.True(t, row.HasScopes(drive.DriveMetadataReadonlyScope))
+	assert.False(t, row.HasScopes(drive.DriveFileScope))
+
+	// a refresh response without scope keeps the recorded grant
+	require.NoError(t, row.FromOAuth2Token(&oauth2.Token{AccessToken: "b"}, encryptor))
+	assert.True(t, row.HasScopes(drive.DriveReadonlyScope))
+
+	upgraded := (&oauth2.Token{AccessToken: "c"}).WithExtra(map[string]any{"scope": drive.DriveScope})
+	require.NoError(t, row.FromOAuth2Token(upgraded, encryptor))
+	assert.True(t, row.HasScopes(drive.DriveFileScope, drive.DriveReadonlyScope))
+}
+
+func TestWrapScopeError(t *testing.T) {
+	scopeErr := &googleapi.Error{
+		Code:    http.StatusForbidden,
+		Message: "Request had insufficient authentication scopes.",
+		Errors: []googleapi.ErrorItem{{
+			Reason:  "insufficientPermissions",
+			Message: "Insufficient Permission: Request had insufficient authentication scopes.",
+		}},
+	}
+	err := wrapScopeError(scopeErr)
+	assert.ErrorIs(t, err, ErrInsufficientScope)
+
+	var apiErr *googleapi.Error
+	assert.True(t, errors.As(err, &apiErr))
+
+	// missing access to a file is not a scope problem
+	fileErr := &googleapi.Error{
+		Code:   http.StatusForbidden,
+		Errors: []googleapi.ErrorItem{{Reason: "insufficientFilePermissions", Message: "The user does not have sufficient permissions for this file."}},
+	}
+	assert.NotErrorIs(t, wrapScopeError(fileErr), ErrInsufficientScope)
+}
+
+func TestOAuthService_AuthCodeURL(t *testing.T) {
+	service := &OAuthService{OauthConfig: &oauth2.Config{
+		ClientID:    "client-id",
+		RedirectURL: "https://app.example.com/callback",
+		Scopes:      ScopeProfileFile.Scopes(),
+		Endpoint:    oauth2.Endpoint{AuthURL: "https://accounts.example.com/auth"},
+	}}
+
+	authURL, err := service.AuthCodeURL(&AuthCodeURLRequest{
+		State:        "state",
+		Email:        "a@example.com",
+		ScopeProfile: ScopeProfileFull,
+	})
+	require.NoError(t, err)
+
+	parsed, err := url.Parse(authURL)
+	require.NoError(t, err)
+	query := parsed.Query()
+	assert.Equal(t, "true", query.Get("include_granted_scopes"))
+	assert.Equal(t, "a@example.com", query.Get("login_hint"))
+	assert.Contains(t, query.Get("scope"), drive.DriveScope)
+	assert.Equal(t, "https://app.example.com/callback", query.Get("redirect_uri"))
+
+	// the client keeps its own scopes
+	assert.Equal(t, ScopeProfileFile.Scopes(), service.OauthConfig.Scopes)
+
+	_, err = service.AuthCodeURL(&AuthCodeURLRequest{})
+	assert.Error(t, err)
+}
@@ -15,6 +15,7 @@ var (
 	ErrInvalidUserID            = errors.New("invalid user ID provided")
 	ErrInvalidEmail             = errors.New("invalid email provided")
 	ErrInvalidAuthorizationCode = errors.New("invalid authorization code provided")
+	ErrAuthorizationDenied      = errors.New("authorization denied by the user")
 )
 
 // IOAuthService defines the interface for OAuth operations
@@ -27,13 +28,33 @@ type IOAuthService interface {
 	ExchangeToken(ctx context.Context, req *ExchangeTokenRequest) (*oauth2.Token, error)
 	DeleteToken(ctx context.Context, req *DeleteTokenRequest) error
 	ListUserTokens(ctx context.Context, req *ListUserTokensRequest) ([]OAuthToken, error)
+	GetUserToken(ctx context.Context, req *GetUserTokenRequest) (*OAuthToken, error)
+	AuthCodeURL(req *AuthCodeURLRequest) (string, error)
+	AuthorizeLoopback(ctx context.Context, req *LoopbackAuthRequest) (*AuthorizationResult, error)
+	AuthorizeDevice(ctx context.Context, req *DeviceAuthRequest) (*AuthorizationResult, error)
+	SaveOAuthClient(ctx context.Context, req *SaveOAuthClientRequest) error
+	DeleteOAuthClient(ctx context.Context, req *DeleteOAuthClientRequest) error
 }
 
+// TokenChangeHook is called after the token of an account is saved or deleted, the
+// tenant of the account is available with TenantFromContext
+type TokenChangeHook func(ctx context.Context, userID, email string)
+
 // OAuthConfig contains the configuration for OAuth service
 type OAuthConfig struct {
-	DB             *gorm.DB
-	OAuth2Config   *oauth2.Config
-	TokenEncryptor *TokenEncryption
+	DB               *gorm.DB
+	OAuth2Config     *oauth2.Config
+	TokenEncryptor   *TokenEncryption
+	TokenChangeHooks []TokenChangeHook
+
+	// Tenants are the registered tenants, the empty tenant uses OAuth2Config and TokenEncryptor
+	Tenants map[string]*Tenant
+
+	// TablePrefix defaults to DefaultTablePrefix
+	TablePrefix string
+
+	// ClientResolver supplies registered OAuth clients, see OAuthClientResolver
+	ClientResolver OAuthClientResolver
 }
 
 // Validate validates the OAuth configuration
@@ -49,9 +70,13 @@ func (c *OAuthConfig) Validate() error {
 
 // OAuthService implements IOAuthService interface
 type OAuthService struct {
-	DB             *gorm.DB
-	OauthConfig    *oauth2.Config
-	TokenEncryptor *TokenEncryption
+	DB               *gorm.DB
+	OauthConfig      *oauth2.Config
+	TokenEncryptor   *TokenEncryption
+	TokenChangeHooks []TokenChangeHook
+	Tenants          map[string]*Tenant
+	TablePrefix      string
+	ClientResolver   OAuthClientResolver
 }
 
 // NewOAuthService creates a new instance of OAuthService
@@ -61,8 +86,54 @@ func NewOAuthService(config *OAuthConfig) (IOAuthService, error) {
 	}
 
 	return &OAuthService{
-		DB:             config.DB,
-		OauthConfig:    config.OAuth2Config,
-		TokenEncryptor: config.TokenEncryptor,
+		DB:               config.DB,
+		OauthConfig:      config.OAuth2Config,
+		TokenEncryptor:   config.TokenEncryptor,
+		TokenChangeHooks: config.TokenChangeHooks,
+		Tenants:          config.Tenants,
+		TablePrefix:      config.TablePrefix,
+		ClientResolver:   config.ClientResolver,
+	}, nil
+}
+
+// notifyTokenChange runs the registered token change hooks, ctx carries the tenant
+func (s *OAuthService) notifyTokenChange(ctx context.Context, tenantID, userID, email string) {
+	ctx = ContextWithTenant(ctx, tenantID)
+	for _, hook := range s.TokenChangeHooks {
+		hook(ctx, userID, email)
+	}
+}
+
+// AuthorizationResult is the account connected by an authorization flow
+type AuthorizationResult struct {
+	UserID   string          `json:"user_id"`
+	Email    string          `json:"email"`
+	UserInfo *GoogleUserInfo `json:"user_info"`
+	Token    *oauth2.Token   `json:"-"`
+}
+
+// completeAuthorization saves the token of a finished authorization flow under the
+// email of the Google account it was issued for, with the OAuth client that issued it
+func (s *OAuthService) completeAuthorization(ctx context.Context, userID, clientName string, token *oauth2.Token) (*AuthorizationResult, error) {
+	userInfo, err := s.GetGoogleUserInfo(ctx, &GetUserInfoRequest{Token: token})
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.SaveToken(ctx, &SaveTokenRequest{
+		UserID:     userID,
+		Email:      userInfo.Email,
+		ClientName: clientName,
+		Token:      token,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthorizationResult{
+		UserID:   userID,
+		Email:    userInfo.Email,
+		UserInfo: userInfo,
+		Token:    token,
 	}, nil
 }
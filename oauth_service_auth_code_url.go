@@ -0,0 +1,92 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/oauth2"
+)
+
+type AuthCodeURLRequest struct {
+	// TenantID selects the OAuth client of the tenant
+	TenantID string `json:"tenant_id"`
+	State    string `json:"state"`
+
+	// ClientName selects a registered OAuth client of the tenant, save the token with
+	// the same name after the exchange
+	ClientName string `json:"client_name"`
+
+	// RedirectURL overrides the redirect URL of the OAuth client
+	RedirectURL string `json:"redirect_url"`
+
+	// Email preselects a connected account on the consent screen, combined with a
+	// wider ScopeProfile it upgrades the account and keeps the scopes granted before
+	Email string `json:"email"`
+
+	// ScopeProfile defaults to the scopes of the OAuth client, Scopes overrides it
+	ScopeProfile ScopeProfile `json:"scope_profile"`
+	Scopes       []string     `json:"scopes"`
+
+	// Options are appended to the URL parameters, e.g. a PKCE challenge
+	Options []oauth2.AuthCodeOption `json:"-"`
+}
+
+func (r *AuthCodeURLRequest) Validate() error {
+	if r.State == "" {
+		return errors.New("state is required")
+	}
+
+	return r.ScopeProfile.Validate()
+}
+
+// AuthCodeURL returns the URL of the consent page. It always requests incremental
+// authorization so the token keeps the scopes the account granted before
+func (s *OAuthService) AuthCodeURL(req *AuthCodeURLRequest) (string, error) {
+	if err := req.Validate(); err != nil {
+		return "", err
+	}
+
+	client, err := s.oauthClient(context.Background(), req.TenantID, req.ClientName)
+	if err != nil {
+		return "", err
+	}
+
+	config := authConfig(client, req.RedirectURL, req.ScopeProfile, req.Scopes)
+	opts := append(authCodeOptions(req.Email), req.Options...)
+
+	return config.AuthCodeURL(req.State, opts...), nil
+}
+
+// authConfig returns a copy of the OAuth client with the redirect URL and scopes of a flow
+func authConfig(client *oauth2.Config, redirectURL string, profile ScopeProfile, scopes []string) *oauth2.Config {
+	config := *client
+
+	if redirectURL != "" {
+		config.RedirectURL = redirectURL
+	}
+
+	switch {
+	case len(scopes) > 0:
+		config.Scopes = scopes
+	case profile != "":
+		config.Scopes = profile.Scopes()
+	}
+
+	return &config
+}
+
+// authCodeOptions requests a refresh token and incremental authorization
+func authCodeOptions(email string) []oauth2.AuthCodeOption {
+	// https://medium.com/starthinker/google-oauth-2-0-access-token-and-refresh-token-explained-cccf2fc0a6d9
+	opts := []oauth2.AuthCodeOption{
+		oauth2.AccessTypeOffline, // obtain the refresh token
+		oauth2.ApprovalForce,     // forces the users to view the consent dialog
+		oauth2.SetAuthURLParam("include_granted_scopes", "true"),
+	}
+
+	if email != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("login_hint", email))
+	}
+
+	return opts
+}
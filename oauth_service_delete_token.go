@@ -6,8 +6,9 @@ import (
 )
 
 type DeleteTokenRequest struct {
-	UserID string `json:"user_id"`
-	Email  string `json:"email"`
+	TenantID string `json:"tenant_id"`
+	UserID   string `json:"user_id"`
+	Email    string `json:"email"`
 }
 
 func (s *DeleteTokenRequest) Validate() error {
@@ -28,7 +29,9 @@ func (s *OAuthService) DeleteToken(ctx context.Context, req *DeleteTokenRequest)
 		return err
 	}
 
-	err := s.DB.WithContext(ctx).
+	tenantID := tenantID(ctx, req.TenantID)
+
+	err := s.tokens(ctx, tenantID).
 		Where("user_id = ? AND email = ?", req.UserID, req.Email).
 		Delete(&OAuthToken{}).
 		Error
@@ -37,5 +40,7 @@ func (s *OAuthService) DeleteToken(ctx context.Context, req *DeleteTokenRequest)
 		return fmt.Errorf("failed to delete token: %w", err)
 	}
 
+	s.notifyTokenChange(ctx, tenantID, req.UserID, req.Email)
+
 	return nil
 }
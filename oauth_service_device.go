@@ -0,0 +1,88 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+)
+
+// DeviceAuthScopes are the scopes requested by AuthorizeDevice by default, Google only
+// allows the drive.file and drive.appdata Drive scopes for the device flow
+var DeviceAuthScopes = append(append([]string{}, userScopes...), drive.DriveFileScope)
+
+// DeviceAuthRequest connects an account with the device authorization grant, for
+// machines without a browser. It requires a "TVs and Limited Input devices" OAuth client
+type DeviceAuthRequest struct {
+	// TenantID defaults to the tenant of the context
+	TenantID string `json:"tenant_id"`
+	UserID   string `json:"user_id"`
+
+	// ClientName selects a registered OAuth client of the tenant
+	ClientName string `json:"client_name"`
+
+	// Prompt shows the user code and the verification URL to the user
+	Prompt func(auth *oauth2.DeviceAuthResponse) error `json:"-"`
+
+	// Scopes defaults to DeviceAuthScopes
+	Scopes []string `json:"scopes"`
+}
+
+func (r *DeviceAuthRequest) Validate() error {
+	if r.UserID == "" {
+		return ErrInvalidUserID
+	}
+
+	if r.Prompt == nil {
+		return errors.New("device prompt is required")
+	}
+
+	return nil
+}
+
+// AuthorizeDevice runs the OAuth 2.0 device authorization grant: it asks Google for a
+// user code, shows it with Prompt and polls until the user consents on another device
+func (s *OAuthService) AuthorizeDevice(ctx context.Context, req *DeviceAuthRequest) (*AuthorizationResult, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	ctx = ContextWithTenant(ctx, tenantID(ctx, req.TenantID))
+	client, err := s.oauthClient(ctx, TenantFromContext(ctx), req.ClientName)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := req.Scopes
+	if len(scopes) == 0 {
+		scopes = DeviceAuthScopes
+	}
+	config := authConfig(client, "", "", scopes)
+	// client configs loaded from JSON do not carry the device endpoint
+	if config.Endpoint.DeviceAuthURL == "" {
+		config.Endpoint.DeviceAuthURL = google.Endpoint.DeviceAuthURL
+	}
+
+	auth, err := config.DeviceAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting device code: %w", err)
+	}
+
+	if err := req.Prompt(auth); err != nil {
+		return nil, err
+	}
+
+	token, err := config.DeviceAccessToken(ctx, auth)
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "access_denied" {
+			return nil, fmt.Errorf("%w: %s", ErrAuthorizationDenied, retrieveErr.ErrorCode)
+		}
+		return nil, fmt.Errorf("error polling device token: %w", err)
+	}
+
+	return s.completeAuthorization(ctx, req.UserID, req.ClientName, token)
+}
@@ -6,8 +6,13 @@ import (
 )
 
 type ExchangeTokenRequest struct {
+	TenantID          string `json:"tenant_id"`
 	UserID            string `json:"user_id"`
 	AuthorizationCode string `json:"authorization_code"`
+
+	// ClientName is the registered OAuth client of the consent page, empty for the
+	// client of the tenant
+	ClientName string `json:"client_name"`
 }
 
 func (s *ExchangeTokenRequest) Validate() error {
@@ -28,7 +33,12 @@ func (s *OAuthService) ExchangeToken(ctx context.Context, req *ExchangeTokenRequ
 		return nil, err
 	}
 
-	oauth2Token, err := CreateToken(s.OauthConfig, req.AuthorizationCode)
+	client, err := s.oauthClient(ctx, tenantID(ctx, req.TenantID), req.ClientName)
+	if err != nil {
+		return nil, err
+	}
+
+	oauth2Token, err := CreateToken(client, req.AuthorizationCode)
 	if err != nil {
 		return nil, err
 	}
@@ -10,8 +10,9 @@ import (
 )
 
 type GetTokenRequest struct {
-	UserID string `json:"user_id"`
-	Email  string `json:"email"`
+	TenantID string `json:"tenant_id"`
+	UserID   string `json:"user_id"`
+	Email    string `json:"email"`
 }
 
 func (s *GetTokenRequest) Validate() error {
@@ -26,14 +27,21 @@ func (s *GetTokenRequest) Validate() error {
 	return nil
 }
 
-// GetToken retrieves an OAuth token for a user
+// GetToken retrieves an OAuth token for a user, the token names the OAuth client that
+// issued it so RefreshToken can use the same client, and carries its client ID
 func (s *OAuthService) GetToken(ctx context.Context, req *GetTokenRequest) (*oauth2.Token, error) {
 	if err := req.Validate(); err != nil {
 		return nil, err
 	}
 
+	tenantID := tenantID(ctx, req.TenantID)
+	tenant, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
 	var oauthToken OAuthToken
-	err := s.DB.WithContext(ctx).
+	err = s.tokens(ctx, tenantID).
 		Where("user_id = ? AND email = ?", req.UserID, req.Email).
 		First(&oauthToken).
 		Error
@@ -45,10 +53,20 @@ func (s *OAuthService) GetToken(ctx context.Context, req *GetTokenRequest) (*oau
 		return nil, fmt.Errorf("failed to get token: %w", err)
 	}
 
-	oauth2Token, err := oauthToken.ToOAuth2Token(s.TokenEncryptor)
+	oauth2Token, err := oauthToken.ToOAuth2Token(tenant.TokenEncryptor)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := s.oauthClient(ctx, tenantID, oauthToken.ClientName)
 	if err != nil {
 		return nil, err
 	}
 
-	return oauth2Token, nil
+	extra := map[string]any{tokenClientExtra: oauthToken.ClientName}
+	if client != nil {
+		extra[tokenClientIDExtra] = client.ClientID
+	}
+
+	return oauth2Token.WithExtra(extra), nil
 }
@@ -8,7 +8,8 @@ import (
 )
 
 type GetTokenByUserIDRequest struct {
-	UserID string `json:"user_id"`
+	TenantID string `json:"tenant_id"`
+	UserID   string `json:"user_id"`
 }
 
 func (s *GetTokenByUserIDRequest) Validate() error {
@@ -27,7 +28,7 @@ func (s *OAuthService) GetTokenByUserID(ctx context.Context, req *GetTokenByUser
 
 	var token OAuthToken
 
-	err := s.DB.WithContext(ctx).
+	err := s.tokens(ctx, tenantID(ctx, req.TenantID)).
 		Where("user_id = ?", req.UserID).
 		First(&token).
 		Error
@@ -21,6 +21,9 @@ type GoogleUserInfo struct {
 	Locale        string `json:"locale"`
 }
 
+// userInfoURL is the Google endpoint returning the profile of the token owner
+var userInfoURL = "https://www.googleapis.com/oauth2/v2/userinfo"
+
 // GetUserInfoRequest represents the request for getting user information
 type GetUserInfoRequest struct {
 	Token *oauth2.Token `json:"token"`
@@ -32,7 +35,7 @@ func (s *OAuthService) GetGoogleUserInfo(ctx context.Context, req *GetUserInfoRe
 		return nil, ErrInvalidToken
 	}
 
-	resp, err := http.Get("https://www.googleapis.com/oauth2/v2/userinfo?access_token=" + req.Token.AccessToken)
+	resp, err := http.Get(userInfoURL + "?access_token=" + req.Token.AccessToken)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user info: %w", err)
 	}
@@ -0,0 +1,50 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+type GetUserTokenRequest struct {
+	TenantID string `json:"tenant_id"`
+	UserID   string `json:"user_id"`
+	Email    string `json:"email"`
+}
+
+func (s *GetUserTokenRequest) Validate() error {
+	if s.UserID == "" {
+		return ErrInvalidUserID
+	}
+
+	if s.Email == "" {
+		return ErrInvalidEmail
+	}
+
+	return nil
+}
+
+// GetUserToken gets the stored OAuth token row of an account
+func (s *OAuthService) GetUserToken(ctx context.Context, req *GetUserTokenRequest) (*OAuthToken, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	var token OAuthToken
+
+	err := s.tokens(ctx, tenantID(ctx, req.TenantID)).
+		Where("user_id = ? AND email = ?", req.UserID, req.Email).
+		First(&token).
+		Error
+
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrTokenNotFound
+		}
+		return nil, fmt.Errorf("failed to get user token: %w", err)
+	}
+
+	return &token, nil
+}
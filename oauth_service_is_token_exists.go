@@ -6,8 +6,9 @@ import (
 )
 
 type IsTokenExistsRequest struct {
-	UserID string `json:"user_id"`
-	Email  string `json:"email"`
+	TenantID string `json:"tenant_id"`
+	UserID   string `json:"user_id"`
+	Email    string `json:"email"`
 }
 
 func (s *IsTokenExistsRequest) Validate() error {
@@ -29,8 +30,7 @@ func (s *OAuthService) IsTokenExists(ctx context.Context, req *IsTokenExistsRequ
 	}
 
 	var count int64
-	err := s.DB.WithContext(ctx).
-		Model(&OAuthToken{}).
+	err := s.tokens(ctx, tenantID(ctx, req.TenantID)).
 		Where("user_id = ? AND email = ?", req.UserID, req.Email).
 		Count(&count).
 		Error
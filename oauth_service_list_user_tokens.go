@@ -6,7 +6,8 @@ import (
 )
 
 type ListUserTokensRequest struct {
-	UserID string `json:"user_id"`
+	TenantID string `json:"tenant_id"`
+	UserID   string `json:"user_id"`
 }
 
 func (s *ListUserTokensRequest) Validate() error {
@@ -25,7 +26,7 @@ func (s *OAuthService) ListUserTokens(ctx context.Context, req *ListUserTokensRe
 
 	tokens := make([]OAuthToken, 0)
 
-	err := s.DB.WithContext(ctx).
+	err := s.tokens(ctx, tenantID(ctx, req.TenantID)).
 		Where("user_id = ?", req.UserID).
 		Find(&tokens).
 		Error
@@ -0,0 +1,192 @@
+package fundrive
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// DefaultLoopbackTimeout is how long AuthorizeLoopback waits for the user to consent
+const DefaultLoopbackTimeout = 5 * time.Minute
+
+// LoopbackAuthRequest connects an account with the loopback redirect flow: the consent
+// page redirects to a server listening on 127.0.0.1, which requires a desktop OAuth client
+type LoopbackAuthRequest struct {
+	// TenantID defaults to the tenant of the context
+	TenantID string `json:"tenant_id"`
+	UserID   string `json:"user_id"`
+
+	// ClientName selects a registered OAuth client of the tenant
+	ClientName string `json:"client_name"`
+
+	// Email upgrades a connected account, see AuthCodeURLRequest
+	Email string `json:"email"`
+
+	// ScopeProfile defaults to the scopes of the OAuth client, Scopes overrides it
+	ScopeProfile ScopeProfile `json:"scope_profile"`
+	Scopes       []string     `json:"scopes"`
+
+	// ListenAddr is the loopback address of the callback server, defaults to a random port
+	ListenAddr string `json:"listen_addr"`
+
+	// OpenBrowser shows the consent page to the user, defaults to OpenBrowser. Set it to
+	// print the URL instead when there is no browser on the machine
+	OpenBrowser func(authURL string) error `json:"-"`
+
+	// Timeout defaults to DefaultLoopbackTimeout
+	Timeout time.Duration `json:"timeout"`
+}
+
+func (r *LoopbackAuthRequest) Validate() error {
+	if r.UserID == "" {
+		return ErrInvalidUserID
+	}
+
+	return r.ScopeProfile.Validate()
+}
+
+// AuthorizeLoopback runs the authorization code flow with PKCE against an ephemeral
+// callback server on the loopback interface and saves the token of the consenting account
+func (s *OAuthService) AuthorizeLoopback(ctx context.Context, req *LoopbackAuthRequest) (*AuthorizationResult, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	ctx = ContextWithTenant(ctx, tenantID(ctx, req.TenantID))
+	client, err := s.oauthClient(ctx, TenantFromContext(ctx), req.ClientName)
+	if err != nil {
+		return nil, err
+	}
+
+	listenAddr := req.ListenAddr
+	if listenAddr == "" {
+		listenAddr = "127.0.0.1:0"
+	}
+	openBrowser := req.OpenBrowser
+	if openBrowser == nil {
+		openBrowser = OpenBrowser
+	}
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = DefaultLoopbackTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error starting loopback server: %w", err)
+	}
+
+	config := authConfig(client, "http://"+listener.Addr().String()+"/", req.ScopeProfile, req.Scopes)
+
+	state, err := randomState()
+	if err != nil {
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	callbacks := make(chan loopbackCallback, 1)
+	server := &http.Server{Handler: loopbackHandler(state, callbacks)}
+	go server.Serve(listener)
+	defer server.Close()
+
+	authURL := config.AuthCodeURL(state, append(authCodeOptions(req.Email), oauth2.S256ChallengeOption(verifier))...)
+	if err := openBrowser(authURL); err != nil {
+		return nil, fmt.Errorf("error opening browser: %w", err)
+	}
+
+	var callback loopbackCallback
+	select {
+	case callback = <-callbacks:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("error waiting for authorization: %w", ctx.Err())
+	}
+	if callback.err != nil {
+		return nil, callback.err
+	}
+
+	token, err := config.Exchange(ctx, callback.code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("error exchanging auth code for token: %w", err)
+	}
+
+	return s.completeAuthorization(ctx, req.UserID, req.ClientName, token)
+}
+
+type loopbackCallback struct {
+	code string
+	err  error
+}
+
+// loopbackHandler receives the redirect of the consent page, requests without the
+// expected state are rejected so other local pages cannot inject a code
+func loopbackHandler(state string, callbacks chan<- loopbackCallback) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		query := r.URL.Query()
+		if query.Get("state") != state {
+			http.Error(w, "invalid state", http.StatusBadRequest)
+			return
+		}
+
+		callback := loopbackCallback{code: query.Get("code")}
+		switch {
+		case query.Get("error") != "":
+			callback.err = fmt.Errorf("%w: %s", ErrAuthorizationDenied, query.Get("error"))
+		case callback.code == "":
+			callback.err = ErrInvalidAuthorizationCode
+		}
+
+		select {
+		case callbacks <- callback:
+		default:
+		}
+
+		if callback.err != nil {
+			http.Error(w, "Authorization failed, you can close this window.", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "Authorization complete, you can close this window.")
+	})
+}
+
+func randomState() (string, error) {
+	state := make([]byte, 16)
+	if _, err := rand.Read(state); err != nil {
+		return "", fmt.Errorf("error generating state: %w", err)
+	}
+	return hex.EncodeToString(state), nil
+}
+
+// OpenBrowser opens a URL in the default browser of the desktop
+func OpenBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
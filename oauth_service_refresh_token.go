@@ -6,13 +6,19 @@ import (
 	"golang.org/x/oauth2"
 )
 
-// RefreshToken refreshes an OAuth token
+// RefreshToken refreshes an OAuth token with the OAuth client that issued it, tokens
+// loaded with GetToken name their client, others use the client of the tenant of ctx
 func (s *OAuthService) RefreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
 	if token == nil {
 		return nil, ErrInvalidToken
 	}
 
-	tokenSource := s.OauthConfig.TokenSource(ctx, token)
+	client, err := s.oauthClient(ctx, TenantFromContext(ctx), tokenClient(token))
+	if err != nil {
+		return nil, err
+	}
+
+	tokenSource := client.TokenSource(ctx, token)
 
 	newToken, err := tokenSource.Token()
 	if err != nil {
@@ -2,20 +2,28 @@ package fundrive
 
 import (
 	"context"
-	"errors"
 	"fmt"
 
 	"github.com/oklog/ulid/v2"
 	"golang.org/x/oauth2"
-	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type SaveTokenRequest struct {
+	TenantID        string        `json:"tenant_id"`
 	UserID          string        `json:"user_id"`
 	Email           string        `json:"email"`
 	BaseFolderID    *string       `json:"base_folder_id"`
 	ExpiryTimestamp *string       `json:"expiry_timestamp"`
 	Token           *oauth2.Token `json:"token"`
+
+	// ClientName is the registered OAuth client that issued the token, it defaults to
+	// the client named by a token loaded with GetToken. Empty is the tenant client
+	ClientName string `json:"client_name"`
+
+	// KeepClient keeps the client saved for the account instead of ClientName, for a
+	// token refreshed with the client that issued it
+	KeepClient bool `json:"keep_client"`
 }
 
 func (s *SaveTokenRequest) Validate() error {
@@ -34,52 +42,71 @@ func (s *SaveTokenRequest) Validate() error {
 	return nil
 }
 
+// SaveToken inserts or updates the token of the account in a single upsert on the
+// unique (tenant_id, user_id, email) index, so concurrent callbacks for one account keep one row.
+// The refresh token, scopes, base folder and expiry timestamp are only replaced when given,
+// the client is always replaced unless KeepClient is set
 func (s *OAuthService) SaveToken(ctx context.Context, req *SaveTokenRequest) error {
 	if err := req.Validate(); err != nil {
 		return err
 	}
 
-	tx := s.DB.WithContext(ctx).Begin()
-	defer tx.Rollback()
+	tenantID := tenantID(ctx, req.TenantID)
+	tenant, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
 
-	var existingToken OAuthToken
+	clientName := req.ClientName
+	if clientName == "" {
+		clientName = tokenClient(req.Token)
+	}
 
-	err := tx.
-		Where("user_id = ? AND email = ?", req.UserID, req.Email).
-		First(&existingToken).
-		Error
+	token := OAuthToken{
+		ID:              ulid.Make().String(),
+		TenantID:        tenantID,
+		ClientName:      clientName,
+		UserID:          req.UserID,
+		Email:           req.Email,
+		BaseFolderID:    req.BaseFolderID,
+		ExpiryTimestamp: req.ExpiryTimestamp,
+	}
 
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		newOauthToken := OAuthToken{
-			ID:              ulid.Make().String(),
-			UserID:          req.UserID,
-			Email:           req.Email,
-			BaseFolderID:    req.BaseFolderID,
-			ExpiryTimestamp: req.ExpiryTimestamp,
-		}
-
-		if err := newOauthToken.FromOAuth2Token(req.Token, s.TokenEncryptor); err != nil {
-			return fmt.Errorf("failed to convert token: %w", err)
-		}
-
-		if err := tx.Create(&newOauthToken).Error; err != nil {
-			return fmt.Errorf("failed to create token: %w", err)
-		}
-	} else if err != nil {
-		return fmt.Errorf("failed to query token: %w", err)
-	} else {
-		if err := existingToken.FromOAuth2Token(req.Token, s.TokenEncryptor); err != nil {
-			return fmt.Errorf("failed to convert token: %w", err)
-		}
-
-		if err := tx.Save(&existingToken).Error; err != nil {
-			return fmt.Errorf("failed to update token: %w", err)
-		}
+	if err := token.FromOAuth2Token(req.Token, tenant.TokenEncryptor); err != nil {
+		return fmt.Errorf("failed to convert token: %w", err)
 	}
 
-	if err := tx.Commit().Error; err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+	// Google omits the refresh token when the user consents again
+	columns := []string{"access_token", "token_type", "expiry", "updated_at"}
+	if token.RefreshToken != "" {
+		columns = append(columns, "refresh_token")
+	}
+	if token.Scopes != "" {
+		columns = append(columns, "scopes")
 	}
+	if req.BaseFolderID != nil {
+		columns = append(columns, "base_folder_id")
+	}
+	if req.ExpiryTimestamp != nil {
+		columns = append(columns, "expiry_timestamp")
+	}
+	if !req.KeepClient {
+		columns = append(columns, "client_name")
+	}
+
+	err = s.DB.WithContext(ctx).
+		Table(s.tokenTable()).
+		Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "tenant_id"}, {Name: "user_id"}, {Name: "email"}},
+			DoUpdates: clause.AssignmentColumns(columns),
+		}).
+		Create(&token).
+		Error
+	if err != nil {
+		return fmt.Errorf("failed to save token: %w", err)
+	}
+
+	s.notifyTokenChange(ctx, tenantID, req.UserID, req.Email)
 
 	return nil
 }
@@ -0,0 +1,276 @@
+package fundrive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// fakeGoogleOAuth serves the token, device code and userinfo endpoints
+type fakeGoogleOAuth struct {
+	server        *httptest.Server
+	codeChallenge atomic.Value
+	devicePolls   atomic.Int32
+}
+
+func newFakeGoogleOAuth(t *testing.T) *fakeGoogleOAuth {
+	fake := &fakeGoogleOAuth{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Form.Get("grant_type") {
+		case "authorization_code":
+			// the verifier has to match the challenge sent to the consent page
+			sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+			if r.Form.Get("code") != "auth-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != fake.codeChallenge.Load() {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+				return
+			}
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			if fake.devicePolls.Add(1) == 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "authorization_pending"})
+				return
+			}
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "access-token",
+			"refresh_token": "refresh-token",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	})
+	mux.HandleFunc("/device/code", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"device_code":      "device-code",
+			"user_code":        "ABCD-EFGH",
+			"verification_url": "https://www.google.com/device",
+			"expires_in":       60,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("access_token") != "access-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(GoogleUserInfo{ID: "1", Email: "a@example.com"})
+	})
+
+	fake.server = httptest.NewServer(mux)
+	t.Cleanup(fake.server.Close)
+
+	previous := userInfoURL
+	userInfoURL = fake.server.URL + "/userinfo"
+	t.Cleanup(func() { userInfoURL = previous })
+
+	return fake
+}
+
+func newTestOAuthService(t *testing.T, fake *fakeGoogleOAuth) *OAuthService {
+	encryptor, err := NewTokenEncryption("12345678901234567890123456789012")
+	require.NoError(t, err)
+
+	return &OAuthService{
+		DB: newTestDB(t, &OAuthToken{}),
+		OauthConfig: &oauth2.Config{
+			ClientID:     "client-id",
+			ClientSecret: "client-secret",
+			Scopes:       ScopeProfileFull.Scopes(),
+			Endpoint: oauth2.Endpoint{
+				AuthURL:       "https://accounts.example.com/auth",
+				TokenURL:      fake.server.URL + "/token",
+				DeviceAuthURL: fake.server.URL + "/device/code",
+				AuthStyle:     oauth2.AuthStyleInParams,
+			},
+		},
+		TokenEncryptor: encryptor,
+	}
+}
+
+func TestOAuthService_AuthorizeLoopback(t *testing.T) {
+	fake := newFakeGoogleOAuth(t)
+	service := newTestOAuthService(t, fake)
+
+	// the browser consents and follows the redirect to the loopback server
+	browser := func(authURL string) error {
+		parsed, err := url.Parse(authURL)
+		if err != nil {
+			return err
+		}
+		query := parsed.Query()
+		assert.Equal(t, "S256", query.Get("code_challenge_method"))
+		assert.Equal(t, "offline", query.Get("access_type"))
+		fake.codeChallenge.Store(query.Get("code_challenge"))
+
+		// a request without the state is rejected and does not end the flow
+		resp, err := http.Get(query.Get("redirect_uri") + "?code=stolen")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		go func() {
+			resp, err := http.Get(query.Get("redirect_uri") + "?" + url.Values{
+				"code":  {"auth-code"},
+				"state": {query.Get("state")},
+			}.Encode())
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+		return nil
+	}
+
+	result, err := service.AuthorizeLoopback(context.Background(), &LoopbackAuthRequest{UserID: "user-1", OpenBrowser: browser})
+	require.NoError(t, err)
+	assert.Equal(t, "a@example.com", result.Email)
+
+	token, err := service.GetToken(context.Background(), &GetTokenRequest{UserID: "user-1", Email: "a@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "refresh-token", token.RefreshToken)
+}
+
+func TestOAuthService_AuthorizeLoopbackDenied(t *testing.T) {
+	fake := newFakeGoogleOAuth(t)
+	service := newTestOAuthService(t, fake)
+
+	browser := func(authURL string) error {
+		parsed, _ := url.Parse(authURL)
+		query := parsed.Query()
+
+		go func() {
+			resp, err := http.Get(query.Get("redirect_uri") + "?error=access_denied&state=" + query.Get("state"))
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+		return nil
+	}
+
+	_, err := service.AuthorizeLoopback(context.Background(), &LoopbackAuthRequest{UserID: "user-1", OpenBrowser: browser})
+	assert.ErrorIs(t, err, ErrAuthorizationDenied)
+}
+
+func TestOAuthService_AuthorizeDevice(t *testing.T) {
+	fake := newFakeGoogleOAuth(t)
+	service := newTestOAuthService(t, fake)
+
+	var prompted *oauth2.DeviceAuthResponse
+	result, err := service.AuthorizeDevice(context.Background(), &DeviceAuthRequest{
+		UserID: "user-1",
+		Prompt: func(auth *oauth2.DeviceAuthResponse) error {
+			prompted = auth
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	require.NotNil(t, prompted)
+	assert.Equal(t, "ABCD-EFGH", prompted.UserCode)
+	assert.Equal(t, "https://www.google.com/device", prompted.VerificationURI)
+	assert.Equal(t, int32(2), fake.devicePolls.Load())
+	assert.Equal(t, "a@example.com", result.Email)
+
+	exists, err := service.IsTokenExists(context.Background(), &IsTokenExistsRequest{UserID: "user-1", Email: "a@example.com"})
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestOAuthService_SaveToken(t *testing.T) {
+	encryptor, err := NewTokenEncryption("12345678901234567890123456789012")
+	require.NoError(t, err)
+
+	service := &OAuthService{DB: newTestDB(t, &OAuthToken{}), TokenEncryptor: encryptor}
+	ctx := context.Background()
+	folderID := "folder-1"
+
+	require.NoError(t, service.SaveToken(ctx, &SaveTokenRequest{
+		UserID:       "user-1",
+		Email:        "a@example.com",
+		BaseFolderID: &folderID,
+		Token:        &oauth2.Token{AccessToken: "access-1", RefreshToken: "refresh-1"},
+	}))
+
+	// re-consent omits the refresh token and keeps the base folder
+	require.NoError(t, service.SaveToken(ctx, &SaveTokenRequest{
+		UserID: "user-1",
+		Email:  "a@example.com",
+		Token:  &oauth2.Token{AccessToken: "access-2"},
+	}))
+
+	var row OAuthToken
+	require.NoError(t, service.DB.First(&row, "user_id = ? AND email = ?", "user-1", "a@example.com").Error)
+	token, err := row.ToOAuth2Token(encryptor)
+	require.NoError(t, err)
+	assert.Equal(t, "access-2", token.AccessToken)
+	assert.Equal(t, "refresh-1", token.RefreshToken)
+	require.NotNil(t, row.BaseFolderID)
+	assert.Equal(t, folderID, *row.BaseFolderID)
+
+	// the base folder and expiry timestamp are written on update too
+	folderID, expiry := "folder-2", "1700000000"
+	require.NoError(t, service.SaveToken(ctx, &SaveTokenRequest{
+		UserID:          "user-1",
+		Email:           "a@example.com",
+		BaseFolderID:    &folderID,
+		ExpiryTimestamp: &expiry,
+		Token:           &oauth2.Token{AccessToken: "access-3", RefreshToken: "refresh-3"},
+	}))
+	require.NoError(t, service.DB.First(&row, "id = ?", row.ID).Error)
+	assert.Equal(t, "folder-2", *row.BaseFolderID)
+	assert.Equal(t, expiry, *row.ExpiryTimestamp)
+
+	var count int64
+	require.NoError(t, service.DB.Model(&OAuthToken{}).Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestOAuthService_SaveTokenConcurrent(t *testing.T) {
+	encryptor, err := NewTokenEncryption("12345678901234567890123456789012")
+	require.NoError(t, err)
+
+	db := newTestDB(t, &OAuthToken{})
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	// SQLite allows one writer, the upsert is what keeps a single row
+	sqlDB.SetMaxOpenConns(1)
+
+	service := &OAuthService{DB: db, TokenEncryptor: encryptor}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, service.SaveToken(context.Background(), &SaveTokenRequest{
+				UserID: "user-1",
+				Email:  "a@example.com",
+				Token:  &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"},
+			}))
+		}()
+	}
+	wg.Wait()
+
+	var count int64
+	require.NoError(t, db.Model(&OAuthToken{}).Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+}
@@ -0,0 +1,132 @@
+package fundrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+// ErrUnknownTenant is returned for a tenant without a registered configuration
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// DefaultTablePrefix is the prefix of the fundrive tables
+const DefaultTablePrefix = "fundrive_"
+
+// TenantConfig is the OAuth client and token encryption key of a tenant, empty
+// fields fall back to the service configuration
+type TenantConfig struct {
+	ClientSecretFilePath string
+	OAuth2Config         *oauth2.Config
+	EncryptionKey        string
+}
+
+// Tenant is the resolved configuration of a tenant
+type Tenant struct {
+	OauthConfig    *oauth2.Config
+	TokenEncryptor *TokenEncryption
+}
+
+type tenantContextKey struct{}
+
+// ContextWithTenant scopes every token and data read and write made with ctx to the
+// tenant, a TenantID set on a request takes precedence
+func ContextWithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenantID)
+}
+
+// TenantFromContext returns the tenant of ctx, empty for the default tenant
+func TenantFromContext(ctx context.Context) string {
+	tenantID, _ := ctx.Value(tenantContextKey{}).(string)
+	return tenantID
+}
+
+// tenantID returns the tenant of a request, falling back to the tenant of ctx
+func tenantID(ctx context.Context, reqTenantID string) string {
+	if reqTenantID != "" {
+		return reqTenantID
+	}
+	return TenantFromContext(ctx)
+}
+
+// tenant returns the configuration of a tenant, the empty tenant uses the service
+// configuration and any other tenant must be registered
+func (s *OAuthService) tenant(tenantID string) (*Tenant, error) {
+	if tenantID == "" {
+		return &Tenant{OauthConfig: s.OauthConfig, TokenEncryptor: s.TokenEncryptor}, nil
+	}
+
+	tenant, ok := s.Tenants[tenantID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTenant, tenantID)
+	}
+
+	return tenant, nil
+}
+
+// tokenTable returns the name of the token table
+func (s *OAuthService) tokenTable() string {
+	return tablePrefix(s.TablePrefix) + "oauth_tokens"
+}
+
+// tokens returns a query on the token rows of the tenant. Every token query starts
+// here so a tenant never reads or writes the rows of another
+func (s *OAuthService) tokens(ctx context.Context, tenantID string) *gorm.DB {
+	return s.DB.WithContext(ctx).
+		Table(s.tokenTable()).
+		Where("tenant_id = ?", tenantID)
+}
+
+// tenantScope limits a query on the data tables to the tenant of its context, use it
+// with Scopes on every catalog, pool, stripe, migration, change, watch and sync query
+func tenantScope(db *gorm.DB) *gorm.DB {
+	return db.Where("tenant_id = ?", TenantFromContext(db.Statement.Context))
+}
+
+// tablePrefix returns the prefix, DefaultTablePrefix when empty
+func tablePrefix(prefix string) string {
+	if prefix == "" {
+		return DefaultTablePrefix
+	}
+	return prefix
+}
+
+// newTenants resolves the tenant configurations, fields left empty use the default
+// OAuth client and encryption key
+func newTenants(configs map[string]TenantConfig, oauth2Config *oauth2.Config, encryptor *TokenEncryption) (map[string]*Tenant, error) {
+	tenants := make(map[string]*Tenant, len(configs))
+
+	for tenantID, config := range configs {
+		if tenantID == "" {
+			return nil, errors.New("tenant ID is empty")
+		}
+
+		tenant := &Tenant{OauthConfig: config.OAuth2Config, TokenEncryptor: encryptor}
+
+		if tenant.OauthConfig == nil && config.ClientSecretFilePath != "" {
+			tenantConfig, err := NewOAuth2Config(config.ClientSecretFilePath)
+			if err != nil {
+				return nil, fmt.Errorf("error reading OAuth client of tenant %s: %w", tenantID, err)
+			}
+			tenantConfig.Scopes = oauth2Config.Scopes
+			tenant.OauthConfig = tenantConfig
+		}
+		if tenant.OauthConfig == nil {
+			tenant.OauthConfig = oauth2Config
+		}
+
+		if config.EncryptionKey != "" {
+			tenantEncryptor, err := NewTokenEncryption(config.EncryptionKey)
+			if err != nil {
+				return nil, fmt.Errorf("error creating token encryption of tenant %s: %w", tenantID, err)
+			}
+			tenant.TokenEncryptor = tenantEncryptor
+		}
+
+		tenants[tenantID] = tenant
+	}
+
+	return tenants, nil
+}
@@ -0,0 +1,107 @@
+package fundrive
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestOAuthService_Tenants(t *testing.T) {
+	defaultEncryptor, err := NewTokenEncryption("12345678901234567890123456789012")
+	require.NoError(t, err)
+
+	tenants, err := newTenants(map[string]TenantConfig{
+		"acme":   {EncryptionKey: "acme5678901234567890123456789012"},
+		"globex": {OAuth2Config: &oauth2.Config{ClientID: "globex-client"}},
+	}, &oauth2.Config{ClientID: "default-client"}, defaultEncryptor)
+	require.NoError(t, err)
+	assert.Equal(t, "default-client", tenants["acme"].OauthConfig.ClientID)
+	assert.Equal(t, defaultEncryptor, tenants["globex"].TokenEncryptor)
+
+	service := &OAuthService{
+		DB:             newTestDB(t, &OAuthToken{}),
+		OauthConfig:    &oauth2.Config{ClientID: "default-client"},
+		TokenEncryptor: defaultEncryptor,
+		Tenants:        tenants,
+	}
+	ctx := context.Background()
+
+	// the same account is connected in two tenants
+	for _, tenantID := range []string{"acme", "globex"} {
+		require.NoError(t, service.SaveToken(ctx, &SaveTokenRequest{
+			TenantID: tenantID,
+			UserID:   "user-1",
+			Email:    "a@example.com",
+			Token:    &oauth2.Token{AccessToken: tenantID + "-access"},
+		}))
+	}
+
+	token, err := service.GetToken(ctx, &GetTokenRequest{TenantID: "acme", UserID: "user-1", Email: "a@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "acme-access", token.AccessToken)
+
+	// the tenant of the context applies when the request has none
+	globexCtx := ContextWithTenant(ctx, "globex")
+	token, err = service.GetToken(globexCtx, &GetTokenRequest{UserID: "user-1", Email: "a@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "globex-access", token.AccessToken)
+
+	// the default tenant has no token for the account
+	_, err = service.GetToken(ctx, &GetTokenRequest{UserID: "user-1", Email: "a@example.com"})
+	assert.ErrorIs(t, err, ErrTokenNotFound)
+
+	account, err := service.GetUserToken(globexCtx, &GetUserTokenRequest{UserID: "user-1", Email: "a@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "globex", account.TenantID)
+	_, err = service.GetUserToken(ctx, &GetUserTokenRequest{UserID: "user-1", Email: "a@example.com"})
+	assert.ErrorIs(t, err, ErrTokenNotFound)
+
+	// the rows of acme are encrypted with its own key
+	var row OAuthToken
+	require.NoError(t, service.DB.First(&row, "tenant_id = ?", "acme").Error)
+	_, err = row.ToOAuth2Token(defaultEncryptor)
+	assert.Error(t, err)
+
+	_, err = service.GetToken(ctx, &GetTokenRequest{TenantID: "initech", UserID: "user-1", Email: "a@example.com"})
+	assert.ErrorIs(t, err, ErrUnknownTenant)
+	_, err = service.AuthCodeURL(&AuthCodeURLRequest{TenantID: "initech", State: "state"})
+	assert.ErrorIs(t, err, ErrUnknownTenant)
+
+	// deleting the account in one tenant keeps the other
+	require.NoError(t, service.DeleteToken(globexCtx, &DeleteTokenRequest{UserID: "user-1", Email: "a@example.com"}))
+	tokens, err := service.ListUserTokens(ctx, &ListUserTokensRequest{TenantID: "acme", UserID: "user-1"})
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	assert.Equal(t, "acme", tokens[0].TenantID)
+
+	exists, err := service.IsTokenExists(globexCtx, &IsTokenExistsRequest{UserID: "user-1", Email: "a@example.com"})
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestOAuthService_TablePrefix(t *testing.T) {
+	encryptor, err := NewTokenEncryption("12345678901234567890123456789012")
+	require.NoError(t, err)
+
+	db := newTestDB(t)
+	ctx := context.Background()
+	require.NoError(t, Migrate(ctx, db, WithMigrationTablePrefix("acme_")))
+
+	service := &OAuthService{DB: db, TokenEncryptor: encryptor, TablePrefix: "acme_"}
+	require.NoError(t, service.SaveToken(ctx, &SaveTokenRequest{
+		UserID: "user-1",
+		Email:  "a@example.com",
+		Token:  &oauth2.Token{AccessToken: "access"},
+	}))
+
+	var count int64
+	require.NoError(t, db.Table("acme_oauth_tokens").Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+
+	token, err := service.GetToken(ctx, &GetTokenRequest{UserID: "user-1", Email: "a@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "access", token.AccessToken)
+}